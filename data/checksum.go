@@ -0,0 +1,148 @@
+// CRC32C checksums of documents, overflow records and hash table buckets.
+//
+// Checksums live in spare bytes of the existing headers, so that files written
+// without checksums remain readable. Records without a checksum are not
+// verified until they are written again.
+
+package data
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+const (
+	FLAG_CRC          = 8             // Document flag - header carries a checksum of document room and flags
+	DOC_CHECKSUM      = DOC_FLAGS + 1 // Offset of document checksum (uint32) in header
+	OVERFLOW_SUMMED   = 1 + 5         // Offset of overflow record checksum marker (single byte) in header, length never takes more than 5 bytes
+	OVERFLOW_CHECKSUM = 1 + 6         // Offset of overflow record checksum (uint32) in header
+	BUCKET_SUMMED     = 5             // Offset of bucket checksum marker (single byte) in header, next bucket number never takes more than 5 bytes
+	BUCKET_CHECKSUM   = 6             // Offset of bucket checksum (uint32) in header
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// A record that failed verification.
+type Corruption struct {
+	File   string `json:"file"`   // Path of the data file
+	Offset int    `json:"offset"` // Location of the record in the file
+	Reason string `json:"reason"`
+}
+
+// Checksum of header fields followed by record data.
+func checksum(header, data []byte) uint32 {
+	return crc32.Update(crc32.Checksum(header, castagnoli), castagnoli, data)
+}
+
+// Calculate and store checksum of a document whose header and room are written.
+func (col *Collection) sumDoc(id, docEnd int) {
+	col.Buf[id+DOC_FLAGS] |= FLAG_CRC
+	binary.LittleEndian.PutUint32(col.Buf[id+DOC_CHECKSUM:id+DOC_HEADER], checksum(col.Buf[id+1:id+DOC_CHECKSUM], col.Buf[id+DOC_HEADER:docEnd]))
+}
+
+// Return true if the document matches its checksum, or does not have one.
+func (col *Collection) docIntact(id, docEnd int) bool {
+	return col.Buf[id+DOC_FLAGS]&FLAG_CRC == 0 ||
+		binary.LittleEndian.Uint32(col.Buf[id+DOC_CHECKSUM:id+DOC_HEADER]) == checksum(col.Buf[id+1:id+DOC_CHECKSUM], col.Buf[id+DOC_HEADER:docEnd])
+}
+
+// Calculate and store checksum of an overflow record whose header and data are written.
+func (col *Collection) sumOverflow(ref, end int) {
+	col.overflow.Buf[ref+OVERFLOW_SUMMED] = 1
+	binary.LittleEndian.PutUint32(col.overflow.Buf[ref+OVERFLOW_CHECKSUM:ref+OVERFLOW_HEADER], checksum(col.overflow.Buf[ref+1:ref+OVERFLOW_SUMMED], col.overflow.Buf[ref+OVERFLOW_HEADER:end]))
+}
+
+// Return true if the overflow record matches its checksum, or does not have one.
+func (col *Collection) overflowIntact(ref, end int) bool {
+	return col.overflow.Buf[ref+OVERFLOW_SUMMED] != 1 ||
+		binary.LittleEndian.Uint32(col.overflow.Buf[ref+OVERFLOW_CHECKSUM:ref+OVERFLOW_HEADER]) == checksum(col.overflow.Buf[ref+1:ref+OVERFLOW_SUMMED], col.overflow.Buf[ref+OVERFLOW_HEADER:end])
+}
+
+// Calculate and store checksum of a bucket after its header or entries changed.
+func (ht *HashTable) sumBucket(bucket int) {
+	addr := bucket * BUCKET_SIZE
+	ht.Buf[addr+BUCKET_SUMMED] = 1
+	binary.LittleEndian.PutUint32(ht.Buf[addr+BUCKET_CHECKSUM:addr+BUCKET_HEADER], checksum(ht.Buf[addr:addr+BUCKET_SUMMED], ht.Buf[addr+BUCKET_HEADER:addr+BUCKET_SIZE]))
+}
+
+// Return true if the bucket matches its checksum, or does not have one.
+func (ht *HashTable) bucketIntact(bucket int) bool {
+	addr := bucket * BUCKET_SIZE
+	return ht.Buf[addr+BUCKET_SUMMED] != 1 ||
+		binary.LittleEndian.Uint32(ht.Buf[addr+BUCKET_CHECKSUM:addr+BUCKET_HEADER]) == checksum(ht.Buf[addr:addr+BUCKET_SUMMED], ht.Buf[addr+BUCKET_HEADER:addr+BUCKET_SIZE])
+}
+
+// Report documents and overflow records that fail their checksum or have a corrupted header. Does not modify anything.
+func (col *Collection) Verify() (corrupt []Corruption) {
+	corrupt = make([]Corruption, 0)
+	badSince := -1
+	for id := 0; id < col.Used-DOC_HEADER && id >= 0; {
+		validity := col.Buf[id]
+		room, _ := binary.Varint(col.Buf[id+1 : id+11])
+		docEnd := id + DOC_HEADER + int(room)
+		plausible := (validity == 0 || validity == 1) && room >= 0 && room <= DOC_MAX_ROOM && docEnd > 0 && docEnd <= col.Used
+		if plausible && badSince != -1 && (validity != 1 || col.Buf[id+DOC_FLAGS]&FLAG_CRC == 0) {
+			// Only a checksummed document ends a run of corrupted bytes, zeros and text look alike headers
+			plausible = false
+		}
+		if plausible {
+			if badSince != -1 {
+				corrupt = append(corrupt, Corruption{col.Path, badSince, "corrupted document header"})
+				badSince = -1
+			}
+			if validity == 1 {
+				if !col.docIntact(id, docEnd) {
+					corrupt = append(corrupt, Corruption{col.Path, id, "document checksum mismatch"})
+				} else if col.Buf[id+DOC_FLAGS]&FLAG_OVERFLOW != 0 {
+					if reason := col.verifyOverflow(col.overflowRef(id)); reason != "" {
+						corrupt = append(corrupt, Corruption{col.Path + OVERFLOW_SUFFIX, col.overflowRef(id), reason})
+					}
+				}
+			}
+			id = docEnd
+		} else {
+			// Report a run of corrupted bytes once
+			if badSince == -1 {
+				badSince = id
+			}
+			id++
+		}
+	}
+	if badSince != -1 {
+		corrupt = append(corrupt, Corruption{col.Path, badSince, "corrupted document header"})
+	}
+	return
+}
+
+// Return the reason why an overflow record is corrupted, or an empty string if it is intact.
+func (col *Collection) verifyOverflow(ref int) string {
+	if col.overflow == nil || ref < 0 || ref > col.overflow.Used-OVERFLOW_HEADER || col.overflow.Buf[ref] != 1 {
+		return "bad overflow reference"
+	}
+	size, _ := binary.Varint(col.overflow.Buf[ref+1 : ref+OVERFLOW_HEADER])
+	if size < 0 || ref+OVERFLOW_HEADER+int(size) > col.overflow.Used {
+		return "corrupted overflow record header"
+	} else if !col.overflowIntact(ref, ref+OVERFLOW_HEADER+int(size)) {
+		return "overflow record checksum mismatch"
+	}
+	return ""
+}
+
+// Report buckets that fail their checksum or are chained incorrectly. Does not modify anything.
+func (ht *HashTable) Verify() (corrupt []Corruption) {
+	corrupt = make([]Corruption, 0)
+	for bucket := 0; bucket < ht.numBuckets && (bucket+1)*BUCKET_SIZE <= ht.Size; bucket++ {
+		addr := bucket * BUCKET_SIZE
+		if !ht.bucketIntact(bucket) {
+			corrupt = append(corrupt, Corruption{ht.Path, addr, "bucket checksum mismatch"})
+		} else if next, n := binary.Varint(ht.Buf[addr : addr+BUCKET_HEADER]); next != 0 && (n <= 0 || next <= int64(bucket) || next >= int64(ht.numBuckets) || next < INITIAL_BUCKETS) {
+			corrupt = append(corrupt, Corruption{ht.Path, addr, "bad bucket chain"})
+		}
+	}
+	return
+}
+
+// Report corrupted records of the partition's document file and ID lookup table. Caller should hold data lock.
+func (part *Partition) Verify() []Corruption {
+	return append(part.col.Verify(), part.lookup.Verify()...)
+}
@@ -0,0 +1,158 @@
+package data
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestDocChecksum(t *testing.T) {
+	tmp := "/tmp/tiedot_test_col"
+	os.Remove(tmp)
+	os.Remove(tmp + OVERFLOW_SUFFIX)
+	defer os.Remove(tmp)
+	defer os.Remove(tmp + OVERFLOW_SUFFIX)
+	col, err := OpenCollection(tmp)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer col.Close()
+	intactID, err := col.Insert([]byte("intact"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptID, err := col.Insert([]byte("corrupt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	largeID, err := col.Insert(bytes.Repeat([]byte("a"), DOC_MAX_ROOM+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Updated in place
+	if newID, err := col.Update(intactID, []byte("intac")); err != nil || newID != intactID {
+		t.Fatal(newID, err)
+	}
+	if corrupt := col.Verify(); len(corrupt) != 0 {
+		t.Fatal(corrupt)
+	}
+	// A flipped bit is detected
+	col.Buf[corruptID+DOC_HEADER+1] ^= 1
+	if doc := col.Read(corruptID); doc != nil {
+		t.Fatal(string(doc))
+	} else if _, err = col.read(corruptID); dberr.Type(err) != dberr.ErrorCorruptDoc {
+		t.Fatal(err)
+	} else if doc, err = col.read(intactID); err != nil || string(doc[:5]) != "intac" {
+		t.Fatal(string(doc), err)
+	}
+	found := 0
+	col.ForEachDoc(func(id int, doc []byte) bool {
+		if id == corruptID {
+			t.Fatal("Corrupted document is not skipped")
+		}
+		found++
+		return true
+	})
+	if found != 2 {
+		t.Fatal(found)
+	}
+	// Corrupted overflow record
+	ref := col.overflowRef(largeID)
+	col.overflow.Buf[ref+OVERFLOW_HEADER+10] = 'b'
+	if _, err = col.read(largeID); dberr.Type(err) != dberr.ErrorCorruptDoc {
+		t.Fatal(err)
+	}
+	// Corrupted header
+	col.Buf[intactID] = 3
+	corrupt := col.Verify()
+	if len(corrupt) != 3 ||
+		corrupt[0] != (Corruption{tmp, intactID, "corrupted document header"}) ||
+		corrupt[1] != (Corruption{tmp, corruptID, "document checksum mismatch"}) ||
+		corrupt[2] != (Corruption{tmp + OVERFLOW_SUFFIX, ref, "overflow record checksum mismatch"}) {
+		t.Fatal(corrupt)
+	}
+	// Deleted documents are not verified, and documents without checksum are read as usual
+	col.Buf[intactID] = 1
+	if err = col.Delete(corruptID); err != nil {
+		t.Fatal(err)
+	}
+	col.Buf[intactID+DOC_FLAGS] &^= FLAG_CRC
+	col.Buf[intactID+DOC_HEADER] = 'I'
+	if doc := col.Read(intactID); doc == nil || string(doc[:5]) != "Intac" {
+		t.Fatal(string(doc))
+	} else if corrupt = col.Verify(); len(corrupt) != 1 {
+		t.Fatal(corrupt)
+	}
+}
+
+func TestBucketChecksum(t *testing.T) {
+	tmp := "/tmp/tiedot_test_ht"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	ht, err := OpenHashTable(tmp)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer ht.Close()
+	// Fill a bucket and its chained bucket
+	for i := 0; i < PER_BUCKET+1; i++ {
+		ht.Put(0, i)
+	}
+	ht.Remove(0, 3)
+	if corrupt := ht.Verify(); len(corrupt) != 0 {
+		t.Fatal(corrupt)
+	}
+	head := HashKey(0)
+	chained := ht.nextBucket(head)
+	ht.Buf[head*BUCKET_SIZE+BUCKET_HEADER+5*ENTRY_SIZE+11] ^= 1
+	ht.Buf[chained*BUCKET_SIZE+BUCKET_HEADER] = 0
+	if corrupt := ht.Verify(); len(corrupt) != 2 ||
+		corrupt[0] != (Corruption{tmp, head * BUCKET_SIZE, "bucket checksum mismatch"}) ||
+		corrupt[1] != (Corruption{tmp, chained * BUCKET_SIZE, "bucket checksum mismatch"}) {
+		t.Fatal(corrupt)
+	}
+}
+
+func TestPartitionCorruptDoc(t *testing.T) {
+	colPath := "/tmp/tiedot_test_col"
+	htPath := "/tmp/tiedot_test_ht"
+	os.Remove(colPath)
+	os.Remove(htPath)
+	defer os.Remove(colPath)
+	defer os.Remove(htPath)
+	part, err := OpenPartition(colPath, htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer part.Close()
+	physID, err := part.Insert(1, []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = part.Insert(2, []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	part.col.Buf[physID+DOC_HEADER] = '2'
+	if _, err = part.Read(1); dberr.Type(err) != dberr.ErrorCorruptDoc || err.Error() != "Document `1` is corrupted" {
+		t.Fatal(err)
+	} else if _, err = part.Read(3); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	if corrupt := part.Verify(); len(corrupt) != 1 || corrupt[0].Offset != physID {
+		t.Fatal(corrupt)
+	}
+	// Compaction leaves the corrupted document alone
+	if err = part.Compact(); dberr.Type(err) != dberr.ErrorCorruptDoc {
+		t.Fatal(err)
+	} else if _, err = part.Read(2); err != nil {
+		t.Fatal(err)
+	}
+	// Corrupted document may be deleted
+	if err = part.Delete(1); err != nil {
+		t.Fatal(err)
+	} else if corrupt := part.Verify(); len(corrupt) != 0 {
+		t.Fatal(corrupt)
+	}
+}
@@ -0,0 +1,83 @@
+// Document compression codecs.
+//
+// The codec of a partition decides how newly written documents are encoded;
+// every document records its own codec in header flags, hence documents of
+// different codecs coexist in the same partition.
+
+package data
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	CODEC_NONE  = "none"  // Documents are stored as they are (default)
+	CODEC_FLATE = "flate" // Documents are compressed in DEFLATE format
+	FLAG_FLATE  = 2       // Document flag - document data is compressed in DEFLATE format
+)
+
+// Compressors are expensive to allocate, hence they are reused.
+var flateWriters = sync.Pool{New: func() interface{} {
+	// Favour speed over ratio, documents are compressed while the partition is locked
+	writer, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return writer
+}}
+
+// Return an error if the codec is unknown.
+func ValidateCodec(codec string) error {
+	switch codec {
+	case "", CODEC_NONE, CODEC_FLATE:
+		return nil
+	}
+	return fmt.Errorf("Unknown compression codec %s, please use %s or %s", codec, CODEC_NONE, CODEC_FLATE)
+}
+
+// Compress document data according to the collection's codec, return the compressed data and its codec flag.
+// The data is stored as it is if compression does not make it smaller.
+func (col *Collection) compress(data []byte) (stored []byte, flags byte) {
+	if col.Codec != CODEC_FLATE {
+		return data, 0
+	}
+	compressed := new(bytes.Buffer)
+	writer := flateWriters.Get().(*flate.Writer)
+	writer.Reset(compressed)
+	_, err := writer.Write(data)
+	if err == nil {
+		err = writer.Close()
+	}
+	flateWriters.Put(writer)
+	if err != nil || compressed.Len() >= len(data) {
+		return data, 0
+	}
+	return compressed.Bytes(), FLAG_FLATE
+}
+
+// Decompress document data according to its flags. Return value is a copy if the data is compressed.
+func (col *Collection) decompress(stored []byte, flags byte) []byte {
+	if flags&FLAG_FLATE == 0 {
+		return stored
+	}
+	// Padding that follows the compressed data is not read
+	data, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(stored)))
+	if err != nil {
+		tdlog.CritNoRepeat("Failed to decompress document in %s: %v - repair ASAP", col.Path, err)
+		return nil
+	}
+	return data
+}
+
+// Change the codec of documents written from now on. Caller must hold exclusive data lock.
+func (part *Partition) SetCodec(codec string) {
+	part.col.Codec = codec
+}
+
+// Return the codec of the partition.
+func (part *Partition) Codec() string {
+	return part.col.Codec
+}
@@ -0,0 +1,73 @@
+package data
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCodec(t *testing.T) {
+	tmp := "/tmp/tiedot_test_col"
+	os.Remove(tmp)
+	os.Remove(tmp + OVERFLOW_SUFFIX)
+	defer os.Remove(tmp)
+	defer os.Remove(tmp + OVERFLOW_SUFFIX)
+	if ValidateCodec("whatever") == nil || ValidateCodec(CODEC_FLATE) != nil {
+		t.Fatal("Wrong validation")
+	}
+	col, err := OpenCollection(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repetitive := []byte(strings.Repeat(`{"a":"repetitive"}`, 100))
+	plainID, err := col.Insert(repetitive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	col.Codec = CODEC_FLATE
+	compressedID, err := col.Insert(repetitive)
+	if err != nil {
+		t.Fatal(err)
+	} else if col.Buf[compressedID+DOC_FLAGS] != FLAG_FLATE|FLAG_CRC || col.Used-compressedID >= compressedID {
+		t.Fatal("Document is not compressed", col.Buf[compressedID+DOC_FLAGS], col.Used-compressedID)
+	}
+	// Incompressible document is stored as it is
+	if id, err := col.Insert([]byte("a")); err != nil || col.Buf[id+DOC_FLAGS] != FLAG_CRC {
+		t.Fatal(err)
+	}
+	// Compressed and uncompressed documents coexist
+	if doc := col.Read(plainID); strings.TrimSpace(string(doc)) != string(repetitive) {
+		t.Fatal("Failed to read uncompressed document")
+	} else if doc := col.Read(compressedID); !bytes.Equal(doc, repetitive) {
+		t.Fatal("Failed to read compressed document", string(doc))
+	}
+	// Updating a document compresses it
+	if newID, err := col.Update(plainID, []byte(`{"a":"b"}`)); err != nil || newID != plainID {
+		t.Fatal(newID, err)
+	} else if newID, err = col.Update(plainID, repetitive); err != nil || newID != plainID || col.Buf[plainID+DOC_FLAGS] != FLAG_FLATE|FLAG_CRC {
+		t.Fatal(newID, err)
+	} else if doc := col.Read(plainID); !bytes.Equal(doc, repetitive) {
+		t.Fatal("Failed to read updated document", string(doc))
+	}
+	// Compressed large document overflows only if it is still too large
+	large := bytes.Repeat([]byte("a"), 2*DOC_MAX_ROOM)
+	if id, err := col.Insert(large); err != nil || col.Buf[id+DOC_FLAGS] != FLAG_FLATE|FLAG_CRC {
+		t.Fatal(err)
+	} else if doc := col.Read(id); !bytes.Equal(doc, large) {
+		t.Fatal("Failed to read large document", len(doc))
+	}
+	found := 0
+	col.ForEachDoc(func(id int, doc []byte) bool {
+		if bytes.Equal(doc, repetitive) || bytes.Equal(doc, large) {
+			found++
+		}
+		return true
+	})
+	if found != 3 {
+		t.Fatal(found)
+	}
+	if err = col.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
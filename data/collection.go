@@ -3,26 +3,39 @@
 // Every document has a binary header and UTF-8 text content.
 //
 // Documents are inserted one after another, and occupies 2x original document
-// size to leave room for future updates.
+// size (or as the room policy says) to leave room for future updates.
 //
 // Deleted documents are marked as deleted and the space is irrecoverable until
-// a "scrub" action (in DB logic) is carried out.
+// the partition is compacted, or a "scrub" action (in DB logic) is carried out.
 //
 // When update takes place, the new document may overwrite original document if
 // there is enough space, otherwise the original document is marked as deleted
 // and the updated document is inserted as a new document.
+//
+// Documents larger than DOC_MAX_ROOM overflow into a separate file, and the
+// collection file only keeps a reference to the overflow record.
+//
+// Documents may be compressed and encrypted, in which case the room is
+// reserved for the compressed and encrypted data.
+//
+// Document header carries a CRC32C checksum of the room, so that corrupted
+// documents are detected when they are read.
 
 package data
 
 import (
 	"encoding/binary"
+	"os"
 
 	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/HouzuoGuo/tiedot/tdlog"
 )
 
 const (
-	DOC_MAX_ROOM = 2 * 1048576 // Max document size (2 MBytes)
+	DOC_MAX_ROOM = 2 * 1048576 // Max document room (2 MBytes), larger documents overflow into overflow file
+	DOC_MAX_SIZE = 1 << 30     // Max document size (1 GBytes)
 	DOC_HEADER   = 1 + 10      // Document header size - validity (single byte), document room (int 10 bytes)
+	DOC_FLAGS    = 1 + 5       // Offset of document flags (single byte) in header, room never takes more than 5 bytes
 	// Pre-compiled document padding (128 spaces)
 	PADDING     = "                                                                                                                                "
 	LEN_PADDING = len(PADDING)
@@ -31,33 +44,121 @@ const (
 // Collection file contains document headers and document text data.
 type Collection struct {
 	*DataFile
+	Policy   RoomPolicy // Room of newly inserted documents
+	Codec    string     // Compression codec of newly written documents, empty means CODEC_NONE
+	Keys     *Keyring   // Encryption keys of newly written documents (nil if documents are not encrypted)
+	overflow *DataFile  // Large documents (nil if there has not been any)
 }
 
-// Open a collection file.
+// Open a collection file, and its overflow file if there is one.
 func OpenCollection(path string) (col *Collection, err error) {
+	return openCollection(path, false)
+}
+
+func openCollection(path string, readOnly bool) (col *Collection, err error) {
 	col = new(Collection)
-	col.DataFile, err = OpenDataFile(path, COL_FILE_GROWTH)
+	if readOnly {
+		col.DataFile, err = OpenDataFileReadOnly(path)
+	} else {
+		col.DataFile, err = OpenDataFile(path, COL_FILE_GROWTH)
+	}
+	if err != nil {
+		return
+	}
+	if _, statErr := os.Stat(path + OVERFLOW_SUFFIX); statErr == nil {
+		err = col.openOverflow()
+	}
 	return
 }
 
 // Find and retrieve a document by ID (physical document location). Return value is a copy of the document.
 func (col *Collection) Read(id int) []byte {
+	doc, _ := col.read(id)
+	return doc
+}
+
+// Find and retrieve a document by ID (physical document location), tell a corrupted document apart from a missing one.
+func (col *Collection) read(id int) ([]byte, error) {
 	if id < 0 || id > col.Used-DOC_HEADER || col.Buf[id] != 1 {
-		return nil
+		return nil, dberr.New(dberr.ErrorNoDoc, id)
 	} else if room, _ := binary.Varint(col.Buf[id+1 : id+11]); room > DOC_MAX_ROOM {
-		return nil
+		return nil, dberr.New(dberr.ErrorNoDoc, id)
 	} else if docEnd := id + DOC_HEADER + int(room); docEnd >= col.Size {
-		return nil
+		return nil, dberr.New(dberr.ErrorNoDoc, id)
+	} else if !col.docIntact(id, docEnd) {
+		tdlog.CritNoRepeat("Document %d in %s is corrupted - repair ASAP", id, col.Path)
+		return nil, dberr.New(dberr.ErrorCorruptDoc, id)
+	} else if col.Buf[id+DOC_FLAGS]&^FLAG_CRC != 0 {
+		return col.content(id, docEnd)
 	} else {
 		docCopy := make([]byte, room)
 		copy(docCopy, col.Buf[id+DOC_HEADER:docEnd])
-		return docCopy
+		return docCopy, nil
 	}
 }
 
+// Return document data of a valid document that has flags, resolving overflow reference and decompressing as needed.
+func (col *Collection) content(id, docEnd int) ([]byte, error) {
+	flags := col.Buf[id+DOC_FLAGS]
+	stored := col.Buf[id+DOC_HEADER : docEnd]
+	if flags&FLAG_OVERFLOW != 0 {
+		if stored = col.readOverflow(col.overflowRef(id)); stored == nil {
+			return nil, dberr.New(dberr.ErrorCorruptDoc, id)
+		}
+	}
+	if data := col.decode(stored, flags); data != nil {
+		return data, nil
+	}
+	return nil, dberr.New(dberr.ErrorNoDoc, id)
+}
+
+// Compress and then encrypt document data as configured, return the data to be stored and its flags.
+func (col *Collection) encode(data []byte) ([]byte, byte, error) {
+	compressed, flags := col.compress(data)
+	stored, flags, err := col.encrypt(compressed, flags)
+	// Used space of data file ends before the trailing zero bytes, a padding keeps them in the last document
+	if err == nil && (len(stored) == 0 || stored[len(stored)-1] == 0) {
+		stored = append(stored[:len(stored):len(stored)], PADDING[0])
+	}
+	return stored, flags, err
+}
+
+// Decrypt and then decompress stored document data according to its flags.
+func (col *Collection) decode(stored []byte, flags byte) []byte {
+	if stored = col.decrypt(stored, flags); stored == nil {
+		return nil
+	}
+	return col.decompress(stored, flags)
+}
+
 // Insert a new document, return the new document ID.
 func (col *Collection) Insert(data []byte) (id int, err error) {
-	room := len(data) << 1
+	if len(data) > DOC_MAX_SIZE {
+		return 0, dberr.New(dberr.ErrorDocTooLarge, DOC_MAX_SIZE, len(data))
+	}
+	stored, flags, err := col.encode(data)
+	if err != nil {
+		return 0, err
+	}
+	return col.insertEncoded(stored, flags)
+}
+
+// Insert encoded document data, return the new document ID.
+func (col *Collection) insertEncoded(stored []byte, flags byte) (id int, err error) {
+	if len(stored) > DOC_MAX_ROOM {
+		// Put the document into overflow file, and a reference to it into collection file
+		ref, err := col.writeOverflow(stored)
+		if err != nil {
+			return 0, err
+		}
+		// The reference ends with zero bytes, a padding follows it
+		return col.insertRoom(overflowRefBytes(ref), OVERFLOW_REF_SIZE+1, flags|FLAG_OVERFLOW)
+	}
+	return col.insertRoom(stored, col.Policy.Room(len(stored)), flags)
+}
+
+// Insert a new document into room of the size, return the new document ID.
+func (col *Collection) insertRoom(data []byte, room int, flags byte) (id int, err error) {
 	if room > DOC_MAX_ROOM {
 		return 0, dberr.New(dberr.ErrorDocTooLarge, DOC_MAX_ROOM, room)
 	}
@@ -70,6 +171,7 @@ func (col *Collection) Insert(data []byte) (id int, err error) {
 	// Write validity, room, document data and padding
 	col.Buf[id] = 1
 	binary.PutVarint(col.Buf[id+1:id+11], int64(room))
+	col.Buf[id+DOC_FLAGS] = flags
 	copy(col.Buf[id+DOC_HEADER:col.Used], data)
 	for padding := id + DOC_HEADER + len(data); padding < col.Used; padding += LEN_PADDING {
 		copySize := LEN_PADDING
@@ -78,14 +180,15 @@ func (col *Collection) Insert(data []byte) (id int, err error) {
 		}
 		copy(col.Buf[padding:padding+copySize], PADDING)
 	}
+	col.sumDoc(id, col.Used)
 	return
 }
 
 // Overwrite or re-insert a document, return the new document ID if re-inserted.
 func (col *Collection) Update(id int, data []byte) (newID int, err error) {
 	dataLen := len(data)
-	if dataLen > DOC_MAX_ROOM {
-		return 0, dberr.New(dberr.ErrorDocTooLarge, DOC_MAX_ROOM, dataLen)
+	if dataLen > DOC_MAX_SIZE {
+		return 0, dberr.New(dberr.ErrorDocTooLarge, DOC_MAX_SIZE, dataLen)
 	}
 	if id < 0 || id >= col.Used-DOC_HEADER || col.Buf[id] != 1 {
 		return 0, dberr.New(dberr.ErrorNoDoc, id)
@@ -97,11 +200,29 @@ func (col *Collection) Update(id int, data []byte) (newID int, err error) {
 	if docEnd := id + DOC_HEADER + int(currentDocRoom); docEnd >= col.Size {
 		return 0, dberr.New(dberr.ErrorNoDoc, id)
 	}
-	if dataLen <= int(currentDocRoom) {
-		padding := id + DOC_HEADER + len(data)
+	stored, flags, err := col.encode(data)
+	if err != nil {
+		return 0, err
+	}
+	overflown := col.Buf[id+DOC_FLAGS]&FLAG_OVERFLOW != 0
+	if overflown && len(stored) > DOC_MAX_ROOM {
+		// Replace overflow record and keep the reference in place
+		ref, err := col.writeOverflow(stored)
+		if err != nil {
+			return 0, err
+		}
+		col.deleteOverflow(col.overflowRef(id))
+		copy(col.Buf[id+DOC_HEADER:id+DOC_HEADER+OVERFLOW_REF_SIZE], overflowRefBytes(ref))
+		col.Buf[id+DOC_FLAGS] = flags | FLAG_OVERFLOW
+		col.sumDoc(id, id+DOC_HEADER+int(currentDocRoom))
+		return id, nil
+	}
+	if !overflown && len(stored) <= int(currentDocRoom) {
+		padding := id + DOC_HEADER + len(stored)
 		paddingEnd := id + DOC_HEADER + int(currentDocRoom)
 		// Overwrite data and then overwrite padding
-		copy(col.Buf[id+DOC_HEADER:padding], data)
+		copy(col.Buf[id+DOC_HEADER:padding], stored)
+		col.Buf[id+DOC_FLAGS] = flags
 		for ; padding < paddingEnd; padding += LEN_PADDING {
 			copySize := LEN_PADDING
 			if padding+LEN_PADDING >= paddingEnd {
@@ -109,12 +230,13 @@ func (col *Collection) Update(id int, data []byte) (newID int, err error) {
 			}
 			copy(col.Buf[padding:padding+copySize], PADDING)
 		}
+		col.sumDoc(id, paddingEnd)
 		return id, nil
 	}
 
 	// No enough room - re-insert the document
 	col.Delete(id)
-	return col.Insert(data)
+	return col.insertEncoded(stored, flags)
 }
 
 // Delete a document by ID.
@@ -127,10 +249,40 @@ func (col *Collection) Delete(id int) error {
 	if col.Buf[id] == 1 {
 		col.Buf[id] = 0
 	}
+	if col.Buf[id+DOC_FLAGS]&FLAG_OVERFLOW != 0 {
+		col.deleteOverflow(col.overflowRef(id))
+	}
 
 	return nil
 }
 
+// Return true if there is a valid document header at the location, the document may still fail its checksum.
+func (col *Collection) validAt(id int) bool {
+	if id < 0 || id > col.Used-DOC_HEADER || col.Buf[id] != 1 {
+		return false
+	}
+	room, _ := binary.Varint(col.Buf[id+1 : id+11])
+	return room >= 0 && room <= DOC_MAX_ROOM && id+DOC_HEADER+int(room) < col.Size
+}
+
+// Run the function on location of every valid document header, including documents that fail their checksum.
+func (col *Collection) forEachHeader(fun func(id int)) {
+	for id := 0; id < col.Used-DOC_HEADER && id >= 0; {
+		validity := col.Buf[id]
+		room, _ := binary.Varint(col.Buf[id+1 : id+11])
+		docEnd := id + DOC_HEADER + int(room)
+		if (validity == 0 || validity == 1) && room >= 0 && room <= DOC_MAX_ROOM && docEnd > 0 && docEnd <= col.Used {
+			if validity == 1 {
+				fun(id)
+			}
+			id = docEnd
+		} else {
+			// Corrupted document - move on
+			id++
+		}
+	}
+}
+
 // Run the function on every document; stop when the function returns false.
 func (col *Collection) ForEachDoc(fun func(id int, doc []byte) bool) {
 	for id := 0; id < col.Used-DOC_HEADER && id >= 0; {
@@ -138,7 +290,14 @@ func (col *Collection) ForEachDoc(fun func(id int, doc []byte) bool) {
 		room, _ := binary.Varint(col.Buf[id+1 : id+11])
 		docEnd := id + DOC_HEADER + int(room)
 		if (validity == 0 || validity == 1) && room <= DOC_MAX_ROOM && docEnd > 0 && docEnd <= col.Used {
-			if validity == 1 && !fun(id, col.Buf[id+DOC_HEADER:docEnd]) {
+			doc := col.Buf[id+DOC_HEADER : docEnd]
+			if validity == 1 && !col.docIntact(id, docEnd) {
+				// Corrupted document - skip
+				doc = nil
+			} else if validity == 1 && col.Buf[id+DOC_FLAGS]&^FLAG_CRC != 0 {
+				doc, _ = col.content(id, docEnd)
+			}
+			if validity == 1 && doc != nil && !fun(id, doc) {
 				break
 			}
 			id = docEnd
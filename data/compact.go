@@ -0,0 +1,227 @@
+// Online partition compaction.
+//
+// Live documents are copied into fresh collection and lookup files in several
+// rounds, the partition lock is only held for reading during each round, so
+// documents may be read and written in between. Documents written during the
+// copy are remembered and copied once more at the end, then the fresh files
+// replace the original ones under a brief exclusive lock.
+//
+// A marker file is created right before the fresh files are renamed into place,
+// so that an interrupted replacement can be completed when the partition is
+// opened next time. Overflow file is replaced before collection file.
+
+package data
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	COMPACT_SUFFIX = ".compact"   // File name suffix of fresh files made by compaction
+	COMPACT_MARKER = ".compacted" // File name suffix of the marker that says fresh files are ready to replace originals
+	COMPACT_ROUNDS = 64           // Copy live documents in this many rounds, the lock is released between rounds
+)
+
+// Complete or roll back a compaction that was interrupted.
+func recoverCompaction(colPath, lookupPath string) error {
+	marker := colPath + COMPACT_MARKER
+	if _, err := os.Stat(marker); err == nil {
+		// Fresh files are complete, finish replacing the originals
+		if _, err := os.Stat(colPath + COMPACT_SUFFIX); err == nil {
+			if err = replaceOverflow(colPath); err != nil {
+				return err
+			}
+		}
+		for _, orig := range []string{colPath, lookupPath} {
+			if _, err := os.Stat(orig + COMPACT_SUFFIX); err == nil {
+				if err = os.Rename(orig+COMPACT_SUFFIX, orig); err != nil {
+					return err
+				}
+			}
+		}
+		tdlog.Noticef("Completed interrupted compaction of %s", colPath)
+		return os.Remove(marker)
+	}
+	// Fresh files may be incomplete, discard them
+	if err := os.Remove(colPath + COMPACT_SUFFIX + OVERFLOW_SUFFIX); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, orig := range []string{colPath, lookupPath} {
+		if err := os.Remove(orig + COMPACT_SUFFIX); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replace the overflow file of collection with the fresh one, or remove it if there is no fresh one.
+func replaceOverflow(colPath string) error {
+	overflowPath := colPath + OVERFLOW_SUFFIX
+	if _, err := os.Stat(colPath + COMPACT_SUFFIX + OVERFLOW_SUFFIX); err == nil {
+		return os.Rename(colPath+COMPACT_SUFFIX+OVERFLOW_SUFFIX, overflowPath)
+	}
+	if err := os.Remove(overflowPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Remember that the document is changed while the partition is being compacted. Caller must hold exclusive data lock.
+func (part *Partition) noteChange(id int) {
+	if part.changed != nil {
+		part.changed[id] = struct{}{}
+	}
+}
+
+// Copy live documents of the round (out of COMPACT_ROUNDS) into fresh files. Caller must hold data lock.
+func (part *Partition) copyRound(round int, newCol *Collection, newLookup *HashTable) error {
+	ids, physIDs := part.lookup.GetPartition(round, COMPACT_ROUNDS)
+	for i, id := range ids {
+		doc, err := part.col.read(physIDs[i])
+		if dberr.Type(err) == dberr.ErrorCorruptDoc {
+			// The document would be lost, leave the partition as it is for repair
+			return dberr.New(dberr.ErrorCorruptDoc, id)
+		} else if doc != nil {
+			newPhysID, err := newCol.Insert(bytes.TrimRight(doc, PADDING[:1]))
+			if err != nil {
+				return err
+			}
+			newLookup.Put(id, newPhysID)
+		}
+	}
+	return nil
+}
+
+// Put the current version of a document that changed during the copy into fresh files, nil document is deleted.
+func copyChange(newCol *Collection, newLookup *HashTable, id int, doc []byte) (err error) {
+	newPhysIDs := newLookup.Get(id, 1)
+	if doc == nil {
+		// Deleted in the meantime
+		for _, physID := range newPhysIDs {
+			newCol.Delete(physID)
+			newLookup.Remove(id, physID)
+		}
+		return
+	}
+	doc = bytes.TrimRight(doc, PADDING[:1])
+	if len(newPhysIDs) == 0 {
+		// Inserted in the meantime
+		var newPhysID int
+		if newPhysID, err = newCol.Insert(doc); err != nil {
+			return
+		}
+		newLookup.Put(id, newPhysID)
+		return
+	}
+	// Updated in the meantime
+	var newPhysID int
+	if newPhysID, err = newCol.Update(newPhysIDs[0], doc); err != nil {
+		return
+	} else if newPhysID != newPhysIDs[0] {
+		newLookup.Remove(id, newPhysIDs[0])
+		newLookup.Put(id, newPhysID)
+	}
+	return
+}
+
+// Reclaim the space of deleted documents and excessive document room, while documents may still be read and written.
+func (part *Partition) Compact() (err error) {
+	part.compactLock.Lock()
+	defer part.compactLock.Unlock()
+	colPath, lookupPath := part.col.Path, part.lookup.Path
+	if err = recoverCompaction(colPath, lookupPath); err != nil {
+		return
+	}
+	newCol, err := OpenCollection(colPath + COMPACT_SUFFIX)
+	if err != nil {
+		return
+	}
+	newLookup, err := OpenHashTable(lookupPath + COMPACT_SUFFIX)
+	if err != nil {
+		newCol.Close()
+		os.Remove(newCol.Path)
+		return
+	}
+	discard := func() {
+		newCol.Close()
+		newLookup.Close()
+		os.Remove(newCol.Path)
+		os.Remove(newCol.Path + OVERFLOW_SUFFIX)
+		os.Remove(newLookup.Path)
+	}
+	part.DataLock.Lock()
+	part.changed = make(map[int]struct{})
+	// Documents get their room, codec and encryption according to the current configuration
+	newCol.Policy, newCol.Codec, newCol.Keys = part.col.Policy, part.col.Codec, part.col.Keys
+	part.DataLock.Unlock()
+	// Copy live documents round by round
+	for round := 0; round < COMPACT_ROUNDS; round++ {
+		part.DataLock.RLock()
+		err = part.copyRound(round, newCol, newLookup)
+		part.DataLock.RUnlock()
+		if err != nil {
+			part.DataLock.Lock()
+			part.changed = nil
+			part.DataLock.Unlock()
+			discard()
+			return
+		}
+	}
+	part.DataLock.Lock()
+	defer part.DataLock.Unlock()
+	// Copy documents that were changed in the meantime once more
+	for id := range part.changed {
+		var doc []byte
+		if physIDs := part.lookup.Get(id, 1); len(physIDs) > 0 {
+			doc = part.col.Read(physIDs[0])
+		}
+		if err = copyChange(newCol, newLookup, id, doc); err != nil {
+			break
+		}
+	}
+	part.changed = nil
+	if err == nil && newCol.overflow != nil {
+		err = newCol.overflow.Fh.Sync()
+	}
+	if err == nil {
+		if err = newCol.Fh.Sync(); err == nil {
+			err = newLookup.Fh.Sync()
+		}
+	}
+	if err != nil {
+		discard()
+		return
+	}
+	// Replace original files with the fresh files
+	before := part.col.Stats()
+	if err = part.col.Close(); err != nil {
+		return
+	} else if err = part.lookup.Close(); err != nil {
+		return
+	}
+	marker, err := os.OpenFile(colPath+COMPACT_MARKER, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return
+	}
+	marker.Close()
+	if err = replaceOverflow(colPath); err != nil {
+		return
+	} else if err = os.Rename(newCol.Path, colPath); err != nil {
+		return
+	} else if err = os.Rename(newLookup.Path, lookupPath); err != nil {
+		return
+	} else if err = os.Remove(colPath + COMPACT_MARKER); err != nil {
+		return
+	}
+	newCol.Path, newLookup.Path = colPath, lookupPath
+	if newCol.overflow != nil {
+		newCol.overflow.Path = colPath + OVERFLOW_SUFFIX
+	}
+	part.col, part.lookup = newCol, newLookup
+	tdlog.Infof("%s compacted: %d bytes of documents (%d bytes deleted) -> %d bytes", colPath, before.Live, before.Deleted, newCol.Used)
+	return
+}
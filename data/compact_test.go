@@ -0,0 +1,189 @@
+package data
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestPartitionCompact(t *testing.T) {
+	colPath := "/tmp/tiedot_test_col"
+	htPath := "/tmp/tiedot_test_ht"
+	os.Remove(colPath)
+	os.Remove(htPath)
+	defer os.Remove(colPath)
+	defer os.Remove(htPath)
+	part, err := OpenPartition(colPath, htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err = part.Insert(i, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 1000; i += 2 {
+		if err = part.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := part.DocStats(); stats.Live == 0 || stats.Deleted == 0 {
+		t.Fatal(stats)
+	}
+	usedBefore := part.col.Used
+	// Keep writing while compacting
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1000; i < 1200; i++ {
+			part.DataLock.Lock()
+			if _, err := part.Insert(i, []byte(strconv.Itoa(i))); err != nil {
+				t.Error(err)
+			}
+			if err := part.Update(i-999, []byte("updated"+strconv.Itoa(i))); err != nil && (i-999)%2 == 1 {
+				t.Error(err)
+			}
+			part.DataLock.Unlock()
+		}
+	}()
+	if err = part.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if part.col.Used >= usedBefore {
+		t.Fatal(part.col.Used, usedBefore)
+	}
+	for i := 0; i < 1200; i++ {
+		doc, err := part.Read(i)
+		if i < 1000 && i%2 == 0 {
+			if err == nil {
+				t.Fatal("Deleted document came back", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		expected := strconv.Itoa(i)
+		if i < 201 {
+			expected = "updated" + strconv.Itoa(i+999)
+		}
+		if string(doc[:len(expected)]) != expected {
+			t.Fatal(i, string(doc))
+		}
+	}
+	// Compacted files survive reopening, and there are no leftovers
+	if err = part.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, leftover := range []string{colPath + COMPACT_SUFFIX, htPath + COMPACT_SUFFIX, colPath + COMPACT_MARKER} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Fatal(leftover, err)
+		}
+	}
+	if part, err = OpenPartition(colPath, htPath); err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := part.Read(999); err != nil || string(doc[:3]) != "999" {
+		t.Fatal(string(doc), err)
+	}
+	if err = part.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverCompaction(t *testing.T) {
+	colPath := "/tmp/tiedot_test_col"
+	htPath := "/tmp/tiedot_test_ht"
+	for _, file := range []string{colPath, htPath, colPath + COMPACT_SUFFIX, htPath + COMPACT_SUFFIX, colPath + COMPACT_MARKER} {
+		os.Remove(file)
+		defer os.Remove(file)
+	}
+	// Incomplete compaction is discarded
+	for _, file := range []string{colPath, htPath, colPath + COMPACT_SUFFIX} {
+		if f, err := os.Create(file); err != nil {
+			t.Fatal(err)
+		} else {
+			f.WriteString(file)
+			f.Close()
+		}
+	}
+	if err := recoverCompaction(colPath, htPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(colPath + COMPACT_SUFFIX); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	// Complete compaction replaces original files
+	for _, file := range []string{colPath + COMPACT_SUFFIX, htPath + COMPACT_SUFFIX, colPath + COMPACT_MARKER} {
+		if f, err := os.Create(file); err != nil {
+			t.Fatal(err)
+		} else {
+			f.WriteString(file)
+			f.Close()
+		}
+	}
+	if err := recoverCompaction(colPath, htPath); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{colPath, htPath} {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content := make([]byte, 100)
+		n, _ := f.Read(content)
+		f.Close()
+		if string(content[:n]) != file+COMPACT_SUFFIX {
+			t.Fatal(string(content[:n]))
+		}
+	}
+	if _, err := os.Stat(colPath + COMPACT_MARKER); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestCompactOverflow(t *testing.T) {
+	colPath := "/tmp/tiedot_test_col"
+	htPath := "/tmp/tiedot_test_ht"
+	os.Remove(colPath)
+	os.Remove(colPath + OVERFLOW_SUFFIX)
+	os.Remove(htPath)
+	defer os.Remove(colPath)
+	defer os.Remove(colPath + OVERFLOW_SUFFIX)
+	defer os.Remove(htPath)
+	part, err := OpenPartition(colPath, htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := bytes.Repeat([]byte("a"), DOC_MAX_ROOM+1)
+	for i := 0; i < 2; i++ {
+		if _, err = part.Insert(i, large); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = part.Delete(0); err != nil {
+		t.Fatal(err)
+	} else if err = part.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := part.DocStats(); stats.Overflow != OVERFLOW_HEADER+len(large) || stats.OverflowDeleted != 0 {
+		t.Fatalf("Overflow file is not compacted %+v", stats)
+	} else if doc, err := part.Read(1); err != nil || !bytes.Equal(doc, large) {
+		t.Fatal(len(doc), err)
+	}
+	// Overflow file goes away when there are no more large documents
+	if err = part.Delete(1); err != nil {
+		t.Fatal(err)
+	} else if err = part.Compact(); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(colPath + OVERFLOW_SUFFIX); !os.IsNotExist(err) {
+		t.Fatal("Overflow file is not removed", err)
+	}
+	if err = part.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,173 @@
+// Document encryption at rest.
+//
+// Encrypted document data is made of the version of the key that encrypted
+// it, a random nonce, length of sealed data, and AES-GCM sealed (compressed)
+// document. Documents
+// encrypted by different key versions coexist in the same partition until
+// they are re-encrypted by the current key.
+
+package data
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	FLAG_AES        = 4 // Document flag - document data is encrypted by AES-GCM
+	KEY_VERSION_LEN = 4 // Size of key version (big endian unsigned 32-bit integer) in front of encrypted data
+)
+
+// Encryption keys of all versions, the current version encrypts new documents.
+type Keyring struct {
+	current uint32
+	aeads   map[uint32]cipher.AEAD
+}
+
+// Prepare AES-GCM ciphers of the keys (16, 24, or 32 bytes long).
+func NewKeyring(keys map[uint32][]byte, current uint32) (*Keyring, error) {
+	if _, exists := keys[current]; !exists {
+		return nil, fmt.Errorf("Current encryption key version %d is not among the keys", current)
+	}
+	ring := &Keyring{current: current, aeads: make(map[uint32]cipher.AEAD, len(keys))}
+	for version, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("Encryption key version %d: %v", version, err)
+		}
+		if ring.aeads[version], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return ring, nil
+}
+
+// Return the current key version.
+func (ring *Keyring) Current() uint32 {
+	return ring.current
+}
+
+// Encrypt data by the current key.
+func (ring *Keyring) Seal(data []byte) ([]byte, error) {
+	aead := ring.aeads[ring.current]
+	nonceEnd := KEY_VERSION_LEN + aead.NonceSize()
+	sealedLen := len(data) + aead.Overhead()
+	stored := make([]byte, nonceEnd+binary.MaxVarintLen64, nonceEnd+binary.MaxVarintLen64+sealedLen)
+	binary.BigEndian.PutUint32(stored, ring.current)
+	if _, err := rand.Read(stored[KEY_VERSION_LEN:nonceEnd]); err != nil {
+		return nil, err
+	}
+	stored = stored[:nonceEnd+binary.PutUvarint(stored[nonceEnd:], uint64(sealedLen))]
+	return aead.Seal(stored, stored[KEY_VERSION_LEN:nonceEnd], data, nil), nil
+}
+
+// Return the version of key that encrypted the data.
+func keyVersion(stored []byte) (uint32, bool) {
+	if len(stored) < KEY_VERSION_LEN {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(stored), true
+}
+
+// Decrypt data, the data may be followed by padding.
+func (ring *Keyring) Open(stored []byte) ([]byte, error) {
+	version, ok := keyVersion(stored)
+	if !ok {
+		return nil, fmt.Errorf("Encrypted data is too short")
+	}
+	aead, exists := ring.aeads[version]
+	if !exists {
+		return nil, fmt.Errorf("Encryption key version %d is not available", version)
+	}
+	nonceEnd := KEY_VERSION_LEN + aead.NonceSize()
+	if len(stored) < nonceEnd {
+		return nil, fmt.Errorf("Encrypted data is too short")
+	}
+	// Padding is appended to stored data, the sealed length is stored right after the nonce
+	sealedLen, n := binary.Uvarint(stored[nonceEnd:])
+	if n <= 0 || uint64(len(stored)-nonceEnd-n) < sealedLen {
+		return nil, fmt.Errorf("Encrypted data is corrupted")
+	}
+	return aead.Open(nil, stored[KEY_VERSION_LEN:nonceEnd], stored[nonceEnd+n:nonceEnd+n+int(sealedLen)], nil)
+}
+
+// Encrypt document data if the collection has a keyring, return the data to be stored and its flags.
+func (col *Collection) encrypt(data []byte, flags byte) ([]byte, byte, error) {
+	if col.Keys == nil {
+		return data, flags, nil
+	}
+	sealed, err := col.Keys.Seal(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return sealed, flags | FLAG_AES, nil
+}
+
+// Decrypt stored document data if it is encrypted.
+func (col *Collection) decrypt(stored []byte, flags byte) []byte {
+	if flags&FLAG_AES == 0 {
+		return stored
+	} else if col.Keys == nil {
+		tdlog.CritNoRepeat("Document in %s is encrypted, but there is no encryption key", col.Path)
+		return nil
+	}
+	data, err := col.Keys.Open(stored)
+	if err != nil {
+		tdlog.CritNoRepeat("Failed to decrypt document in %s: %v", col.Path, err)
+		return nil
+	}
+	return data
+}
+
+// Change the encryption keys of documents written from now on, nil disables encryption. Caller must hold exclusive data lock.
+func (part *Partition) SetKeyring(ring *Keyring) {
+	part.col.Keys = ring
+}
+
+// Return true if the valid document is not encrypted by the current key of the collection's keyring.
+func (col *Collection) keyOutdated(id int) bool {
+	if col.Keys == nil || id < 0 || id > col.Used-DOC_HEADER || col.Buf[id] != 1 {
+		return false
+	}
+	flags := col.Buf[id+DOC_FLAGS]
+	if flags&FLAG_AES == 0 {
+		return true
+	}
+	stored := col.Buf[id+DOC_HEADER : col.Used]
+	if flags&FLAG_OVERFLOW != 0 {
+		ref := col.overflowRef(id)
+		if col.overflow == nil || ref < 0 || ref > col.overflow.Used-OVERFLOW_HEADER {
+			return false
+		}
+		stored = col.overflow.Buf[ref+OVERFLOW_HEADER : col.overflow.Used]
+	}
+	version, ok := keyVersion(stored)
+	return ok && version != col.Keys.current
+}
+
+// Re-encrypt the documents of one of the rounds that are not yet encrypted by the current key. Return number of
+// re-encrypted documents. Caller must hold exclusive data lock.
+func (part *Partition) Reencrypt(round, rounds int) (reencrypted int, err error) {
+	ids, physIDs := part.lookup.GetPartition(round, rounds)
+	for i, id := range ids {
+		if !part.col.keyOutdated(physIDs[i]) {
+			continue
+		}
+		doc := part.col.Read(physIDs[i])
+		if doc == nil {
+			// Cannot be decrypted, leave it alone
+			continue
+		}
+		if err = part.Update(id, bytes.TrimRight(doc, PADDING[:1])); err != nil {
+			return
+		}
+		reencrypted++
+	}
+	return
+}
@@ -0,0 +1,87 @@
+package data
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	colPath := "/tmp/tiedot_test_col"
+	htPath := "/tmp/tiedot_test_ht"
+	os.Remove(colPath)
+	os.Remove(htPath)
+	defer os.Remove(colPath)
+	defer os.Remove(htPath)
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+	if _, err := NewKeyring(map[uint32][]byte{1: oldKey}, 2); err == nil {
+		t.Fatal("Did not error")
+	} else if _, err = NewKeyring(map[uint32][]byte{1: []byte("short")}, 1); err == nil {
+		t.Fatal("Did not error")
+	}
+	oldRing, err := NewKeyring(map[uint32][]byte{1: oldKey}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part, err := OpenPartition(colPath, htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.SetKeyring(oldRing)
+	part.SetCodec(CODEC_FLATE)
+	secret := strings.Repeat(`{"secret":"plaintext"}`, 10)
+	for i := 0; i < 100; i++ {
+		if _, err = part.Insert(i, []byte(secret+strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bytes.Contains(part.col.Buf[:part.col.Used], []byte("plaintext")) {
+		t.Fatal("Document is not encrypted")
+	}
+	// Update in place, documents are followed by padding
+	if err = part.Update(0, []byte("short")); err != nil {
+		t.Fatal(err)
+	} else if doc, err := part.Read(0); err != nil || string(doc) != "short" {
+		t.Fatal(string(doc), err)
+	}
+	// Rotate key
+	newRing, err := NewKeyring(map[uint32][]byte{1: oldKey, 2: newKey}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.SetKeyring(newRing)
+	reencrypted := 0
+	for round := 0; round < 4; round++ {
+		count, err := part.Reencrypt(round, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reencrypted += count
+	}
+	if reencrypted != 100 {
+		t.Fatal(reencrypted)
+	} else if count, err := part.Reencrypt(0, 1); count != 0 || err != nil {
+		t.Fatal(count, err)
+	}
+	// Old key is no longer needed
+	newOnly, err := NewKeyring(map[uint32][]byte{2: newKey}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.SetKeyring(newOnly)
+	for i := 1; i < 100; i++ {
+		if doc, err := part.Read(i); err != nil || string(doc) != secret+strconv.Itoa(i) {
+			t.Fatal(i, string(doc), err)
+		}
+	}
+	// Documents cannot be read without key
+	part.SetKeyring(nil)
+	if _, err := part.Read(1); err == nil {
+		t.Fatal("Did not error")
+	}
+	if err = part.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
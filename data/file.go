@@ -3,6 +3,7 @@
 package data
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/HouzuoGuo/tiedot/gommap"
@@ -15,6 +16,7 @@ type DataFile struct {
 	Size, Used, Growth int
 	Fh                 *os.File
 	Buf                gommap.MMap
+	readOnly           bool // Changes to the buffer are not written to the file, and the file does not grow
 }
 
 // Return true if the buffer begins with 64 consecutive zero bytes.
@@ -33,8 +35,22 @@ func LooksEmpty(buf gommap.MMap) bool {
 
 // Open a data file that grows by the specified size.
 func OpenDataFile(path string, growth int) (file *DataFile, err error) {
-	file = &DataFile{Path: path, Growth: growth}
-	if file.Fh, err = os.OpenFile(file.Path, os.O_CREATE|os.O_RDWR, 0600); err != nil {
+	return openDataFile(path, growth, false)
+}
+
+// Open an existing data file for reading. The buffer may still be written, but changes never reach the file.
+func OpenDataFileReadOnly(path string) (file *DataFile, err error) {
+	return openDataFile(path, 0, true)
+}
+
+func openDataFile(path string, growth int, readOnly bool) (file *DataFile, err error) {
+	file = &DataFile{Path: path, Growth: growth, readOnly: readOnly}
+	if readOnly {
+		file.Fh, err = os.Open(file.Path)
+	} else {
+		file.Fh, err = os.OpenFile(file.Path, os.O_CREATE|os.O_RDWR, 0600)
+	}
+	if err != nil {
 		return
 	}
 	var size int64
@@ -47,9 +63,18 @@ func OpenDataFile(path string, growth int) (file *DataFile, err error) {
 			return
 		}
 	}
-	if file.Buf == nil {
+	if file.Size == 0 {
+		// Nothing to map
+		file.Buf = gommap.MMap{}
+		return
+	} else if readOnly {
+		file.Buf, err = gommap.MapCopy(file.Fh)
+	} else if file.Buf == nil {
 		file.Buf, err = gommap.Map(file.Fh)
 	}
+	if err != nil {
+		return
+	}
 	defer tdlog.Infof("%s opened: %d of %d bytes in-use", file.Path, file.Used, file.Size)
 	// Bi-sect file buffer to find out how much space is in-use
 	for low, mid, high := 0, file.Size/2, file.Size; ; {
@@ -101,7 +126,9 @@ func (file *DataFile) overwriteWithZero(from int, size int) (err error) {
 func (file *DataFile) EnsureSize(more int) (err error) {
 	if file.Used+more <= file.Size {
 		return
-	} else if file.Buf != nil {
+	} else if file.readOnly {
+		return fmt.Errorf("%s is opened read-only", file.Path)
+	} else if len(file.Buf) > 0 {
 		if err = file.Buf.Unmap(); err != nil {
 			return
 		}
@@ -116,17 +143,31 @@ func (file *DataFile) EnsureSize(more int) (err error) {
 	return file.EnsureSize(more)
 }
 
+// Write changes of the file buffer to disk, and wait for the disk.
+func (file *DataFile) Sync() error {
+	if file.readOnly {
+		return nil
+	} else if err := file.Buf.Flush(); err != nil {
+		return err
+	}
+	return file.Fh.Sync()
+}
+
 // Un-map the file buffer and close the file handle.
 func (file *DataFile) Close() (err error) {
-	if err = file.Buf.Unmap(); err != nil {
-		return
+	if len(file.Buf) > 0 {
+		if err = file.Buf.Unmap(); err != nil {
+			return
+		}
 	}
 	return file.Fh.Close()
 }
 
 // Clear the entire file and resize it to initial size.
 func (file *DataFile) Clear() (err error) {
-	if err = file.Close(); err != nil {
+	if file.readOnly {
+		return fmt.Errorf("%s is opened read-only", file.Path)
+	} else if err = file.Close(); err != nil {
 		return
 	} else if err = os.Truncate(file.Path, 0); err != nil {
 		return
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"io/ioutil"
 	"os"
 	"testing"
 )
@@ -117,3 +118,36 @@ func TestFileGrow(t *testing.T) {
 	tmpFile.Buf[11] = 1
 	tmpFile.Close()
 }
+
+func TestSync(t *testing.T) {
+	tmp := "/tmp/tiedot_test_file"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	tmpFile, err := OpenDataFile(tmp, 1024)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	tmpFile.Buf[10] = 1
+	if err = tmpFile.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// Synced content is in the file, even before the buffer is unmapped
+	content, err := ioutil.ReadFile(tmp)
+	if err != nil || len(content) != 1024 || content[10] != 1 {
+		t.Fatal(len(content), err)
+	}
+	if err = tmpFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Syncing a read-only file does not write changes of the buffer
+	if tmpFile, err = OpenDataFileReadOnly(tmp); err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	tmpFile.Buf[11] = 1
+	if err = tmpFile.Sync(); err != nil {
+		t.Fatal(err)
+	} else if content, err = ioutil.ReadFile(tmp); err != nil || content[11] != 0 {
+		t.Fatal(content[11], err)
+	}
+}
@@ -8,11 +8,15 @@
 // integer key and value. An entry key may have multiple values assigned to it,
 // however the combination of entry key and value must be unique across the
 // entire hash table.
+//
+// Bucket header carries a CRC32C checksum of the bucket, which is verified by
+// Verify.
 
 package data
 
 import (
 	"encoding/binary"
+	"fmt"
 	"sync"
 
 	"github.com/HouzuoGuo/tiedot/tdlog"
@@ -30,6 +34,7 @@ type HashTable struct {
 	*DataFile
 	numBuckets int
 	Lock       *sync.RWMutex
+	SyncWrites bool // Write changes to disk before Put and Remove return
 }
 
 // Open a hash table file.
@@ -42,6 +47,19 @@ func OpenHashTable(path string) (ht *HashTable, err error) {
 	return
 }
 
+// Open an existing hash table file for reading, changes to the table never reach the file.
+func OpenHashTableReadOnly(path string) (ht *HashTable, err error) {
+	ht = &HashTable{Lock: new(sync.RWMutex)}
+	if ht.DataFile, err = OpenDataFileReadOnly(path); err != nil {
+		return
+	} else if ht.Size < INITIAL_BUCKETS*BUCKET_SIZE {
+		ht.Close()
+		return nil, fmt.Errorf("Hash table %s is truncated to %d bytes", path, ht.Size)
+	}
+	ht.calculateNumBuckets()
+	return
+}
+
 // Follow the longest bucket chain to calculate total number of buckets, hence the "used size" of hash table file.
 func (ht *HashTable) calculateNumBuckets() {
 	ht.numBuckets = ht.Size / BUCKET_SIZE
@@ -94,8 +112,10 @@ func (ht *HashTable) lastBucket(bucket int) int {
 // Create and chain a new bucket.
 func (ht *HashTable) growBucket(bucket int) {
 	ht.EnsureSize(BUCKET_SIZE)
-	lastBucketAddr := ht.lastBucket(bucket) * BUCKET_SIZE
+	lastBucket := ht.lastBucket(bucket)
+	lastBucketAddr := lastBucket * BUCKET_SIZE
 	binary.PutVarint(ht.Buf[lastBucketAddr:lastBucketAddr+10], int64(ht.numBuckets))
+	ht.sumBucket(lastBucket)
 	ht.Used += BUCKET_SIZE
 	ht.numBuckets++
 }
@@ -111,19 +131,25 @@ func (ht *HashTable) Clear() (err error) {
 
 // Store the entry into a vacant (invalidated or empty) place in the appropriate bucket.
 func (ht *HashTable) Put(key, val int) {
+	ht.put(key, val)
+	ht.syncWrite()
+}
+
+func (ht *HashTable) put(key, val int) {
 	for bucket, entry := HashKey(key), 0; ; {
 		entryAddr := bucket*BUCKET_SIZE + BUCKET_HEADER + entry*ENTRY_SIZE
 		if ht.Buf[entryAddr] != 1 {
 			ht.Buf[entryAddr] = 1
 			binary.PutVarint(ht.Buf[entryAddr+1:entryAddr+11], int64(key))
 			binary.PutVarint(ht.Buf[entryAddr+11:entryAddr+21], int64(val))
+			ht.sumBucket(bucket)
 			return
 		}
 		if entry++; entry == PER_BUCKET {
 			entry = 0
 			if bucket = ht.nextBucket(bucket); bucket == 0 {
 				ht.growBucket(HashKey(key))
-				ht.Put(key, val)
+				ht.put(key, val)
 				return
 			}
 		}
@@ -169,6 +195,8 @@ func (ht *HashTable) Remove(key, val int) {
 		if ht.Buf[entryAddr] == 1 {
 			if int(entryKey) == key && int(entryVal) == val {
 				ht.Buf[entryAddr] = 0
+				ht.sumBucket(bucket)
+				ht.syncWrite()
 				return
 			}
 		} else if entryKey == 0 && entryVal == 0 {
@@ -183,6 +211,15 @@ func (ht *HashTable) Remove(key, val int) {
 	}
 }
 
+// Write changes to disk if writes are synchronous. Index entries can be rebuilt from documents, failure is only logged.
+func (ht *HashTable) syncWrite() {
+	if ht.SyncWrites {
+		if err := ht.Sync(); err != nil {
+			tdlog.CritNoRepeat("Failed to sync %s: %v", ht.Path, err)
+		}
+	}
+}
+
 // Divide the entire hash table into roughly equally sized partitions, and return the start/end key range of the chosen partition.
 func GetPartitionRange(partNum, totalParts int) (start int, end int) {
 	perPart := INITIAL_BUCKETS / totalParts
@@ -0,0 +1,218 @@
+// Order log file records the order in which documents were inserted.
+//
+// The file is a sequence of fixed size records, one appended per inserted
+// document. Every record has a validity byte, a sequence number drawn from a
+// counter shared by all partitions of a collection, the document ID, and the
+// document size. Removing a document invalidates its record; once the oldest
+// valid record is past half of the log, valid records are moved to the
+// beginning of the file to reclaim the space.
+
+package data
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+const (
+	ORDER_RECORD_SIZE = 1 + 10 + 10 + 10 // Order record size: validity (single byte), sequence, document ID, document size (int 10 bytes each)
+	ORDER_FILE_GROWTH = 1048576          // Order log file initial size & size growth (1 MBytes)
+)
+
+// Sequence hands out increasing numbers to order log records.
+type Sequence struct {
+	last int64
+}
+
+// Return the next sequence number.
+func (seq *Sequence) Next() int {
+	return int(atomic.AddInt64(&seq.last, 1))
+}
+
+// Make sure that the sequence hands out numbers greater than the one given.
+func (seq *Sequence) Observe(num int) {
+	for {
+		last := atomic.LoadInt64(&seq.last)
+		if int64(num) <= last || atomic.CompareAndSwapInt64(&seq.last, last, int64(num)) {
+			return
+		}
+	}
+}
+
+// Order log is a file of insertion order records.
+type OrderLog struct {
+	*DataFile
+	head       int // Location of the oldest valid record
+	Count      int // Number of valid records
+	Bytes      int // Total size of documents in valid records
+	LastSeqNum int         // The largest sequence number in the log
+	addrs      map[int]int // Location of the valid record of each document ID
+}
+
+// Open an order log file.
+func OpenOrderLog(path string) (olog *OrderLog, err error) {
+	olog = new(OrderLog)
+	if olog.DataFile, err = OpenDataFile(path, ORDER_FILE_GROWTH); err != nil {
+		return
+	}
+	olog.calculateStats()
+	return
+}
+
+// Open an existing order log file for reading, changes to the log never reach the file.
+func OpenOrderLogReadOnly(path string) (olog *OrderLog, err error) {
+	olog = new(OrderLog)
+	if olog.DataFile, err = OpenDataFileReadOnly(path); err != nil {
+		return
+	}
+	olog.calculateStats()
+	return
+}
+
+// Read a record at the location.
+func (olog *OrderLog) record(addr int) (valid bool, seq, id, size int) {
+	seq64, _ := binary.Varint(olog.Buf[addr+1 : addr+11])
+	id64, _ := binary.Varint(olog.Buf[addr+11 : addr+21])
+	size64, _ := binary.Varint(olog.Buf[addr+21 : addr+31])
+	return olog.Buf[addr] == 1, int(seq64), int(id64), int(size64)
+}
+
+// Scan all records to find the oldest valid record, number of valid records, and the largest sequence number.
+func (olog *OrderLog) calculateStats() {
+	// Trailing zeros of the last record are not counted as in-use by the file bi-sect
+	if leftOver := olog.Used % ORDER_RECORD_SIZE; leftOver != 0 {
+		olog.Used += ORDER_RECORD_SIZE - leftOver
+	}
+	olog.head = olog.Used
+	olog.Count, olog.Bytes, olog.LastSeqNum = 0, 0, 0
+	olog.addrs = make(map[int]int)
+	for addr := 0; addr < olog.Used; addr += ORDER_RECORD_SIZE {
+		valid, seq, id, size := olog.record(addr)
+		if seq > olog.LastSeqNum {
+			olog.LastSeqNum = seq
+		}
+		if valid {
+			if _, exists := olog.addrs[id]; exists {
+				// Moving records was interrupted, the moved record comes first
+				olog.Buf[addr] = 0
+				continue
+			}
+			if addr < olog.head {
+				olog.head = addr
+			}
+			olog.addrs[id] = addr
+			olog.Count++
+			olog.Bytes += size
+		}
+	}
+}
+
+// Append a record for a newly inserted document.
+func (olog *OrderLog) Append(seq, id, size int) (err error) {
+	if err = olog.EnsureSize(ORDER_RECORD_SIZE); err != nil {
+		return
+	}
+	addr := olog.Used
+	olog.Buf[addr] = 1
+	binary.PutVarint(olog.Buf[addr+1:addr+11], int64(seq))
+	binary.PutVarint(olog.Buf[addr+11:addr+21], int64(id))
+	binary.PutVarint(olog.Buf[addr+21:addr+31], int64(size))
+	olog.addrs[id] = addr
+	olog.Used += ORDER_RECORD_SIZE
+	olog.Count++
+	olog.Bytes += size
+	if seq > olog.LastSeqNum {
+		olog.LastSeqNum = seq
+	}
+	return
+}
+
+// Return location of the valid record of the document, or -1 if there is none.
+func (olog *OrderLog) find(id int) int {
+	if addr, exists := olog.addrs[id]; exists {
+		return addr
+	}
+	return -1
+}
+
+// Record the new size of an updated document.
+func (olog *OrderLog) Resize(id, size int) {
+	if addr := olog.find(id); addr != -1 {
+		_, _, _, oldSize := olog.record(addr)
+		binary.PutVarint(olog.Buf[addr+21:addr+31], int64(size))
+		olog.Bytes += size - oldSize
+	}
+}
+
+// Invalidate the record of a removed document.
+func (olog *OrderLog) Remove(id int) {
+	addr := olog.find(id)
+	if addr == -1 {
+		return
+	}
+	_, _, _, size := olog.record(addr)
+	olog.Buf[addr] = 0
+	delete(olog.addrs, id)
+	olog.Count--
+	olog.Bytes -= size
+	// Move on to the next valid record if the oldest one has gone
+	if addr == olog.head {
+		for ; olog.head < olog.Used; olog.head += ORDER_RECORD_SIZE {
+			if valid, _, _, _ := olog.record(olog.head); valid {
+				break
+			}
+		}
+		if olog.head > 0 && olog.head >= olog.Used/2 {
+			olog.reclaim()
+		}
+	}
+}
+
+// Move records from the oldest valid one to the beginning of the file, and clear the space after them. The last
+// record is kept even if it is invalid, so that the largest sequence number is not lost.
+func (olog *OrderLog) reclaim() {
+	from := olog.head
+	if from == olog.Used {
+		from -= ORDER_RECORD_SIZE
+	}
+	if from <= 0 {
+		return
+	}
+	// Records are copied before the old ones are cleared, the destination does not overlap the source
+	moved := copy(olog.Buf, olog.Buf[from:olog.Used])
+	for i := moved; i < olog.Used; i++ {
+		olog.Buf[i] = 0
+	}
+	for id, addr := range olog.addrs {
+		olog.addrs[id] = addr - from
+	}
+	olog.head -= from
+	olog.Used = moved
+}
+
+// Return sequence number and ID of the oldest document; return false if there is none.
+func (olog *OrderLog) Oldest() (seq, id int, found bool) {
+	if olog.head >= olog.Used {
+		return
+	}
+	_, seq, id, _ = olog.record(olog.head)
+	return seq, id, true
+}
+
+// Run the function on every valid record from the oldest to the newest; stop when the function returns false.
+func (olog *OrderLog) ForEach(fun func(seq, id int) bool) {
+	for addr := olog.head; addr < olog.Used; addr += ORDER_RECORD_SIZE {
+		if valid, seq, id, _ := olog.record(addr); valid && !fun(seq, id) {
+			return
+		}
+	}
+}
+
+// Clear the entire log.
+func (olog *OrderLog) Clear() (err error) {
+	if err = olog.DataFile.Clear(); err != nil {
+		return
+	}
+	olog.calculateStats()
+	return
+}
@@ -0,0 +1,174 @@
+package data
+
+import (
+	"os"
+	"testing"
+)
+
+func TestOrderLogAppendRemove(t *testing.T) {
+	tmp := "/tmp/tiedot_test_order"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	olog, err := OpenOrderLog(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, found := olog.Oldest(); found {
+		t.Fatal("Empty log has oldest record")
+	}
+	for i := 1; i <= 5; i++ {
+		if err = olog.Append(i*10, i, i*100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if olog.Count != 5 || olog.Bytes != 1500 || olog.LastSeqNum != 50 {
+		t.Fatal(olog.Count, olog.Bytes, olog.LastSeqNum)
+	}
+	// Remove from the middle and then the oldest
+	olog.Remove(3)
+	olog.Remove(1)
+	if seq, id, found := olog.Oldest(); !found || seq != 20 || id != 2 {
+		t.Fatal(seq, id, found)
+	}
+	olog.Resize(2, 1000)
+	if olog.Count != 3 || olog.Bytes != 1900 {
+		t.Fatal(olog.Count, olog.Bytes)
+	}
+	ids := make([]int, 0)
+	olog.ForEach(func(seq, id int) bool {
+		ids = append(ids, id)
+		return true
+	})
+	if len(ids) != 3 || ids[0] != 2 || ids[1] != 4 || ids[2] != 5 {
+		t.Fatal(ids)
+	}
+	// Reopen and verify
+	if err = olog.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if olog, err = OpenOrderLog(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if olog.Count != 3 || olog.Bytes != 1900 || olog.LastSeqNum != 50 || olog.Used != 5*ORDER_RECORD_SIZE {
+		t.Fatal(olog.Count, olog.Bytes, olog.LastSeqNum, olog.Used)
+	}
+	if seq, id, found := olog.Oldest(); !found || seq != 20 || id != 2 {
+		t.Fatal(seq, id, found)
+	}
+	// Read-only log sees the same records
+	readOnly, err := OpenOrderLogReadOnly(tmp)
+	if err != nil {
+		t.Fatal(err)
+	} else if readOnly.Count != 3 || readOnly.LastSeqNum != 50 {
+		t.Fatal(readOnly.Count, readOnly.LastSeqNum)
+	} else if err = readOnly.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Clear
+	if err = olog.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, found := olog.Oldest(); found || olog.Count != 0 || olog.Bytes != 0 {
+		t.Fatal("Did not clear")
+	}
+	if err = olog.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOrderLogReclaim(t *testing.T) {
+	tmp := "/tmp/tiedot_test_order"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	olog, err := OpenOrderLog(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A rolling log of 10 records does not grow
+	for i := 1; i <= 1000; i++ {
+		if err = olog.Append(i, i, 1); err != nil {
+			t.Fatal(err)
+		}
+		if i > 10 {
+			olog.Remove(i - 10)
+		}
+	}
+	if olog.Count != 10 || olog.Used > 20*ORDER_RECORD_SIZE {
+		t.Fatal(olog.Count, olog.Used)
+	}
+	olog.Resize(995, 5)
+	if seq, id, found := olog.Oldest(); !found || seq != 991 || id != 991 || olog.Bytes != 14 {
+		t.Fatal(seq, id, found, olog.Bytes)
+	}
+	// Sequence number survives removal of all records
+	for i := 991; i <= 1000; i++ {
+		olog.Remove(i)
+	}
+	if err = olog.Close(); err != nil {
+		t.Fatal(err)
+	} else if olog, err = OpenOrderLog(tmp); err != nil {
+		t.Fatal(err)
+	}
+	defer olog.Close()
+	if _, _, found := olog.Oldest(); found || olog.Count != 0 || olog.LastSeqNum != 1000 {
+		t.Fatal(olog.Count, olog.LastSeqNum)
+	}
+}
+
+func TestPartitionTrackOrder(t *testing.T) {
+	colPath := "/tmp/tiedot_test_col"
+	htPath := "/tmp/tiedot_test_ht"
+	orderPath := "/tmp/tiedot_test_order"
+	os.Remove(colPath)
+	os.Remove(htPath)
+	os.Remove(orderPath)
+	defer os.Remove(colPath)
+	defer os.Remove(htPath)
+	defer os.Remove(orderPath)
+	part, err := OpenPartition(colPath, htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Existing document goes into the log when tracking starts
+	if _, err = part.Insert(1, []byte("11")); err != nil {
+		t.Fatal(err)
+	}
+	seq := new(Sequence)
+	if err = part.TrackOrder(orderPath, seq); err != nil {
+		t.Fatal(err)
+	}
+	if count, size := part.OrderedStats(); count != 1 || size != 2 {
+		t.Fatal(count, size)
+	}
+	if _, err = part.Insert(2, []byte("222")); err != nil {
+		t.Fatal(err)
+	}
+	if err = part.Update(1, []byte("1111111")); err != nil {
+		t.Fatal(err)
+	}
+	if count, size := part.OrderedStats(); count != 2 || size != 10 {
+		t.Fatal(count, size)
+	}
+	if s, id, found := part.Oldest(); !found || s != 1 || id != 1 {
+		t.Fatal(s, id, found)
+	}
+	if err = part.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	if s, id, found := part.Oldest(); !found || s != 2 || id != 2 {
+		t.Fatal(s, id, found)
+	}
+	// Stop tracking
+	if err = part.UntrackOrder(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(orderPath); !os.IsNotExist(err) {
+		t.Fatal("Order log is not removed")
+	}
+	if _, _, found := part.Oldest(); found {
+		t.Fatal("Order is still tracked")
+	}
+	if err = part.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,144 @@
+// Overflow file contains documents that are too large for collection file.
+//
+// Every overflow record has a binary header and document data, the record is
+// referenced by its location from the document in collection file. Records are
+// appended one after another, and a record is never updated in place.
+
+package data
+
+import (
+	"encoding/binary"
+	"os"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	OVERFLOW_SUFFIX   = ".overflow" // File name suffix of overflow file next to collection file
+	OVERFLOW_HEADER   = 1 + 10      // Overflow record header size - validity (single byte), data length (int 10 bytes)
+	OVERFLOW_REF_SIZE = 10          // Size of overflow record reference (int 10 bytes) in collection file
+	FLAG_OVERFLOW     = 1           // Document flag - document data is an overflow record reference
+)
+
+// Open (or create) the overflow file.
+func (col *Collection) openOverflow() (err error) {
+	if col.overflow == nil && col.readOnly {
+		col.overflow, err = OpenDataFileReadOnly(col.Path + OVERFLOW_SUFFIX)
+	} else if col.overflow == nil {
+		col.overflow, err = OpenDataFile(col.Path+OVERFLOW_SUFFIX, COL_FILE_GROWTH)
+	}
+	return
+}
+
+// Encode an overflow record reference.
+func overflowRefBytes(ref int) []byte {
+	buf := make([]byte, OVERFLOW_REF_SIZE)
+	binary.PutVarint(buf, int64(ref))
+	return buf
+}
+
+// Return the overflow record reference of a document.
+func (col *Collection) overflowRef(id int) int {
+	ref, _ := binary.Varint(col.Buf[id+DOC_HEADER : id+DOC_HEADER+OVERFLOW_REF_SIZE])
+	return int(ref)
+}
+
+// Append an overflow record, return its reference.
+func (col *Collection) writeOverflow(data []byte) (ref int, err error) {
+	if err = col.openOverflow(); err != nil {
+		return
+	}
+	ref = col.overflow.Used
+	if err = col.overflow.EnsureSize(OVERFLOW_HEADER + len(data)); err != nil {
+		return
+	}
+	col.overflow.Used += OVERFLOW_HEADER + len(data)
+	col.overflow.Buf[ref] = 1
+	binary.PutVarint(col.overflow.Buf[ref+1:ref+OVERFLOW_HEADER], int64(len(data)))
+	copy(col.overflow.Buf[ref+OVERFLOW_HEADER:col.overflow.Used], data)
+	col.sumOverflow(ref, col.overflow.Used)
+	return
+}
+
+// Return a copy of overflow record data, or nil if the reference is invalid or the record is corrupted.
+func (col *Collection) readOverflow(ref int) []byte {
+	if col.overflow == nil || ref < 0 || ref > col.overflow.Used-OVERFLOW_HEADER || col.overflow.Buf[ref] != 1 {
+		tdlog.CritNoRepeat("Bad overflow reference %d in %s - repair ASAP", ref, col.Path)
+		return nil
+	}
+	size, _ := binary.Varint(col.overflow.Buf[ref+1 : ref+OVERFLOW_HEADER])
+	if size < 0 || ref+OVERFLOW_HEADER+int(size) > col.overflow.Used {
+		tdlog.CritNoRepeat("Bad overflow record %d in %s - repair ASAP", ref, col.Path)
+		return nil
+	} else if !col.overflowIntact(ref, ref+OVERFLOW_HEADER+int(size)) {
+		tdlog.CritNoRepeat("Overflow record %d in %s is corrupted - repair ASAP", ref, col.Path)
+		return nil
+	}
+	dataCopy := make([]byte, size)
+	copy(dataCopy, col.overflow.Buf[ref+OVERFLOW_HEADER:ref+OVERFLOW_HEADER+int(size)])
+	return dataCopy
+}
+
+// Mark an overflow record as deleted.
+func (col *Collection) deleteOverflow(ref int) {
+	if col.overflow != nil && ref >= 0 && ref <= col.overflow.Used-OVERFLOW_HEADER && col.overflow.Buf[ref] == 1 {
+		col.overflow.Buf[ref] = 0
+	}
+}
+
+// Close collection file and overflow file.
+func (col *Collection) Close() (err error) {
+	if col.overflow != nil {
+		if err = col.overflow.Close(); err != nil {
+			return
+		}
+	}
+	return col.DataFile.Close()
+}
+
+// Write changes of collection file and overflow file to disk.
+func (col *Collection) Sync() (err error) {
+	if col.overflow != nil {
+		if err = col.overflow.Sync(); err != nil {
+			return
+		}
+	}
+	return col.DataFile.Sync()
+}
+
+// Clear collection file and remove overflow file.
+func (col *Collection) Clear() (err error) {
+	if col.overflow != nil {
+		if err = col.overflow.Close(); err != nil {
+			return
+		} else if err = os.Remove(col.overflow.Path); err != nil {
+			return
+		}
+		col.overflow = nil
+	}
+	return col.DataFile.Clear()
+}
+
+// Return the amount of space taken by valid and deleted overflow records, including headers.
+func (col *Collection) overflowStats() (live, deleted int) {
+	if col.overflow == nil {
+		return
+	}
+	for ref := 0; ref <= col.overflow.Used-OVERFLOW_HEADER; {
+		size, _ := binary.Varint(col.overflow.Buf[ref+1 : ref+OVERFLOW_HEADER])
+		validity := col.overflow.Buf[ref]
+		if (validity != 0 && validity != 1) || size < 0 || ref+OVERFLOW_HEADER+int(size) > col.overflow.Used {
+			// Corrupted record - move on
+			deleted++
+			ref++
+			continue
+		}
+		if validity == 1 {
+			live += OVERFLOW_HEADER + int(size)
+		} else {
+			deleted += OVERFLOW_HEADER + int(size)
+		}
+		ref += OVERFLOW_HEADER + int(size)
+	}
+	return
+}
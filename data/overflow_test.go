@@ -0,0 +1,94 @@
+package data
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestOverflow(t *testing.T) {
+	tmp := "/tmp/tiedot_test_col"
+	os.Remove(tmp)
+	os.Remove(tmp + OVERFLOW_SUFFIX)
+	defer os.Remove(tmp)
+	defer os.Remove(tmp + OVERFLOW_SUFFIX)
+	col, err := OpenCollection(tmp)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	small := []byte("abc")
+	large := bytes.Repeat([]byte("a"), DOC_MAX_ROOM+1)
+	larger := bytes.Repeat([]byte("b"), 2*DOC_MAX_ROOM)
+	// Small documents do not create overflow file
+	smallID, err := col.Insert(small)
+	if err != nil || col.overflow != nil {
+		t.Fatal(err, col.overflow)
+	}
+	largeID, err := col.Insert(large)
+	if err != nil {
+		t.Fatal(err)
+	} else if col.Used != 2*DOC_HEADER+2*len(small)+OVERFLOW_REF_SIZE+1 {
+		t.Fatal("Large document is not kept in overflow file", col.Used)
+	}
+	if doc := col.Read(largeID); !bytes.Equal(doc, large) {
+		t.Fatal("Failed to read large document", len(doc))
+	}
+	if doc := col.Read(smallID); strings.TrimSpace(string(doc)) != "abc" {
+		t.Fatal("Failed to read small document", doc)
+	}
+	// Update large document into larger document - reference stays in place
+	if newID, err := col.Update(largeID, larger); err != nil || newID != largeID {
+		t.Fatal(newID, err)
+	} else if doc := col.Read(largeID); !bytes.Equal(doc, larger) {
+		t.Fatal("Failed to read updated document", len(doc))
+	}
+	// Small document grows large, large document shrinks small
+	if smallID, err = col.Update(smallID, large); err != nil {
+		t.Fatal(err)
+	} else if largeID, err = col.Update(largeID, small); err != nil {
+		t.Fatal(err)
+	}
+	if doc := col.Read(smallID); !bytes.Equal(doc, large) {
+		t.Fatal("Failed to read grown document", len(doc))
+	} else if doc := col.Read(largeID); strings.TrimSpace(string(doc)) != "abc" {
+		t.Fatal("Failed to read shrunk document", doc)
+	}
+	stats := col.Stats()
+	if stats.Docs != 2 || stats.Overflow != OVERFLOW_HEADER+len(large) || stats.OverflowDeleted != 2*OVERFLOW_HEADER+len(large)+len(larger) {
+		t.Fatalf("Wrong stats %+v", stats)
+	}
+	// Reopen
+	if err = col.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if col, err = OpenCollection(tmp); err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	col.ForEachDoc(func(id int, doc []byte) bool {
+		if id == smallID && bytes.Equal(doc, large) {
+			found++
+		}
+		return true
+	})
+	if found != 1 {
+		t.Fatal("Did not find large document after reopening")
+	}
+	if err = col.Delete(smallID); err != nil {
+		t.Fatal(err)
+	} else if col.Read(smallID) != nil {
+		t.Fatal("Did not delete")
+	} else if stats := col.Stats(); stats.Overflow != 0 {
+		t.Fatalf("Did not delete overflow record %+v", stats)
+	}
+	// Clear removes overflow file
+	if err = col.Clear(); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(tmp + OVERFLOW_SUFFIX); !os.IsNotExist(err) {
+		t.Fatal("Overflow file is not removed", err)
+	}
+	if err = col.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,6 +6,9 @@
 package data
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
 	"sync"
 
 	"github.com/HouzuoGuo/tiedot/dberr"
@@ -14,12 +17,19 @@ import (
 
 // Partition associates a hash table with collection documents, allowing addressing of a document using an unchanging ID.
 type Partition struct {
-	col      *Collection
-	lookup   *HashTable
-	DataLock *sync.RWMutex // guard against concurrent document updates
+	col        *Collection
+	lookup     *HashTable
+	order      *OrderLog     // insertion order of documents (nil if order is not tracked)
+	seq        *Sequence     // hands out order sequence numbers, shared by all partitions of a collection
+	DataLock   *sync.RWMutex // guard against concurrent document updates
+	SyncWrites bool          // write changes to disk before Insert, Update, and Delete return
 
 	exclUpdate     map[int]chan struct{}
 	exclUpdateLock *sync.Mutex // guard against concurrent exclusive locking of documents
+
+	changed     map[int]struct{} // documents changed during compaction or copy (nil if neither is in progress)
+	compactLock *sync.Mutex      // guard against concurrent compaction and copy
+	backupMark  string           // snapshot that has an identical copy of the partition (empty if changed since)
 }
 
 func newPartition() *Partition {
@@ -27,27 +37,59 @@ func newPartition() *Partition {
 		exclUpdateLock: new(sync.Mutex),
 		exclUpdate:     make(map[int]chan struct{}),
 		DataLock:       new(sync.RWMutex),
+		compactLock:    new(sync.Mutex),
 	}
 }
 
 // Open a collection partition.
 func OpenPartition(colPath, lookupPath string) (part *Partition, err error) {
 	part = newPartition()
+	if err = recoverCompaction(colPath, lookupPath); err != nil {
+		return
+	}
 	if part.col, err = OpenCollection(colPath); err != nil {
 		return
 	} else if part.lookup, err = OpenHashTable(lookupPath); err != nil {
 		return
 	}
+	if mark, err := ioutil.ReadFile(colPath + BACKUP_MARK_SUFFIX); err == nil {
+		part.backupMark = string(mark)
+	}
+	return
+}
+
+// Open an existing collection partition for reading, changes to the partition never reach the files. An interrupted
+// compaction is left alone, it completes or rolls back when the partition is opened for writing.
+func OpenPartitionReadOnly(colPath, lookupPath string) (part *Partition, err error) {
+	part = newPartition()
+	if _, err := os.Stat(colPath + COMPACT_MARKER); err == nil {
+		tdlog.Noticef("%s has an interrupted compaction, reading the original files", colPath)
+	}
+	if part.col, err = openCollection(colPath, true); err != nil {
+		return
+	} else if part.lookup, err = OpenHashTableReadOnly(lookupPath); err != nil {
+		return
+	}
 	return
 }
 
 // Insert a document. The ID may be used to retrieve/update/delete the document later on.
 func (part *Partition) Insert(id int, data []byte) (physID int, err error) {
+	if err = part.unmark(); err != nil {
+		return
+	}
 	physID, err = part.col.Insert(data)
 	if err != nil {
 		return
 	}
 	part.lookup.Put(id, physID)
+	part.noteChange(id)
+	if part.order != nil {
+		if err = part.order.Append(part.seq.Next(), id, len(data)); err != nil {
+			return
+		}
+	}
+	err = part.syncWrite()
 	return
 }
 
@@ -59,9 +101,12 @@ func (part *Partition) Read(id int) ([]byte, error) {
 		return nil, dberr.New(dberr.ErrorNoDoc, id)
 	}
 
-	data := part.col.Read(physID[0])
+	data, err := part.col.read(physID[0])
 
-	if data == nil {
+	if err != nil {
+		if dberr.Type(err) == dberr.ErrorCorruptDoc {
+			return nil, dberr.New(dberr.ErrorCorruptDoc, id)
+		}
 		return nil, dberr.New(dberr.ErrorNoDoc, id)
 	}
 
@@ -73,6 +118,8 @@ func (part *Partition) Update(id int, data []byte) (err error) {
 	physID := part.lookup.Get(id, 1)
 	if len(physID) == 0 {
 		return dberr.New(dberr.ErrorNoDoc, id)
+	} else if err = part.unmark(); err != nil {
+		return
 	}
 	newID, err := part.col.Update(physID[0], data)
 	if err != nil {
@@ -82,7 +129,11 @@ func (part *Partition) Update(id int, data []byte) (err error) {
 		part.lookup.Remove(id, physID[0])
 		part.lookup.Put(id, newID)
 	}
-	return
+	part.noteChange(id)
+	if part.order != nil {
+		part.order.Resize(id, len(data))
+	}
+	return part.syncWrite()
 }
 
 // Lock a document for exclusive update.
@@ -116,18 +167,121 @@ func (part *Partition) Delete(id int) (err error) {
 	physID := part.lookup.Get(id, 1)
 	if len(physID) == 0 {
 		return dberr.New(dberr.ErrorNoDoc, id)
+	} else if err = part.unmark(); err != nil {
+		return
 	}
 	part.col.Delete(physID[0])
 	part.lookup.Remove(id, physID[0])
+	part.noteChange(id)
+	if part.order != nil {
+		part.order.Remove(id)
+	}
+	return part.syncWrite()
+}
+
+// Write changes of document file, ID lookup table, and order log to disk. Caller should hold data lock.
+func (part *Partition) Sync() error {
+	if err := part.col.Sync(); err != nil {
+		return err
+	} else if err = part.lookup.Sync(); err != nil {
+		return err
+	} else if part.order != nil {
+		return part.order.Sync()
+	}
+	return nil
+}
+
+// Write changes to disk if writes are synchronous.
+func (part *Partition) syncWrite() error {
+	if part.SyncWrites {
+		return part.Sync()
+	}
+	return nil
+}
+
+// Start tracking insertion order of documents in the order log file, sequence numbers come from the shared sequence.
+// Documents that are already in the partition are put into an empty log in no particular order.
+func (part *Partition) TrackOrder(orderPath string, seq *Sequence) (err error) {
+	if err = part.unmark(); err != nil {
+		return
+	} else if part.order, err = OpenOrderLog(orderPath); err != nil {
+		return
+	}
+	part.seq = seq
+	seq.Observe(part.order.LastSeqNum)
+	if part.order.Count == 0 {
+		ids, _ := part.lookup.GetPartition(0, 1)
+		for _, id := range ids {
+			if data, err := part.Read(id); err == nil {
+				if err = part.order.Append(seq.Next(), id, len(bytes.TrimRight(data, PADDING[:1]))); err != nil {
+					return err
+				}
+			}
+		}
+	}
 	return
 }
 
+// Open the existing order log of a read-only partition, for reading insertion order of documents.
+func (part *Partition) ReadOrder(orderPath string) (err error) {
+	part.order, err = OpenOrderLogReadOnly(orderPath)
+	return
+}
+
+// Stop tracking insertion order of documents and remove the order log file.
+func (part *Partition) UntrackOrder() error {
+	if part.order == nil {
+		return nil
+	} else if err := part.unmark(); err != nil {
+		return err
+	}
+	if err := part.order.Close(); err != nil {
+		return err
+	}
+	orderPath := part.order.Path
+	part.order, part.seq = nil, nil
+	return os.Remove(orderPath)
+}
+
+// Remove a document from insertion order log, even if the document itself is gone.
+func (part *Partition) RemoveFromOrder(id int) {
+	if part.order != nil {
+		part.unmarkOrLog()
+		part.order.Remove(id)
+	}
+}
+
+// Return number and total size of documents in insertion order log.
+func (part *Partition) OrderedStats() (count, size int) {
+	if part.order == nil {
+		return
+	}
+	return part.order.Count, part.order.Bytes
+}
+
+// Return sequence number and ID of the oldest document in insertion order log; return false if there is none.
+func (part *Partition) Oldest() (seq, id int, found bool) {
+	if part.order == nil {
+		return
+	}
+	return part.order.Oldest()
+}
+
+// Run the function on sequence number and ID of every document from the oldest to the newest.
+func (part *Partition) ForEachInOrder(fun func(seq, id int) bool) {
+	if part.order != nil {
+		part.order.ForEach(fun)
+	}
+}
+
 // Partition documents into roughly equally sized portions, and run the function on every document in the portion.
 func (part *Partition) ForEachDoc(partNum, totalPart int, fun func(id int, doc []byte) bool) (moveOn bool) {
 	ids, physIDs := part.lookup.GetPartition(partNum, totalPart)
 	for i, id := range ids {
-		data := part.col.Read(physIDs[i])
-		if data != nil {
+		data, err := part.col.read(physIDs[i])
+		if dberr.Type(err) == dberr.ErrorCorruptDoc {
+			tdlog.CritNoRepeat("Skipped corrupted document %d in %s", id, part.col.Path)
+		} else if data != nil {
 			if !fun(id, data) {
 				return false
 			}
@@ -136,6 +290,48 @@ func (part *Partition) ForEachDoc(partNum, totalPart int, fun func(id int, doc [
 	return true
 }
 
+// An entry of ID lookup table.
+type LookupEntry struct {
+	ID     int `json:"id"`
+	PhysID int `json:"physID"` // Location of the document in collection file
+}
+
+// Return all entries of ID lookup table. Caller should hold data lock.
+func (part *Partition) Lookups() []LookupEntry {
+	ids, physIDs := part.lookup.GetPartition(0, 1)
+	entries := make([]LookupEntry, len(ids))
+	for i, id := range ids {
+		entries[i] = LookupEntry{id, physIDs[i]}
+	}
+	return entries
+}
+
+// Cross-check ID lookup table against document headers. Return lookup entries that do not refer to a valid document
+// (orphans), and locations of valid documents that no lookup entry refers to. Caller should hold data lock.
+func (part *Partition) CheckLookup() (orphans []LookupEntry, unreferenced []int) {
+	orphans, unreferenced = make([]LookupEntry, 0), make([]int, 0)
+	referenced := make(map[int]struct{})
+	for _, entry := range part.Lookups() {
+		if part.col.validAt(entry.PhysID) {
+			referenced[entry.PhysID] = struct{}{}
+		} else {
+			orphans = append(orphans, entry)
+		}
+	}
+	part.col.forEachHeader(func(id int) {
+		if _, exists := referenced[id]; !exists {
+			unreferenced = append(unreferenced, id)
+		}
+	})
+	return
+}
+
+// Remove an entry from ID lookup table and leave the document alone. Caller should hold data lock.
+func (part *Partition) RemoveLookup(id, physID int) {
+	part.unmarkOrLog()
+	part.lookup.Remove(id, physID)
+}
+
 // Return approximate number of documents in the partition.
 func (part *Partition) ApproxDocCount() int {
 	totalPart := 24 // not magic; a larger number makes estimation less accurate, but improves performance
@@ -158,6 +354,10 @@ func (part *Partition) Clear() error {
 
 	var err error
 
+	if e := part.unmark(); e != nil {
+		return e
+	}
+
 	if e := part.col.Clear(); e != nil {
 		tdlog.CritNoRepeat("Failed to clear %s: %v", part.col.Path, e)
 
@@ -170,6 +370,14 @@ func (part *Partition) Clear() error {
 		err = dberr.New(dberr.ErrorIO)
 	}
 
+	if part.order != nil {
+		if e := part.order.Clear(); e != nil {
+			tdlog.CritNoRepeat("Failed to clear %s: %v", part.order.Path, e)
+
+			err = dberr.New(dberr.ErrorIO)
+		}
+	}
+
 	return err
 }
 
@@ -186,5 +394,11 @@ func (part *Partition) Close() error {
 		tdlog.CritNoRepeat("Failed to close %s: %v", part.lookup.Path, e)
 		err = dberr.New(dberr.ErrorIO)
 	}
+	if part.order != nil {
+		if e := part.order.Close(); e != nil {
+			tdlog.CritNoRepeat("Failed to close %s: %v", part.order.Path, e)
+			err = dberr.New(dberr.ErrorIO)
+		}
+	}
 	return err
 }
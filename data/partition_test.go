@@ -1,6 +1,8 @@
 package data
 
 import (
+	"bytes"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"strconv"
@@ -147,3 +149,31 @@ func TestApproxDocCount(t *testing.T) {
 		t.Fatal("Algorithm is way too slow")
 	}
 }
+
+func TestPartitionSyncWrites(t *testing.T) {
+	colPath := "/tmp/tiedot_test_col"
+	htPath := "/tmp/tiedot_test_ht"
+	os.Remove(colPath)
+	os.Remove(htPath)
+	defer os.Remove(colPath)
+	defer os.Remove(htPath)
+	part, err := OpenPartition(colPath, htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer part.Close()
+	part.SyncWrites = true
+	if _, err = part.Insert(1, []byte("synced")); err != nil {
+		t.Fatal(err)
+	} else if err = part.Update(1, []byte("updated")); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(colPath); err != nil || !bytes.Contains(content, []byte("updated")) {
+		t.Fatal(err)
+	}
+	if err = part.Delete(1); err != nil {
+		t.Fatal(err)
+	} else if err = part.Delete(1); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,60 @@
+// Document room policy - how much room a document occupies in collection file.
+
+package data
+
+import "fmt"
+
+const (
+	ROOM_DOUBLE  = "double"  // Room is twice the document size (default)
+	ROOM_EXACT   = "exact"   // Room is exactly the document size, suitable for documents that are never updated
+	ROOM_SLACK   = "slack"   // Room is the document size plus a fixed number of bytes
+	ROOM_PERCENT = "percent" // Room is the document size plus a percentage of it
+)
+
+// Policy of reserving room for future growth of a document.
+type RoomPolicy struct {
+	Policy string `json:"policy"` // One of ROOM_* constants, empty means ROOM_DOUBLE
+	Value  int    `json:"value"`  // Number of slack bytes or percentage
+}
+
+// Return an error if the policy is unknown or its value is out of range.
+func (policy RoomPolicy) Validate() error {
+	switch policy.Policy {
+	case "", ROOM_DOUBLE, ROOM_EXACT:
+		return nil
+	case ROOM_SLACK, ROOM_PERCENT:
+		if policy.Value < 0 {
+			return fmt.Errorf("Room policy %s may not have a negative value", policy.Policy)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown room policy %s, please use %s, %s, %s, or %s", policy.Policy, ROOM_DOUBLE, ROOM_EXACT, ROOM_SLACK, ROOM_PERCENT)
+}
+
+// Return room size of a document according to the policy, the room never exceeds DOC_MAX_ROOM unless the document does.
+func (policy RoomPolicy) Room(size int) (room int) {
+	switch policy.Policy {
+	case ROOM_EXACT:
+		room = size
+	case ROOM_SLACK:
+		room = size + policy.Value
+	case ROOM_PERCENT:
+		room = size + size*policy.Value/100
+	default:
+		room = size << 1
+	}
+	if room > DOC_MAX_ROOM && size <= DOC_MAX_ROOM {
+		room = DOC_MAX_ROOM
+	}
+	return
+}
+
+// Change the room policy of documents inserted (or relocated) from now on. Caller must hold exclusive data lock.
+func (part *Partition) SetRoomPolicy(policy RoomPolicy) {
+	part.col.Policy = policy
+}
+
+// Return the room policy of the partition.
+func (part *Partition) RoomPolicy() RoomPolicy {
+	return part.col.Policy
+}
@@ -0,0 +1,53 @@
+package data
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRoomPolicy(t *testing.T) {
+	for _, c := range []struct {
+		policy   RoomPolicy
+		size     int
+		expected int
+	}{
+		{RoomPolicy{}, 10, 20},
+		{RoomPolicy{Policy: ROOM_DOUBLE}, 10, 20},
+		{RoomPolicy{Policy: ROOM_EXACT}, 10, 10},
+		{RoomPolicy{Policy: ROOM_SLACK, Value: 5}, 10, 15},
+		{RoomPolicy{Policy: ROOM_PERCENT, Value: 50}, 10, 15},
+		{RoomPolicy{}, DOC_MAX_ROOM - 1, DOC_MAX_ROOM},
+	} {
+		if room := c.policy.Room(c.size); room != c.expected {
+			t.Fatal(c, room)
+		}
+	}
+	for _, invalid := range []RoomPolicy{{Policy: "whatever"}, {Policy: ROOM_SLACK, Value: -1}} {
+		if invalid.Validate() == nil {
+			t.Fatal("Did not error", invalid)
+		}
+	}
+	// Exact room relocates a document on growth
+	tmp := "/tmp/tiedot_test_col"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	col, err := OpenCollection(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	col.Policy = RoomPolicy{Policy: ROOM_EXACT}
+	id, err := col.Insert([]byte("abc"))
+	if err != nil || col.Used != DOC_HEADER+3 {
+		t.Fatal(col.Used, err)
+	}
+	if newID, err := col.Update(id, []byte("xy")); err != nil || newID != id || string(col.Read(id)) != "xy " {
+		t.Fatal(newID, err)
+	}
+	newID, err := col.Update(id, []byte("abcd"))
+	if err != nil || newID == id || string(col.Read(newID)) != "abcd" || col.Read(id) != nil {
+		t.Fatal(newID, err)
+	}
+	if err = col.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,209 @@
+// Online partition copy for snapshots.
+//
+// Like compaction, live documents are copied into fresh files round by round
+// while the partition stays in use, and documents written in the meantime are
+// remembered. Copies of many partitions are captured at one point in time: the
+// caller holds exclusive locks of all the partitions while changed documents
+// are read into memory, and they are written into the fresh files after the
+// locks are released.
+//
+// A backup marker file next to the collection file remembers the snapshot that
+// captured the partition, and it is removed before the partition changes. A
+// partition still marked by the base snapshot does not copy documents, it only
+// captures the documents changed in the meantime, if there are any, to be
+// written into a copy of the base snapshot's files.
+
+package data
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	BACKUP_MARK_SUFFIX = ".backup" // File name suffix of the marker that names the snapshot identical to the partition
+)
+
+// Copy of a partition in progress.
+type PartitionCopy struct {
+	part                           *Partition
+	colPath, lookupPath, orderPath string
+	newCol                         *Collection
+	newLookup                      *HashTable
+	policy                         RoomPolicy
+	codec                          string
+	keys                           *Keyring
+	Unchanged                      bool           // The partition is identical to the base snapshot, documents are not copied
+	changes                        map[int][]byte // Documents changed during the copy (nil if deleted)
+	order                          []byte         // Captured order log (nil if order is not tracked or unchanged)
+	done                           bool
+}
+
+// Return the snapshot that has an identical copy of the partition, or an empty string if the partition has changed.
+func (part *Partition) BackupMark() string {
+	return part.backupMark
+}
+
+// Remove the backup marker right before the partition changes. Caller must hold exclusive data lock.
+func (part *Partition) unmark() error {
+	if part.backupMark == "" {
+		return nil
+	} else if err := os.Remove(part.col.Path + BACKUP_MARK_SUFFIX); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	part.backupMark = ""
+	return nil
+}
+
+// Remove the backup marker for a change of files that belong to the partition but are kept by the caller, such as
+// expiry tables. Caller must hold exclusive data lock.
+func (part *Partition) Unmark() error {
+	return part.unmark()
+}
+
+// Remove the backup marker for a change that cannot fail.
+func (part *Partition) unmarkOrLog() {
+	if err := part.unmark(); err != nil {
+		tdlog.CritNoRepeat("Failed to remove backup marker of %s: %v", part.col.Path, err)
+	}
+}
+
+// Start copying the partition into fresh files at the paths (order log path is used only if order is tracked), while
+// documents may still be read and written. Documents are not copied if the partition is marked by the base snapshot.
+// The copy must be captured and then completed, or aborted.
+func (part *Partition) StartCopy(colPath, lookupPath, orderPath, baseMark string) (cp *PartitionCopy, err error) {
+	part.compactLock.Lock()
+	cp = &PartitionCopy{part: part, colPath: colPath, lookupPath: lookupPath, orderPath: orderPath}
+	part.DataLock.Lock()
+	part.changed = make(map[int]struct{})
+	cp.policy, cp.codec, cp.keys = part.col.Policy, part.col.Codec, part.col.Keys
+	cp.Unchanged = baseMark != "" && part.backupMark == baseMark
+	part.DataLock.Unlock()
+	if cp.Unchanged {
+		return
+	}
+	if err = cp.open(); err != nil {
+		cp.Abort()
+		return nil, err
+	}
+	for round := 0; round < COMPACT_ROUNDS; round++ {
+		part.DataLock.RLock()
+		err = part.copyRound(round, cp.newCol, cp.newLookup)
+		part.DataLock.RUnlock()
+		if err != nil {
+			cp.Abort()
+			return nil, err
+		}
+	}
+	return
+}
+
+// Open the fresh files, documents get their room, codec and encryption according to the configuration at start.
+func (cp *PartitionCopy) open() (err error) {
+	if cp.newCol, err = OpenCollection(cp.colPath); err != nil {
+		return
+	} else if cp.newLookup, err = OpenHashTable(cp.lookupPath); err != nil {
+		return
+	}
+	cp.newCol.Policy, cp.newCol.Codec, cp.newCol.Keys = cp.policy, cp.codec, cp.keys
+	return
+}
+
+// Capture documents changed since the copy started, and mark the partition by the snapshot. Caller must hold exclusive
+// data lock.
+func (cp *PartitionCopy) Capture(mark string) error {
+	part := cp.part
+	cp.changes = make(map[int][]byte, len(part.changed))
+	for id := range part.changed {
+		var doc []byte
+		if physIDs := part.lookup.Get(id, 1); len(physIDs) > 0 {
+			var err error
+			if doc, err = part.col.read(physIDs[0]); dberr.Type(err) == dberr.ErrorCorruptDoc {
+				return dberr.New(dberr.ErrorCorruptDoc, id)
+			}
+		}
+		cp.changes[id] = doc
+	}
+	part.changed = nil
+	if part.order != nil && cp.Changed() {
+		cp.order = make([]byte, part.order.Used)
+		copy(cp.order, part.order.Buf)
+	}
+	if err := ioutil.WriteFile(part.col.Path+BACKUP_MARK_SUFFIX, []byte(mark), 0600); err != nil {
+		return err
+	}
+	part.backupMark = mark
+	return nil
+}
+
+// Return true if the copy has different content from the base snapshot, that is if the partition was not unchanged
+// or documents changed during the copy. Call after capture.
+func (cp *PartitionCopy) Changed() bool {
+	return !cp.Unchanged || len(cp.changes) > 0
+}
+
+// Write captured changes into the fresh files, then sync and close them. Caller must not hold data lock. If the
+// partition was unchanged since the base snapshot but documents changed during the copy, the caller must put a copy of
+// the base snapshot's files at the paths beforehand.
+func (cp *PartitionCopy) Complete() (err error) {
+	if cp.done {
+		return
+	}
+	defer cp.finish()
+	if !cp.Changed() {
+		return
+	} else if cp.newCol == nil {
+		if err = cp.open(); err != nil {
+			return
+		}
+	}
+	for id, doc := range cp.changes {
+		if err = copyChange(cp.newCol, cp.newLookup, id, doc); err != nil {
+			return
+		}
+	}
+	if cp.order != nil {
+		if err = ioutil.WriteFile(cp.orderPath, cp.order, 0600); err != nil {
+			return
+		}
+	}
+	if err = cp.newCol.Sync(); err != nil {
+		return
+	} else if err = cp.newLookup.Sync(); err != nil {
+		return
+	} else if err = cp.newCol.Close(); err != nil {
+		return
+	}
+	err = cp.newLookup.Close()
+	cp.newCol, cp.newLookup = nil, nil
+	return
+}
+
+// Stop the copy and remove the fresh files. Caller must not hold data lock.
+func (cp *PartitionCopy) Abort() {
+	if cp.done {
+		return
+	}
+	cp.finish()
+	for _, filePath := range []string{cp.colPath, cp.colPath + OVERFLOW_SUFFIX, cp.lookupPath, cp.orderPath} {
+		os.Remove(filePath)
+	}
+}
+
+// Close the fresh files that are still open, stop tracking changes, and let the partition compact.
+func (cp *PartitionCopy) finish() {
+	if cp.newCol != nil {
+		cp.newCol.Close()
+	}
+	if cp.newLookup != nil {
+		cp.newLookup.Close()
+	}
+	cp.part.DataLock.Lock()
+	cp.part.changed = nil
+	cp.part.DataLock.Unlock()
+	cp.done = true
+	cp.part.compactLock.Unlock()
+}
@@ -0,0 +1,173 @@
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPartitionCopy(t *testing.T) {
+	colPath, htPath := "/tmp/tiedot_test_col", "/tmp/tiedot_test_ht"
+	copyColPath, copyHtPath := "/tmp/tiedot_test_col_copy", "/tmp/tiedot_test_ht_copy"
+	for _, filePath := range []string{colPath, htPath, copyColPath, copyHtPath, colPath + BACKUP_MARK_SUFFIX} {
+		os.Remove(filePath)
+		defer os.Remove(filePath)
+	}
+	part, err := OpenPartition(colPath, htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer part.Close()
+	for i := 0; i < 100; i++ {
+		if _, err = part.Insert(i, []byte(strings.Repeat("a", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cp, err := part.StartCopy(copyColPath, copyHtPath, "", "")
+	if err != nil {
+		t.Fatal(err)
+	} else if cp.Unchanged {
+		t.Fatal("Unmarked partition is unchanged")
+	}
+	// Changes during the copy are captured, changes after capture are not
+	part.DataLock.Lock()
+	if err = part.Update(1, []byte("updated")); err != nil {
+		t.Fatal(err)
+	} else if err = part.Delete(2); err != nil {
+		t.Fatal(err)
+	} else if _, err = part.Insert(100, []byte("inserted")); err != nil {
+		t.Fatal(err)
+	} else if err = cp.Capture("snap1"); err != nil {
+		t.Fatal(err)
+	} else if part.BackupMark() != "snap1" {
+		t.Fatal(part.BackupMark())
+	}
+	part.DataLock.Unlock()
+	if mark, err := ioutil.ReadFile(colPath + BACKUP_MARK_SUFFIX); err != nil || string(mark) != "snap1" {
+		t.Fatal(string(mark), err)
+	}
+	part.DataLock.Lock()
+	if err = part.Update(3, []byte("too late")); err != nil {
+		t.Fatal(err)
+	} else if part.BackupMark() != "" {
+		t.Fatal("Change did not remove backup marker")
+	}
+	part.DataLock.Unlock()
+	if _, err = os.Stat(colPath + BACKUP_MARK_SUFFIX); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if err = cp.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	copied, err := OpenPartition(copyColPath, copyHtPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= 100; i++ {
+		doc, err := copied.Read(i)
+		switch i {
+		case 1:
+			if string(doc[:7]) != "updated" {
+				t.Fatal(string(doc), err)
+			}
+		case 2:
+			if err == nil {
+				t.Fatal("Deleted document is copied")
+			}
+		case 3:
+			if string(doc[:3]) != "aaa" {
+				t.Fatal(string(doc), err)
+			}
+		case 100:
+			if string(doc[:8]) != "inserted" {
+				t.Fatal(string(doc), err)
+			}
+		default:
+			if err != nil || !strings.HasPrefix(string(doc), strings.Repeat("a", i)) {
+				t.Fatal(i, string(doc), err)
+			}
+		}
+	}
+	if err = copied.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The partition changed after the first snapshot, hence it is copied in full
+	if cp, err = part.StartCopy(copyColPath+"2", copyHtPath+"2", "", "snap1"); err != nil {
+		t.Fatal(err)
+	} else if cp.Unchanged {
+		t.Fatal("Changed partition is unchanged")
+	}
+	part.DataLock.Lock()
+	err = cp.Capture("snap2")
+	part.DataLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	} else if err = cp.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	// Partition marked by the base snapshot does not copy anything if it stays unchanged
+	if cp, err = part.StartCopy(copyColPath+"3", copyHtPath+"3", "", "snap2"); err != nil {
+		t.Fatal(err)
+	} else if !cp.Unchanged {
+		t.Fatal("Unchanged partition is changed")
+	}
+	part.DataLock.Lock()
+	err = cp.Capture("snap3")
+	part.DataLock.Unlock()
+	if err != nil || cp.Changed() {
+		t.Fatal(err)
+	} else if err = cp.Complete(); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(copyColPath + "3"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	// Changes during the copy are applied to a copy of the base snapshot
+	if cp, err = part.StartCopy(copyColPath+"4", copyHtPath+"4", "", "snap3"); err != nil || !cp.Unchanged {
+		t.Fatal(err)
+	}
+	part.DataLock.Lock()
+	if err = part.Delete(4); err != nil {
+		t.Fatal(err)
+	}
+	err = cp.Capture("snap4")
+	part.DataLock.Unlock()
+	if err != nil || !cp.Changed() {
+		t.Fatal(err)
+	}
+	for _, suffix := range []string{"", OVERFLOW_SUFFIX} {
+		for _, filePath := range []string{copyColPath, copyHtPath} {
+			if content, err := ioutil.ReadFile(filePath + "2" + suffix); err == nil {
+				if err = ioutil.WriteFile(filePath+"4"+suffix, content, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	if err = cp.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if copied, err = OpenPartition(copyColPath+"4", copyHtPath+"4"); err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := copied.Read(3); err != nil || string(doc[:8]) != "too late" {
+		t.Fatal(string(doc), err)
+	} else if _, err = copied.Read(4); err == nil {
+		t.Fatal("Deleted document is copied")
+	}
+	copied.Close()
+	// Aborted copy removes its files and lets the partition compact
+	if cp, err = part.StartCopy(copyColPath+"5", copyHtPath+"5", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	cp.Abort()
+	if _, err = os.Stat(copyColPath + "5"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	} else if err = part.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{"2", "4"} {
+		os.Remove(copyColPath + n)
+		os.Remove(copyHtPath + n)
+	}
+}
@@ -0,0 +1,91 @@
+// Space usage statistics of data files.
+
+package data
+
+import "encoding/binary"
+
+// Space usage of a collection data file.
+type CollectionStats struct {
+	Size    int `json:"size"`    // File size
+	Used    int `json:"used"`    // Amount of space used by documents, valid or not
+	Docs    int `json:"docs"`    // Number of valid documents
+	Live    int `json:"live"`    // Space taken by valid documents, including headers and room
+	Deleted int `json:"deleted"` // Space taken by deleted (or moved) documents and corrupted bytes
+	Padding int `json:"padding"` // Unused room (padding) of valid documents
+
+	Overflow        int `json:"overflow"`        // Space taken by valid documents in overflow file, including headers
+	OverflowDeleted int `json:"overflowDeleted"` // Space taken by deleted (or moved) documents in overflow file
+}
+
+// Space usage of a hash table file.
+type HashTableStats struct {
+	Size           int `json:"size"`           // File size
+	Used           int `json:"used"`           // Amount of space used by buckets
+	Buckets        int `json:"buckets"`        // Total number of buckets
+	ChainedBuckets int `json:"chainedBuckets"` // Number of buckets chained to full buckets
+	Capacity       int `json:"capacity"`       // Number of entries the buckets can hold
+	Entries        int `json:"entries"`        // Number of valid entries
+	DeletedEntries int `json:"deletedEntries"` // Number of removed entries
+}
+
+// Calculate space usage of the collection file.
+func (col *Collection) Stats() (stats CollectionStats) {
+	stats.Size, stats.Used = col.Size, col.Used
+	for id := 0; id < col.Used-DOC_HEADER && id >= 0; {
+		validity := col.Buf[id]
+		room, _ := binary.Varint(col.Buf[id+1 : id+11])
+		docEnd := id + DOC_HEADER + int(room)
+		if (validity == 0 || validity == 1) && room <= DOC_MAX_ROOM && docEnd > 0 && docEnd <= col.Used {
+			if validity == 1 {
+				stats.Docs++
+				stats.Live += docEnd - id
+				for padding := docEnd - 1; padding >= id+DOC_HEADER && col.Buf[padding] == PADDING[0]; padding-- {
+					stats.Padding++
+				}
+			} else {
+				stats.Deleted += docEnd - id
+			}
+			id = docEnd
+		} else {
+			// Corrupted document - move on
+			stats.Deleted++
+			id++
+		}
+	}
+	stats.Overflow, stats.OverflowDeleted = col.overflowStats()
+	return
+}
+
+// Calculate bucket and entry usage of the hash table.
+func (ht *HashTable) Stats() (stats HashTableStats) {
+	stats.Size, stats.Used = ht.Size, ht.numBuckets*BUCKET_SIZE
+	stats.Buckets = ht.numBuckets
+	stats.ChainedBuckets = ht.numBuckets - INITIAL_BUCKETS
+	stats.Capacity = ht.numBuckets * PER_BUCKET
+	for bucket := 0; bucket < ht.numBuckets; bucket++ {
+		for entry := 0; entry < PER_BUCKET; entry++ {
+			entryAddr := bucket*BUCKET_SIZE + BUCKET_HEADER + entry*ENTRY_SIZE
+			if entryAddr+ENTRY_SIZE > ht.Size {
+				return
+			}
+			if ht.Buf[entryAddr] == 1 {
+				stats.Entries++
+			} else if entryKey, _ := binary.Varint(ht.Buf[entryAddr+1 : entryAddr+11]); entryKey != 0 {
+				stats.DeletedEntries++
+			} else if entryVal, _ := binary.Varint(ht.Buf[entryAddr+11 : entryAddr+21]); entryVal != 0 {
+				stats.DeletedEntries++
+			}
+		}
+	}
+	return
+}
+
+// Calculate space usage of the partition's document file. Caller should hold data lock.
+func (part *Partition) DocStats() CollectionStats {
+	return part.col.Stats()
+}
+
+// Calculate bucket and entry usage of the partition's ID lookup table. Caller should hold data lock.
+func (part *Partition) LookupStats() HashTableStats {
+	return part.lookup.Stats()
+}
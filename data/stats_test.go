@@ -0,0 +1,51 @@
+package data
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCollectionStats(t *testing.T) {
+	tmp := "/tmp/tiedot_test_col"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	col, err := OpenCollection(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id1, _ := col.Insert([]byte("abc"))
+	col.Insert([]byte("defgh"))
+	col.Delete(id1)
+	stats := col.Stats()
+	if stats.Size != COL_FILE_GROWTH || stats.Used != 2*DOC_HEADER+6+10 || stats.Docs != 1 ||
+		stats.Live != DOC_HEADER+10 || stats.Deleted != DOC_HEADER+6 || stats.Padding != 5 {
+		t.Fatal(stats)
+	}
+	if err = col.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHashTableStats(t *testing.T) {
+	tmp := "/tmp/tiedot_test_hash"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	ht, err := OpenHashTable(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fill up a bucket to chain another
+	for i := 0; i < PER_BUCKET+1; i++ {
+		ht.Put(1, i+1)
+	}
+	ht.Put(2, 1)
+	ht.Remove(2, 1)
+	stats := ht.Stats()
+	if stats.Buckets != INITIAL_BUCKETS+1 || stats.ChainedBuckets != 1 || stats.Capacity != (INITIAL_BUCKETS+1)*PER_BUCKET ||
+		stats.Entries != PER_BUCKET+1 || stats.DeletedEntries != 1 || stats.Used != (INITIAL_BUCKETS+1)*BUCKET_SIZE {
+		t.Fatal(stats)
+	}
+	if err = ht.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
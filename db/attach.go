@@ -0,0 +1,246 @@
+// Binary attachments of documents, stored in chunk files outside of collection partitions.
+
+package db
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	ATTACH_DIR        = INDEX_PATH_SEP + "attachments" // Attachment directory in collection directory, the separator keeps it apart from index directories
+	ATTACH_CHUNK_SIZE = 4 * 1048576                    // Attachment content is split into chunk files of this size
+)
+
+// Name and size of an attachment.
+type Attachment struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// Attachment content that is read chunk after chunk.
+type attachmentReader struct {
+	io.Reader
+	chunks []*os.File
+}
+
+// Close all chunk files.
+func (reader *attachmentReader) Close() (err error) {
+	for _, chunk := range reader.chunks {
+		if closeErr := chunk.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return
+}
+
+// Return directory of the document's attachments.
+func (col *Col) attachDir(id int) string {
+	return path.Join(col.db.path, col.name, ATTACH_DIR, strconv.Itoa(id))
+}
+
+// Attachment names become directory names, hence they may not contain path separators or begin with a dot.
+func checkAttachmentName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\") {
+		return dberr.New(dberr.ErrorAttachmentName, name)
+	}
+	return nil
+}
+
+// Return true if any document of the collection has an attachment. Caller must hold schema lock.
+func (col *Col) hasAttachments() (bool, error) {
+	docDirs, err := ioutil.ReadDir(path.Join(col.db.path, col.name, ATTACH_DIR))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, docDir := range docDirs {
+		attachDirs, err := ioutil.ReadDir(path.Join(col.db.path, col.name, ATTACH_DIR, docDir.Name()))
+		if err != nil {
+			return false, err
+		}
+		for _, attachDir := range attachDirs {
+			if !strings.HasPrefix(attachDir.Name(), ".") {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Remove all attachments of the document. Does not place schema lock.
+func (col *Col) removeAttachments(id int) error {
+	col.attachLock.Lock()
+	defer col.attachLock.Unlock()
+	return os.RemoveAll(col.attachDir(id))
+}
+
+// Store the content as an attachment of the document, replacing the existing attachment of the same name.
+// Return size of the content. The content is written without holding schema lock, so that a slow writer does not
+// hold up collection management. Attachments are not encrypted and not replicated, hence an encrypted collection, or
+// a database that records changes in the mutation log, does not take them.
+func (col *Col) PutAttachment(id int, name string, content io.Reader) (size int64, err error) {
+	if err = checkAttachmentName(name); err != nil {
+		return
+	}
+	col.db.schemaLock.RLock()
+	if col.indexKey != nil {
+		col.db.schemaLock.RUnlock()
+		return 0, fmt.Errorf("Collection %s is encrypted, attachments would not be", col.name)
+	} else if col.db.replog != nil {
+		col.db.schemaLock.RUnlock()
+		return 0, fmt.Errorf("Changes are recorded in the replication log, attachments would not be")
+	} else if _, err = col.read(id, false); err != nil {
+		col.db.schemaLock.RUnlock()
+		return
+	}
+	docDir := col.attachDir(id)
+	tmpDir := path.Join(docDir, fmt.Sprintf(".%s-%d", name, time.Now().UnixNano()))
+	err = os.MkdirAll(tmpDir, 0700)
+	col.db.schemaLock.RUnlock()
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	// Write content into the temporary directory, chunk by chunk
+	for chunkNum := 0; ; chunkNum++ {
+		var chunk *os.File
+		if chunk, err = os.OpenFile(path.Join(tmpDir, strconv.Itoa(chunkNum)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600); err != nil {
+			return
+		}
+		written, copyErr := io.CopyN(chunk, content, ATTACH_CHUNK_SIZE)
+		if col.db.durability == SYNC_WRITE && (copyErr == nil || copyErr == io.EOF) {
+			if err = chunk.Sync(); err != nil {
+				chunk.Close()
+				return 0, err
+			}
+		}
+		closeErr := chunk.Close()
+		size += written
+		if copyErr == io.EOF {
+			break
+		} else if copyErr != nil {
+			return 0, copyErr
+		} else if closeErr != nil {
+			return 0, closeErr
+		}
+	}
+	// The collection or document may have gone in the meantime, put the attachment in place only if both are there
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if current := col.db.cols[col.name]; current != col {
+		if current != nil {
+			// A rebuilt collection has taken the temporary directory along with attachments
+			os.RemoveAll(path.Join(current.attachDir(id), path.Base(tmpDir)))
+		}
+		return 0, fmt.Errorf("Collection %s is changed while attachment %s is written", col.name, name)
+	}
+	col.attachLock.Lock()
+	defer col.attachLock.Unlock()
+	if _, err = col.read(id, false); err != nil {
+		return 0, err
+	}
+	attachPath := path.Join(docDir, name)
+	if err = os.RemoveAll(attachPath); err != nil {
+		return 0, err
+	} else if err = os.Rename(tmpDir, attachPath); err != nil {
+		return 0, err
+	}
+	return
+}
+
+// Open the attachment of the document for reading, the caller must close the return value.
+func (col *Col) GetAttachment(id int, name string) (content io.ReadCloser, size int64, err error) {
+	if err = checkAttachmentName(name); err != nil {
+		return
+	}
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	col.attachLock.RLock()
+	defer col.attachLock.RUnlock()
+	attachPath := path.Join(col.attachDir(id), name)
+	chunkFiles, err := ioutil.ReadDir(attachPath)
+	if os.IsNotExist(err) {
+		return nil, 0, dberr.New(dberr.ErrorNoAttachment, id, name)
+	} else if err != nil {
+		return
+	}
+	// Open all chunks right away, so that the content stays intact even if the attachment is replaced while being read
+	reader := &attachmentReader{chunks: make([]*os.File, 0, len(chunkFiles))}
+	readers := make([]io.Reader, 0, len(chunkFiles))
+	for chunkNum := 0; chunkNum < len(chunkFiles); chunkNum++ {
+		chunk, openErr := os.Open(path.Join(attachPath, strconv.Itoa(chunkNum)))
+		if openErr != nil {
+			reader.Close()
+			return nil, 0, openErr
+		}
+		reader.chunks = append(reader.chunks, chunk)
+		readers = append(readers, chunk)
+	}
+	for _, chunkFile := range chunkFiles {
+		size += chunkFile.Size()
+	}
+	reader.Reader = io.MultiReader(readers...)
+	return reader, size, nil
+}
+
+// Return names and sizes of all attachments of the document, sorted by name.
+func (col *Col) ListAttachments(id int) (attachments []Attachment, err error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if _, err = col.read(id, false); err != nil {
+		return
+	}
+	col.attachLock.RLock()
+	defer col.attachLock.RUnlock()
+	attachments = make([]Attachment, 0)
+	attachDirs, err := ioutil.ReadDir(col.attachDir(id))
+	if os.IsNotExist(err) {
+		return attachments, nil
+	} else if err != nil {
+		return
+	}
+	for _, attachDir := range attachDirs {
+		if !attachDir.IsDir() || strings.HasPrefix(attachDir.Name(), ".") {
+			// Skip attachments that are being written
+			continue
+		}
+		chunkFiles, err := ioutil.ReadDir(path.Join(col.attachDir(id), attachDir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		attachment := Attachment{Name: attachDir.Name()}
+		for _, chunkFile := range chunkFiles {
+			attachment.Size += chunkFile.Size()
+		}
+		attachments = append(attachments, attachment)
+	}
+	sort.Slice(attachments, func(i, j int) bool { return attachments[i].Name < attachments[j].Name })
+	return
+}
+
+// Remove an attachment of the document.
+func (col *Col) DeleteAttachment(id int, name string) error {
+	if err := checkAttachmentName(name); err != nil {
+		return err
+	}
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	col.attachLock.Lock()
+	defer col.attachLock.Unlock()
+	attachPath := path.Join(col.attachDir(id), name)
+	if _, err := os.Stat(attachPath); os.IsNotExist(err) {
+		return dberr.New(dberr.ErrorNoAttachment, id, name)
+	}
+	return os.RemoveAll(attachPath)
+}
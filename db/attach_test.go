@@ -0,0 +1,147 @@
+package db
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func readAttachment(t *testing.T, col *Col, id int, name string) []byte {
+	content, size, err := col.GetAttachment(id, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		t.Fatal(err)
+	} else if int64(len(data)) != size {
+		t.Fatal(len(data), size)
+	}
+	return data
+}
+
+func TestAttachments(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Content spans several chunks
+	large := bytes.Repeat([]byte("0123456789"), ATTACH_CHUNK_SIZE/5+1)
+	if size, err := col.PutAttachment(id, "large.bin", bytes.NewReader(large)); err != nil || size != int64(len(large)) {
+		t.Fatal(size, err)
+	}
+	if _, err = col.PutAttachment(id, "small.txt", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if data := readAttachment(t, col, id, "large.bin"); !bytes.Equal(data, large) {
+		t.Fatal("Wrong content", len(data))
+	}
+	// Replace
+	if _, err = col.PutAttachment(id, "small.txt", strings.NewReader("bye")); err != nil {
+		t.Fatal(err)
+	} else if data := readAttachment(t, col, id, "small.txt"); string(data) != "bye" {
+		t.Fatal(string(data))
+	}
+	if attachments, err := col.ListAttachments(id); err != nil || len(attachments) != 2 ||
+		attachments[0] != (Attachment{"large.bin", int64(len(large))}) || attachments[1] != (Attachment{"small.txt", 3}) {
+		t.Fatal(attachments, err)
+	}
+	// Bad input
+	if _, err = col.PutAttachment(id, "../x", strings.NewReader("")); dberr.Type(err) != dberr.ErrorAttachmentName {
+		t.Fatal(err)
+	} else if _, err = col.PutAttachment(id+1, "x", strings.NewReader("")); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if _, _, err = col.GetAttachment(id, "x"); dberr.Type(err) != dberr.ErrorNoAttachment {
+		t.Fatal(err)
+	} else if err = col.Index([]string{ATTACH_DIR}); err == nil {
+		t.Fatal("Did not error")
+	}
+	if err = col.DeleteAttachment(id, "large.bin"); err != nil {
+		t.Fatal(err)
+	} else if err = col.DeleteAttachment(id, "large.bin"); dberr.Type(err) != dberr.ErrorNoAttachment {
+		t.Fatal(err)
+	}
+	// Collection management carries on while an attachment is being written, a rebuilt collection fails the write
+	pipeReader, pipeWriter := io.Pipe()
+	putErr := make(chan error, 1)
+	go func() {
+		_, err := col.PutAttachment(id, "slow.bin", pipeReader)
+		putErr <- err
+	}()
+	if _, err = pipeWriter.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("other"); err != nil {
+		t.Fatal(err)
+	}
+	pipeWriter.Close()
+	if err = <-putErr; err != nil {
+		t.Fatal(err)
+	} else if data := readAttachment(t, col, id, "slow.bin"); string(data) != "partial" {
+		t.Fatal(string(data))
+	}
+	pipeReader, pipeWriter = io.Pipe()
+	go func() {
+		_, err := col.PutAttachment(id, "slow.bin", pipeReader)
+		putErr <- err
+	}()
+	if _, err = pipeWriter.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	} else if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	pipeWriter.Close()
+	if err = <-putErr; err == nil {
+		t.Fatal("Did not error")
+	}
+	col = db.Use("col")
+	if err = col.DeleteAttachment(id, "slow.bin"); err != nil {
+		t.Fatal(err)
+	} else if leftover, err := ioutil.ReadDir(col.attachDir(id)); err != nil || len(leftover) != 1 {
+		t.Fatal(leftover, err)
+	}
+	// Attachments survive reopening and scrub, and are not mistaken for index
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	} else if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if len(col.AllIndexes()) != 0 {
+		t.Fatal(col.AllIndexes())
+	} else if data := readAttachment(t, col, id, "small.txt"); string(data) != "bye" {
+		t.Fatal(string(data))
+	}
+	// Deleting document removes its attachments
+	if err = col.Delete(id); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(col.attachDir(id)); !os.IsNotExist(err) {
+		t.Fatal("Attachments are not removed", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
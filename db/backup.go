@@ -0,0 +1,418 @@
+// Online snapshots, incremental backups, and restore.
+//
+// A snapshot copies documents of all partitions while they stay in use, and
+// captures all of them at one point in time under brief exclusive locks. An
+// incremental snapshot refers to the files of its base snapshot for partitions
+// that have not changed since then. Indexes are not copied, they are rebuilt on
+// restore. The manifest is written last, a directory without manifest is not a
+// usable backup.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	BACKUP_MANIFEST = "backup.json" // Manifest file name in backup directory
+)
+
+// Manifest of a backup.
+type Backup struct {
+	ID          string                `json:"id"`
+	Base        string                `json:"base"` // Directory of the base backup (empty if this is a full backup)
+	Time        time.Time             `json:"time"`
+	NumParts    int                   `json:"numParts"` // Number of partitions of the database
+	Collections map[string]*BackupCol `json:"collections"`
+}
+
+// Collection in a backup.
+type BackupCol struct {
+	NumParts   int          `json:"numParts"`
+	Indexes    [][]string   `json:"indexes"`
+	Partitions []BackupPart `json:"partitions"`
+}
+
+// Location of partition files.
+type BackupPart struct {
+	Dir string `json:"dir"` // Backup directory that has the files (empty if it is this backup)
+	ID  string `json:"id"`  // ID of that backup
+}
+
+// Read the manifest of a backup.
+func ReadBackup(dir string) (*Backup, error) {
+	content, err := ioutil.ReadFile(path.Join(dir, BACKUP_MANIFEST))
+	if err != nil {
+		return nil, err
+	}
+	backup := new(Backup)
+	if err = json.Unmarshal(content, backup); err != nil {
+		return nil, fmt.Errorf("Backup manifest in %s is corrupted: %v", dir, err)
+	}
+	for name, bcol := range backup.Collections {
+		if len(bcol.Partitions) != bcol.NumParts {
+			return nil, fmt.Errorf("Backup manifest in %s has %d partitions of %s, expecting %d", dir, len(bcol.Partitions), name, bcol.NumParts)
+		}
+	}
+	return backup, nil
+}
+
+// Return the directory that has the partition files, and the ID of that backup.
+func (backup *Backup) locate(dir, name string, partNum int) BackupPart {
+	loc := backup.Collections[name].Partitions[partNum]
+	if loc.Dir == "" {
+		return BackupPart{dir, backup.ID}
+	}
+	return loc
+}
+
+// Return names of partition files, some of them may not exist.
+func partFiles(partNum int) []string {
+	num := strconv.Itoa(partNum)
+	return []string{DOC_DATA_FILE + num, DOC_DATA_FILE + num + data.OVERFLOW_SUFFIX, DOC_LOOKUP_FILE + num, DOC_ORDER_FILE + num, DOC_EXPIRY_FILE + num}
+}
+
+// Copy a file.
+func copyFile(src, dest string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	destFile, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(destFile, srcFile); err != nil {
+		destFile.Close()
+		return err
+	} else if err = destFile.Sync(); err != nil {
+		destFile.Close()
+		return err
+	}
+	return destFile.Close()
+}
+
+// Copy partition files that exist from one collection directory into another.
+func copyPartFiles(srcDir, destDir string, partNum int) error {
+	for _, name := range partFiles(partNum) {
+		if _, err := os.Stat(path.Join(srcDir, name)); os.IsNotExist(err) {
+			continue
+		} else if err = copyFile(path.Join(srcDir, name), path.Join(destDir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy a directory tree if it exists.
+func copyTree(src, dest string) error {
+	err := filepath.Walk(src, func(currPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, currPath)
+		if err != nil {
+			return err
+		} else if info.IsDir() {
+			return os.MkdirAll(path.Join(dest, relPath), 0700)
+		}
+		return copyFile(currPath, path.Join(dest, relPath))
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Take a snapshot of all collections into the destination directory, which must be empty or not exist. Documents may
+// be read and written during the snapshot. If base backup directory is given, partitions that have not changed since
+// the base snapshot are not copied, provided that the base is the latest snapshot of the partition. Return the manifest.
+func (db *DB) Snapshot(dest, base string) (*Backup, error) {
+	var baseBackup *Backup
+	if base != "" {
+		var err error
+		if base, err = filepath.Abs(base); err != nil {
+			return nil, err
+		} else if baseBackup, err = ReadBackup(base); err != nil {
+			return nil, err
+		}
+	}
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	if entries, err := ioutil.ReadDir(dest); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("Destination %s is not empty", dest)
+	} else if err = os.MkdirAll(dest, 0700); err != nil {
+		return nil, err
+	} else if err = ioutil.WriteFile(path.Join(dest, PART_NUM_FILE), []byte(strconv.Itoa(db.numParts)), 0600); err != nil {
+		return nil, err
+	}
+	backup := &Backup{ID: fmt.Sprintf("%d-%d", time.Now().UnixNano(), rand.Int63()), Base: base, Time: time.Now(),
+		NumParts: db.numParts, Collections: make(map[string]*BackupCol)}
+	names := make([]string, 0, len(db.cols))
+	for name := range db.cols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	copies := make(map[string][]*data.PartitionCopy)
+	abort := func() {
+		for _, cps := range copies {
+			for _, cp := range cps {
+				cp.Abort()
+			}
+		}
+		os.RemoveAll(dest)
+	}
+	// Copy documents while partitions stay in use
+	for _, name := range names {
+		col := db.cols[name]
+		colDir := path.Join(dest, name)
+		if err := os.MkdirAll(colDir, 0700); err != nil {
+			abort()
+			return nil, err
+		} else if err = copyColConf(path.Join(db.path, name), colDir); err != nil {
+			abort()
+			return nil, err
+		}
+		bcol := &BackupCol{NumParts: col.numParts, Indexes: make([][]string, 0, len(col.indexPaths)), Partitions: make([]BackupPart, col.numParts)}
+		idxNames := make([]string, 0, len(col.indexPaths))
+		for idxName := range col.indexPaths {
+			idxNames = append(idxNames, idxName)
+		}
+		sort.Strings(idxNames)
+		for _, idxName := range idxNames {
+			bcol.Indexes = append(bcol.Indexes, col.indexPaths[idxName])
+		}
+		backup.Collections[name] = bcol
+		baseMark := ""
+		if baseBackup != nil && baseBackup.Collections[name] != nil && baseBackup.Collections[name].NumParts == col.numParts {
+			baseMark = baseBackup.ID
+		}
+		for i, part := range col.parts {
+			num := strconv.Itoa(i)
+			cp, err := part.StartCopy(path.Join(colDir, DOC_DATA_FILE+num), path.Join(colDir, DOC_LOOKUP_FILE+num),
+				path.Join(colDir, DOC_ORDER_FILE+num), baseMark)
+			if err != nil {
+				abort()
+				return nil, err
+			}
+			copies[name] = append(copies[name], cp)
+		}
+	}
+	// Capture all partitions at the same point in time
+	var err error
+	for _, name := range names {
+		for _, part := range db.cols[name].parts {
+			part.DataLock.Lock()
+		}
+	}
+	for _, name := range names {
+		for _, cp := range copies[name] {
+			if err = cp.Capture(backup.ID); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	for _, name := range names {
+		for _, part := range db.cols[name].parts {
+			part.DataLock.Unlock()
+		}
+	}
+	if err != nil {
+		abort()
+		return nil, err
+	}
+	// Write captured changes, partitions that did not change refer to the base
+	for _, name := range names {
+		col := db.cols[name]
+		colDir := path.Join(dest, name)
+		for i, cp := range copies[name] {
+			if !cp.Changed() {
+				backup.Collections[name].Partitions[i] = baseBackup.locate(base, name, i)
+				cp.Complete()
+				continue
+			} else if cp.Unchanged {
+				// Changed during the copy, start over from the base snapshot's files
+				loc := baseBackup.locate(base, name, i)
+				if err = copyPartFiles(path.Join(loc.Dir, name), colDir, i); err != nil {
+					abort()
+					return nil, err
+				}
+			}
+			if err = cp.Complete(); err != nil {
+				abort()
+				return nil, err
+			} else if err = col.copyExpiry(i, colDir); err != nil {
+				abort()
+				return nil, err
+			}
+		}
+		col.attachLock.RLock()
+		err = copyTree(path.Join(db.path, name, ATTACH_DIR), path.Join(colDir, ATTACH_DIR))
+		col.attachLock.RUnlock()
+		if err != nil {
+			abort()
+			return nil, err
+		}
+	}
+	manifest, err := json.Marshal(backup)
+	if err != nil {
+		abort()
+		return nil, err
+	} else if err = ioutil.WriteFile(path.Join(dest, BACKUP_MANIFEST), manifest, 0600); err != nil {
+		abort()
+		return nil, err
+	}
+	return backup, nil
+}
+
+// Write expiry times of the documents in a partition copy into the expiry file of the copy.
+func (col *Col) copyExpiry(partNum int, colDir string) error {
+	expPath := path.Join(colDir, DOC_EXPIRY_FILE+strconv.Itoa(partNum))
+	if err := os.Remove(expPath); err != nil && !os.IsNotExist(err) {
+		return err
+	} else if col.ttl == nil {
+		return nil
+	}
+	lookup, err := data.OpenHashTable(path.Join(colDir, DOC_LOOKUP_FILE+strconv.Itoa(partNum)))
+	if err != nil {
+		return err
+	}
+	ids, _ := lookup.GetPartition(0, 1)
+	if err = lookup.Close(); err != nil {
+		return err
+	}
+	exp, err := data.OpenHashTable(expPath)
+	if err != nil {
+		return err
+	}
+	ht := col.exps[partNum]
+	ht.Lock.RLock()
+	for _, id := range ids {
+		for _, expireAt := range ht.Get(id, 1) {
+			exp.Put(id, expireAt)
+		}
+	}
+	ht.Lock.RUnlock()
+	if err = exp.Sync(); err != nil {
+		exp.Close()
+		return err
+	}
+	return exp.Close()
+}
+
+// Restore a backup into the database directory, the database must not be in use. The backup is put together in a
+// temporary directory and validated - indexes are rebuilt and checked along with documents - before it replaces the
+// database. The original database directory, if there is one, is kept under a new name.
+func Restore(backupDir, dbPath string, keys KeyProvider) error {
+	backup, err := ReadBackup(backupDir)
+	if err != nil {
+		return err
+	} else if backupDir, err = filepath.Abs(backupDir); err != nil {
+		return err
+	}
+	dbPath = filepath.Clean(dbPath)
+	tmpDir := fmt.Sprintf("%s.restore-%d", dbPath, time.Now().UnixNano())
+	if err = restoreFiles(backup, backupDir, tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	} else if err = validateRestored(backup, tmpDir, keys); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	if _, err = os.Stat(dbPath); err == nil {
+		oldDir := fmt.Sprintf("%s.pre-restore-%d", dbPath, time.Now().UnixNano())
+		if err = os.Rename(dbPath, oldDir); err != nil {
+			os.RemoveAll(tmpDir)
+			return err
+		}
+		tdlog.Noticef("Restore: the original database is moved to %s", oldDir)
+	}
+	return os.Rename(tmpDir, dbPath)
+}
+
+// Put files of the backup and the backups it refers to into a new database directory.
+func restoreFiles(backup *Backup, backupDir, dbPath string) error {
+	if err := os.MkdirAll(dbPath, 0700); err != nil {
+		return err
+	} else if err = ioutil.WriteFile(path.Join(dbPath, PART_NUM_FILE), []byte(strconv.Itoa(backup.NumParts)), 0600); err != nil {
+		return err
+	}
+	sources := map[string]*Backup{backupDir: backup}
+	for name, bcol := range backup.Collections {
+		colDir := path.Join(dbPath, name)
+		if err := os.MkdirAll(colDir, 0700); err != nil {
+			return err
+		} else if err = copyColConf(path.Join(backupDir, name), colDir); err != nil {
+			return err
+		}
+		for _, idxPath := range bcol.Indexes {
+			if err := os.MkdirAll(path.Join(colDir, strings.Join(idxPath, INDEX_PATH_SEP)), 0700); err != nil {
+				return err
+			}
+		}
+		for i := range bcol.Partitions {
+			loc := backup.locate(backupDir, name, i)
+			source, found := sources[loc.Dir]
+			if !found {
+				var err error
+				if source, err = ReadBackup(loc.Dir); err != nil {
+					return fmt.Errorf("Backup %s that has partition %d of %s cannot be read: %v", loc.Dir, i, name, err)
+				}
+				sources[loc.Dir] = source
+			}
+			if source.ID != loc.ID {
+				return fmt.Errorf("Backup %s that has partition %d of %s is replaced by another backup", loc.Dir, i, name)
+			} else if _, err := os.Stat(path.Join(loc.Dir, name, DOC_DATA_FILE+strconv.Itoa(i))); err != nil {
+				return fmt.Errorf("Backup %s does not have partition %d of %s: %v", loc.Dir, i, name, err)
+			} else if err = copyPartFiles(path.Join(loc.Dir, name), colDir, i); err != nil {
+				return err
+			}
+		}
+		if err := copyTree(path.Join(backupDir, name, ATTACH_DIR), path.Join(colDir, ATTACH_DIR)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rebuild indexes of a restored database and check its integrity.
+func validateRestored(backup *Backup, dbPath string, keys KeyProvider) error {
+	db, err := openDB(dbPath, keys, false, SYNC_NONE)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	for name := range backup.Collections {
+		col := db.cols[name]
+		for idxName := range col.indexPaths {
+			col.fillIndex(idxName)
+		}
+	}
+	if err = db.check("Backup"); err != nil {
+		db.Close()
+		return err
+	}
+	if err = db.Sync(); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
@@ -0,0 +1,202 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	fullDir, incrDir, restoreDir := TEST_DATA_DIR+"_full", TEST_DATA_DIR+"_incr", TEST_DATA_DIR+"_restore"
+	for _, dir := range []string{TEST_DATA_DIR, fullDir, incrDir, restoreDir} {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("capped"); err != nil {
+		t.Fatal(err)
+	}
+	col, capped := db.Use("col"), db.Use("capped")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.SetTTL(nil, 3600); err != nil {
+		t.Fatal(err)
+	} else if err = capped.Cap(5, 0); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 20)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		if _, err = capped.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = col.PutAttachment(ids[0], "file", strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	// Full snapshot
+	full, err := db.Snapshot(fullDir, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if full.Base != "" || full.NumParts != 2 || len(full.Collections) != 2 || len(full.Collections["col"].Indexes) != 1 {
+		t.Fatal(full)
+	} else if _, err = db.Snapshot(fullDir, ""); err == nil {
+		t.Fatal("Did not error")
+	}
+	// Change documents of one partition only
+	changed := ids[1] % 2
+	for i, id := range ids {
+		if id%2 == changed {
+			if err = col.Update(id, map[string]interface{}{"a": i + 100}); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	expireAt, _ := col.expiryOf(ids[0])
+	incr, err := db.Snapshot(incrDir, fullDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, loc := range incr.Collections["col"].Partitions {
+		_, statErr := os.Stat(path.Join(incrDir, "col", DOC_DATA_FILE+strconv.Itoa(i)))
+		if i == changed && (loc.Dir != "" || statErr != nil) {
+			t.Fatal("Changed partition is not stored", loc, statErr)
+		} else if i != changed && (loc.ID != full.ID || !os.IsNotExist(statErr)) {
+			t.Fatal("Unchanged partition is stored", loc, statErr)
+		}
+	}
+	for _, loc := range incr.Collections["capped"].Partitions {
+		if loc.ID != full.ID {
+			t.Fatal("Unchanged partition is stored", loc)
+		}
+	}
+	// Rebuilt expiry tables make the next incremental snapshot copy all partitions
+	for _, part := range capped.parts {
+		if part.BackupMark() == "" {
+			t.Fatal("Unchanged partition is not marked")
+		}
+	}
+	if err = capped.SetTTL(nil, 60); err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range capped.parts {
+		if part.BackupMark() != "" {
+			t.Fatal("Partition is marked after expiry change")
+		}
+	}
+	if err = capped.RemoveTTL(); err != nil {
+		t.Fatal(err)
+	}
+	// Changes after the snapshot are not restored
+	if _, err = col.Insert(map[string]interface{}{"a": "later"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = Restore(incrDir, TEST_DATA_DIR, nil); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	col, capped = db.Use("col"), db.Use("capped")
+	count := 0
+	col.ForEachDoc(func(id int, doc []byte) bool {
+		count++
+		return true
+	})
+	if count != 20 {
+		t.Fatal(count)
+	}
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": 5, "in": []interface{}{"a"}}, col, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	result = make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": "later", "in": []interface{}{"a"}}, col, &result); err != nil || len(result) != 0 {
+		t.Fatal(result, err)
+	}
+	if at, expires := col.expiryOf(ids[0]); !expires || at != expireAt {
+		t.Fatal(at, expires)
+	}
+	if content, _, err := col.GetAttachment(ids[0], "file"); err != nil {
+		t.Fatal(err)
+	} else {
+		got, _ := ioutil.ReadAll(content)
+		content.Close()
+		if string(got) != "content" {
+			t.Fatal(string(got))
+		}
+	}
+	var order []float64
+	if err = capped.ForEachDocInOrder(func(id int, doc []byte) bool {
+		n, _ := capped.Read(id)
+		order = append(order, n["n"].(float64))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	} else if len(order) != 5 || order[0] != 3 || order[4] != 7 {
+		t.Fatal(order)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The original database is kept
+	if leftovers, err := ioutil.ReadDir(path.Dir(TEST_DATA_DIR)); err != nil {
+		t.Fatal(err)
+	} else {
+		for _, entry := range leftovers {
+			if strings.HasPrefix(entry.Name(), path.Base(TEST_DATA_DIR)+".pre-restore-") {
+				defer os.RemoveAll(path.Join(path.Dir(TEST_DATA_DIR), entry.Name()))
+			}
+		}
+	}
+	// Restore into a new directory
+	if err = Restore(fullDir, restoreDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Corrupted backup is not restored, the database stays intact
+	dataFile := path.Join(incrDir, "col", DOC_DATA_FILE+strconv.Itoa(changed))
+	content, err := ioutil.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(content) && i < 64; i++ {
+		content[i] ^= 0xff
+	}
+	if err = ioutil.WriteFile(dataFile, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	before := snapshotFiles(t, restoreDir)
+	if err = Restore(incrDir, restoreDir, nil); err == nil {
+		t.Fatal("Did not error")
+	} else if after := snapshotFiles(t, restoreDir); len(after) != len(before) {
+		t.Fatal("Database is changed")
+	}
+	// Incremental backup cannot be restored without its base
+	if err = os.Remove(path.Join(fullDir, BACKUP_MANIFEST)); err != nil {
+		t.Fatal(err)
+	} else if err = Restore(incrDir, restoreDir, nil); err == nil {
+		t.Fatal("Did not error")
+	}
+}
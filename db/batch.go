@@ -0,0 +1,207 @@
+// Insert and read documents in batches, a partition at a time.
+
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+// A document of InsertMany that is ready to be written.
+type bulkDoc struct {
+	index int // Position in input
+	id    int
+	doc   map[string]interface{}
+	docJS []byte
+}
+
+// Insert the documents partition by partition, each partition takes its batch under a single lock, and indexes are
+// maintained in bulk. In SYNC_WRITE mode, every partition and index table is written to disk once per batch.
+// Return document ID (if inserted) and error (if not inserted, or not written to disk) of every input document.
+func (col *Col) InsertMany(docs []map[string]interface{}) (ids []int, errs []error) {
+	ids = make([]int, len(docs))
+	errs = make([]error, len(docs))
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	// Serialize, validate, and assign IDs
+	byPart := make([][]bulkDoc, col.numParts)
+	for i, doc := range docs {
+		if doc == nil {
+			errs[i] = fmt.Errorf("Input doc may not be nil")
+			continue
+		}
+		docJS, err := col.format.Marshal(doc)
+		if err == nil {
+			if err = col.validateDoc(doc); err == nil {
+				err = col.checkCapSize(docJS)
+			}
+		}
+		var id int
+		if err == nil {
+			id, err = col.nextID()
+		}
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		partNum := id % col.numParts
+		byPart[partNum] = append(byPart[partNum], bulkDoc{index: i, id: id, doc: doc, docJS: docJS})
+	}
+	// Write documents of each partition under a single lock
+	inserted := make([]bulkDoc, 0, len(docs))
+	collided := make([]bulkDoc, 0)
+	var syncErr error
+	now := time.Now().Unix()
+	for partNum, batch := range byPart {
+		if len(batch) == 0 {
+			continue
+		}
+		part := col.parts[partNum]
+		part.DataLock.Lock()
+		syncWrites := part.SyncWrites
+		part.SyncWrites = false
+		expiries := make([][2]int, 0)
+		for _, bdoc := range batch {
+			if _, err := part.Read(bdoc.id); err == nil {
+				collided = append(collided, bdoc)
+				continue
+			}
+			if _, err := part.Insert(bdoc.id, bdoc.docJS); err != nil {
+				errs[bdoc.index] = err
+				continue
+			}
+			col.logWrite(bdoc.id, bdoc.docJS)
+			if col.ttl != nil {
+				if expireAt, expires := col.ttl.expiry(bdoc.doc, now); expires {
+					expiries = append(expiries, [2]int{bdoc.id, int(expireAt)})
+				}
+			}
+			// Keep the document away from updates until it is indexed
+			part.LockUpdate(bdoc.id)
+			inserted = append(inserted, bdoc)
+		}
+		// Expiry times are put in bulk too, along with the documents
+		if col.ttl != nil {
+			putBulk(col.exps[partNum], expiries)
+		}
+		if part.SyncWrites = syncWrites; syncWrites {
+			if err := part.Sync(); err != nil {
+				syncErr = err
+			}
+		}
+		part.DataLock.Unlock()
+	}
+	// Generated IDs that are taken get another chance, one document at a time
+	for _, bdoc := range collided {
+		var err error
+		for attempt := 1; ; attempt++ {
+			if bdoc.id, err = col.nextID(); err != nil {
+				break
+			}
+			err = col.putDoc(bdoc.id, bdoc.doc, bdoc.docJS)
+			if dberr.Type(err) != dberr.ErrorDocExists || attempt == ID_MAX_ATTEMPTS {
+				break
+			}
+		}
+		if err != nil {
+			errs[bdoc.index] = err
+			continue
+		}
+		col.parts[bdoc.id%col.numParts].LockUpdate(bdoc.id)
+		inserted = append(inserted, bdoc)
+	}
+	// Group index entries by index partition, and put them under a single lock per index partition
+	for idxName, idxPath := range col.indexPaths {
+		entries := make([][][2]int, col.numParts)
+		for _, bdoc := range inserted {
+			for _, idxVal := range GetIn(bdoc.doc, idxPath) {
+				if idxVal != nil {
+					hashKey := col.hash(fmt.Sprint(idxVal))
+					partNum := hashKey % col.numParts
+					entries[partNum] = append(entries[partNum], [2]int{hashKey, bdoc.id})
+				}
+			}
+		}
+		for partNum, partEntries := range entries {
+			putBulk(col.hts[partNum][idxName], partEntries)
+		}
+	}
+	for _, bdoc := range inserted {
+		col.parts[bdoc.id%col.numParts].UnlockUpdate(bdoc.id)
+		ids[bdoc.index] = bdoc.id
+		if syncErr != nil {
+			errs[bdoc.index] = syncErr
+		}
+	}
+	tdlog.Infof("Inserted %d out of %d documents into %s", len(inserted), len(docs), col.name)
+	// Make room in capped collection
+	col.evictOverflow()
+	return
+}
+
+// Put the key-value entries into the hash table under a single lock, and write the table to disk once if writes are
+// synchronous. Like index entries put one at a time, failure to write to disk is only logged.
+func putBulk(ht *data.HashTable, entries [][2]int) {
+	if len(entries) == 0 {
+		return
+	}
+	ht.Lock.Lock()
+	defer ht.Lock.Unlock()
+	syncWrites := ht.SyncWrites
+	ht.SyncWrites = false
+	for _, entry := range entries {
+		ht.Put(entry[0], entry[1])
+	}
+	if ht.SyncWrites = syncWrites; syncWrites {
+		if err := ht.Sync(); err != nil {
+			tdlog.CritNoRepeat("Failed to sync %s: %v", ht.Path, err)
+		}
+	}
+}
+
+// Read the documents, each partition is read under a single lock.
+// Return documents by ID, and IDs of documents that do not exist (in input order).
+func (col *Col) ReadMany(ids []int) (docs map[int]map[string]interface{}, missing []int) {
+	docs = make(map[int]map[string]interface{}, len(ids))
+	missing = make([]int, 0)
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	byPart := make([][]int, col.numParts)
+	for _, id := range ids {
+		if id < 0 {
+			continue
+		}
+		byPart[id%col.numParts] = append(byPart[id%col.numParts], id)
+	}
+	now := time.Now().Unix()
+	for partNum, partIDs := range byPart {
+		if len(partIDs) == 0 {
+			continue
+		}
+		part := col.parts[partNum]
+		part.DataLock.RLock()
+		for _, id := range partIDs {
+			if _, done := docs[id]; done {
+				continue
+			}
+			docB, err := part.Read(id)
+			if err != nil || col.expired(id, now) {
+				continue
+			}
+			if doc, err := col.format.Unmarshal(docB); err == nil {
+				docs[id] = doc
+			}
+		}
+		part.DataLock.RUnlock()
+	}
+	for _, id := range ids {
+		if _, found := docs[id]; !found {
+			missing = append(missing, id)
+		}
+	}
+	return
+}
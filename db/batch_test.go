@@ -0,0 +1,110 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestInsertMany(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.SetSchema(map[string]interface{}{"required": []interface{}{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+	docs := make([]map[string]interface{}, 0)
+	for i := 0; i < 100; i++ {
+		docs = append(docs, map[string]interface{}{"a": i % 10})
+	}
+	docs = append(docs, map[string]interface{}{"b": 1}, nil)
+	ids, errs := col.InsertMany(docs)
+	for i := 0; i < 100; i++ {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if doc, err := col.Read(ids[i]); err != nil || doc["a"].(float64) != float64(i%10) {
+			t.Fatal(doc, err)
+		}
+	}
+	if dberr.Type(errs[100]) != dberr.ErrorSchemaViolation || errs[101] == nil {
+		t.Fatal(errs[100:])
+	}
+	if count := countDocs(col); count != 100 {
+		t.Fatal(count)
+	}
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": 3, "in": []interface{}{"a"}}, col, &result); err != nil || len(result) != 10 {
+		t.Fatal(result, err)
+	}
+	// Caller-supplied IDs cannot be generated
+	if err = col.SetIDStrategy(ID_CALLER); err != nil {
+		t.Fatal(err)
+	}
+	if _, errs = col.InsertMany(docs[:1]); dberr.Type(errs[0]) != dberr.ErrorMissing {
+		t.Fatal(errs)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadMany(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make([]int, 0)
+	for i := 0; i < 10; i++ {
+		id, err := col.Insert(map[string]interface{}{"a": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err = col.Delete(ids[3]); err != nil {
+		t.Fatal(err)
+	}
+	docs, missing := col.ReadMany(append(ids, -1))
+	if len(docs) != 9 || len(missing) != 2 || missing[0] != ids[3] || missing[1] != -1 {
+		t.Fatal(docs, missing)
+	}
+	for i, id := range ids {
+		if i != 3 && docs[id]["a"].(float64) != float64(i) {
+			t.Fatal(docs[id])
+		}
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,113 @@
+// Update-by-query and delete-by-query.
+
+package db
+
+import (
+	"sort"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+// Outcome of a bulk update or delete.
+type BulkResult struct {
+	Matched  int `json:"matched"`  // Number of documents matched by the query
+	Affected int `json:"affected"` // Number of documents updated/deleted, or that would be in a dry run
+	Failed   int `json:"failed"`   // Number of documents that could not be updated/deleted, or that would fail in a dry run
+}
+
+// Evaluate the query and group the result document IDs by partition, IDs are sorted within each partition.
+// Does not place schema lock.
+func (col *Col) queryByPart(q interface{}) (byPart [][]int, err error) {
+	result := make(map[int]struct{})
+	if err = evalQuery(q, col, &result, false); err != nil {
+		return
+	}
+	byPart = make([][]int, col.numParts)
+	for id := range result {
+		partNum := id % col.numParts
+		byPart[partNum] = append(byPart[partNum], id)
+	}
+	for _, ids := range byPart {
+		sort.Ints(ids)
+	}
+	return
+}
+
+// Apply patch operators (see ApplyPatch) to all documents matched by the query, one partition after another.
+// Each document is patched atomically, a document that fails to be patched (e.g. schema violation) does not stop the others.
+// In a dry run, the patch is applied to copies of documents and nothing is written.
+func (col *Col) UpdateWhere(q interface{}, ops map[string]interface{}, dryRun bool) (result BulkResult, err error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	byPart, err := col.queryByPart(q)
+	if err != nil {
+		return
+	}
+	for _, ids := range byPart {
+		for _, id := range ids {
+			var patchErr error
+			if dryRun {
+				var doc map[string]interface{}
+				if doc, patchErr = col.read(id, false); patchErr != nil {
+					continue
+				}
+				if patchErr = ApplyPatch(doc, ops); patchErr == nil {
+					patchErr = col.validateDoc(doc)
+				}
+			} else {
+				patchErr = col.patch(id, func(doc map[string]interface{}) error {
+					return ApplyPatch(doc, ops)
+				})
+				if dberr.Type(patchErr) == dberr.ErrorNoDoc {
+					// Deleted in the meantime
+					continue
+				}
+			}
+			result.Matched++
+			if patchErr == nil {
+				result.Affected++
+			} else {
+				tdlog.Infof("UpdateWhere: failed to patch document %d in %s - %v", id, col.name, patchErr)
+				result.Failed++
+			}
+		}
+	}
+	return
+}
+
+// Delete all documents matched by the query, one partition after another.
+// In a dry run, matched documents are counted and nothing is deleted.
+func (col *Col) DeleteWhere(q interface{}, dryRun bool) (result BulkResult, err error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	byPart, err := col.queryByPart(q)
+	if err != nil {
+		return
+	}
+	for _, ids := range byPart {
+		for _, id := range ids {
+			if dryRun {
+				if _, readErr := col.read(id, false); readErr != nil {
+					continue
+				}
+				result.Matched++
+				result.Affected++
+				continue
+			}
+			delErr := col.delete(id, false)
+			if dberr.Type(delErr) == dberr.ErrorNoDoc {
+				// Deleted in the meantime
+				continue
+			}
+			result.Matched++
+			if delErr == nil {
+				result.Affected++
+			} else {
+				tdlog.Infof("DeleteWhere: failed to delete document %d in %s - %v", id, col.name, delErr)
+				result.Failed++
+			}
+		}
+	}
+	return
+}
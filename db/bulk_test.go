@@ -0,0 +1,95 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestUpdateDeleteWhere(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"tenant"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err = col.Insert(map[string]interface{}{"tenant": i % 2, "n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// One of the documents cannot be patched
+	if _, err = col.Insert(map[string]interface{}{"tenant": 0, "n": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	q := map[string]interface{}{"eq": 0, "in": []interface{}{"tenant"}}
+	inc := map[string]interface{}{"$inc": map[string]interface{}{"n": 100}}
+	// Dry run writes nothing
+	result, err := col.UpdateWhere(q, inc, true)
+	if err != nil || result.Matched != 6 || result.Affected != 5 || result.Failed != 1 {
+		t.Fatal(result, err)
+	}
+	countUpdated := func() (updated int) {
+		col.ForEachDoc(func(id int, doc []byte) bool {
+			if d, _ := col.Read(id); d["tenant"].(float64) == 0 {
+				if n, ok := d["n"].(float64); ok && n >= 100 {
+					updated++
+				}
+			}
+			return true
+		})
+		return
+	}
+	if updated := countUpdated(); updated != 0 {
+		t.Fatal(updated)
+	}
+	result, err = col.UpdateWhere(q, inc, false)
+	if err != nil || result.Matched != 6 || result.Affected != 5 || result.Failed != 1 {
+		t.Fatal(result, err)
+	}
+	if updated := countUpdated(); updated != 5 {
+		t.Fatal(updated)
+	}
+	if _, err = col.UpdateWhere("not a query", inc, false); err == nil {
+		t.Fatal("Did not error")
+	}
+	// Delete
+	queryCount := func(q interface{}) int {
+		res := make(map[int]struct{})
+		if err := EvalQuery(q, col, &res); err != nil {
+			t.Fatal(err)
+		}
+		return len(res)
+	}
+	if result, err = col.DeleteWhere(q, true); err != nil || result.Matched != 6 || result.Affected != 6 {
+		t.Fatal(result, err)
+	}
+	if count := queryCount(q); count != 6 {
+		t.Fatal(count)
+	}
+	if result, err = col.DeleteWhere(q, false); err != nil || result.Matched != 6 || result.Affected != 6 || result.Failed != 0 {
+		t.Fatal(result, err)
+	}
+	if count := queryCount(q); count != 0 {
+		t.Fatal(count)
+	}
+	if count := countDocs(col); count != 5 {
+		t.Fatal(count)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
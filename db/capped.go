@@ -0,0 +1,218 @@
+// Capped collection management - fixed size collections that evict the oldest documents.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	CAP_CONF_FILE  = "capped" // Name of capped collection configuration file.
+	DOC_ORDER_FILE = "ord_"   // Prefix of partition insertion order log file name.
+)
+
+// Size limits of a capped collection. Zero means no limit.
+type Capped struct {
+	MaxDocs  int `json:"maxDocs"`  // Maximum number of documents
+	MaxBytes int `json:"maxBytes"` // Maximum total size of (serialized) documents
+}
+
+// Read capped collection configuration from collection directory; return nil if the collection is not capped.
+func (col *Col) loadCapped() (*Capped, error) {
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, CAP_CONF_FILE))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	capped := new(Capped)
+	if err = json.Unmarshal(content, capped); err != nil {
+		return nil, fmt.Errorf("Capped configuration of collection %s is corrupted: %v", col.name, err)
+	}
+	return capped, nil
+}
+
+// Start tracking insertion order in all partitions.
+func (col *Col) trackOrder() error {
+	col.seq = new(data.Sequence)
+	for i, part := range col.parts {
+		if err := part.TrackOrder(path.Join(col.db.path, col.name, DOC_ORDER_FILE+strconv.Itoa(i)), col.seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read insertion order of a read-only collection.
+func (col *Col) readOrder() error {
+	for i, part := range col.parts {
+		if err := part.ReadOrder(path.Join(col.db.path, col.name, DOC_ORDER_FILE+strconv.Itoa(i))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Limit the collection to the number of documents and/or total document size, the oldest documents are evicted on insert.
+// Documents that are already in the collection are assumed to be inserted in no particular order.
+func (col *Col) Cap(maxDocs, maxBytes int) error {
+	if maxDocs < 0 || maxBytes < 0 || maxDocs == 0 && maxBytes == 0 {
+		return fmt.Errorf("Please specify a positive document count limit, size limit, or both")
+	}
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	capped := &Capped{MaxDocs: maxDocs, MaxBytes: maxBytes}
+	content, err := json.Marshal(capped)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path.Join(col.db.path, col.name, CAP_CONF_FILE), content, 0600); err != nil {
+		return err
+	}
+	if col.capped == nil {
+		if err = col.trackOrder(); err != nil {
+			return err
+		}
+	}
+	col.capped = capped
+	col.evictOverflow()
+	col.logConf(CAP_CONF_FILE)
+	return nil
+}
+
+// Return size limits of the collection, or nil if the collection is not capped.
+func (col *Col) GetCap() *Capped {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if col.capped == nil {
+		return nil
+	}
+	return &Capped{MaxDocs: col.capped.MaxDocs, MaxBytes: col.capped.MaxBytes}
+}
+
+// Remove size limits from the collection and stop tracking insertion order.
+func (col *Col) Uncap() error {
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	if col.capped == nil {
+		return fmt.Errorf("Collection %s is not capped", col.name)
+	}
+	for _, part := range col.parts {
+		if err := part.UntrackOrder(); err != nil {
+			return err
+		}
+	}
+	col.capped = nil
+	col.seq = nil
+	if err := os.Remove(path.Join(col.db.path, col.name, CAP_CONF_FILE)); err != nil {
+		return err
+	}
+	col.logConf(CAP_CONF_FILE)
+	return nil
+}
+
+// Return an error if the document alone is larger than the size limit of a capped collection.
+func (col *Col) checkCapSize(docJS []byte) error {
+	if col.capped != nil && col.capped.MaxBytes > 0 && len(docJS) > col.capped.MaxBytes {
+		return dberr.New(dberr.ErrorDocTooLarge, col.capped.MaxBytes, len(docJS))
+	}
+	return nil
+}
+
+// Evict the oldest documents until the collection is within its size limits. Does not place schema lock.
+func (col *Col) evictOverflow() {
+	if col.capped == nil {
+		return
+	}
+	col.capLock.Lock()
+	defer col.capLock.Unlock()
+	for {
+		totalCount, totalSize := 0, 0
+		oldestSeq, oldestID, found := 0, 0, false
+		for _, part := range col.parts {
+			part.DataLock.RLock()
+			count, size := part.OrderedStats()
+			seq, id, ok := part.Oldest()
+			part.DataLock.RUnlock()
+			totalCount += count
+			totalSize += size
+			if ok && (!found || seq < oldestSeq) {
+				oldestSeq, oldestID, found = seq, id, true
+			}
+		}
+		if !found ||
+			(col.capped.MaxDocs == 0 || totalCount <= col.capped.MaxDocs) &&
+				(col.capped.MaxBytes == 0 || totalSize <= col.capped.MaxBytes) {
+			return
+		}
+		if err := col.delete(oldestID, false); err != nil {
+			// The record outlived its document, remove it to avoid evicting it over and over again
+			part := col.parts[oldestID%col.numParts]
+			part.DataLock.Lock()
+			part.RemoveFromOrder(oldestID)
+			part.DataLock.Unlock()
+		}
+	}
+}
+
+// Sequence number and ID of a document in insertion order log.
+type orderedDoc struct {
+	seq, id int
+}
+
+// Documents sorted by sequence number.
+type docsInOrder []orderedDoc
+
+func (docs docsInOrder) Len() int           { return len(docs) }
+func (docs docsInOrder) Less(i, j int) bool { return docs[i].seq < docs[j].seq }
+func (docs docsInOrder) Swap(i, j int)      { docs[i], docs[j] = docs[j], docs[i] }
+
+func (col *Col) forEachDocInOrder(fun func(id int, doc []byte) (moveOn bool), placeSchemaLock bool) error {
+	if placeSchemaLock {
+		col.db.schemaLock.RLock()
+		defer col.db.schemaLock.RUnlock()
+	}
+	if col.capped == nil {
+		return fmt.Errorf("Collection %s is not capped, insertion order is not tracked", col.name)
+	}
+	fun = col.skipExpired(fun)
+	// Merge insertion order of all partitions
+	docs := make(docsInOrder, 0)
+	for _, part := range col.parts {
+		part.DataLock.RLock()
+		part.ForEachInOrder(func(seq, id int) bool {
+			docs = append(docs, orderedDoc{seq, id})
+			return true
+		})
+		part.DataLock.RUnlock()
+	}
+	sort.Sort(docs)
+	for _, doc := range docs {
+		part := col.parts[doc.id%col.numParts]
+		part.DataLock.RLock()
+		docB, err := part.Read(doc.id)
+		part.DataLock.RUnlock()
+		if err != nil {
+			// Evicted or deleted in the meantime
+			continue
+		}
+		if !fun(doc.id, docB) {
+			break
+		}
+	}
+	return nil
+}
+
+// Do fun for all documents (in JSON) of a capped collection, from the oldest to the newest.
+func (col *Col) ForEachDocInOrder(fun func(id int, doc []byte) (moveOn bool)) error {
+	return col.forEachDocInOrder(col.asJSON(fun), true)
+}
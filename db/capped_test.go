@@ -0,0 +1,124 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func countDocs(col *Col) (count int) {
+	col.ForEachDoc(func(id int, doc []byte) bool {
+		count++
+		return true
+	})
+	return
+}
+
+func TestCappedCol(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"n"}); err != nil {
+		t.Fatal(err)
+	}
+	if col.ForEachDocInOrder(func(id int, doc []byte) bool { return true }) == nil {
+		t.Fatal("Did not error")
+	}
+	if col.Cap(0, 0) == nil {
+		t.Fatal("Did not error")
+	}
+	if err = col.Cap(5, 0); err != nil {
+		t.Fatal(err)
+	}
+	if capped := col.GetCap(); capped == nil || capped.MaxDocs != 5 || capped.MaxBytes != 0 {
+		t.Fatal(capped)
+	}
+	ids := make([]int, 20)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the newest 5 documents are left
+	verifyNewest := func(from, to int) {
+		if count := countDocs(col); count != to-from {
+			t.Fatal(count)
+		}
+		for i := range ids {
+			_, err := col.Read(ids[i])
+			if i < from && dberr.Type(err) != dberr.ErrorNoDoc || i >= from && err != nil {
+				t.Fatal(i, err)
+			}
+		}
+		n := from
+		if err := col.ForEachDocInOrder(func(id int, doc []byte) bool {
+			var docObj map[string]interface{}
+			if json.Unmarshal(doc, &docObj); id != ids[n] || docObj["n"].(float64) != float64(n) {
+				t.Fatal(n, id, docObj)
+			}
+			n++
+			return true
+		}); err != nil || n != to {
+			t.Fatal(err, n)
+		}
+	}
+	verifyNewest(15, 20)
+	// Evicted documents are removed from index
+	if vals := col.hashScan("n", StrHash("3"), 0); len(vals) != 0 {
+		t.Fatal(vals)
+	}
+	// Insertion order survives reopening and scrubbing
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	verifyNewest(15, 20)
+	// Limit by size - every document is 8 bytes long
+	if err = col.Cap(0, 30); err != nil {
+		t.Fatal(err)
+	}
+	verifyNewest(17, 20)
+	if _, err = col.Insert(map[string]interface{}{"n": "this document is too large"}); dberr.Type(err) != dberr.ErrorDocTooLarge {
+		t.Fatal("Did not error")
+	}
+	// Uncap
+	if err = col.Uncap(); err != nil {
+		t.Fatal(err)
+	}
+	if capped := col.GetCap(); capped != nil {
+		t.Fatal(capped)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err = col.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := countDocs(col); count != 13 {
+		t.Fatal(count)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,13 +3,13 @@
 package db
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/HouzuoGuo/tiedot/data"
 )
@@ -24,67 +24,157 @@ const (
 type Col struct {
 	db         *DB
 	name       string
+	numParts   int                          // Number of partitions of the collection
 	parts      []*data.Partition            // Collection partitions
 	hts        []map[string]*data.HashTable // Index partitions
 	indexPaths map[string][]string          // Index names and paths
+	ttl        *TTL                         // Document expiry configuration (nil if documents do not expire)
+	exps       []*data.HashTable            // Expiry partitions (document ID to expiry time)
+	capped     *Capped                      // Size limits (nil if the collection is not capped)
+	seq        *data.Sequence               // Insertion order sequence of capped collection
+	capLock    *sync.Mutex                  // Serialize eviction of the oldest documents
+	schema     *Schema                      // Documents must conform to the JSON schema (nil if there is no schema)
+	ids        *idGen                       // Document ID generator
+	upserting  map[string]chan struct{}     // Keys that are being upserted
+	upsertLock *sync.Mutex                  // Guard against concurrent locking of upsert keys
+	attachLock *sync.RWMutex                // Guard attachments against concurrent replacement and removal
+	indexKey   []byte                       // Keyed hashing of index values (nil if the collection is not encrypted)
+	format     DocFormat                    // Serialization of documents
+	formatName string                       // Name of the document format
 }
 
 // Open a collection and load all indexes.
 func OpenCol(db *DB, name string) (*Col, error) {
-	col := &Col{db: db, name: name}
+	col := &Col{db: db, name: name, capLock: new(sync.Mutex),
+		upserting: make(map[string]chan struct{}), upsertLock: new(sync.Mutex), attachLock: new(sync.RWMutex)}
 	return col, col.load()
 }
 
+// Read number of partitions from collection directory, the collection has as many partitions as the database if
+// there is no such configuration.
+func (col *Col) loadNumParts() (int, error) {
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, PART_NUM_FILE))
+	if os.IsNotExist(err) {
+		return col.db.numParts, nil
+	} else if err != nil {
+		return 0, err
+	}
+	numParts, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || numParts < 1 {
+		return 0, fmt.Errorf("Number of partitions of collection %s is corrupted", col.name)
+	}
+	return numParts, nil
+}
+
+// Return the number of partitions of the collection.
+func (col *Col) NumParts() int {
+	return col.numParts
+}
+
 // Load collection schema including index schema.
 func (col *Col) load() error {
-	if err := os.MkdirAll(path.Join(col.db.path, col.name), 0700); err != nil {
+	if !col.db.readOnly {
+		if err := os.MkdirAll(path.Join(col.db.path, col.name), 0700); err != nil {
+			return err
+		}
+	}
+	var err error
+	if col.numParts, err = col.loadNumParts(); err != nil {
 		return err
 	}
-	col.parts = make([]*data.Partition, col.db.numParts)
-	col.hts = make([]map[string]*data.HashTable, col.db.numParts)
-	for i := 0; i < col.db.numParts; i++ {
+	col.parts = make([]*data.Partition, col.numParts)
+	col.hts = make([]map[string]*data.HashTable, col.numParts)
+	for i := 0; i < col.numParts; i++ {
 		col.hts[i] = make(map[string]*data.HashTable)
 	}
 	col.indexPaths = make(map[string][]string)
 	// Open collection document partitions
-	for i := 0; i < col.db.numParts; i++ {
-		var err error
-		if col.parts[i], err = data.OpenPartition(
+	openPartition := data.OpenPartition
+	if col.db.readOnly {
+		openPartition = data.OpenPartitionReadOnly
+	}
+	for i := 0; i < col.numParts; i++ {
+		if col.parts[i], err = openPartition(
 			path.Join(col.db.path, col.name, DOC_DATA_FILE+strconv.Itoa(i)),
 			path.Join(col.db.path, col.name, DOC_LOOKUP_FILE+strconv.Itoa(i))); err != nil {
 			return err
 		}
 	}
+	// Apply document room policy
+	if err = col.loadRoomPolicy(); err != nil {
+		return err
+	}
+	// Apply document compression codec
+	if err = col.loadCompression(); err != nil {
+		return err
+	}
+	// Load document format
+	if err = col.loadFormat(); err != nil {
+		return err
+	}
+	// Apply encryption keys
+	if err = col.loadEncryption(); err != nil {
+		return err
+	}
+	// Load document ID strategy
+	if col.ids, err = col.loadIDGen(); err != nil {
+		return err
+	}
+	// Load JSON schema
+	if col.schema, err = col.loadSchema(); err != nil {
+		return err
+	}
+	// Track insertion order of capped collection
+	if col.capped, err = col.loadCapped(); err != nil {
+		return err
+	} else if col.capped != nil && !col.db.readOnly {
+		if err = col.trackOrder(); err != nil {
+			return err
+		}
+	} else if col.capped != nil {
+		if err = col.readOrder(); err != nil {
+			return err
+		}
+	}
+	// Open document expiry partitions
+	if col.ttl, err = col.loadTTL(); err != nil {
+		return err
+	} else if col.ttl != nil {
+		if err = col.openExpiry(); err != nil {
+			return err
+		}
+	}
 	// Look for index directories
 	colDirContent, err := ioutil.ReadDir(path.Join(col.db.path, col.name))
 	if err != nil {
 		return err
 	}
 	for _, htDir := range colDirContent {
-		if !htDir.IsDir() {
+		if !htDir.IsDir() || htDir.Name() == ATTACH_DIR {
 			continue
 		}
 		// Open index partitions
 		idxName := htDir.Name()
 		idxPath := strings.Split(idxName, INDEX_PATH_SEP)
 		col.indexPaths[idxName] = idxPath
-		for i := 0; i < col.db.numParts; i++ {
+		for i := 0; i < col.numParts; i++ {
 			if col.hts[i] == nil {
 				col.hts[i] = make(map[string]*data.HashTable)
 			}
-			if col.hts[i][idxName], err = data.OpenHashTable(
+			if col.hts[i][idxName], err = col.db.openHashTable(
 				path.Join(col.db.path, col.name, idxName, strconv.Itoa(i))); err != nil {
 				return err
 			}
 		}
 	}
+	col.syncWrites(col.db.durability == SYNC_WRITE)
 	return nil
 }
 
 // Close all collection files. Do not use the collection afterwards!
 func (col *Col) close() error {
 	errs := make([]error, 0, 0)
-	for i := 0; i < col.db.numParts; i++ {
+	for i := 0; i < col.numParts; i++ {
 		col.parts[i].DataLock.Lock()
 		if err := col.parts[i].Close(); err != nil {
 			errs = append(errs, err)
@@ -94,6 +184,11 @@ func (col *Col) close() error {
 				errs = append(errs, err)
 			}
 		}
+		if col.ttl != nil {
+			if err := col.exps[i].Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
 		col.parts[i].DataLock.Unlock()
 	}
 	if len(errs) == 0 {
@@ -107,12 +202,13 @@ func (col *Col) forEachDoc(fun func(id int, doc []byte) (moveOn bool), placeSche
 		col.db.schemaLock.RLock()
 		defer col.db.schemaLock.RUnlock()
 	}
+	fun = col.skipExpired(fun)
 	// Process approx.4k documents in each iteration
-	partDiv := col.approxDocCount(false) / col.db.numParts / 4000
+	partDiv := col.approxDocCount(false) / col.numParts / 4000
 	if partDiv == 0 {
 		partDiv++
 	}
-	for iteratePart := 0; iteratePart < col.db.numParts; iteratePart++ {
+	for iteratePart := 0; iteratePart < col.numParts; iteratePart++ {
 		part := col.parts[iteratePart]
 		part.DataLock.RLock()
 		for i := 0; i < partDiv; i++ {
@@ -125,9 +221,9 @@ func (col *Col) forEachDoc(fun func(id int, doc []byte) (moveOn bool), placeSche
 	}
 }
 
-// Do fun for all documents in the collection.
+// Do fun for all documents (in JSON) in the collection.
 func (col *Col) ForEachDoc(fun func(id int, doc []byte) (moveOn bool)) {
-	col.forEachDoc(fun, true)
+	col.forEachDoc(col.asJSON(fun), true)
 }
 
 // Create an index on the path.
@@ -137,33 +233,49 @@ func (col *Col) Index(idxPath []string) (err error) {
 	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
 	if _, exists := col.indexPaths[idxName]; exists {
 		return fmt.Errorf("Path %v is already indexed", idxPath)
+	} else if idxName == ATTACH_DIR {
+		return fmt.Errorf("Path %v is reserved for attachments", idxPath)
 	}
 	col.indexPaths[idxName] = idxPath
 	idxDir := path.Join(col.db.path, col.name, idxName)
 	if err = os.MkdirAll(idxDir, 0700); err != nil {
 		return err
 	}
-	for i := 0; i < col.db.numParts; i++ {
+	for i := 0; i < col.numParts; i++ {
 		if col.hts[i][idxName], err = data.OpenHashTable(path.Join(idxDir, strconv.Itoa(i))); err != nil {
 			return err
 		}
 	}
 	// Put all documents on the new index
+	col.fillIndex(idxName)
+	hts := make([]*data.HashTable, col.numParts)
+	for i := range hts {
+		hts[i] = col.hts[i][idxName]
+	}
+	if err = col.syncFilled(hts); err != nil {
+		return err
+	}
+	col.db.logSchema(ReplEntry{Op: REPL_INDEX, Col: col.name, Path: idxPath})
+	return nil
+}
+
+// Put all documents on an empty index. Caller must hold exclusive schema lock.
+func (col *Col) fillIndex(idxName string) {
+	idxPath := col.indexPaths[idxName]
 	col.forEachDoc(func(id int, doc []byte) (moveOn bool) {
-		var docObj map[string]interface{}
-		if err := json.Unmarshal(doc, &docObj); err != nil {
+		docObj, err := col.format.Unmarshal(doc)
+		if err != nil {
 			// Skip corrupted document
 			return true
 		}
 		for _, idxVal := range GetIn(docObj, idxPath) {
 			if idxVal != nil {
-				hashKey := StrHash(fmt.Sprint(idxVal))
-				col.hts[hashKey%col.db.numParts][idxName].Put(hashKey, id)
+				hashKey := col.hash(fmt.Sprint(idxVal))
+				col.hts[hashKey%col.numParts][idxName].Put(hashKey, id)
 			}
 		}
 		return true
 	}, false)
-	return
 }
 
 // Return all indexed paths.
@@ -190,13 +302,14 @@ func (col *Col) Unindex(idxPath []string) error {
 		return fmt.Errorf("Path %v is not indexed", idxPath)
 	}
 	delete(col.indexPaths, idxName)
-	for i := 0; i < col.db.numParts; i++ {
+	for i := 0; i < col.numParts; i++ {
 		col.hts[i][idxName].Close()
 		delete(col.hts[i], idxName)
 	}
 	if err := os.RemoveAll(path.Join(col.db.path, col.name, idxName)); err != nil {
 		return err
 	}
+	col.db.logSchema(ReplEntry{Op: REPL_UNINDEX, Col: col.name, Path: idxPath})
 	return nil
 }
 
@@ -219,11 +332,12 @@ func (col *Col) ApproxDocCount() int {
 	return col.approxDocCount(true)
 }
 
-// Divide the collection into roughly equally sized pages, and do fun on all documents in the specified page.
+// Divide the collection into roughly equally sized pages, and do fun on all documents (in JSON) in the specified page.
 func (col *Col) ForEachDocInPage(page, total int, fun func(id int, doc []byte) bool) {
 	col.db.schemaLock.RLock()
 	defer col.db.schemaLock.RUnlock()
-	for iteratePart := 0; iteratePart < col.db.numParts; iteratePart++ {
+	fun = col.skipExpired(col.asJSON(fun))
+	for iteratePart := 0; iteratePart < col.numParts; iteratePart++ {
 		part := col.parts[iteratePart]
 		part.DataLock.RLock()
 		if !part.ForEachDoc(page, total, fun) {
@@ -0,0 +1,57 @@
+// Online compaction - reclaim the space of deleted documents partition by partition.
+
+package db
+
+import (
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	COMPACT_MIN_GARBAGE = 8 * 1048576 // Automatic compaction leaves alone partitions that have less garbage (bytes) than this
+)
+
+var (
+	CompactInterval  = 10 * time.Minute // How often partitions are checked for automatic compaction
+	CompactThreshold = 0.5              // Partitions are automatically compacted when this portion of space is garbage
+)
+
+// Compact partitions in which garbage takes up at least the portion of space and the amount of bytes.
+// Return number of compacted partitions. Does not place schema lock.
+func (col *Col) compact(threshold float64, minGarbage int) (compacted int, err error) {
+	for i, part := range col.parts {
+		part.DataLock.RLock()
+		stats := part.DocStats()
+		part.DataLock.RUnlock()
+		live, garbage := stats.Live+stats.Overflow, stats.Deleted+stats.OverflowDeleted
+		if garbage < minGarbage || garbage == 0 || float64(garbage) < threshold*float64(live+garbage) {
+			continue
+		}
+		if err = part.Compact(); err != nil {
+			tdlog.CritNoRepeat("Failed to compact partition %d of %s: %v", i, col.name, err)
+			return
+		}
+		compacted++
+	}
+	return
+}
+
+// Compact partitions in which garbage (space of deleted documents and excessive room) takes up at least the portion
+// (0 to 1) of space, documents may be read and written during compaction. Return number of compacted partitions.
+func (col *Col) Compact(threshold float64) (compacted int, err error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	return col.compact(threshold, 0)
+}
+
+// Compact fragmented partitions of all collections.
+func (db *DB) compactFragmented() {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	for name, col := range db.cols {
+		if compacted, _ := col.compact(CompactThreshold, COMPACT_MIN_GARBAGE); compacted > 0 {
+			tdlog.Infof("Compacted %d partitions of %s", compacted, name)
+		}
+	}
+}
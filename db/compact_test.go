@@ -0,0 +1,130 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestColCompact(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 0)
+	for i := 0; i < 1000; i++ {
+		id, err := col.Insert(map[string]interface{}{"a": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids[:900] {
+		if err = col.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Nothing is compacted below threshold
+	if compacted, err := col.Compact(1); err != nil || compacted != 0 {
+		t.Fatal(compacted, err)
+	}
+	// Documents are read and written during compaction
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, id := range ids[900:] {
+			if err := col.Update(id, map[string]interface{}{"a": "updated"}); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	if compacted, err := col.Compact(0.5); err != nil || compacted != 2 {
+		t.Fatal(compacted, err)
+	}
+	wg.Wait()
+	for _, part := range col.parts {
+		if stats := part.DocStats(); stats.Deleted > 1024 {
+			t.Fatal(stats)
+		}
+	}
+	if count := countDocs(col); count != 100 {
+		t.Fatal(count)
+	}
+	for _, id := range ids[900:] {
+		if doc, err := col.Read(id); err != nil || doc["a"] != "updated" {
+			t.Fatal(doc, err)
+		}
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorageStats(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		id, err := col.Insert(map[string]interface{}{"a": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			if err = col.Delete(id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	stats := col.StorageStats()
+	if len(stats) != 2 {
+		t.Fatal(stats)
+	}
+	docs, lookups, indexed := 0, 0, 0
+	for _, partStats := range stats {
+		docs += partStats.Documents.Docs
+		lookups += partStats.Lookup.Entries
+		indexed += partStats.Indexes["a"].Entries
+		if partStats.Documents.Docs > 0 && partStats.Documents.Padding == 0 || partStats.Documents.Deleted == 0 && partStats.Lookup.DeletedEntries > 0 {
+			t.Fatal(partStats)
+		}
+	}
+	if docs != 5 || lookups != 5 || indexed != 5 {
+		t.Fatal(docs, lookups, indexed)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
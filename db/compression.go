@@ -0,0 +1,64 @@
+// Document compression of collections.
+
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+const (
+	COMPRESS_CONF_FILE = "compression" // Name of document compression codec configuration file.
+)
+
+// Read compression codec from collection directory and apply it to all partitions.
+func (col *Col) loadCompression() error {
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, COMPRESS_CONF_FILE))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	codec := strings.TrimSpace(string(content))
+	if err = data.ValidateCodec(codec); err != nil {
+		return err
+	}
+	for _, part := range col.parts {
+		part.SetCodec(codec)
+	}
+	return nil
+}
+
+// Change how documents are compressed: not at all ("none", default) or in DEFLATE format ("flate"). The codec
+// applies to documents written from now on; existing documents are recompressed by compaction or scrub.
+func (col *Col) SetCompression(codec string) error {
+	if err := data.ValidateCodec(codec); err != nil {
+		return err
+	}
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	if err := ioutil.WriteFile(path.Join(col.db.path, col.name, COMPRESS_CONF_FILE), []byte(codec), 0600); err != nil {
+		return err
+	}
+	for _, part := range col.parts {
+		part.DataLock.Lock()
+		part.SetCodec(codec)
+		part.DataLock.Unlock()
+	}
+	col.logConf(COMPRESS_CONF_FILE)
+	return nil
+}
+
+// Return document compression codec of the collection.
+func (col *Col) GetCompression() string {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if codec := col.parts[0].Codec(); codec != "" {
+		return codec
+	}
+	return data.CODEC_NONE
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+func TestColCompression(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if codec := col.GetCompression(); codec != data.CODEC_NONE {
+		t.Fatal(codec)
+	} else if col.SetCompression("whatever") == nil {
+		t.Fatal("Did not error")
+	}
+	doc := map[string]interface{}{"a": strings.Repeat("repetitive", 1000)}
+	plainID, err := col.Insert(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = col.SetCompression(data.CODEC_FLATE); err != nil {
+		t.Fatal(err)
+	}
+	compressedID, err := col.Insert(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Codec survives reopening, and scrub compresses all documents
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if codec := col.GetCompression(); codec != data.CODEC_FLATE {
+		t.Fatal(codec)
+	}
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	live := 0
+	for _, stats := range col.StorageStats() {
+		live += stats.Documents.Live
+	}
+	if live > 1000 {
+		t.Fatal("Documents are not compressed", live)
+	}
+	for _, id := range []int{plainID, compressedID} {
+		if readBack, err := col.Read(id); err != nil || readBack["a"] != doc["a"] {
+			t.Fatal(readBack, err)
+		}
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
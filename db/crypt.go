@@ -0,0 +1,256 @@
+// Encryption at rest - key providers, encrypted collections, and key rotation.
+
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	ENCRYPT_CONF_FILE = "encryption"       // Name of encryption configuration file, collection is encrypted if the file exists.
+	KEY_ENV           = "TIEDOT_KEYS"      // Default environment variable of encryption keys
+	INDEX_KEY_INFO    = "tiedot index key" // Index hashing key is derived from an encryption key and this text
+	REENCRYPT_ROUNDS  = 64                 // Re-encrypt documents of a partition in this many rounds, the lock is released between rounds
+)
+
+// Supply encryption keys by version, the highest version is the current key that encrypts documents.
+type KeyProvider interface {
+	Keys() (map[uint32][]byte, error)
+}
+
+// Read keys from a file, every line has a key version and hex-encoded key separated by a colon.
+type FileKeyProvider string
+
+func (file FileKeyProvider) Keys() (map[uint32][]byte, error) {
+	content, err := ioutil.ReadFile(string(file))
+	if err != nil {
+		return nil, err
+	}
+	return parseKeys(string(content), "\n")
+}
+
+// Read keys from an environment variable, key versions and hex-encoded keys are separated by colons and commas.
+type EnvKeyProvider string
+
+func (name EnvKeyProvider) Keys() (map[uint32][]byte, error) {
+	return parseKeys(os.Getenv(string(name)), ",")
+}
+
+// Parse "version:hex-key" entries separated by the separator, blank entries and # comments are skipped.
+func parseKeys(text, sep string) (map[uint32][]byte, error) {
+	keys := make(map[uint32][]byte)
+	for _, entry := range strings.Split(text, sep) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		versionAndKey := strings.SplitN(entry, ":", 2)
+		if len(versionAndKey) != 2 {
+			return nil, fmt.Errorf("Encryption key entry should look like version:hex-key")
+		}
+		version, err := strconv.ParseUint(strings.TrimSpace(versionAndKey[0]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid encryption key version '%s'", versionAndKey[0])
+		}
+		if keys[uint32(version)], err = hex.DecodeString(strings.TrimSpace(versionAndKey[1])); err != nil {
+			return nil, fmt.Errorf("Encryption key version %d is not hex-encoded", version)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("There is no encryption key")
+	}
+	return keys, nil
+}
+
+// Encryption configuration of a collection.
+type encryptConf struct {
+	IndexKey uint32 `json:"indexKey"` // Version of the encryption key that index hashing key is derived from
+}
+
+// Get keys from the database's key provider, return keyring of the keys and all the keys.
+func (db *DB) loadKeyring() (*data.Keyring, map[uint32][]byte, error) {
+	if db.keys == nil {
+		return nil, nil, fmt.Errorf("Database is not opened with encryption keys")
+	}
+	keys, err := db.keys.Keys()
+	if err != nil {
+		return nil, nil, err
+	}
+	current := uint32(0)
+	for version := range keys {
+		if version > current {
+			current = version
+		}
+	}
+	ring, err := data.NewKeyring(keys, current)
+	return ring, keys, err
+}
+
+// Derive the index hashing key from an encryption key.
+func deriveIndexKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(INDEX_KEY_INFO))
+	return mac.Sum(nil)
+}
+
+// Read encryption configuration from collection directory and apply encryption keys to all partitions.
+func (col *Col) loadEncryption() error {
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, ENCRYPT_CONF_FILE))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var conf encryptConf
+	if err = json.Unmarshal(content, &conf); err != nil {
+		return fmt.Errorf("Encryption configuration of collection %s is corrupted: %v", col.name, err)
+	}
+	ring, keys, err := col.db.loadKeyring()
+	if err != nil {
+		return fmt.Errorf("Collection %s is encrypted: %v", col.name, err)
+	}
+	indexKey, exists := keys[conf.IndexKey]
+	if !exists {
+		return fmt.Errorf("Collection %s needs encryption key version %d for its indexes", col.name, conf.IndexKey)
+	}
+	col.indexKey = deriveIndexKey(indexKey)
+	for _, part := range col.parts {
+		part.SetKeyring(ring)
+	}
+	return nil
+}
+
+// Hash an index value. Encrypted collection uses keyed hashing, so that index files do not reveal document content.
+func (col *Col) hash(str string) int {
+	if col.indexKey == nil {
+		return StrHash(str)
+	}
+	mac := hmac.New(sha256.New, col.indexKey)
+	mac.Write([]byte(str))
+	return int(uint(binary.BigEndian.Uint64(mac.Sum(nil))) >> 1)
+}
+
+// Write encryption configuration of the current key into collection directory, or remove it to disable encryption.
+func (db *DB) writeEncryptConf(colDir string, enabled bool) error {
+	confPath := path.Join(colDir, ENCRYPT_CONF_FILE)
+	if !enabled {
+		if err := os.Remove(confPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	ring, _, err := db.loadKeyring()
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(encryptConf{IndexKey: ring.Current()})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(confPath, content, 0600)
+}
+
+// Encrypt or decrypt all documents and indexes of a collection. Like scrub, the collection is rebuilt and
+// unavailable in the meantime. Attachments are not encrypted, hence a collection that has them cannot be encrypted.
+func (db *DB) SetEncryption(name string, enabled bool) error {
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	col, exists := db.cols[name]
+	if !exists {
+		return fmt.Errorf("Collection %s does not exist", name)
+	} else if enabled {
+		if attached, err := col.hasAttachments(); err != nil {
+			return err
+		} else if attached {
+			return fmt.Errorf("Collection %s has attachments, they would not be encrypted", name)
+		}
+	}
+	if err := db.scrub(name, func(tmpColDir string) error {
+		return db.writeEncryptConf(tmpColDir, enabled)
+	}); err != nil {
+		return err
+	}
+	db.cols[name].logConf(ENCRYPT_CONF_FILE)
+	return nil
+}
+
+// Return true if the collection is encrypted.
+func (col *Col) Encrypted() bool {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	return col.indexKey != nil
+}
+
+// Re-encrypt documents of a collection by the current key of key provider. Documents remain readable and writable
+// while they are re-encrypted in background; the number of re-encrypted documents is sent to the returned channel
+// once finished. Index hashes are re-keyed by the next scrub.
+func (db *DB) RotateKey(name string) (<-chan int, error) {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	col, exists := db.cols[name]
+	if !exists {
+		return nil, fmt.Errorf("Collection %s does not exist", name)
+	} else if col.indexKey == nil {
+		return nil, fmt.Errorf("Collection %s is not encrypted", name)
+	}
+	ring, _, err := db.loadKeyring()
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range col.parts {
+		part.DataLock.Lock()
+		part.SetKeyring(ring)
+		part.DataLock.Unlock()
+	}
+	if db.replog != nil {
+		db.replog.setKeyring(ring)
+	}
+	done := make(chan int, 1)
+	db.bgWait.Add(1)
+	go func() {
+		defer db.bgWait.Done()
+		defer close(done)
+		total := 0
+		for i := range col.parts {
+			for round := 0; round < REENCRYPT_ROUNDS; round++ {
+				select {
+				case <-db.bgStop:
+					tdlog.Noticef("Re-encryption of %s is interrupted after %d documents", name, total)
+					return
+				default:
+				}
+				db.schemaLock.RLock()
+				if db.cols[name] != col {
+					// The collection has been dropped, renamed, or rebuilt
+					db.schemaLock.RUnlock()
+					return
+				}
+				part := col.parts[i]
+				part.DataLock.Lock()
+				count, err := part.Reencrypt(round, REENCRYPT_ROUNDS)
+				part.DataLock.Unlock()
+				db.schemaLock.RUnlock()
+				total += count
+				if err != nil {
+					tdlog.CritNoRepeat("Failed to re-encrypt partition %d of %s: %v", i, name, err)
+				}
+			}
+		}
+		tdlog.Infof("Re-encrypted %d documents of %s by key version %d", total, name, ring.Current())
+		done <- total
+	}()
+	return done, nil
+}
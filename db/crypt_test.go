@@ -0,0 +1,148 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestKeyProviders(t *testing.T) {
+	keyFile := "/tmp/tiedot_test_keys"
+	defer os.Remove(keyFile)
+	if err := ioutil.WriteFile(keyFile, []byte("# keys\n1:00112233445566778899aabbccddeeff\n\n2: ffeeddccbbaa99887766554433221100\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := FileKeyProvider(keyFile).Keys()
+	if err != nil || len(keys) != 2 || keys[2][0] != 0xff {
+		t.Fatal(keys, err)
+	}
+	os.Setenv("TIEDOT_TEST_KEYS", "3:00112233445566778899aabbccddeeff,4:zz")
+	defer os.Unsetenv("TIEDOT_TEST_KEYS")
+	if _, err = EnvKeyProvider("TIEDOT_TEST_KEYS").Keys(); err == nil {
+		t.Fatal("Did not error")
+	}
+	os.Setenv("TIEDOT_TEST_KEYS", "")
+	if _, err = EnvKeyProvider("TIEDOT_TEST_KEYS").Keys(); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestEncryptedCol(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := "/tmp/tiedot_test_keys"
+	defer os.Remove(keyFile)
+	if err := ioutil.WriteFile(keyFile, []byte("1:"+strings.Repeat("01", 32)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Use("col").Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 10)
+	for i := range ids {
+		if ids[i], err = db.Use("col").Insert(map[string]interface{}{"a": i, "b": "plaintext"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Encryption needs keys
+	if err = db.SetEncryption("col", true); err == nil {
+		t.Fatal("Did not error")
+	} else if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Attachments are not encrypted, so they stand in the way of encryption
+	if db, err = OpenDBWithKeys(TEST_DATA_DIR, FileKeyProvider(keyFile)); err != nil {
+		t.Fatal(err)
+	} else if _, err = db.Use("col").PutAttachment(ids[0], "a.txt", strings.NewReader("plaintext")); err != nil {
+		t.Fatal(err)
+	} else if err = db.SetEncryption("col", true); err == nil {
+		t.Fatal("Did not error")
+	} else if err = db.Use("col").DeleteAttachment(ids[0], "a.txt"); err != nil {
+		t.Fatal(err)
+	} else if err = db.SetEncryption("col", true); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if !col.Encrypted() {
+		t.Fatal("Not encrypted")
+	} else if _, err = col.PutAttachment(ids[0], "a.txt", strings.NewReader("plaintext")); err == nil {
+		t.Fatal("Did not error")
+	}
+	for i := 0; i < 2; i++ {
+		content, err := ioutil.ReadFile(path.Join(TEST_DATA_DIR, "col", DOC_DATA_FILE+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		} else if bytes.Contains(content, []byte("plaintext")) {
+			t.Fatal("Document is not encrypted")
+		}
+	}
+	// Index lookup works on keyed hashes
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": 3, "in": []interface{}{"a"}}, col, &result); err != nil {
+		t.Fatal(err)
+	} else if _, found := result[ids[3]]; !found || len(result) != 1 {
+		t.Fatal(result)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Encrypted collection cannot be opened without keys
+	if _, err = OpenDB(TEST_DATA_DIR); err == nil {
+		t.Fatal("Did not error")
+	}
+	// Rotate to a new key, and then retire the old key
+	if err = ioutil.WriteFile(keyFile, []byte("1:"+strings.Repeat("01", 32)+"\n2:"+strings.Repeat("02", 32)), 0600); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDBWithKeys(TEST_DATA_DIR, FileKeyProvider(keyFile)); err != nil {
+		t.Fatal(err)
+	}
+	done, err := db.RotateKey("col")
+	if err != nil {
+		t.Fatal(err)
+	} else if reencrypted := <-done; reencrypted != 10 {
+		t.Fatal(reencrypted)
+	} else if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, []byte("2:"+strings.Repeat("02", 32)), 0600); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDBWithKeys(TEST_DATA_DIR, FileKeyProvider(keyFile)); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	result = make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": 5, "in": []interface{}{"a"}}, col, &result); err != nil {
+		t.Fatal(err)
+	} else if _, found := result[ids[5]]; !found || len(result) != 1 {
+		t.Fatal(result)
+	}
+	// Decrypt
+	if err = db.SetEncryption("col", false); err != nil {
+		t.Fatal(err)
+	} else if col = db.Use("col"); col.Encrypted() {
+		t.Fatal("Still encrypted")
+	} else if doc, err := col.Read(ids[7]); err != nil || doc["b"] != "plaintext" {
+		t.Fatal(doc, err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,7 +3,6 @@
 package db
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -17,6 +16,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/HouzuoGuo/tiedot/data"
 	"github.com/HouzuoGuo/tiedot/tdlog"
 )
 
@@ -24,27 +24,77 @@ const (
 	PART_NUM_FILE = "number_of_partitions" // DB-collection-partition-number-configuration file name
 )
 
+var (
+	COL_CONF_FILES = []string{PART_NUM_FILE, TTL_CONF_FILE, CAP_CONF_FILE, SCHEMA_CONF_FILE, ID_CONF_FILE, ID_COUNTER_FILE, ROOM_CONF_FILE, COMPRESS_CONF_FILE, ENCRYPT_CONF_FILE, FORMAT_CONF_FILE} // Configuration files that live in collection directory
+)
+
 // Database structures.
 type DB struct {
 	path       string          // Root path of database directory
 	numParts   int             // Total number of partitions
 	cols       map[string]*Col // All collections
 	schemaLock *sync.RWMutex   // Control access to collection instances.
+	bgStop     chan struct{}   // Closed to stop background maintenance routines
+	bgWait     *sync.WaitGroup // Wait for background maintenance routines to stop
+	keys       KeyProvider     // Encryption keys (nil if there is none)
+	readOnly   bool            // Data files are opened for reading only, and there is no background maintenance
+	durability string          // When changes of data files are written to disk, one of SYNC_* constants
+	replog     *ReplLog        // Mutation log for replicas (nil if changes are not recorded)
 }
 
 // Open database and load all collections & indexes.
 func OpenDB(dbPath string) (*DB, error) {
+	return OpenDBWithKeys(dbPath, nil)
+}
+
+// Open database with encryption keys, and load all collections & indexes.
+func OpenDBWithKeys(dbPath string, keys KeyProvider) (*DB, error) {
+	return OpenDBWithDurability(dbPath, keys, SYNC_NONE)
+}
+
+// Open database without background maintenance, changes to data files of a read-only database never reach the files.
+func openDB(dbPath string, keys KeyProvider, readOnly bool, durability string) (*DB, error) {
 	rand.Seed(time.Now().UnixNano()) // document ID generation relies on this RNG
-	db := &DB{path: dbPath, schemaLock: new(sync.RWMutex)}
+	db := &DB{path: dbPath, schemaLock: new(sync.RWMutex), bgStop: make(chan struct{}), bgWait: new(sync.WaitGroup), keys: keys, readOnly: readOnly, durability: durability}
 	return db, db.load()
 }
 
+// Open a hash table, only for reading if the database is read-only.
+func (db *DB) openHashTable(path string) (*data.HashTable, error) {
+	if db.readOnly {
+		return data.OpenHashTableReadOnly(path)
+	}
+	return data.OpenHashTable(path)
+}
+
+// Run the function periodically until the database is closed.
+func (db *DB) runInBackground(interval time.Duration, fun func()) {
+	db.bgWait.Add(1)
+	go func() {
+		defer db.bgWait.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.bgStop:
+				return
+			case <-ticker.C:
+				fun()
+			}
+		}
+	}()
+}
+
 // Load all collection schema.
 func (db *DB) load() error {
 	// Create DB directory and PART_NUM_FILE if necessary
 	var numPartsAssumed = false
 	numPartsFilePath := path.Join(db.path, PART_NUM_FILE)
-	if err := os.MkdirAll(db.path, 0700); err != nil {
+	if db.readOnly {
+		if _, err := os.Stat(numPartsFilePath); err != nil {
+			return err
+		}
+	} else if err := os.MkdirAll(db.path, 0700); err != nil {
 		return err
 	}
 	if partNumFile, err := os.Stat(numPartsFilePath); err != nil {
@@ -84,14 +134,32 @@ func (db *DB) load() error {
 
 // Close all database files. Do not use the DB afterwards!
 func (db *DB) Close() error {
+	// Background routines may hold schema lock, stop them first
+	select {
+	case <-db.bgStop:
+	default:
+		close(db.bgStop)
+	}
+	db.bgWait.Wait()
 	db.schemaLock.Lock()
 	defer db.schemaLock.Unlock()
 	errs := make([]error, 0, 0)
 	for _, col := range db.cols {
+		if db.durability != SYNC_NONE {
+			if err := col.sync(); err != nil {
+				errs = append(errs, err)
+			}
+		}
 		if err := col.close(); err != nil {
 			errs = append(errs, err)
 		}
 	}
+	if db.replog != nil {
+		if err := db.replog.close(); err != nil {
+			errs = append(errs, err)
+		}
+		db.replog = nil
+	}
 	if len(errs) == 0 {
 		return nil
 	}
@@ -100,15 +168,30 @@ func (db *DB) Close() error {
 
 // Create a new collection.
 func (db *DB) Create(name string) error {
+	return db.CreateWithPartitions(name, 0)
+}
+
+// Create a new collection with the number of partitions, or as many partitions as the database if the number is 0.
+func (db *DB) CreateWithPartitions(name string, numParts int) error {
+	if numParts < 0 {
+		return fmt.Errorf("Number of partitions may not be negative")
+	}
 	db.schemaLock.Lock()
 	defer db.schemaLock.Unlock()
 	if _, exists := db.cols[name]; exists {
 		return fmt.Errorf("Collection %s already exists", name)
 	} else if err := os.MkdirAll(path.Join(db.path, name), 0700); err != nil {
 		return err
-	} else if db.cols[name], err = OpenCol(db, name); err != nil {
+	} else if numParts > 0 {
+		if err = ioutil.WriteFile(path.Join(db.path, name, PART_NUM_FILE), []byte(strconv.Itoa(numParts)), 0600); err != nil {
+			return err
+		}
+	}
+	var err error
+	if db.cols[name], err = OpenCol(db, name); err != nil {
 		return err
 	}
+	db.logSchema(ReplEntry{Op: REPL_CREATE, Col: name, NumParts: numParts})
 	return nil
 }
 
@@ -151,6 +234,7 @@ func (db *DB) Rename(oldName, newName string) error {
 		return err
 	}
 	delete(db.cols, oldName)
+	db.logSchema(ReplEntry{Op: REPL_RENAME, Col: oldName, NewName: newName})
 	return nil
 }
 
@@ -162,7 +246,7 @@ func (db *DB) Truncate(name string) error {
 		return fmt.Errorf("Collection %s does not exist", name)
 	}
 	col := db.cols[name]
-	for i := 0; i < db.numParts; i++ {
+	for i := 0; i < col.numParts; i++ {
 		if err := col.parts[i].Clear(); err != nil {
 			return err
 		}
@@ -171,7 +255,16 @@ func (db *DB) Truncate(name string) error {
 				return err
 			}
 		}
+		if col.ttl != nil {
+			if err := col.exps[i].Clear(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.RemoveAll(path.Join(db.path, name, ATTACH_DIR)); err != nil {
+		return err
 	}
+	db.logSchema(ReplEntry{Op: REPL_TRUNCATE, Col: name})
 	return nil
 }
 
@@ -182,39 +275,78 @@ func (db *DB) Scrub(name string) error {
 	if _, exists := db.cols[name]; !exists {
 		return fmt.Errorf("Collection %s does not exist", name)
 	}
+	return db.scrub(name, func(tmpColDir string) error {
+		// Indexes are rebuilt, hence they may be hashed by the current encryption key
+		if _, err := os.Stat(path.Join(tmpColDir, ENCRYPT_CONF_FILE)); err == nil {
+			return db.writeEncryptConf(tmpColDir, true)
+		}
+		return nil
+	})
+}
+
+// Rebuild a collection by putting all of its documents into a new collection, the configuration function may
+// change configuration files of the new collection before it is opened. Caller must hold exclusive schema lock.
+func (db *DB) scrub(name string, conf func(tmpColDir string) error) error {
 	// Prepare a temporary collection in file system
 	tmpColName := fmt.Sprintf("scrub-%s-%d", name, time.Now().UnixNano())
 	tmpColDir := path.Join(db.path, tmpColName)
 	if err := os.MkdirAll(tmpColDir, 0700); err != nil {
 		return err
 	}
-	// Mirror indexes from original collection
+	// Mirror indexes and configuration from original collection
 	for _, idxPath := range db.cols[name].indexPaths {
 		if err := os.MkdirAll(path.Join(tmpColDir, strings.Join(idxPath, INDEX_PATH_SEP)), 0700); err != nil {
 			return err
 		}
 	}
+	if err := copyColConf(path.Join(db.path, name), tmpColDir); err != nil {
+		return err
+	} else if err = conf(tmpColDir); err != nil {
+		os.RemoveAll(tmpColDir)
+		return err
+	}
 	// Iterate through all documents and put them into the temporary collection
 	tmpCol, err := OpenCol(db, tmpColName)
 	if err != nil {
 		return err
 	}
-	db.cols[name].forEachDoc(func(id int, doc []byte) bool {
-		var docObj map[string]interface{}
-		if err := json.Unmarshal([]byte(doc), &docObj); err != nil {
-			// Skip corrupted document
+	// The new collection is synced all at once
+	tmpCol.syncWrites(false)
+	// Capped collection keeps its insertion order
+	forEachDoc := db.cols[name].forEachDoc
+	if db.cols[name].capped != nil {
+		forEachDoc = func(fun func(id int, doc []byte) bool, placeSchemaLock bool) {
+			db.cols[name].forEachDocInOrder(fun, placeSchemaLock)
+		}
+	}
+	unmarshal := convertFormat(db.cols[name].format, tmpCol.format)
+	forEachDoc(func(id int, doc []byte) bool {
+		docObj, err := unmarshal(doc)
+		if err != nil {
+			tdlog.Noticef("Scrub %s: dropped unreadable document %d: %v", name, id, err)
 			return true
 		}
 		if err := tmpCol.InsertRecovery(id, docObj); err != nil {
 			tdlog.Noticef("Scrub %s: failed to insert back document %v", name, docObj)
+		} else if expireAt, expires := db.cols[name].expiryOf(id); expires {
+			tmpCol.setExpiry(id, expireAt)
 		}
 		return true
 	}, false)
+	if db.durability != SYNC_NONE {
+		if err := tmpCol.sync(); err != nil {
+			tmpCol.close()
+			return err
+		}
+	}
 	if err := tmpCol.close(); err != nil {
 		return err
 	}
-	// Replace the original collection with the "temporary" one
+	// Replace the original collection with the "temporary" one, attachments move along
 	db.cols[name].close()
+	if err := os.Rename(path.Join(db.path, name, ATTACH_DIR), path.Join(tmpColDir, ATTACH_DIR)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	if err := os.RemoveAll(path.Join(db.path, name)); err != nil {
 		return err
 	}
@@ -227,6 +359,22 @@ func (db *DB) Scrub(name string) error {
 	return nil
 }
 
+// Copy collection configuration files (not documents or indexes) from one collection directory to another.
+func copyColConf(srcDir, destDir string) error {
+	for _, confFile := range COL_CONF_FILES {
+		content, err := ioutil.ReadFile(path.Join(srcDir, confFile))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(path.Join(destDir, confFile), content, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Drop a collection and lose all of its documents and indexes.
 func (db *DB) Drop(name string) error {
 	db.schemaLock.Lock()
@@ -239,6 +387,7 @@ func (db *DB) Drop(name string) error {
 		return err
 	}
 	delete(db.cols, name)
+	db.logSchema(ReplEntry{Op: REPL_DROP, Col: name})
 	return nil
 }
 
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"strconv"
 	"testing"
 )
 
@@ -253,3 +254,72 @@ func TestDumpDB(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestCreateWithPartitions(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.CreateWithPartitions("bad", -1); err == nil {
+		t.Fatal("Did not error")
+	} else if err = db.CreateWithPartitions("small", 1); err != nil {
+		t.Fatal(err)
+	} else if err = db.CreateWithPartitions("big", 5); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("default"); err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string][]int)
+	for _, name := range []string{"small", "big", "default"} {
+		col := db.Use(name)
+		if err = col.Index([]string{"a"}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			id, err := col.Insert(map[string]interface{}{"a": i})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids[name] = append(ids[name], id)
+		}
+	}
+	// Scrub keeps the number of partitions
+	if err = db.Scrub("big"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for name, numParts := range map[string]int{"small": 1, "big": 5, "default": 2} {
+		col := db.Use(name)
+		if col.NumParts() != numParts {
+			t.Fatal(name, col.NumParts())
+		} else if _, err = os.Stat(path.Join(TEST_DATA_DIR, name, DOC_DATA_FILE+strconv.Itoa(numParts-1))); err != nil {
+			t.Fatal(err)
+		} else if _, err = os.Stat(path.Join(TEST_DATA_DIR, name, DOC_DATA_FILE+strconv.Itoa(numParts))); !os.IsNotExist(err) {
+			t.Fatal(err)
+		} else if _, err = os.Stat(path.Join(TEST_DATA_DIR, name, "a", strconv.Itoa(numParts))); !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		for i, id := range ids[name] {
+			if doc, err := col.Read(id); err != nil || doc["a"] != float64(i) {
+				t.Fatal(doc, err)
+			}
+			result := make(map[int]struct{})
+			if err = EvalQuery(map[string]interface{}{"eq": i, "in": []interface{}{"a"}}, col, &result); err != nil || len(result) != 1 {
+				t.Fatal(result, err)
+			}
+		}
+	}
+}
@@ -5,8 +5,9 @@ package db
 import (
 	"encoding/json"
 	"fmt"
-	"math/rand"
+	"time"
 
+	"github.com/HouzuoGuo/tiedot/dberr"
 	"github.com/HouzuoGuo/tiedot/tdlog"
 )
 
@@ -50,13 +51,13 @@ func StrHash(str string) int {
 	return hash
 }
 
-// Put a document on all user-created indexes.
+// Put a document on all user-created indexes. Expiry time is remembered along with the document data.
 func (col *Col) indexDoc(id int, doc map[string]interface{}) {
 	for idxName, idxPath := range col.indexPaths {
 		for _, idxVal := range GetIn(doc, idxPath) {
 			if idxVal != nil {
-				hashKey := StrHash(fmt.Sprint(idxVal))
-				partNum := hashKey % col.db.numParts
+				hashKey := col.hash(fmt.Sprint(idxVal))
+				partNum := hashKey % col.numParts
 				ht := col.hts[partNum][idxName]
 				ht.Lock.Lock()
 				ht.Put(hashKey, id)
@@ -71,8 +72,8 @@ func (col *Col) unindexDoc(id int, doc map[string]interface{}) {
 	for idxName, idxPath := range col.indexPaths {
 		for _, idxVal := range GetIn(doc, idxPath) {
 			if idxVal != nil {
-				hashKey := StrHash(fmt.Sprint(idxVal))
-				partNum := hashKey % col.db.numParts
+				hashKey := col.hash(fmt.Sprint(idxVal))
+				partNum := hashKey % col.numParts
 				ht := col.hts[partNum][idxName]
 				ht.Lock.Lock()
 				ht.Remove(hashKey, id)
@@ -84,55 +85,76 @@ func (col *Col) unindexDoc(id int, doc map[string]interface{}) {
 
 // Insert a document with the specified ID into the collection (incl. index). Does not place partition/schema lock.
 func (col *Col) InsertRecovery(id int, doc map[string]interface{}) (err error) {
-	docJS, err := json.Marshal(doc)
+	docJS, err := col.format.Marshal(doc)
 	if err != nil {
 		return
 	}
-	partNum := id % col.db.numParts
+	partNum := id % col.numParts
 	part := col.parts[partNum]
 	// Put document data into collection
 	if _, err = part.Insert(id, []byte(docJS)); err != nil {
 		return
 	}
+	col.expireDoc(id, doc)
 	// Index the document
 	col.indexDoc(id, doc)
 	return
 }
 
-// Insert a document into the collection.
-func (col *Col) Insert(doc map[string]interface{}) (id int, err error) {
-	docJS, err := json.Marshal(doc)
+// Index a newly inserted document and make room in capped collection. Does not place schema lock.
+func (col *Col) indexNewDoc(id int, doc map[string]interface{}) {
+	part := col.parts[id%col.numParts]
+	part.LockUpdate(id)
+	// Index the document
+	col.indexDoc(id, doc)
+	part.UnlockUpdate(id)
+
+	// Make room in capped collection
+	col.evictOverflow()
+}
+
+func (col *Col) insert(doc map[string]interface{}, placeSchemaLock bool) (id int, err error) {
+	docJS, err := col.format.Marshal(doc)
 	if err != nil {
 		return
 	}
-	id = rand.Int()
-	partNum := id % col.db.numParts
-	col.db.schemaLock.RLock()
-	part := col.parts[partNum]
+	if placeSchemaLock {
+		col.db.schemaLock.RLock()
+		defer col.db.schemaLock.RUnlock()
+	}
+	if err = col.validateDoc(doc); err != nil {
+		return
+	} else if err = col.checkCapSize(docJS); err != nil {
+		return
+	}
 
-	// Put document data into collection
-	part.DataLock.Lock()
-	_, err = part.Insert(id, []byte(docJS))
-	part.DataLock.Unlock()
+	// Put document data into collection, try another ID if the generated ID is taken
+	for attempt := 1; ; attempt++ {
+		if id, err = col.nextID(); err != nil {
+			return
+		}
+		err = col.putDoc(id, doc, docJS)
+		if dberr.Type(err) != dberr.ErrorDocExists || attempt == ID_MAX_ATTEMPTS {
+			break
+		}
+	}
 	if err != nil {
-		col.db.schemaLock.RUnlock()
 		return
 	}
-
-	part.LockUpdate(id)
-	// Index the document
-	col.indexDoc(id, doc)
-	part.UnlockUpdate(id)
-
-	col.db.schemaLock.RUnlock()
+	col.indexNewDoc(id, doc)
 	return
 }
 
+// Insert a document into the collection.
+func (col *Col) Insert(doc map[string]interface{}) (id int, err error) {
+	return col.insert(doc, true)
+}
+
 func (col *Col) read(id int, placeSchemaLock bool) (doc map[string]interface{}, err error) {
 	if placeSchemaLock {
 		col.db.schemaLock.RLock()
 	}
-	part := col.parts[id%col.db.numParts]
+	part := col.parts[id%col.numParts]
 
 	part.DataLock.RLock()
 	docB, err := part.Read(id)
@@ -144,7 +166,14 @@ func (col *Col) read(id int, placeSchemaLock bool) (doc map[string]interface{},
 		return
 	}
 
-	err = json.Unmarshal(docB, &doc)
+	if col.expired(id, time.Now().Unix()) {
+		// Expired but not yet deleted by the sweeper
+		if placeSchemaLock {
+			col.db.schemaLock.RUnlock()
+		}
+		return nil, dberr.New(dberr.ErrorNoDoc, id)
+	}
+	doc, err = col.format.Unmarshal(docB)
 	if placeSchemaLock {
 		col.db.schemaLock.RUnlock()
 	}
@@ -156,36 +185,42 @@ func (col *Col) Read(id int) (doc map[string]interface{}, err error) {
 	return col.read(id, true)
 }
 
-// Update a document.
-func (col *Col) Update(id int, doc map[string]interface{}) error {
+func (col *Col) update(id int, doc map[string]interface{}, placeSchemaLock bool) error {
 	if doc == nil {
 		return fmt.Errorf("Updating %d: input doc may not be nil", id)
 	}
-	docJS, err := json.Marshal(doc)
+	docJS, err := col.format.Marshal(doc)
 	if err != nil {
 		return err
 	}
-	col.db.schemaLock.RLock()
-	part := col.parts[id%col.db.numParts]
+	if placeSchemaLock {
+		col.db.schemaLock.RLock()
+		defer col.db.schemaLock.RUnlock()
+	}
+	part := col.parts[id%col.numParts]
+	if err = col.validateDoc(doc); err != nil {
+		return err
+	}
 
 	// Place lock, read back original document and update
 	part.DataLock.Lock()
 	originalB, err := part.Read(id)
 	if err != nil {
 		part.DataLock.Unlock()
-		col.db.schemaLock.RUnlock()
 		return err
 	}
 	err = part.Update(id, []byte(docJS))
+	if err == nil {
+		col.logWrite(id, []byte(docJS))
+		col.expireDoc(id, doc)
+	}
 	part.DataLock.Unlock()
 	if err != nil {
-		col.db.schemaLock.RUnlock()
 		return err
 	}
 
 	// Done with the collection data, next is to maintain indexed values
-	var original map[string]interface{}
-	json.Unmarshal(originalB, &original)
+	original, _ := col.format.Unmarshal(originalB)
 	part.LockUpdate(id)
 	if original != nil {
 		col.unindexDoc(id, original)
@@ -195,11 +230,14 @@ func (col *Col) Update(id int, doc map[string]interface{}) error {
 	col.indexDoc(id, doc)
 	// Done with the index
 	part.UnlockUpdate(id)
-
-	col.db.schemaLock.RUnlock()
 	return nil
 }
 
+// Update a document.
+func (col *Col) Update(id int, doc map[string]interface{}) error {
+	return col.update(id, doc, true)
+}
+
 // UpdateBytesFunc will update a document bytes.
 // update func will get current document bytes and should return bytes of updated document;
 // updated document should be valid JSON;
@@ -207,7 +245,7 @@ func (col *Col) Update(id int, doc map[string]interface{}) error {
 // non-nil error will be propagated back and returned from UpdateBytesFunc.
 func (col *Col) UpdateBytesFunc(id int, update func(origDoc []byte) (newDoc []byte, err error)) error {
 	col.db.schemaLock.RLock()
-	part := col.parts[id%col.db.numParts]
+	part := col.parts[id%col.numParts]
 
 	// Place lock, read back original document and update
 	part.DataLock.Lock()
@@ -217,8 +255,16 @@ func (col *Col) UpdateBytesFunc(id int, update func(origDoc []byte) (newDoc []by
 		col.db.schemaLock.RUnlock()
 		return err
 	}
-	var original map[string]interface{}
-	json.Unmarshal(originalB, &original) // Unmarshal originalB before passing it to update
+	original, _ := col.format.Unmarshal(originalB) // Unmarshal originalB before passing it to update
+	// The function works on JSON regardless of document format
+	_, isJSON := col.format.(jsonFormat)
+	if !isJSON {
+		if originalB, err = json.Marshal(original); err != nil {
+			part.DataLock.Unlock()
+			col.db.schemaLock.RUnlock()
+			return err
+		}
+	}
 	docB, err := update(originalB)
 	if err != nil {
 		part.DataLock.Unlock()
@@ -231,7 +277,23 @@ func (col *Col) UpdateBytesFunc(id int, update func(origDoc []byte) (newDoc []by
 		col.db.schemaLock.RUnlock()
 		return err
 	}
+	if err = col.validateDoc(doc); err != nil {
+		part.DataLock.Unlock()
+		col.db.schemaLock.RUnlock()
+		return err
+	}
+	if !isJSON {
+		if docB, err = col.format.Marshal(doc); err != nil {
+			part.DataLock.Unlock()
+			col.db.schemaLock.RUnlock()
+			return err
+		}
+	}
 	err = part.Update(id, docB)
+	if err == nil {
+		col.logWrite(id, docB)
+		col.expireDoc(id, doc)
+	}
 	part.DataLock.Unlock()
 	if err != nil {
 		col.db.schemaLock.RUnlock()
@@ -259,7 +321,7 @@ func (col *Col) UpdateBytesFunc(id int, update func(origDoc []byte) (newDoc []by
 // non-nil error will be propagated back and returned from UpdateFunc.
 func (col *Col) UpdateFunc(id int, update func(origDoc map[string]interface{}) (newDoc map[string]interface{}, err error)) error {
 	col.db.schemaLock.RLock()
-	part := col.parts[id%col.db.numParts]
+	part := col.parts[id%col.numParts]
 
 	// Place lock, read back original document and update
 	part.DataLock.Lock()
@@ -269,8 +331,7 @@ func (col *Col) UpdateFunc(id int, update func(origDoc map[string]interface{}) (
 		col.db.schemaLock.RUnlock()
 		return err
 	}
-	var original map[string]interface{}
-	err = json.Unmarshal(originalB, &original)
+	original, err := col.format.Unmarshal(originalB)
 	if err != nil {
 		part.DataLock.Unlock()
 		col.db.schemaLock.RUnlock()
@@ -282,13 +343,22 @@ func (col *Col) UpdateFunc(id int, update func(origDoc map[string]interface{}) (
 		col.db.schemaLock.RUnlock()
 		return err
 	}
-	docJS, err := json.Marshal(doc)
+	if err = col.validateDoc(doc); err != nil {
+		part.DataLock.Unlock()
+		col.db.schemaLock.RUnlock()
+		return err
+	}
+	docJS, err := col.format.Marshal(doc)
 	if err != nil {
 		part.DataLock.Unlock()
 		col.db.schemaLock.RUnlock()
 		return err
 	}
 	err = part.Update(id, []byte(docJS))
+	if err == nil {
+		col.logWrite(id, []byte(docJS))
+		col.expireDoc(id, doc)
+	}
 	part.DataLock.Unlock()
 	if err != nil {
 		col.db.schemaLock.RUnlock()
@@ -306,29 +376,45 @@ func (col *Col) UpdateFunc(id int, update func(origDoc map[string]interface{}) (
 	return nil
 }
 
-// Delete a document.
-func (col *Col) Delete(id int) error {
-	col.db.schemaLock.RLock()
-	part := col.parts[id%col.db.numParts]
+func (col *Col) delete(id int, placeSchemaLock bool) error {
+	_, err := col.deleteIf(id, placeSchemaLock, nil)
+	return err
+}
 
-	// Place lock, read back original document and delete document
+// Delete a document if the condition (nil for always) holds for the document as it is read under the partition's
+// exclusive data lock; return false if the condition does not hold.
+func (col *Col) deleteIf(id int, placeSchemaLock bool, cond func(doc []byte) bool) (deleted bool, err error) {
+	if placeSchemaLock {
+		col.db.schemaLock.RLock()
+		defer col.db.schemaLock.RUnlock()
+	}
+	part := col.parts[id%col.numParts]
+
+	// Place lock, read back original document and delete document, a corrupted document may be deleted too
 	part.DataLock.Lock()
 	originalB, err := part.Read(id)
-	if err != nil {
+	if err != nil && dberr.Type(err) != dberr.ErrorCorruptDoc {
 		part.DataLock.Unlock()
-		col.db.schemaLock.RUnlock()
-		return err
+		return false, err
+	} else if cond != nil && !cond(originalB) {
+		part.DataLock.Unlock()
+		return false, nil
 	}
 	err = part.Delete(id)
+	if err == nil {
+		col.logWrite(id, nil)
+		col.unexpireDoc(id)
+	}
 	part.DataLock.Unlock()
 	if err != nil {
-		col.db.schemaLock.RUnlock()
-		return err
+		return false, err
+	}
+	if err = col.removeAttachments(id); err != nil {
+		tdlog.Noticef("Failed to remove attachments of document %d: %v", id, err)
 	}
 
 	// Done with the collection data, next is to remove indexed values
-	var original map[string]interface{}
-	err = json.Unmarshal(originalB, &original)
+	original, err := col.format.Unmarshal(originalB)
 	if err == nil {
 		part.LockUpdate(id)
 		col.unindexDoc(id, original)
@@ -336,7 +422,10 @@ func (col *Col) Delete(id int) error {
 	} else {
 		tdlog.Noticef("Will not attempt to unindex document %d during delete", id)
 	}
+	return true, nil
+}
 
-	col.db.schemaLock.RUnlock()
-	return nil
+// Delete a document.
+func (col *Col) Delete(id int) error {
+	return col.delete(id, true)
 }
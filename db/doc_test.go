@@ -92,9 +92,9 @@ func GetInTest(t *testing.T) {
 func idxHas(col *Col, path []string, idxVal interface{}, docID int) error {
 	idxName := strings.Join(path, INDEX_PATH_SEP)
 	hashKey := StrHash(fmt.Sprint(idxVal))
-	vals := col.hts[hashKey%col.db.numParts][idxName].Get(hashKey, 0)
+	vals := col.hts[hashKey%col.numParts][idxName].Get(hashKey, 0)
 	if len(vals) != 1 || vals[0] != docID {
-		return fmt.Errorf("Looking for %v (%v) docID %v in %v partition %d, but got result %v", idxVal, hashKey, docID, path, hashKey%col.db.numParts, vals)
+		return fmt.Errorf("Looking for %v (%v) docID %v in %v partition %d, but got result %v", idxVal, hashKey, docID, path, hashKey%col.numParts, vals)
 	}
 	return nil
 }
@@ -102,7 +102,7 @@ func idxHas(col *Col, path []string, idxVal interface{}, docID int) error {
 func idxHasNot(col *Col, path []string, idxVal, docID int) error {
 	idxName := strings.Join(path, INDEX_PATH_SEP)
 	hashKey := StrHash(fmt.Sprint(idxVal))
-	vals := col.hts[hashKey%col.db.numParts][idxName].Get(hashKey, 0)
+	vals := col.hts[hashKey%col.numParts][idxName].Get(hashKey, 0)
 	for _, v := range vals {
 		if v == docID {
 			return fmt.Errorf("Looking for %v %v %v in %v (should not return any), but got result %v", idxVal, hashKey, docID, path, vals)
@@ -0,0 +1,226 @@
+// Logical export and import of collections in NDJSON, portable across partition counts and integer sizes.
+//
+// The first line identifies the format and its version. Each collection starts with a line carrying its name,
+// configuration files and indexes, followed by a line per document carrying its ID, content in JSON and expiry
+// time. Documents of capped collections are exported from the oldest to the newest. The last line marks the end of
+// export and carries the number of collections, an export without it is incomplete.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+)
+
+const (
+	EXPORT_FORMAT  = "tiedot-export" // Format name on the first line of an export
+	EXPORT_VERSION = 1               // Version of export format
+)
+
+var (
+	EXPORT_CONF_FILES = []string{PART_NUM_FILE, TTL_CONF_FILE, CAP_CONF_FILE, SCHEMA_CONF_FILE, ID_CONF_FILE, ROOM_CONF_FILE, COMPRESS_CONF_FILE, ENCRYPT_CONF_FILE, FORMAT_CONF_FILE} // Configuration files carried by an export (ID counters depend on partition count)
+)
+
+// A line of export.
+type exportLine struct {
+	Format     string            `json:"format,omitempty"`
+	Version    int               `json:"version,omitempty"`
+	Collection string            `json:"collection,omitempty"`
+	Config     map[string]string `json:"config,omitempty"`
+	Indexes    [][]string        `json:"indexes,omitempty"`
+	ID         json.Number       `json:"id,omitempty"`
+	Doc        json.RawMessage   `json:"doc,omitempty"`
+	ExpireAt   *int64            `json:"expireAt,omitempty"`
+	End        bool              `json:"end,omitempty"`
+	Cols       int               `json:"collections,omitempty"`
+}
+
+// Write all collections, their configuration, indexes and documents to the writer. Documents may be written during
+// the export, a document changed in the meantime may or may not be exported in its latest version.
+func (db *DB) Export(w io.Writer) error {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(exportLine{Format: EXPORT_FORMAT, Version: EXPORT_VERSION}); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(db.cols))
+	for name := range db.cols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := db.cols[name].export(enc); err != nil {
+			return err
+		}
+	}
+	return enc.Encode(exportLine{End: true, Cols: len(names)})
+}
+
+// Write the collection to the encoder. Caller must hold schema lock.
+func (col *Col) export(enc *json.Encoder) error {
+	header := exportLine{Collection: col.name, Config: make(map[string]string), Indexes: make([][]string, 0, len(col.indexPaths))}
+	for _, confFile := range EXPORT_CONF_FILES {
+		content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, confFile))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		header.Config[confFile] = string(content)
+	}
+	idxNames := make([]string, 0, len(col.indexPaths))
+	for idxName := range col.indexPaths {
+		idxNames = append(idxNames, idxName)
+	}
+	sort.Strings(idxNames)
+	for _, idxName := range idxNames {
+		header.Indexes = append(header.Indexes, col.indexPaths[idxName])
+	}
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	var err error
+	exportDoc := col.asJSON(func(id int, doc []byte) bool {
+		line := exportLine{ID: json.Number(strconv.Itoa(id)), Doc: json.RawMessage(doc)}
+		if expireAt, expires := col.expiryOf(id); expires {
+			line.ExpireAt = &expireAt
+		}
+		err = enc.Encode(line)
+		return err == nil
+	})
+	if col.capped != nil {
+		if orderErr := col.forEachDocInOrder(exportDoc, false); orderErr != nil {
+			return orderErr
+		}
+	} else {
+		col.forEachDoc(exportDoc, false)
+	}
+	return err
+}
+
+// Read collections exported by Export and create them in the database. The collections must not already exist.
+// Documents keep their IDs; expiry times and insertion order of capped collections are kept as well. An export that
+// does not reach its end line is rejected.
+func (db *DB) Import(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	var line exportLine
+	if err := dec.Decode(&line); err != nil {
+		return fmt.Errorf("Cannot read export header: %v", err)
+	} else if line.Format != EXPORT_FORMAT {
+		return fmt.Errorf("Input is not a tiedot export")
+	} else if line.Version < 1 || line.Version > EXPORT_VERSION {
+		return fmt.Errorf("Export version %d is not supported, the latest supported version is %d", line.Version, EXPORT_VERSION)
+	}
+	var col *Col
+	var indexes [][]string
+	var maxID, numCols int
+	finish := func() error {
+		if col == nil {
+			return nil
+		}
+		return col.finishImport(indexes, maxID)
+	}
+	for {
+		line = exportLine{}
+		if err := dec.Decode(&line); err == io.EOF {
+			return fmt.Errorf("Export is incomplete, it ends before its end line")
+		} else if err != nil {
+			return fmt.Errorf("Cannot read export: %v", err)
+		}
+		if line.End {
+			if line.Cols != numCols {
+				return fmt.Errorf("Export is incomplete, it has %d collections out of %d", numCols, line.Cols)
+			} else if err := dec.Decode(&line); err != io.EOF {
+				return fmt.Errorf("Export continues after its end line")
+			}
+			return finish()
+		} else if line.Collection != "" {
+			if err := finish(); err != nil {
+				return err
+			}
+			var err error
+			if col, err = db.createImported(line.Collection, line.Config); err != nil {
+				return err
+			}
+			indexes, maxID = line.Indexes, 0
+			numCols++
+			continue
+		} else if col == nil {
+			return fmt.Errorf("Document appears before any collection in export")
+		}
+		id, err := strconv.ParseInt(string(line.ID), 10, strconv.IntSize)
+		if err != nil {
+			return fmt.Errorf("Document ID %s in collection %s is not supported on this platform: %v", line.ID, col.name, err)
+		}
+		doc, err := convertFormat(jsonFormat{}, col.format)(line.Doc)
+		if err != nil {
+			return fmt.Errorf("Document %d in collection %s is malformed: %v", id, col.name, err)
+		} else if err = col.InsertWithID(int(id), doc); err != nil {
+			return fmt.Errorf("Cannot import document %d into collection %s: %v", id, col.name, err)
+		}
+		if col.ttl != nil {
+			if line.ExpireAt == nil {
+				col.unexpireDoc(int(id))
+			} else {
+				col.setExpiry(int(id), *line.ExpireAt)
+			}
+		}
+		if int(id) > maxID {
+			maxID = int(id)
+		}
+	}
+}
+
+// Create a collection with the exported configuration files.
+func (db *DB) createImported(name string, config map[string]string) (*Col, error) {
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	if _, exists := db.cols[name]; exists {
+		return nil, fmt.Errorf("Collection %s already exists", name)
+	}
+	colDir := path.Join(db.path, name)
+	if err := os.MkdirAll(colDir, 0700); err != nil {
+		return nil, err
+	}
+	for _, confFile := range EXPORT_CONF_FILES {
+		if content, exists := config[confFile]; exists {
+			if err := ioutil.WriteFile(path.Join(colDir, confFile), []byte(content), 0600); err != nil {
+				return nil, err
+			}
+		}
+	}
+	col, err := OpenCol(db, name)
+	if err != nil {
+		return nil, err
+	}
+	db.cols[name] = col
+	if db.replog != nil {
+		numParts, _ := strconv.Atoi(config[PART_NUM_FILE])
+		db.logSchema(ReplEntry{Op: REPL_CREATE, Col: name, NumParts: numParts})
+		for _, confFile := range EXPORT_CONF_FILES {
+			if _, exists := config[confFile]; exists && confFile != PART_NUM_FILE {
+				col.logConf(confFile)
+			}
+		}
+	}
+	return col, nil
+}
+
+// Create indexes on imported documents, and let monotonic IDs continue after the imported IDs.
+func (col *Col) finishImport(indexes [][]string, maxID int) error {
+	for _, idxPath := range indexes {
+		if err := col.Index(idxPath); err != nil {
+			return err
+		}
+	}
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	return col.continueIDs(maxID)
+}
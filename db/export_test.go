@@ -0,0 +1,151 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	importDir := TEST_DATA_DIR + "_import"
+	for _, dir := range []string{TEST_DATA_DIR, importDir} {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(importDir+"/number_of_partitions", []byte("3"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"col", "packed", "capped", "counted"} {
+		if err = db.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	col, packed, capped, counted := db.Use("col"), db.Use("packed"), db.Use("capped"), db.Use("counted")
+	if err = col.Index([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.SetTTL([]string{"at"}, 0); err != nil {
+		t.Fatal(err)
+	} else if err = db.SetFormat("packed", FORMAT_MSGPACK); err != nil {
+		t.Fatal(err)
+	} else if err = capped.Cap(3, 0); err != nil {
+		t.Fatal(err)
+	} else if err = counted.SetIDStrategy(ID_MONOTONIC); err != nil {
+		t.Fatal(err)
+	}
+	packed = db.Use("packed")
+	expiring, err := col.Insert(map[string]interface{}{"a": map[string]interface{}{"b": "x"}, "at": 4000000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lasting, err := col.Insert(map[string]interface{}{"a": map[string]interface{}{"b": "y"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packedID, err := packed.Insert(map[string]interface{}{"int": 9007199254740993, "float": 1.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err = capped.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = counted.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out bytes.Buffer
+	if err = db.Export(&out); err != nil {
+		t.Fatal(err)
+	} else if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1+4+2+1+3+5+1 || !strings.Contains(lines[0], EXPORT_FORMAT) || lines[len(lines)-1] != `{"end":true,"collections":4}` {
+		t.Fatal(len(lines), lines[0], lines[len(lines)-1])
+	}
+	// Import into a database of another partition count
+	if db, err = OpenDB(importDir); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Import(bytes.NewReader(out.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	col, packed, capped, counted = db.Use("col"), db.Use("packed"), db.Use("capped"), db.Use("counted")
+	if doc, err := col.Read(lasting); err != nil || doc["a"].(map[string]interface{})["b"] != "y" {
+		t.Fatal(doc, err)
+	} else if indexes := col.AllIndexes(); len(indexes) != 1 || strings.Join(indexes[0], ",") != "a,b" {
+		t.Fatal(indexes)
+	}
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": "x", "in": []interface{}{"a", "b"}}, col, &result); err != nil {
+		t.Fatal(err)
+	} else if _, found := result[expiring]; !found || len(result) != 1 {
+		t.Fatal(result)
+	}
+	if expireAt, expires := col.expiryOf(expiring); !expires || expireAt != 4000000000 {
+		t.Fatal(expireAt, expires)
+	} else if _, expires = col.expiryOf(lasting); expires {
+		t.Fatal("Document without expiry expires")
+	}
+	if packed.GetFormat() != FORMAT_MSGPACK {
+		t.Fatal(packed.GetFormat())
+	} else if doc, err := packed.Read(packedID); err != nil || doc["int"] != int64(9007199254740993) || doc["float"] != 1.5 {
+		t.Fatal(doc, err)
+	}
+	var order []float64
+	if err = capped.ForEachDocInOrder(func(id int, doc []byte) bool {
+		n, _ := capped.Read(id)
+		order = append(order, n["n"].(float64))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	} else if len(order) != 3 || order[0] != 2 || order[2] != 4 {
+		t.Fatal(order)
+	}
+	// Monotonic IDs continue after the imported ones
+	newID, err := counted.Insert(map[string]interface{}{"n": 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted.ForEachDoc(func(id int, doc []byte) bool {
+		if id > newID {
+			t.Fatal("New ID is not the greatest", id, newID)
+		}
+		return true
+	})
+	// Existing collections are not overwritten, IDs must fit into int
+	if err = db.Import(bytes.NewReader(out.Bytes())); err == nil {
+		t.Fatal("Did not error")
+	}
+	tooLarge := lines[0] + "\n" + `{"collection":"big"}` + "\n" + `{"id":123456789012345678901234567890,"doc":{}}` + "\n" + `{"end":true,"collections":1}` + "\n"
+	if err = db.Import(strings.NewReader(tooLarge)); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Fatal(err)
+	} else if err = db.Import(strings.NewReader(`{"doc":{}}`)); err == nil {
+		t.Fatal("Did not error")
+	}
+	// An export cut short is rejected
+	for _, cut := range []string{
+		lines[0] + "\n" + `{"collection":"cut1"}` + "\n" + `{"id":1,"doc":{}}` + "\n",
+		lines[0] + "\n" + `{"collection":"cut2"}` + "\n" + `{"end":true,"collections":2}` + "\n",
+		lines[0] + "\n" + `{"collection":"cut3"}` + "\n" + `{"end":true,"collections":1}` + "\n" + `{"collection":"cut4"}` + "\n",
+	} {
+		if err = db.Import(strings.NewReader(cut)); err == nil {
+			t.Fatal("Did not error", cut)
+		}
+	}
+	if err = db.Import(strings.NewReader(lines[0] + "\n" + `{"end":true}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+}
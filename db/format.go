@@ -0,0 +1,214 @@
+// Document formats - how documents are serialized in collection files.
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	FORMAT_CONF_FILE = "format"  // Name of document format configuration file.
+	FORMAT_JSON      = "json"    // Documents are stored as JSON text (default)
+	FORMAT_MSGPACK   = "msgpack" // Documents are stored in MessagePack, integers and floats are told apart
+	MSGPACK_END      = 0xc0      // MessagePack nil placed after each document
+	MSGPACK_ESCAPE   = 0xc1      // Byte never used by MessagePack, escapes zero bytes and itself in stored documents
+)
+
+// Serialize documents into collection files and back.
+type DocFormat interface {
+	Marshal(doc map[string]interface{}) ([]byte, error)
+	// The data may be followed by padding (spaces).
+	Unmarshal(data []byte) (map[string]interface{}, error)
+}
+
+var (
+	docFormats     = map[string]DocFormat{FORMAT_JSON: jsonFormat{}, FORMAT_MSGPACK: msgpackFormat{}}
+	docFormatsLock = new(sync.RWMutex)
+)
+
+// Make a document format available to collections under the name.
+func RegisterFormat(name string, format DocFormat) {
+	docFormatsLock.Lock()
+	defer docFormatsLock.Unlock()
+	docFormats[name] = format
+}
+
+// Return the registered document format of the name.
+func getFormat(name string) (DocFormat, error) {
+	docFormatsLock.RLock()
+	defer docFormatsLock.RUnlock()
+	if format, exists := docFormats[name]; exists {
+		return format, nil
+	}
+	return nil, fmt.Errorf("Unknown document format %s", name)
+}
+
+// Documents in JSON text.
+type jsonFormat struct{}
+
+func (jsonFormat) Marshal(doc map[string]interface{}) ([]byte, error) {
+	return json.Marshal(doc)
+}
+
+func (jsonFormat) Unmarshal(data []byte) (doc map[string]interface{}, err error) {
+	err = json.Unmarshal(data, &doc)
+	return
+}
+
+// Documents in MessagePack.
+type msgpackFormat struct{}
+
+func (msgpackFormat) Marshal(doc map[string]interface{}) ([]byte, error) {
+	data, err := appendMsgpack(make([]byte, 0, 256), doc)
+	if err != nil {
+		return nil, err
+	}
+	// Trailing spaces are trimmed as padding (e.g. by compaction), a nil keeps the document's own trailing bytes intact
+	return escapeZeros(append(data, MSGPACK_END)), nil
+}
+
+func (msgpackFormat) Unmarshal(data []byte) (map[string]interface{}, error) {
+	data, err := unescapeZeros(data)
+	if err != nil {
+		return nil, err
+	}
+	val, err := (&msgpackDecoder{data: data}).value()
+	if err != nil {
+		return nil, err
+	} else if val == nil {
+		return nil, nil
+	}
+	doc, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("MessagePack document is not a map")
+	}
+	return doc, nil
+}
+
+// Replace zero bytes, so that a stored document never looks like free space of collection file (a run of zero bytes)
+// when the file is opened.
+func escapeZeros(data []byte) []byte {
+	escaped := make([]byte, 0, len(data)+len(data)/8)
+	for _, b := range data {
+		switch b {
+		case 0:
+			escaped = append(escaped, MSGPACK_ESCAPE, 1)
+		case MSGPACK_ESCAPE:
+			escaped = append(escaped, MSGPACK_ESCAPE, 2)
+		default:
+			escaped = append(escaped, b)
+		}
+	}
+	return escaped
+}
+
+// Restore zero bytes replaced by escapeZeros.
+func unescapeZeros(escaped []byte) ([]byte, error) {
+	if bytes.IndexByte(escaped, MSGPACK_ESCAPE) == -1 {
+		return escaped, nil
+	}
+	data := make([]byte, 0, len(escaped))
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] != MSGPACK_ESCAPE {
+			data = append(data, escaped[i])
+		} else if i++; i < len(escaped) && escaped[i] == 1 {
+			data = append(data, 0)
+		} else if i < len(escaped) && escaped[i] == 2 {
+			data = append(data, MSGPACK_ESCAPE)
+		} else {
+			return nil, fmt.Errorf("MessagePack document has a malformed escape")
+		}
+	}
+	return data, nil
+}
+
+// Return a function that reads documents of a format as if they were read from the other format. JSON numbers are
+// told apart into integers and floats for the other format.
+func convertFormat(from, to DocFormat) func(data []byte) (map[string]interface{}, error) {
+	if from == to {
+		return from.Unmarshal
+	}
+	return func(data []byte) (doc map[string]interface{}, err error) {
+		if _, isJSON := from.(jsonFormat); isJSON {
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.UseNumber()
+			err = decoder.Decode(&doc)
+		} else {
+			doc, err = from.Unmarshal(data)
+		}
+		if err != nil {
+			return
+		}
+		converted, err := to.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		return to.Unmarshal(converted)
+	}
+}
+
+// Read document format from collection directory, documents are in JSON if there is no configuration.
+func (col *Col) loadFormat() (err error) {
+	col.formatName = FORMAT_JSON
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, FORMAT_CONF_FILE))
+	if err == nil {
+		col.formatName = strings.TrimSpace(string(content))
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	col.format, err = getFormat(col.formatName)
+	return
+}
+
+// Convert documents given to the function into JSON, for the functions that expect JSON regardless of document format.
+func (col *Col) asJSON(fun func(id int, doc []byte) bool) func(id int, doc []byte) bool {
+	if _, isJSON := col.format.(jsonFormat); isJSON {
+		return fun
+	}
+	return func(id int, doc []byte) bool {
+		docObj, err := col.format.Unmarshal(doc)
+		if err != nil {
+			// Skip corrupted document
+			return true
+		}
+		docJS, err := json.Marshal(docObj)
+		if err != nil {
+			return true
+		}
+		return fun(id, docJS)
+	}
+}
+
+// Convert all documents of a collection into the registered format. Like scrub, the collection is rebuilt and
+// unavailable in the meantime.
+func (db *DB) SetFormat(name, format string) error {
+	if _, err := getFormat(format); err != nil {
+		return err
+	}
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	if _, exists := db.cols[name]; !exists {
+		return fmt.Errorf("Collection %s does not exist", name)
+	}
+	if err := db.scrub(name, func(tmpColDir string) error {
+		return ioutil.WriteFile(path.Join(tmpColDir, FORMAT_CONF_FILE), []byte(format), 0600)
+	}); err != nil {
+		return err
+	}
+	db.cols[name].logConf(FORMAT_CONF_FILE)
+	return nil
+}
+
+// Return the document format of the collection.
+func (col *Col) GetFormat() string {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	return col.formatName
+}
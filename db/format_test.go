@@ -0,0 +1,238 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+func TestMsgpackFormat(t *testing.T) {
+	format := msgpackFormat{}
+	doc := map[string]interface{}{
+		"int": 32, "neg": -70000, "big": uint64(1 << 63), "float": 1.0, "str": "trailing ", "yes": true, "no": nil,
+		"list": []interface{}{1, "two", 3.5, []interface{}{}},
+		"map":  map[string]interface{}{"nested": map[string]interface{}{"deep": int64(-1)}},
+		"num":  json.Number("12"), "bin": []byte{0x20},
+	}
+	encoded, err := format.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Decode as read back from a collection, that is with padding
+	decoded, err := format.Unmarshal(append(encoded, "    "...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"int": int64(32), "neg": int64(-70000), "big": uint64(1 << 63), "float": 1.0, "str": "trailing ", "yes": true, "no": nil,
+		"list": []interface{}{int64(1), "two", 3.5, []interface{}{}},
+		"map":  map[string]interface{}{"nested": map[string]interface{}{"deep": int64(-1)}},
+		"num":  int64(12), "bin": []byte{0x20},
+	}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Fatal(decoded)
+	}
+	// Zero bytes are escaped
+	if zeros, err := format.Marshal(map[string]interface{}{"z": []interface{}{0, 0.0, "\x00\xc1"}}); err != nil {
+		t.Fatal(err)
+	} else if bytes.IndexByte(zeros, 0) != -1 {
+		t.Fatal(zeros)
+	} else if decoded, err = format.Unmarshal(zeros); err != nil || !reflect.DeepEqual(decoded["z"], []interface{}{int64(0), 0.0, "\x00\xc1"}) {
+		t.Fatal(decoded, err)
+	}
+	// Truncated documents are errors
+	if _, err = format.Unmarshal(encoded[:len(encoded)/2]); err == nil {
+		t.Fatal("Did not error")
+	}
+	// Values unknown to MessagePack go through JSON
+	type point struct{ X, Y int }
+	if encoded, err = format.Marshal(map[string]interface{}{"p": point{1, 2}}); err != nil {
+		t.Fatal(err)
+	} else if decoded, err = format.Unmarshal(encoded); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(decoded, map[string]interface{}{"p": map[string]interface{}{"X": int64(1), "Y": int64(2)}}) {
+		t.Fatal(decoded)
+	}
+}
+
+func TestColFormat(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if format := col.GetFormat(); format != FORMAT_JSON {
+		t.Fatal(format)
+	} else if db.SetFormat("col", "whatever") == nil || db.SetFormat("whatever", FORMAT_MSGPACK) == nil {
+		t.Fatal("Did not error")
+	}
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 10)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"a": i, "b": float64(i) + 0.5}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Migrate JSON documents
+	if err = db.SetFormat("col", FORMAT_MSGPACK); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if format := col.GetFormat(); format != FORMAT_MSGPACK {
+		t.Fatal(format)
+	}
+	// Integers stay integers after migration, because JSON documents are read back in numbers
+	readBack, err := col.Read(ids[3])
+	if err != nil {
+		t.Fatal(err)
+	} else if readBack["a"] != int64(3) || readBack["b"] != 3.5 {
+		t.Fatal(readBack)
+	}
+	newID, err := col.Insert(map[string]interface{}{"a": 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Index lookup
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": 32, "in": []interface{}{"a"}}, col, &result); err != nil {
+		t.Fatal(err)
+	} else if _, found := result[newID]; !found || len(result) != 1 {
+		t.Fatal(result)
+	}
+	// Update and unindex
+	if err = col.Update(newID, map[string]interface{}{"a": 33, "z": 32}); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.UpdateBytesFunc(ids[0], func(origDoc []byte) ([]byte, error) {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(origDoc, &doc); err != nil {
+			return nil, err
+		}
+		doc["c"] = true
+		return json.Marshal(doc)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	result = make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": 32, "in": []interface{}{"a"}}, col, &result); err != nil || len(result) != 0 {
+		t.Fatal(result, err)
+	}
+	// Iteration yields JSON
+	count := 0
+	col.ForEachDoc(func(id int, doc []byte) bool {
+		var docObj map[string]interface{}
+		if err := json.Unmarshal(doc, &docObj); err != nil {
+			t.Fatal(err)
+		} else if id == ids[0] && docObj["c"] != true {
+			t.Fatal(docObj)
+		}
+		count++
+		return true
+	})
+	if count != 11 {
+		t.Fatal(count)
+	}
+	// Documents ending with bytes alike padding survive compaction, even without room to spare
+	if err = col.SetRoomPolicy(data.ROOM_EXACT, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids[1:] {
+		if id%db.numParts == newID%db.numParts {
+			if err = col.Delete(id); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if compacted, err := col.Compact(0); err != nil || compacted == 0 {
+		t.Fatal(compacted, err)
+	} else if readBack, err = col.Read(newID); err != nil || readBack["z"] != int64(32) {
+		t.Fatal(readBack, err)
+	}
+	// Format persists
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if format := col.GetFormat(); format != FORMAT_MSGPACK {
+		t.Fatal(format)
+	} else if readBack, err = col.Read(ids[9]); err != nil || readBack["a"] != int64(9) || readBack["b"] != 9.5 {
+		t.Fatal(readBack, err)
+	}
+	// Back to JSON
+	if err = db.SetFormat("col", FORMAT_JSON); err != nil {
+		t.Fatal(err)
+	}
+	if readBack, err = db.Use("col").Read(ids[0]); err != nil || readBack["a"] != float64(0) || readBack["c"] != true {
+		t.Fatal(readBack, err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestColFormatZeros(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	} else if err = db.SetFormat("col", FORMAT_MSGPACK); err != nil {
+		t.Fatal(err)
+	} else if err = db.Use("col").SetRoomPolicy(data.ROOM_EXACT, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Long runs of zero integers, the large document goes into overflow file
+	ids := make([]int, 0, 2)
+	for _, size := range []int{4096, 1 << 20} {
+		zeros := make([]interface{}, size)
+		for i := range zeros {
+			zeros[i] = 0
+		}
+		id, err := db.Use("col").Insert(map[string]interface{}{"z": zeros})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	col := db.Use("col")
+	for i := 0; i < 2*db.numParts; i++ {
+		if _, err = col.Insert(map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, id := range ids {
+		if doc, err := col.Read(id); err != nil || len(doc["z"].([]interface{})) != []int{4096, 1 << 20}[i] {
+			t.Fatal(i, id, err)
+		}
+	}
+}
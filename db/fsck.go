@@ -0,0 +1,192 @@
+// Offline integrity check and repair of collections.
+
+package db
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+)
+
+const (
+	FSCK_CORRUPTED      = "corrupted"     // Record fails its checksum or has a corrupted header
+	FSCK_UNREADABLE     = "unreadable"    // Document cannot be read or parsed
+	FSCK_ORPHAN_LOOKUP  = "orphanLookup"  // ID lookup entry refers to no document
+	FSCK_UNREFERENCED   = "unreferenced"  // Document is not referred to by ID lookup, its space is wasted
+	FSCK_DANGLING_INDEX = "danglingIndex" // Index entry refers to a document that does not have the value
+	FSCK_MISSING_INDEX  = "missingIndex"  // Value of a document is missing from index
+)
+
+// A problem found by integrity check.
+type FsckProblem struct {
+	Collection string `json:"collection"`
+	Kind       string `json:"kind"`   // One of FSCK_* constants
+	File       string `json:"file"`   // Path of the data file
+	ID         int    `json:"id"`     // Document ID, or location in the file of corrupted records and unreferenced documents
+	Detail     string `json:"detail"` // Reason of corruption, or the hash of indexed value
+	Repaired   bool   `json:"repaired"`
+}
+
+// Result of integrity check.
+type FsckReport struct {
+	Collections  int           `json:"collections"`
+	Documents    int           `json:"documents"`
+	IndexEntries int           `json:"indexEntries"`
+	Problems     []FsckProblem `json:"problems"`
+}
+
+// An index entry - hash of indexed value and document ID.
+type fsckIndexEntry struct {
+	key, id int
+}
+
+// Check integrity of all collections in a database that is not in use: document headers and checksums, ID lookup
+// tables against documents, and index entries against documents. The database is opened read-only, unless repair is
+// true, in which case dangling index entries and orphan ID lookup entries are removed.
+func Fsck(dbPath string, keys KeyProvider, repair bool) (*FsckReport, error) {
+	db, err := openDB(dbPath, keys, !repair, SYNC_NONE)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	report := &FsckReport{Problems: make([]FsckProblem, 0)}
+	names := db.AllCols()
+	sort.Strings(names)
+	for _, name := range names {
+		report.Collections++
+		db.cols[name].fsck(report, repair)
+	}
+	if repair {
+		return report, db.Sync()
+	}
+	return report, nil
+}
+
+// Check integrity of all collections, return an error describing the first problem if there are any. The subject
+// names what is checked in the error message.
+func (db *DB) check(subject string) error {
+	report := &FsckReport{Problems: make([]FsckProblem, 0)}
+	for _, col := range db.cols {
+		col.fsck(report, false)
+	}
+	if len(report.Problems) == 0 {
+		return nil
+	}
+	problem := report.Problems[0]
+	return fmt.Errorf("%s has %d problems, the first is %s of %s in %s (%d): %s",
+		subject, len(report.Problems), problem.Kind, problem.Collection, problem.File, problem.ID, problem.Detail)
+}
+
+// Check integrity of the collection and put problems into the report.
+func (col *Col) fsck(report *FsckReport, repair bool) {
+	colDir := path.Join(col.db.path, col.name)
+	problem := func(kind, file string, id int, detail string, repaired bool) {
+		report.Problems = append(report.Problems, FsckProblem{col.name, kind, file, id, detail, repaired})
+	}
+	idxNames := make([]string, 0, len(col.indexPaths))
+	for idxName := range col.indexPaths {
+		idxNames = append(idxNames, idxName)
+	}
+	sort.Strings(idxNames)
+	// Index entries expected from readable documents, by index name and then by index partition
+	expected := make(map[string][]map[fsckIndexEntry]struct{})
+	for _, idxName := range idxNames {
+		expected[idxName] = make([]map[fsckIndexEntry]struct{}, col.numParts)
+		for i := range expected[idxName] {
+			expected[idxName][i] = make(map[fsckIndexEntry]struct{})
+		}
+	}
+	unreadable := make(map[int]struct{})
+	for i, part := range col.parts {
+		docFile := path.Join(colDir, DOC_DATA_FILE+strconv.Itoa(i))
+		lookupFile := path.Join(colDir, DOC_LOOKUP_FILE+strconv.Itoa(i))
+		part.DataLock.Lock()
+		for _, corrupt := range part.Verify() {
+			problem(FSCK_CORRUPTED, corrupt.File, corrupt.Offset, corrupt.Reason, false)
+		}
+		orphans, unreferenced := part.CheckLookup()
+		orphaned := make(map[int]struct{})
+		for _, orphan := range orphans {
+			if repair {
+				part.RemoveLookup(orphan.ID, orphan.PhysID)
+			}
+			orphaned[orphan.ID] = struct{}{}
+			problem(FSCK_ORPHAN_LOOKUP, lookupFile, orphan.ID, fmt.Sprintf("no document at %d", orphan.PhysID), repair)
+		}
+		for _, physID := range unreferenced {
+			problem(FSCK_UNREFERENCED, docFile, physID, "document is not referred to by ID lookup", false)
+		}
+		// Read every document once
+		checked := make(map[int]struct{})
+		for _, entry := range part.Lookups() {
+			if _, isOrphan := orphaned[entry.ID]; isOrphan {
+				continue
+			} else if _, isChecked := checked[entry.ID]; isChecked {
+				continue
+			}
+			checked[entry.ID] = struct{}{}
+			report.Documents++
+			docB, err := part.Read(entry.ID)
+			var doc map[string]interface{}
+			if err == nil {
+				doc, err = col.format.Unmarshal(docB)
+			}
+			if err != nil {
+				unreadable[entry.ID] = struct{}{}
+				problem(FSCK_UNREADABLE, docFile, entry.ID, err.Error(), false)
+				continue
+			}
+			for _, idxName := range idxNames {
+				for _, idxVal := range GetIn(doc, col.indexPaths[idxName]) {
+					if idxVal != nil {
+						hashKey := col.hash(fmt.Sprint(idxVal))
+						expected[idxName][hashKey%col.numParts][fsckIndexEntry{hashKey, entry.ID}] = struct{}{}
+					}
+				}
+			}
+		}
+		part.DataLock.Unlock()
+	}
+	// Cross-check index entries against documents
+	for _, idxName := range idxNames {
+		for i := 0; i < col.numParts; i++ {
+			idxFile := path.Join(colDir, idxName, strconv.Itoa(i))
+			ht := col.hts[i][idxName]
+			ht.Lock.Lock()
+			for _, corrupt := range ht.Verify() {
+				problem(FSCK_CORRUPTED, corrupt.File, corrupt.Offset, corrupt.Reason, false)
+			}
+			keys, ids := ht.GetPartition(0, 1)
+			found := make(map[fsckIndexEntry]struct{}, len(keys))
+			for j, key := range keys {
+				entry := fsckIndexEntry{key, ids[j]}
+				found[entry] = struct{}{}
+				report.IndexEntries++
+				if _, isExpected := expected[idxName][i][entry]; isExpected {
+					continue
+				} else if _, isUnreadable := unreadable[entry.id]; isUnreadable {
+					// There is no telling whether the document has the value
+					continue
+				}
+				if repair {
+					ht.Remove(entry.key, entry.id)
+				}
+				problem(FSCK_DANGLING_INDEX, idxFile, entry.id, fmt.Sprintf("value hash %d", entry.key), repair)
+			}
+			ht.Lock.Unlock()
+			missing := make([]fsckIndexEntry, 0)
+			for entry := range expected[idxName][i] {
+				if _, isFound := found[entry]; !isFound {
+					missing = append(missing, entry)
+				}
+			}
+			sort.Slice(missing, func(a, b int) bool {
+				return missing[a].id < missing[b].id || missing[a].id == missing[b].id && missing[a].key < missing[b].key
+			})
+			for _, entry := range missing {
+				problem(FSCK_MISSING_INDEX, idxFile, entry.id, fmt.Sprintf("value hash %d", entry.key), false)
+			}
+		}
+	}
+}
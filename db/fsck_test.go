@@ -0,0 +1,174 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+// Return content of every file under the directory.
+func snapshotFiles(t *testing.T, dir string) map[string][]byte {
+	files := make(map[string][]byte)
+	var walk func(dir string)
+	walk = func(dir string) {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			entryPath := path.Join(dir, entry.Name())
+			if entry.IsDir() {
+				walk(entryPath)
+			} else if files[entryPath], err = ioutil.ReadFile(entryPath); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	walk(dir)
+	return files
+}
+
+func TestFsck(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("empty"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 10)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	victim, err := col.Insert(map[string]interface{}{"a": "needle"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Clean database
+	report, err := Fsck(TEST_DATA_DIR, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if report.Collections != 2 || report.Documents != 11 || report.IndexEntries != 11 || len(report.Problems) != 0 {
+		t.Fatal(report)
+	}
+	// Damage the document on disk, then add an orphan lookup entry
+	dataFile := path.Join(TEST_DATA_DIR, "col", DOC_DATA_FILE+strconv.Itoa(victim%2))
+	content, err := ioutil.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	needle := bytes.Index(content, []byte("needle"))
+	if needle == -1 {
+		t.Fatal("Document is not found in data file")
+	}
+	content[needle] = 'N'
+	if err = ioutil.WriteFile(dataFile, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	lookupFile := path.Join(TEST_DATA_DIR, "col", DOC_LOOKUP_FILE+"0")
+	lookup, err := data.OpenHashTable(lookupFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup.Put(1000, 1<<30)
+	if err = lookup.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Checking without repair does not modify anything
+	before := snapshotFiles(t, TEST_DATA_DIR)
+	if report, err = Fsck(TEST_DATA_DIR, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if after := snapshotFiles(t, TEST_DATA_DIR); !reflect.DeepEqual(before, after) {
+		t.Fatal("Files are modified")
+	}
+	kinds := make(map[string]FsckProblem)
+	for _, problem := range report.Problems {
+		kinds[problem.Kind] = problem
+	}
+	if report.Documents != 11 || len(report.Problems) != 3 ||
+		kinds[FSCK_CORRUPTED].File != dataFile ||
+		kinds[FSCK_ORPHAN_LOOKUP].ID != 1000 || kinds[FSCK_ORPHAN_LOOKUP].Repaired ||
+		kinds[FSCK_UNREADABLE].ID != victim {
+		t.Fatal(report)
+	}
+	// Deleting the corrupted document leaves its index entry dangling, and the victim's value is no longer indexed
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if err = col.Delete(victim); err != nil {
+		t.Fatal(err)
+	}
+	missingKey := col.hash("0")
+	ht := col.hts[missingKey%db.numParts]["a"]
+	ht.Lock.Lock()
+	ht.Remove(missingKey, ids[0])
+	ht.Lock.Unlock()
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = Fsck(TEST_DATA_DIR, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	kinds = make(map[string]FsckProblem)
+	for _, problem := range report.Problems {
+		kinds[problem.Kind] = problem
+	}
+	if len(report.Problems) != 3 || report.Documents != 10 ||
+		!kinds[FSCK_ORPHAN_LOOKUP].Repaired || kinds[FSCK_ORPHAN_LOOKUP].ID != 1000 ||
+		!kinds[FSCK_DANGLING_INDEX].Repaired || kinds[FSCK_DANGLING_INDEX].ID != victim ||
+		kinds[FSCK_MISSING_INDEX].Repaired || kinds[FSCK_MISSING_INDEX].ID != ids[0] {
+		t.Fatal(report)
+	}
+	// Only the missing index entry remains
+	if report, err = Fsck(TEST_DATA_DIR, nil, false); err != nil {
+		t.Fatal(err)
+	} else if len(report.Problems) != 1 || report.Problems[0].Kind != FSCK_MISSING_INDEX {
+		t.Fatal(report)
+	}
+	// Reindexing fixes it
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Use("col").Unindex([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err = db.Use("col").Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = Fsck(TEST_DATA_DIR, nil, false); err != nil || len(report.Problems) != 0 || report.IndexEntries != 10 {
+		t.Fatal(report, err)
+	}
+	// Database must exist
+	if _, err = Fsck(path.Join(TEST_DATA_DIR, "whatever"), nil, false); err == nil {
+		t.Fatal("Did not error")
+	}
+}
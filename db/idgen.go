@@ -0,0 +1,222 @@
+// Document ID strategies - random, caller-supplied, monotonic, and time-ordered IDs.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	ID_CONF_FILE    = "id_strategy" // Name of document ID strategy configuration file.
+	ID_COUNTER_FILE = "id_counters" // Name of monotonic ID counter file.
+
+	ID_RANDOM    = "random"    // Random IDs (default)
+	ID_CALLER    = "caller"    // Caller supplies IDs to InsertWithID
+	ID_MONOTONIC = "monotonic" // IDs increase monotonically in every partition, and partitions take turns
+	ID_TIME      = "time"      // Snowflake-like IDs made of millisecond timestamp followed by sequence number
+
+	ID_COUNTER_RESERVE = 1000          // Monotonic counters are persisted once every so many IDs
+	ID_TIME_EPOCH      = 1577836800000 // Timestamp (milliseconds) of 2020-01-01T00:00:00Z, the epoch of time-ordered IDs
+	ID_TIME_SEQ_BITS   = 20            // Number of sequence bits following the timestamp of time-ordered IDs
+	ID_MAX_ATTEMPTS    = 10            // Give up generating a new ID after so many collisions
+)
+
+// Document ID generator of a collection.
+type idGen struct {
+	strategy string
+	lock     *sync.Mutex
+	next     []int // Monotonic: the next counter value of each partition
+	reserved []int // Monotonic: persisted counter ceiling of each partition
+	round    int   // Monotonic: the partition that takes the next ID
+	last     int   // Time-ordered: the last generated ID
+	seq      int   // Time-ordered: sequence number
+}
+
+// Read ID strategy and counters from collection directory.
+func (col *Col) loadIDGen() (*idGen, error) {
+	gen := &idGen{strategy: ID_RANDOM, lock: new(sync.Mutex)}
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, ID_CONF_FILE))
+	if err == nil {
+		gen.strategy = strings.TrimSpace(string(content))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	switch gen.strategy {
+	case ID_RANDOM, ID_CALLER, ID_TIME:
+	case ID_MONOTONIC:
+		if gen.reserved, err = col.loadIDCounters(); err != nil {
+			return nil, err
+		}
+		// Continue from the persisted ceilings, IDs reserved but not used before shutdown are skipped
+		gen.next = make([]int, len(gen.reserved))
+		copy(gen.next, gen.reserved)
+	default:
+		return nil, fmt.Errorf("Unknown ID strategy %s of collection %s", gen.strategy, col.name)
+	}
+	return gen, nil
+}
+
+// Read monotonic ID counters from collection directory, counters start from 0 if there is no counter file.
+func (col *Col) loadIDCounters() ([]int, error) {
+	counters := make([]int, col.numParts)
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, ID_COUNTER_FILE))
+	if os.IsNotExist(err) {
+		return counters, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, &counters); err != nil || len(counters) != col.numParts {
+		return nil, fmt.Errorf("ID counters of collection %s are corrupted", col.name)
+	}
+	return counters, nil
+}
+
+// Generate a new document ID according to the collection's ID strategy. Does not place schema lock.
+func (col *Col) nextID() (id int, err error) {
+	gen := col.ids
+	switch gen.strategy {
+	case ID_CALLER:
+		return 0, dberr.New(dberr.ErrorMissing, "document ID")
+	case ID_MONOTONIC:
+		gen.lock.Lock()
+		defer gen.lock.Unlock()
+		partNum := gen.round
+		gen.round = (gen.round + 1) % col.numParts
+		if gen.next[partNum] >= gen.reserved[partNum] {
+			// Persist a new ceiling before handing out IDs below it
+			reserved := make([]int, len(gen.reserved))
+			copy(reserved, gen.reserved)
+			reserved[partNum] = gen.next[partNum] + ID_COUNTER_RESERVE
+			content, err := json.Marshal(reserved)
+			if err != nil {
+				return 0, err
+			}
+			if err = ioutil.WriteFile(path.Join(col.db.path, col.name, ID_COUNTER_FILE), content, 0600); err != nil {
+				return 0, err
+			}
+			gen.reserved = reserved
+		}
+		id = gen.next[partNum]*col.numParts + partNum
+		gen.next[partNum]++
+		return id, nil
+	case ID_TIME:
+		gen.lock.Lock()
+		defer gen.lock.Unlock()
+		// The sequence number carries on across milliseconds, so that IDs spread evenly among partitions
+		gen.seq = (gen.seq + 1) & (1<<ID_TIME_SEQ_BITS - 1)
+		id = int(time.Now().UnixNano()/int64(time.Millisecond)-ID_TIME_EPOCH)<<ID_TIME_SEQ_BITS | gen.seq
+		if id <= gen.last {
+			id = gen.last + 1
+		}
+		gen.last = id
+		return id, nil
+	}
+	return rand.Int(), nil
+}
+
+// Put document data into the partition and remember its expiry time, unless the ID is already taken. Does not place
+// schema lock.
+func (col *Col) putDoc(id int, doc map[string]interface{}, docJS []byte) error {
+	part := col.parts[id%col.numParts]
+	part.DataLock.Lock()
+	defer part.DataLock.Unlock()
+	if _, err := part.Read(id); err == nil {
+		return dberr.New(dberr.ErrorDocExists, id)
+	}
+	if _, err := part.Insert(id, docJS); err != nil {
+		return err
+	}
+	col.logWrite(id, docJS)
+	col.expireDoc(id, doc)
+	return nil
+}
+
+// Change the strategy of generating IDs for new documents. Existing documents keep their IDs.
+func (col *Col) SetIDStrategy(strategy string) error {
+	switch strategy {
+	case ID_RANDOM, ID_CALLER, ID_MONOTONIC:
+	case ID_TIME:
+		if strconv.IntSize < 64 {
+			return fmt.Errorf("Time-ordered IDs require 64-bit integers")
+		}
+	default:
+		return fmt.Errorf("Unknown ID strategy %s, please use %s, %s, %s, or %s", strategy, ID_RANDOM, ID_CALLER, ID_MONOTONIC, ID_TIME)
+	}
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	if err := ioutil.WriteFile(path.Join(col.db.path, col.name, ID_CONF_FILE), []byte(strategy), 0600); err != nil {
+		return err
+	}
+	gen, err := col.loadIDGen()
+	if err != nil {
+		return err
+	}
+	col.ids = gen
+	col.logConf(ID_CONF_FILE)
+	return nil
+}
+
+// Return the strategy of generating IDs for new documents.
+func (col *Col) GetIDStrategy() string {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	return col.ids.strategy
+}
+
+// Insert a document with the caller-supplied ID, the ID must not be already taken.
+func (col *Col) InsertWithID(id int, doc map[string]interface{}) error {
+	if id < 0 {
+		return fmt.Errorf("Document ID may not be negative")
+	}
+	docJS, err := col.format.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err = col.validateDoc(doc); err != nil {
+		return err
+	} else if err = col.checkCapSize(docJS); err != nil {
+		return err
+	}
+	if err = col.putDoc(id, doc, docJS); err != nil {
+		return err
+	}
+	col.indexNewDoc(id, doc)
+	return nil
+}
+
+// Let monotonic IDs continue after the ID, for documents put into the collection with their own IDs. Caller must hold
+// exclusive schema lock.
+func (col *Col) continueIDs(maxID int) error {
+	if col.ids.strategy != ID_MONOTONIC {
+		return nil
+	}
+	counters := make([]int, col.numParts)
+	for i := range counters {
+		counters[i] = maxID/col.numParts + 1
+	}
+	content, err := json.Marshal(counters)
+	if err != nil {
+		return err
+	} else if err = ioutil.WriteFile(path.Join(col.db.path, col.name, ID_COUNTER_FILE), content, 0600); err != nil {
+		return err
+	}
+	gen, err := col.loadIDGen()
+	if err != nil {
+		return err
+	}
+	col.ids = gen
+	return nil
+}
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestIDStrategies(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if strategy := col.GetIDStrategy(); strategy != ID_RANDOM {
+		t.Fatal(strategy)
+	}
+	if col.SetIDStrategy("whatever") == nil {
+		t.Fatal("Did not error")
+	}
+	// Caller-supplied IDs
+	if err = col.SetIDStrategy(ID_CALLER); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = col.Insert(map[string]interface{}{}); dberr.Type(err) != dberr.ErrorMissing {
+		t.Fatal(err)
+	}
+	if err = col.InsertWithID(123, map[string]interface{}{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.InsertWithID(123, map[string]interface{}{"a": 2}); dberr.Type(err) != dberr.ErrorDocExists {
+		t.Fatal(err)
+	}
+	if doc, err := col.Read(123); err != nil || doc["a"].(float64) != 1 {
+		t.Fatal(doc, err)
+	}
+	// Monotonic IDs are evenly distributed and continue after reopening
+	if err = col.SetIDStrategy(ID_MONOTONIC); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 0)
+	perPart := make([]int, 2)
+	for i := 0; i < 10; i++ {
+		id, err := col.Insert(map[string]interface{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		perPart[id%2]++
+	}
+	if perPart[0] != 5 || perPart[1] != 5 {
+		t.Fatal(perPart)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if strategy := col.GetIDStrategy(); strategy != ID_MONOTONIC {
+		t.Fatal(strategy)
+	}
+	id, err := col.Insert(map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prev := range ids {
+		if prev%2 == id%2 && prev >= id {
+			t.Fatal(prev, id)
+		}
+	}
+	// Time-ordered IDs keep increasing and are evenly distributed
+	if err = col.SetIDStrategy(ID_TIME); err != nil {
+		t.Fatal(err)
+	}
+	ids = ids[:0]
+	perPart = make([]int, 2)
+	for i := 0; i < 10; i++ {
+		id, err := col.Insert(map[string]interface{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		perPart[id%2]++
+	}
+	if !sort.IntsAreSorted(ids) {
+		t.Fatal(ids)
+	}
+	if perPart[0] != 5 || perPart[1] != 5 {
+		t.Fatal(perPart)
+	}
+	// Strategy survives scrubbing
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	if strategy := db.Use("col").GetIDStrategy(); strategy != ID_TIME {
+		t.Fatal(strategy)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,307 @@
+// MessagePack document encoding.
+//
+// Integers and floating point numbers are encoded as different MessagePack
+// types, and they decode into int64 and float64 respectively.
+
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Append MessagePack encoding of the value.
+func appendMsgpack(buf []byte, val interface{}) ([]byte, error) {
+	switch v := val.(type) {
+	case nil:
+		return append(buf, 0xc0), nil
+	case bool:
+		if v {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case int:
+		return appendMsgpackInt(buf, int64(v)), nil
+	case int8:
+		return appendMsgpackInt(buf, int64(v)), nil
+	case int16:
+		return appendMsgpackInt(buf, int64(v)), nil
+	case int32:
+		return appendMsgpackInt(buf, int64(v)), nil
+	case int64:
+		return appendMsgpackInt(buf, v), nil
+	case uint:
+		return appendMsgpackUint(buf, uint64(v)), nil
+	case uint8:
+		return appendMsgpackUint(buf, uint64(v)), nil
+	case uint16:
+		return appendMsgpackUint(buf, uint64(v)), nil
+	case uint32:
+		return appendMsgpackUint(buf, uint64(v)), nil
+	case uint64:
+		return appendMsgpackUint(buf, v), nil
+	case float32:
+		buf = append(buf, 0xca, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buf[len(buf)-4:], math.Float32bits(v))
+		return buf, nil
+	case float64:
+		buf = append(buf, 0xcb, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[len(buf)-8:], math.Float64bits(v))
+		return buf, nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return appendMsgpackInt(buf, i), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return appendMsgpack(buf, f)
+	case string:
+		buf = appendMsgpackLen(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		return append(buf, v...), nil
+	case []byte:
+		buf = appendMsgpackLen(buf, len(v), 0, 0, 0xc4, 0xc5, 0xc6)
+		return append(buf, v...), nil
+	case []interface{}:
+		buf = appendMsgpackLen(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		var err error
+		for _, elem := range v {
+			if buf, err = appendMsgpack(buf, elem); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]interface{}:
+		buf = appendMsgpackLen(buf, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		// Sort keys so that the same document always has the same encoding
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var err error
+		for _, key := range keys {
+			if buf, err = appendMsgpack(buf, key); err != nil {
+				return nil, err
+			} else if buf, err = appendMsgpack(buf, v[key]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	// Other types (structs, typed slices and maps) are converted the way JSON sees them
+	content, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(content)))
+	decoder.UseNumber()
+	var generic interface{}
+	if err = decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return appendMsgpack(buf, generic)
+}
+
+// Append a signed integer in the most compact encoding.
+func appendMsgpackInt(buf []byte, v int64) []byte {
+	switch {
+	case v >= 0:
+		return appendMsgpackUint(buf, uint64(v))
+	case v >= -32:
+		return append(buf, byte(v))
+	case v >= math.MinInt8:
+		return append(buf, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		return append(buf, 0xd1, byte(v>>8), byte(v))
+	case v >= math.MinInt32:
+		return append(buf, 0xd2, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	buf = append(buf, 0xd3, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(buf[len(buf)-8:], uint64(v))
+	return buf
+}
+
+// Append an unsigned integer in the most compact encoding.
+func appendMsgpackUint(buf []byte, v uint64) []byte {
+	switch {
+	case v < 128:
+		return append(buf, byte(v))
+	case v <= math.MaxUint8:
+		return append(buf, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		return append(buf, 0xcd, byte(v>>8), byte(v))
+	case v <= math.MaxUint32:
+		return append(buf, 0xce, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	buf = append(buf, 0xcf, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(buf[len(buf)-8:], v)
+	return buf
+}
+
+// Append the header of a string, binary, array, or map of the length. Fix type is used if the length is below fixMax.
+func appendMsgpackLen(buf []byte, length int, fix byte, fixMax int, type8, type16, type32 byte) []byte {
+	switch {
+	case length < fixMax:
+		return append(buf, fix|byte(length))
+	case type8 != 0 && length <= math.MaxUint8:
+		return append(buf, type8, byte(length))
+	case length <= math.MaxUint16:
+		return append(buf, type16, byte(length>>8), byte(length))
+	}
+	return append(buf, type32, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+}
+
+// Decode MessagePack values one after another.
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+// Consume the next n bytes.
+func (dec *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || dec.pos+n > len(dec.data) {
+		return nil, fmt.Errorf("MessagePack data is truncated")
+	}
+	dec.pos += n
+	return dec.data[dec.pos-n : dec.pos], nil
+}
+
+// Consume a big endian unsigned integer of n bytes.
+func (dec *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := dec.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// Decode the next value.
+func (dec *msgpackDecoder) value() (interface{}, error) {
+	head, err := dec.next(1)
+	if err != nil {
+		return nil, err
+	}
+	switch c := head[0]; {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return dec.mapOf(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return dec.arrayOf(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return dec.str(int(c & 0x1f))
+	case c == 0xc0:
+		return nil, nil
+	case c == 0xc2:
+		return false, nil
+	case c == 0xc3:
+		return true, nil
+	case c == 0xc4 || c == 0xc5 || c == 0xc6:
+		length, err := dec.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := dec.next(int(length))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, b...), nil
+	case c == 0xca:
+		bits, err := dec.uint(4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case c == 0xcb:
+		bits, err := dec.uint(8)
+		return math.Float64frombits(bits), err
+	case c >= 0xcc && c <= 0xcf:
+		v, err := dec.uint(1 << (c - 0xcc))
+		if err == nil && v > math.MaxInt64 {
+			return v, nil
+		}
+		return int64(v), err
+	case c >= 0xd0 && c <= 0xd3:
+		size := 1 << (c - 0xd0)
+		v, err := dec.uint(size)
+		// Sign-extend
+		shift := uint(64 - 8*size)
+		return int64(v<<shift) >> shift, err
+	case c == 0xd9 || c == 0xda || c == 0xdb:
+		length, err := dec.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return dec.str(int(length))
+	case c == 0xdc || c == 0xdd:
+		length, err := dec.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return dec.arrayOf(int(length))
+	case c == 0xde || c == 0xdf:
+		length, err := dec.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return dec.mapOf(int(length))
+	}
+	return nil, fmt.Errorf("Unsupported MessagePack type 0x%x", head[0])
+}
+
+// Decode a string of the length.
+func (dec *msgpackDecoder) str(length int) (interface{}, error) {
+	b, err := dec.next(length)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Decode an array of the length.
+func (dec *msgpackDecoder) arrayOf(length int) (interface{}, error) {
+	if length > len(dec.data)-dec.pos {
+		return nil, fmt.Errorf("MessagePack data is truncated")
+	}
+	arr := make([]interface{}, length)
+	for i := range arr {
+		var err error
+		if arr[i], err = dec.value(); err != nil {
+			return nil, err
+		}
+	}
+	return arr, nil
+}
+
+// Decode a map of the length, keys are converted to strings.
+func (dec *msgpackDecoder) mapOf(length int) (interface{}, error) {
+	if length > len(dec.data)-dec.pos {
+		return nil, fmt.Errorf("MessagePack data is truncated")
+	}
+	obj := make(map[string]interface{}, length)
+	for i := 0; i < length; i++ {
+		key, err := dec.value()
+		if err != nil {
+			return nil, err
+		}
+		val, err := dec.value()
+		if err != nil {
+			return nil, err
+		}
+		if keyStr, ok := key.(string); ok {
+			obj[keyStr] = val
+		} else {
+			obj[fmt.Sprint(key)] = val
+		}
+	}
+	return obj, nil
+}
@@ -0,0 +1,361 @@
+// Partial document update - patch operators and JSON merge patch.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	PATCH_PATH_SEP = "." // Separator between attribute names in patch operator paths.
+)
+
+// Walk down the path (except the last segment) and return the container (object or array) of the last segment.
+// When create is true, missing objects along the path are created.
+func patchContainer(doc map[string]interface{}, segs []string, create bool) (container interface{}, err error) {
+	container = doc
+	for i, seg := range segs[:len(segs)-1] {
+		var next interface{}
+		switch c := container.(type) {
+		case map[string]interface{}:
+			next = c[seg]
+			if next == nil {
+				if !create {
+					return nil, nil
+				}
+				next = make(map[string]interface{})
+				c[seg] = next
+			}
+		case []interface{}:
+			index, convErr := strconv.Atoi(seg)
+			if convErr != nil || index < 0 || index >= len(c) {
+				return nil, dberr.New(dberr.ErrorBadPatch, fmt.Sprintf("%s is not an index of array %s", seg, strings.Join(segs[:i], PATCH_PATH_SEP)))
+			}
+			next = c[index]
+		default:
+			return nil, dberr.New(dberr.ErrorBadPatch, fmt.Sprintf("%s is neither an object nor an array", strings.Join(segs[:i], PATCH_PATH_SEP)))
+		}
+		container = next
+	}
+	switch container.(type) {
+	case map[string]interface{}, []interface{}:
+		return container, nil
+	}
+	return nil, dberr.New(dberr.ErrorBadPatch, fmt.Sprintf("%s is neither an object nor an array", strings.Join(segs[:len(segs)-1], PATCH_PATH_SEP)))
+}
+
+// Return the value on the path, or nil if there is nothing.
+func patchGet(doc map[string]interface{}, segs []string) (interface{}, error) {
+	container, err := patchContainer(doc, segs, false)
+	if err != nil || container == nil {
+		return nil, err
+	}
+	last := segs[len(segs)-1]
+	switch c := container.(type) {
+	case map[string]interface{}:
+		return c[last], nil
+	case []interface{}:
+		if index, err := strconv.Atoi(last); err == nil && index >= 0 && index < len(c) {
+			return c[index], nil
+		}
+	}
+	return nil, nil
+}
+
+// Put the value on the path, create missing objects along the path.
+func patchSet(doc map[string]interface{}, segs []string, val interface{}) error {
+	container, err := patchContainer(doc, segs, true)
+	if err != nil {
+		return err
+	}
+	last := segs[len(segs)-1]
+	switch c := container.(type) {
+	case map[string]interface{}:
+		c[last] = val
+	case []interface{}:
+		index, err := strconv.Atoi(last)
+		if err != nil || index < 0 || index >= len(c) {
+			return dberr.New(dberr.ErrorBadPatch, fmt.Sprintf("%s is not an index of array %s", last, strings.Join(segs[:len(segs)-1], PATCH_PATH_SEP)))
+		}
+		c[index] = val
+	}
+	return nil
+}
+
+// Remove the attribute on the path.
+func patchUnset(doc map[string]interface{}, segs []string) error {
+	container, err := patchContainer(doc, segs, false)
+	if err != nil || container == nil {
+		return err
+	}
+	if obj, ok := container.(map[string]interface{}); ok {
+		delete(obj, segs[len(segs)-1])
+		return nil
+	}
+	return dberr.New(dberr.ErrorBadPatch, fmt.Sprintf("cannot unset array element %s", strings.Join(segs, PATCH_PATH_SEP)))
+}
+
+// Convert a number of any kind to float64.
+func patchNumber(val interface{}) (float64, bool) {
+	if num, ok := normalizeJSON(val).(float64); ok {
+		return num, true
+	}
+	return 0, false
+}
+
+// Convert an integer of any kind to int64, floats and integers beyond int64 are not.
+func patchInteger(val interface{}) (int64, bool) {
+	if num, ok := val.(json.Number); ok {
+		i, err := num.Int64()
+		return i, err == nil
+	}
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), rv.Uint() <= math.MaxInt64
+	}
+	return 0, false
+}
+
+// Apply patch operators to the document. Supported operators are:
+// $set - {"$set": {"a.b": value}} sets attribute value, missing objects along the path are created.
+// $unset - {"$unset": {"a.b": ""}} removes an attribute.
+// $inc - {"$inc": {"a.b": number}} increases a number, a missing attribute is treated as 0; integers stay integers.
+// $push - {"$push": {"a.b": value}} appends a value to an array, or {"$push": {"a.b": {"$each": [values]}}} appends several.
+// $pull - {"$pull": {"a.b": value}} removes all elements equal to the value from an array.
+func ApplyPatch(doc map[string]interface{}, ops map[string]interface{}) error {
+	// Apply operators in a fixed order
+	for _, op := range []string{"$set", "$unset", "$inc", "$push", "$pull"} {
+		opArgs, exists := ops[op]
+		if !exists {
+			continue
+		}
+		args, ok := opArgs.(map[string]interface{})
+		if !ok {
+			return dberr.New(dberr.ErrorBadPatch, fmt.Sprintf("%s expects an object of paths and values, but %v given", op, opArgs))
+		}
+		for attrPath, arg := range args {
+			segs := strings.Split(attrPath, PATCH_PATH_SEP)
+			var err error
+			switch op {
+			case "$set":
+				err = patchSet(doc, segs, arg)
+			case "$unset":
+				err = patchUnset(doc, segs)
+			case "$inc":
+				err = patchInc(doc, segs, arg)
+			case "$push":
+				err = patchPush(doc, segs, arg)
+			case "$pull":
+				err = patchPull(doc, segs, arg)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for op := range ops {
+		switch op {
+		case "$set", "$unset", "$inc", "$push", "$pull":
+		default:
+			return dberr.New(dberr.ErrorBadPatch, fmt.Sprintf("unknown operator %s", op))
+		}
+	}
+	return nil
+}
+
+func patchInc(doc map[string]interface{}, segs []string, arg interface{}) error {
+	delta, ok := patchNumber(arg)
+	if !ok {
+		return dberr.New(dberr.ErrorBadPatch, fmt.Sprintf("$inc expects a number, but %v given", arg))
+	}
+	current, err := patchGet(doc, segs)
+	if err != nil {
+		return err
+	}
+	intDelta, isInt := patchInteger(arg)
+	if current == nil {
+		if isInt {
+			return patchSet(doc, segs, intDelta)
+		}
+		return patchSet(doc, segs, delta)
+	}
+	num, ok := patchNumber(current)
+	if !ok {
+		return dberr.New(dberr.ErrorBadPatch, fmt.Sprintf("%s is not a number", strings.Join(segs, PATCH_PATH_SEP)))
+	}
+	// Integers stay integers (e.g. in MessagePack documents), unless the sum overflows
+	if intCurrent, ok := patchInteger(current); ok && isInt {
+		if sum := intCurrent + intDelta; (sum > intCurrent) == (intDelta > 0) {
+			return patchSet(doc, segs, sum)
+		}
+	}
+	return patchSet(doc, segs, num+delta)
+}
+
+func patchPush(doc map[string]interface{}, segs []string, arg interface{}) error {
+	elems := []interface{}{arg}
+	if argObj, ok := arg.(map[string]interface{}); ok {
+		if each, exists := argObj["$each"]; exists {
+			if elems, ok = each.([]interface{}); !ok {
+				return dberr.New(dberr.ErrorBadPatch, fmt.Sprintf("$each expects an array, but %v given", each))
+			}
+		}
+	}
+	current, err := patchGet(doc, segs)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return patchSet(doc, segs, elems)
+	}
+	arr, ok := current.([]interface{})
+	if !ok {
+		return dberr.New(dberr.ErrorBadPatch, fmt.Sprintf("%s is not an array", strings.Join(segs, PATCH_PATH_SEP)))
+	}
+	return patchSet(doc, segs, append(arr, elems...))
+}
+
+func patchPull(doc map[string]interface{}, segs []string, arg interface{}) error {
+	current, err := patchGet(doc, segs)
+	if err != nil || current == nil {
+		return err
+	}
+	arr, ok := current.([]interface{})
+	if !ok {
+		return dberr.New(dberr.ErrorBadPatch, fmt.Sprintf("%s is not an array", strings.Join(segs, PATCH_PATH_SEP)))
+	}
+	remove := normalizeJSON(arg)
+	kept := make([]interface{}, 0, len(arr))
+	for _, elem := range arr {
+		if !reflect.DeepEqual(normalizeJSON(elem), remove) {
+			kept = append(kept, elem)
+		}
+	}
+	return patchSet(doc, segs, kept)
+}
+
+// Apply JSON merge patch (RFC 7396) to the document.
+func ApplyMergePatch(doc map[string]interface{}, patch map[string]interface{}) {
+	for key, val := range patch {
+		if val == nil {
+			delete(doc, key)
+		} else if valObj, ok := val.(map[string]interface{}); ok {
+			target, ok := doc[key].(map[string]interface{})
+			if !ok {
+				target = make(map[string]interface{})
+			}
+			ApplyMergePatch(target, valObj)
+			doc[key] = target
+		} else {
+			doc[key] = val
+		}
+	}
+}
+
+// Maintain index entries of the paths on which the original and the new document differ.
+func (col *Col) reindexChanged(id int, original, doc map[string]interface{}) {
+	valSet := func(doc map[string]interface{}, idxPath []string) map[string]struct{} {
+		set := make(map[string]struct{})
+		for _, idxVal := range GetIn(doc, idxPath) {
+			if idxVal != nil {
+				set[fmt.Sprint(idxVal)] = struct{}{}
+			}
+		}
+		return set
+	}
+	for idxName, idxPath := range col.indexPaths {
+		oldVals, newVals := valSet(original, idxPath), valSet(doc, idxPath)
+		for val := range oldVals {
+			if _, stays := newVals[val]; !stays {
+				hashKey := col.hash(val)
+				ht := col.hts[hashKey%col.numParts][idxName]
+				ht.Lock.Lock()
+				ht.Remove(hashKey, id)
+				ht.Lock.Unlock()
+			}
+		}
+		for val := range newVals {
+			if _, existed := oldVals[val]; !existed {
+				hashKey := col.hash(val)
+				ht := col.hts[hashKey%col.numParts][idxName]
+				ht.Lock.Lock()
+				ht.Put(hashKey, id)
+				ht.Lock.Unlock()
+			}
+		}
+	}
+}
+
+// Atomically read a document, modify it with the function, write it back, and reindex the changed paths.
+// The document is exclusively locked for the entire duration. Does not place schema lock.
+func (col *Col) patch(id int, modify func(doc map[string]interface{}) error) error {
+	part := col.parts[id%col.numParts]
+	part.LockUpdate(id)
+	defer part.UnlockUpdate(id)
+
+	part.DataLock.Lock()
+	originalB, err := part.Read(id)
+	if err != nil {
+		part.DataLock.Unlock()
+		return err
+	}
+	original, err := col.format.Unmarshal(originalB)
+	if err != nil {
+		part.DataLock.Unlock()
+		return err
+	}
+	doc, _ := col.format.Unmarshal(originalB)
+	if err = modify(doc); err != nil {
+		part.DataLock.Unlock()
+		return err
+	}
+	if err = col.validateDoc(doc); err != nil {
+		part.DataLock.Unlock()
+		return err
+	}
+	docJS, err := col.format.Marshal(doc)
+	if err != nil {
+		part.DataLock.Unlock()
+		return err
+	}
+	err = part.Update(id, docJS)
+	if err == nil {
+		col.logWrite(id, docJS)
+		col.expireDoc(id, doc)
+	}
+	part.DataLock.Unlock()
+	if err != nil {
+		return err
+	}
+	col.reindexChanged(id, original, doc)
+	return nil
+}
+
+// Atomically modify a document using patch operators ($set, $unset, $inc, $push, $pull), see ApplyPatch for details.
+func (col *Col) Patch(id int, ops map[string]interface{}) error {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	return col.patch(id, func(doc map[string]interface{}) error {
+		return ApplyPatch(doc, ops)
+	})
+}
+
+// Atomically modify a document using JSON merge patch (RFC 7396).
+func (col *Col) MergePatch(id int, patch map[string]interface{}) error {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	return col.patch(id, func(doc map[string]interface{}) error {
+		ApplyMergePatch(doc, patch)
+		return nil
+	})
+}
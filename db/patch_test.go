@@ -0,0 +1,162 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestApplyPatch(t *testing.T) {
+	var doc, ops, expected map[string]interface{}
+	json.Unmarshal([]byte(`{"a": {"b": 1}, "n": 1, "arr": [1, 2, 1, {"x": 1}], "gone": true}`), &doc)
+	json.Unmarshal([]byte(`{
+		"$set": {"a.c.d": "new", "arr.3.x": 2},
+		"$unset": {"gone": "", "nothing.here": ""},
+		"$inc": {"n": 2.5, "m": -1},
+		"$push": {"list": "a", "a.more": {"$each": [1, 2]}},
+		"$pull": {"arr": 1}
+	}`), &ops)
+	json.Unmarshal([]byte(`{"a": {"b": 1, "c": {"d": "new"}, "more": [1, 2]}, "n": 3.5, "m": -1, "arr": [2, {"x": 2}], "list": ["a"]}`), &expected)
+	if err := ApplyPatch(doc, ops); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Fatal(doc)
+	}
+	for _, bad := range []string{
+		`{"$rename": {"a": "b"}}`,
+		`{"$set": 1}`,
+		`{"$inc": {"a": 1}}`,
+		`{"$inc": {"n": "1"}}`,
+		`{"$push": {"n": 1}}`,
+		`{"$set": {"n.x": 1}}`,
+		`{"$set": {"arr.9": 1}}`,
+	} {
+		json.Unmarshal([]byte(bad), &ops)
+		if err := ApplyPatch(doc, ops); dberr.Type(err) != dberr.ErrorBadPatch {
+			t.Fatal(bad, err)
+		}
+	}
+}
+
+func TestApplyMergePatch(t *testing.T) {
+	var doc, patch, expected map[string]interface{}
+	json.Unmarshal([]byte(`{"a": "b", "c": {"d": "e", "f": "g"}, "h": [1]}`), &doc)
+	json.Unmarshal([]byte(`{"a": "z", "c": {"f": null}, "h": {"i": 1}, "j": null}`), &patch)
+	json.Unmarshal([]byte(`{"a": "z", "c": {"d": "e"}, "h": {"i": 1}}`), &expected)
+	ApplyMergePatch(doc, patch)
+	if !reflect.DeepEqual(doc, expected) {
+		t.Fatal(doc)
+	}
+}
+
+func TestColPatch(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.Index([]string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"a": 1, "b": 1, "n": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Operators
+	if err = col.Patch(id, map[string]interface{}{
+		"$set": map[string]interface{}{"a": 2},
+		"$inc": map[string]interface{}{"n": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := col.Read(id); err != nil || doc["a"].(float64) != 2 || doc["b"].(float64) != 1 || doc["n"].(float64) != 1 {
+		t.Fatal(doc, err)
+	}
+	if vals := col.hashScan("a", StrHash("1"), 0); len(vals) != 0 {
+		t.Fatal(vals)
+	}
+	if vals := col.hashScan("a", StrHash("2"), 0); len(vals) != 1 || vals[0] != id {
+		t.Fatal(vals)
+	}
+	if vals := col.hashScan("b", StrHash("1"), 0); len(vals) != 1 || vals[0] != id {
+		t.Fatal(vals)
+	}
+	// Merge patch
+	if err = col.MergePatch(id, map[string]interface{}{"b": nil, "c": "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := col.Read(id); err != nil || doc["b"] != nil || doc["c"] != "new" || doc["a"].(float64) != 2 {
+		t.Fatal(doc, err)
+	}
+	if vals := col.hashScan("b", StrHash("1"), 0); len(vals) != 0 {
+		t.Fatal(vals)
+	}
+	// Errors leave the document untouched
+	if err = col.Patch(id, map[string]interface{}{"$inc": map[string]interface{}{"c": 1}}); dberr.Type(err) != dberr.ErrorBadPatch {
+		t.Fatal(err)
+	}
+	if err = col.Patch(id+1, map[string]interface{}{"$set": map[string]interface{}{"a": 1}}); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	if err = col.SetSchema(map[string]interface{}{"required": []interface{}{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.MergePatch(id, map[string]interface{}{"a": nil}); dberr.Type(err) != dberr.ErrorSchemaViolation {
+		t.Fatal(err)
+	}
+	if doc, err := col.Read(id); err != nil || doc["a"].(float64) != 2 || doc["c"] != "new" {
+		t.Fatal(doc, err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestColPatchInteger(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	} else if err = db.SetFormat("col", FORMAT_MSGPACK); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	id, err := col.Insert(map[string]interface{}{"n": 1<<53 + 1, "f": 1.5, "max": math.MaxInt64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Integers stay integers through MessagePack, beyond the precision of float64
+	if err = col.Patch(id, map[string]interface{}{"$inc": map[string]interface{}{
+		"n": 1, "f": 1, "m": json.Number("-2"), "max": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := col.Read(id)
+	if err != nil || doc["n"] != int64(1<<53+2) || doc["f"] != 2.5 || doc["m"] != int64(-2) || doc["max"] != float64(math.MaxInt64)+1 {
+		t.Fatal(doc, err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/HouzuoGuo/tiedot/dberr"
 	"github.com/HouzuoGuo/tiedot/tdlog"
@@ -58,12 +59,12 @@ func Lookup(lookupValue interface{}, expr map[string]interface{}, src *Col, resu
 		}
 	}
 	lookupStrValue := fmt.Sprint(lookupValue) // the value to look for
-	lookupValueHash := StrHash(lookupStrValue)
+	lookupValueHash := src.hash(lookupStrValue)
 	scanPath := strings.Join(vecPath, INDEX_PATH_SEP)
 	if _, indexed := src.indexPaths[scanPath]; !indexed {
 		return dberr.New(dberr.ErrorNeedIndex, scanPath, expr)
 	}
-	num := lookupValueHash % src.db.numParts
+	num := lookupValueHash % src.numParts
 	ht := src.hts[num][scanPath]
 	ht.Lock.RLock()
 	vals := ht.Get(lookupValueHash, intLimit)
@@ -108,16 +109,21 @@ func PathExistence(hasPath interface{}, expr map[string]interface{}, src *Col, r
 		return dberr.New(dberr.ErrorNeedIndex, vecPath, expr)
 	}
 	counter := 0
-	partDiv := src.approxDocCount(false) / src.db.numParts / 4000 // collect approx. 4k document IDs in each iteration
+	now := time.Now().Unix()
+	partDiv := src.approxDocCount(false) / src.numParts / 4000 // collect approx. 4k document IDs in each iteration
 	if partDiv == 0 {
 		partDiv++
 	}
-	for iteratePart := 0; iteratePart < src.db.numParts; iteratePart++ {
+	for iteratePart := 0; iteratePart < src.numParts; iteratePart++ {
 		ht := src.hts[iteratePart][jointPath]
 		ht.Lock.RLock()
 		for i := 0; i < partDiv; i++ {
 			_, ids := ht.GetPartition(i, partDiv)
 			for _, id := range ids {
+				if src.expired(id, now) {
+					// Expired but not yet deleted by the sweeper
+					continue
+				}
 				(*result)[id] = struct{}{}
 				counter++
 				if counter == intLimit {
@@ -195,7 +201,7 @@ func Complement(subExprs interface{}, src *Col, result *map[int]struct{}) (err e
 }
 
 func (col *Col) hashScan(idxName string, key, limit int) []int {
-	ht := col.hts[key%col.db.numParts][idxName]
+	ht := col.hts[key%col.numParts][idxName]
 	ht.Lock.RLock()
 	vals := ht.Get(key, limit)
 	ht.Lock.RUnlock()
@@ -260,6 +266,7 @@ func IntRange(intFrom interface{}, expr map[string]interface{}, src *Col, result
 		tdlog.CritNoRepeat("Query %v involves index lookup on more than 1000 values, which can be very inefficient", expr)
 	}
 	counter := int(0) // Number of results already collected
+	now := time.Now().Unix()
 	htPath := strings.Join(vecPath, ",")
 	if _, indexScan := src.indexPaths[htPath]; !indexScan {
 		return dberr.New(dberr.ErrorNeedIndex, vecPath, expr)
@@ -268,11 +275,13 @@ func IntRange(intFrom interface{}, expr map[string]interface{}, src *Col, result
 		// Forward scan - from low value to high value
 		for lookupValue := from; lookupValue <= to; lookupValue++ {
 			lookupStrValue := fmt.Sprint(float64(lookupValue))
-			hashValue := StrHash(lookupStrValue)
+			hashValue := src.hash(lookupStrValue)
 			vals := src.hashScan(htPath, hashValue, int(intLimit))
 			for _, docID := range vals {
 				if intLimit > 0 && counter == intLimit {
 					break
+				} else if src.expired(docID, now) {
+					continue
 				}
 				counter++
 				(*result)[docID] = struct{}{}
@@ -282,11 +291,13 @@ func IntRange(intFrom interface{}, expr map[string]interface{}, src *Col, result
 		// Backward scan - from high value to low value
 		for lookupValue := from; lookupValue >= to; lookupValue-- {
 			lookupStrValue := fmt.Sprint(float64(lookupValue))
-			hashValue := StrHash(lookupStrValue)
+			hashValue := src.hash(lookupStrValue)
 			vals := src.hashScan(htPath, hashValue, int(intLimit))
 			for _, docID := range vals {
 				if intLimit > 0 && counter == intLimit {
 					break
+				} else if src.expired(docID, now) {
+					continue
 				}
 				counter++
 				(*result)[docID] = struct{}{}
@@ -313,7 +324,9 @@ func evalQuery(q interface{}, src *Col, result *map[int]struct{}, placeSchemaLoc
 		if err != nil {
 			return dberr.New(dberr.ErrorExpectingInt, "Single Document ID", docID)
 		}
-		(*result)[int(docID)] = struct{}{}
+		if !src.expired(int(docID), time.Now().Unix()) {
+			(*result)[int(docID)] = struct{}{}
+		}
 	case map[string]interface{}:
 		if lookupValue, lookup := expr["eq"]; lookup { // eq - lookup
 			return Lookup(lookupValue, expr, src, result)
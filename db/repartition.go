@@ -0,0 +1,134 @@
+// Change the number of partitions of a database.
+
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+// Redistribute documents, index entries and expiry times of a database that is not in use among the number of
+// partitions; documents keep their IDs. The database must pass integrity check. The new database is put together and
+// checked in a temporary directory before it replaces the database, the original database directory is kept under a
+// new name.
+func Repartition(dbPath string, keys KeyProvider, numParts int) error {
+	if numParts < 1 {
+		return fmt.Errorf("Number of partitions must be positive")
+	}
+	dbPath = filepath.Clean(dbPath)
+	src, err := openDB(dbPath, keys, true, SYNC_NONE)
+	if err != nil {
+		return err
+	}
+	tmpDir := fmt.Sprintf("%s.repartition-%d", dbPath, time.Now().UnixNano())
+	err = repartitionInto(src, tmpDir, keys, numParts)
+	if closeErr := src.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	oldDir := fmt.Sprintf("%s.pre-repartition-%d", dbPath, time.Now().UnixNano())
+	if err = os.Rename(dbPath, oldDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	tdlog.Noticef("Repartition: the original database is moved to %s", oldDir)
+	return os.Rename(tmpDir, dbPath)
+}
+
+// Put all collections into a new database of the number of partitions, and check the new database.
+func repartitionInto(src *DB, dbPath string, keys KeyProvider, numParts int) error {
+	if err := src.check("Database"); err != nil {
+		return fmt.Errorf("%v - please repair it first", err)
+	} else if err = os.MkdirAll(dbPath, 0700); err != nil {
+		return err
+	} else if err = ioutil.WriteFile(path.Join(dbPath, PART_NUM_FILE), []byte(strconv.Itoa(numParts)), 0600); err != nil {
+		return err
+	}
+	db, err := openDB(dbPath, keys, false, SYNC_NONE)
+	if err != nil {
+		return err
+	}
+	names := src.AllCols()
+	sort.Strings(names)
+	for _, name := range names {
+		if err = db.repartitionCol(src.cols[name]); err != nil {
+			db.Close()
+			return fmt.Errorf("Cannot repartition collection %s: %v", name, err)
+		}
+	}
+	if err = db.check("Repartitioned database"); err != nil {
+		db.Close()
+		return err
+	} else if err = db.Sync(); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+// Create the collection with its configuration and indexes, and put all of its documents into the database.
+func (db *DB) repartitionCol(src *Col) error {
+	colDir := path.Join(db.path, src.name)
+	if err := os.MkdirAll(colDir, 0700); err != nil {
+		return err
+	} else if err = copyColConf(path.Join(src.db.path, src.name), colDir); err != nil {
+		return err
+	}
+	for _, idxPath := range src.indexPaths {
+		if err := os.MkdirAll(path.Join(colDir, strings.Join(idxPath, INDEX_PATH_SEP)), 0700); err != nil {
+			return err
+		}
+	}
+	// ID counters are kept per partition, they are made anew below
+	if err := os.Remove(path.Join(colDir, ID_COUNTER_FILE)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	col, err := OpenCol(db, src.name)
+	if err != nil {
+		return err
+	}
+	db.cols[src.name] = col
+	// Capped collection keeps its insertion order
+	forEachDoc := src.forEachDoc
+	if src.capped != nil {
+		forEachDoc = func(fun func(id int, doc []byte) bool, placeSchemaLock bool) {
+			src.forEachDocInOrder(fun, placeSchemaLock)
+		}
+	}
+	maxID := 0
+	forEachDoc(func(id int, doc []byte) bool {
+		var docObj map[string]interface{}
+		if docObj, err = src.format.Unmarshal(doc); err != nil {
+			return false
+		} else if err = col.InsertRecovery(id, docObj); err != nil {
+			return false
+		}
+		if expireAt, expires := src.expiryOf(id); expires {
+			col.setExpiry(id, expireAt)
+		} else {
+			col.unexpireDoc(id)
+		}
+		if id > maxID {
+			maxID = id
+		}
+		return true
+	}, false)
+	if err != nil {
+		return err
+	} else if err = col.continueIDs(maxID); err != nil {
+		return err
+	}
+	return copyTree(path.Join(src.db.path, src.name, ATTACH_DIR), path.Join(colDir, ATTACH_DIR))
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRepartition(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("capped"); err != nil {
+		t.Fatal(err)
+	}
+	col, capped := db.Use("col"), db.Use("capped")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.SetTTL(nil, 3600); err != nil {
+		t.Fatal(err)
+	} else if err = col.SetIDStrategy(ID_MONOTONIC); err != nil {
+		t.Fatal(err)
+	} else if err = capped.Cap(3, 0); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 50)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if _, err = capped.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = col.PutAttachment(ids[7], "file", strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	expireAt, _ := col.expiryOf(ids[7])
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = Repartition(TEST_DATA_DIR, nil, 0); err == nil {
+		t.Fatal("Did not error")
+	} else if err = Repartition(TEST_DATA_DIR, nil, 5); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(path.Dir(TEST_DATA_DIR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), path.Base(TEST_DATA_DIR)+".pre-repartition-") {
+			defer os.RemoveAll(path.Join(path.Dir(TEST_DATA_DIR), entry.Name()))
+		}
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.numParts != 5 {
+		t.Fatal(db.numParts)
+	}
+	col, capped = db.Use("col"), db.Use("capped")
+	for i, id := range ids {
+		if doc, err := col.Read(id); err != nil || doc["a"] != float64(i) {
+			t.Fatal(doc, err)
+		}
+		result := make(map[int]struct{})
+		if err = EvalQuery(map[string]interface{}{"eq": i, "in": []interface{}{"a"}}, col, &result); err != nil {
+			t.Fatal(err)
+		} else if _, found := result[id]; !found || len(result) != 1 {
+			t.Fatal(result)
+		}
+	}
+	if at, expires := col.expiryOf(ids[7]); !expires || at != expireAt {
+		t.Fatal(at, expires)
+	} else if attachments, err := col.ListAttachments(ids[7]); err != nil || len(attachments) != 1 {
+		t.Fatal(attachments, err)
+	}
+	var order []float64
+	if err = capped.ForEachDocInOrder(func(id int, doc []byte) bool {
+		n, _ := capped.Read(id)
+		order = append(order, n["n"].(float64))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	} else if len(order) != 3 || order[0] != 2 || order[2] != 4 {
+		t.Fatal(order)
+	}
+	// Monotonic IDs continue after the existing ones
+	newID, err := col.Insert(map[string]interface{}{"a": "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if id >= newID {
+			t.Fatal(id, newID)
+		}
+	}
+}
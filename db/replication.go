@@ -0,0 +1,628 @@
+// Asynchronous primary/replica replication.
+//
+// The primary records changes in an ordered mutation log: the latest content of a written document (or its
+// deletion), collection management and configuration changes. A replica applies log entries in order, every entry
+// may be applied more than once with the same outcome. A replica that falls behind the retained log, or follows a
+// primary of another log, starts over from an export of the primary.
+
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	REPL_LOG_FILE      = "replication_log"  // Mutation log file name in database directory
+	REPL_POSITION_FILE = "replica_position" // File name of the last applied log entry in replica database directory
+
+	REPL_PUT      = "put"      // Document is inserted or updated
+	REPL_DELETE   = "delete"   // Document is deleted
+	REPL_CREATE   = "create"   // Collection is created
+	REPL_DROP     = "drop"     // Collection is dropped
+	REPL_RENAME   = "rename"   // Collection is renamed
+	REPL_TRUNCATE = "truncate" // All documents of collection are deleted
+	REPL_INDEX    = "index"    // Path is indexed
+	REPL_UNINDEX  = "unindex"  // Path is no longer indexed
+	REPL_CONF     = "conf"     // Collection configuration file is changed
+)
+
+// An entry of mutation log.
+type ReplEntry struct {
+	Seq      int64           `json:"seq"`
+	Time     int64           `json:"time"` // Unix nanoseconds of the change
+	Op       string          `json:"op"`   // One of REPL_* constants
+	Col      string          `json:"col"`
+	ID       int             `json:"id,omitempty"`       // Document ID
+	Doc      json.RawMessage `json:"doc,omitempty"`      // Document content in JSON
+	NewName  string          `json:"newName,omitempty"`  // New collection name
+	NumParts int             `json:"numParts,omitempty"` // Number of partitions of new collection (0 for as many as the database)
+	Path     []string        `json:"path,omitempty"`     // Index path
+	Conf     string          `json:"conf,omitempty"`     // Configuration file name
+	Content  string          `json:"content,omitempty"`  // Configuration file content
+	Removed  bool            `json:"removed,omitempty"`  // Configuration file is removed
+	sealed   bool            // Document belongs to an encrypted collection, it is encrypted in log file
+}
+
+// An entry in log file, document of an encrypted collection is encrypted instead of being in JSON.
+type storedReplEntry struct {
+	ReplEntry
+	Sealed []byte `json:"sealed,omitempty"`
+}
+
+// Ordered mutation log of a primary, the latest entries are kept in memory and in a file.
+type ReplLog struct {
+	ID         string // Tells apart logs of different databases, and a log started over
+	path       string
+	retain     int           // Number of entries to retain
+	syncWrites bool          // Write each entry to disk before carrying on
+	ring       *data.Keyring // Encrypts documents of encrypted collections in log file (nil without encryption keys)
+	lock       *sync.Mutex
+	file       *os.File
+	entries    []ReplEntry   // Retained entries from the oldest
+	last       int64         // Sequence number of the latest entry
+	appended   chan struct{} // Closed and replaced when an entry is appended
+	rotating   bool          // Log file is being rewritten in background
+	rotated    *sync.WaitGroup
+}
+
+// Start recording changes in the mutation log, the latest entries of the number are retained. Entries recorded
+// earlier are read from the log file in database directory. Documents of encrypted collections are encrypted in the
+// log file by the database's encryption keys. Attachments are not replicated, hence collections must not have them.
+func (db *DB) StartReplicationLog(retain int) error {
+	if retain < 1 {
+		return fmt.Errorf("Number of retained log entries must be positive")
+	}
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	if db.replog != nil {
+		return fmt.Errorf("Replication log is already started")
+	}
+	for name, col := range db.cols {
+		if attached, err := col.hasAttachments(); err != nil {
+			return err
+		} else if attached {
+			return fmt.Errorf("Collection %s has attachments, they would not be replicated", name)
+		}
+	}
+	var ring *data.Keyring
+	if db.keys != nil {
+		var err error
+		if ring, _, err = db.loadKeyring(); err != nil {
+			return err
+		}
+	}
+	replog, err := openReplLog(path.Join(db.path, REPL_LOG_FILE), retain, ring)
+	if err != nil {
+		return err
+	}
+	replog.syncWrites = db.durability == SYNC_WRITE
+	db.replog = replog
+	return nil
+}
+
+// Return the mutation log, or nil if changes are not recorded.
+func (db *DB) ReplicationLog() *ReplLog {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	return db.replog
+}
+
+// Open a log file, or create a new log if there is none. The keyring decrypts and encrypts documents of encrypted
+// collections.
+func openReplLog(logPath string, retain int, ring *data.Keyring) (replog *ReplLog, err error) {
+	replog = &ReplLog{path: logPath, retain: retain, ring: ring, lock: new(sync.Mutex), appended: make(chan struct{}), rotated: new(sync.WaitGroup)}
+	fh, err := os.Open(logPath)
+	if os.IsNotExist(err) {
+		replog.ID = fmt.Sprintf("%d-%d", time.Now().UnixNano(), rand.Int63())
+		return replog, replog.rewrite()
+	} else if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	dec := json.NewDecoder(bufio.NewReader(fh))
+	var header struct {
+		ID   string `json:"id"`
+		Last int64  `json:"last"`
+	}
+	if err = dec.Decode(&header); err != nil || header.ID == "" {
+		return nil, fmt.Errorf("Replication log %s is corrupted", logPath)
+	}
+	replog.ID, replog.last = header.ID, header.Last
+	for {
+		var stored storedReplEntry
+		if err = dec.Decode(&stored); err == io.EOF {
+			break
+		} else if err != nil {
+			// An entry cut short by a crash is the last one
+			tdlog.Noticef("Replication log %s ends with an incomplete entry: %v", logPath, err)
+			break
+		}
+		entry := stored.ReplEntry
+		if stored.Sealed != nil {
+			if ring == nil {
+				return nil, fmt.Errorf("Replication log %s has encrypted documents, but there is no encryption key", logPath)
+			}
+			doc, err := ring.Open(stored.Sealed)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to decrypt entry %d of replication log %s: %v", entry.Seq, logPath, err)
+			}
+			entry.Doc, entry.sealed = json.RawMessage(doc), true
+		}
+		replog.entries = append(replog.entries, entry)
+		replog.last = entry.Seq
+	}
+	if len(replog.entries) > retain {
+		replog.entries = replog.entries[len(replog.entries)-retain:]
+	}
+	return replog, replog.rewrite()
+}
+
+// Write retained entries into a new log file that replaces the current one, and continue appending to it.
+// Caller must hold the log lock.
+func (replog *ReplLog) rewrite() error {
+	last := replog.last
+	if len(replog.entries) > 0 {
+		last = replog.entries[0].Seq - 1
+	}
+	fh, err := replog.create(last, replog.entries, replog.ring)
+	if err != nil {
+		return err
+	}
+	return replog.replace(fh)
+}
+
+// Write a new temporary log file that starts after the sequence number and has the entries, and write it to disk.
+func (replog *ReplLog) create(last int64, entries []ReplEntry, ring *data.Keyring) (*os.File, error) {
+	fh, err := os.OpenFile(replog.path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(fh)
+	err = json.NewEncoder(writer).Encode(map[string]interface{}{"id": replog.ID, "last": last})
+	for i := 0; err == nil && i < len(entries); i++ {
+		var line []byte
+		if line, err = replLine(entries[i], ring); err == nil {
+			_, err = writer.Write(line)
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = fh.Sync()
+	}
+	if err != nil {
+		fh.Close()
+		os.Remove(fh.Name())
+		return nil, err
+	}
+	return fh, nil
+}
+
+// Replace the log file by a new one created earlier, and continue appending to it. Caller must hold the log lock.
+func (replog *ReplLog) replace(fh *os.File) error {
+	if err := os.Rename(fh.Name(), replog.path); err != nil {
+		fh.Close()
+		return err
+	}
+	if replog.file != nil {
+		replog.file.Close()
+	}
+	replog.file = fh
+	return nil
+}
+
+// Rewrite the log file with retained entries in background, while entries are being appended to the current file.
+func (replog *ReplLog) rotate() {
+	defer replog.rotated.Done()
+	replog.lock.Lock()
+	entries, ring := replog.entries, replog.ring
+	replog.lock.Unlock()
+	fh, err := replog.create(entries[0].Seq-1, entries, ring)
+	replog.lock.Lock()
+	defer replog.lock.Unlock()
+	replog.rotating = false
+	if err == nil {
+		// Entries are not discarded during rotation, those appended in the meantime follow the written ones
+		var lines []byte
+		for i := len(entries); err == nil && i < len(replog.entries); i++ {
+			var line []byte
+			if line, err = replLine(replog.entries[i], replog.ring); err == nil {
+				lines = append(lines, line...)
+			}
+		}
+		if err == nil {
+			_, err = fh.Write(lines)
+		}
+		if err == nil && replog.syncWrites {
+			err = fh.Sync()
+		}
+		if err == nil {
+			err = replog.replace(fh)
+		} else {
+			fh.Close()
+			os.Remove(fh.Name())
+		}
+	}
+	if err != nil {
+		tdlog.CritNoRepeat("Failed to rewrite replication log %s: %v", replog.path, err)
+	}
+}
+
+// Serialize an entry into a line of log file, document of an encrypted collection is encrypted by the keyring.
+func replLine(entry ReplEntry, ring *data.Keyring) ([]byte, error) {
+	stored := storedReplEntry{ReplEntry: entry}
+	if entry.sealed && entry.Doc != nil {
+		if ring == nil {
+			return nil, fmt.Errorf("Document %d of %s cannot be encrypted without encryption key", entry.ID, entry.Col)
+		}
+		sealed, err := ring.Seal(entry.Doc)
+		if err != nil {
+			return nil, err
+		}
+		stored.Doc, stored.Sealed = nil, sealed
+	}
+	line, err := json.Marshal(stored)
+	return append(line, '\n'), err
+}
+
+// Change the keyring that encrypts documents of encrypted collections written to log file from now on.
+func (replog *ReplLog) setKeyring(ring *data.Keyring) {
+	replog.lock.Lock()
+	defer replog.lock.Unlock()
+	replog.ring = ring
+}
+
+// Append an entry, it gets the next sequence number and the current time. In SYNC_WRITE mode the entry is written to
+// disk before returning.
+func (replog *ReplLog) append(entry ReplEntry) {
+	replog.lock.Lock()
+	defer replog.lock.Unlock()
+	replog.last++
+	entry.Seq, entry.Time = replog.last, time.Now().UnixNano()
+	replog.entries = append(replog.entries, entry)
+	line, err := replLine(entry, replog.ring)
+	if err == nil {
+		_, err = replog.file.Write(line)
+	}
+	if err == nil && replog.syncWrites {
+		err = replog.file.Sync()
+	}
+	if err != nil {
+		tdlog.CritNoRepeat("Failed to write replication log %s: %v", replog.path, err)
+	}
+	// Discard old entries once twice as many as retained, the log file is rewritten in background
+	if len(replog.entries) >= 2*replog.retain && !replog.rotating {
+		replog.entries = replog.entries[len(replog.entries)-replog.retain:]
+		replog.rotating = true
+		replog.rotated.Add(1)
+		go replog.rotate()
+	}
+	close(replog.appended)
+	replog.appended = make(chan struct{})
+}
+
+// Return the sequence numbers of the oldest retained entry and the latest entry. The oldest is greater than the
+// latest if there is no entry.
+func (replog *ReplLog) Range() (first, last int64) {
+	replog.lock.Lock()
+	defer replog.lock.Unlock()
+	return replog.first(), replog.last
+}
+
+// Return sequence number of the oldest retained entry. Caller must hold the log lock.
+func (replog *ReplLog) first() int64 {
+	if len(replog.entries) == 0 {
+		return replog.last + 1
+	}
+	return replog.entries[0].Seq
+}
+
+// Return up to the limit of entries after the sequence number, waiting up to the duration for new entries if there
+// are none. Return an error if entries right after the sequence number are no longer retained.
+func (replog *ReplLog) Read(after int64, limit int, wait time.Duration) ([]ReplEntry, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		replog.lock.Lock()
+		if after < replog.first()-1 || after > replog.last {
+			replog.lock.Unlock()
+			return nil, fmt.Errorf("Replication log %s does not have entries after %d", replog.ID, after)
+		} else if after < replog.last {
+			start := int(after - replog.first() + 1)
+			end := len(replog.entries)
+			if limit > 0 && end-start > limit {
+				end = start + limit
+			}
+			entries := append([]ReplEntry{}, replog.entries[start:end]...)
+			replog.lock.Unlock()
+			return entries, nil
+		}
+		appended := replog.appended
+		replog.lock.Unlock()
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return []ReplEntry{}, nil
+		}
+		select {
+		case <-appended:
+		case <-time.After(remaining):
+		}
+	}
+}
+
+// Write the log file to disk.
+func (replog *ReplLog) sync() error {
+	replog.lock.Lock()
+	defer replog.lock.Unlock()
+	return replog.file.Sync()
+}
+
+// Wait for the log file to be rewritten, and close it.
+func (replog *ReplLog) close() error {
+	replog.rotated.Wait()
+	replog.lock.Lock()
+	defer replog.lock.Unlock()
+	return replog.file.Close()
+}
+
+// Record the latest content of a document (nil if it is deleted) in mutation log, the document is serialized in
+// collection's format. Caller must hold the partition's exclusive data lock.
+func (col *Col) logWrite(id int, doc []byte) {
+	replog := col.db.replog
+	if replog == nil {
+		return
+	} else if doc == nil {
+		replog.append(ReplEntry{Op: REPL_DELETE, Col: col.name, ID: id})
+		return
+	}
+	if _, isJSON := col.format.(jsonFormat); !isJSON {
+		docObj, err := col.format.Unmarshal(doc)
+		if err == nil {
+			doc, err = json.Marshal(docObj)
+		}
+		if err != nil {
+			tdlog.CritNoRepeat("Failed to record document %d of %s in replication log: %v", id, col.name, err)
+			return
+		}
+	}
+	replog.append(ReplEntry{Op: REPL_PUT, Col: col.name, ID: id, Doc: json.RawMessage(doc), sealed: col.indexKey != nil})
+}
+
+// Record a collection management change in mutation log. Caller must hold exclusive schema lock.
+func (db *DB) logSchema(entry ReplEntry) {
+	if db.replog != nil {
+		db.replog.append(entry)
+	}
+}
+
+// Record the content of a configuration file of the collection in mutation log. Caller must hold exclusive schema lock.
+func (col *Col) logConf(confFile string) {
+	if col.db.replog == nil {
+		return
+	}
+	entry := ReplEntry{Op: REPL_CONF, Col: col.name, Conf: confFile}
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, confFile))
+	if os.IsNotExist(err) {
+		entry.Removed = true
+	} else if err != nil {
+		tdlog.CritNoRepeat("Failed to record configuration %s of %s in replication log: %v", confFile, col.name, err)
+		return
+	}
+	entry.Content = string(content)
+	col.db.replog.append(entry)
+}
+
+// Position of a replica in the mutation log of its primary.
+type ReplPosition struct {
+	LogID string `json:"logID"`
+	Seq   int64  `json:"seq"` // Sequence number of the last applied entry
+}
+
+// Return the position of a replica, which is empty if the database has not been a replica.
+func (db *DB) ReplicaPosition() (pos ReplPosition, err error) {
+	content, err := ioutil.ReadFile(path.Join(db.path, REPL_POSITION_FILE))
+	if os.IsNotExist(err) {
+		return pos, nil
+	} else if err != nil {
+		return
+	}
+	if err = json.Unmarshal(content, &pos); err != nil {
+		err = fmt.Errorf("Replica position of %s is corrupted: %v", db.path, err)
+	}
+	return
+}
+
+// Remember the position of a replica.
+func (db *DB) setReplicaPosition(pos ReplPosition) error {
+	content, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	tmpPath := path.Join(db.path, REPL_POSITION_FILE+".tmp")
+	if err = ioutil.WriteFile(tmpPath, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path.Join(db.path, REPL_POSITION_FILE))
+}
+
+// Replace all collections of a replica with the export of its primary, which was taken after the position.
+func (db *DB) ResetReplica(pos ReplPosition, export io.Reader) error {
+	// A reset cut short starts over again
+	if err := os.Remove(path.Join(db.path, REPL_POSITION_FILE)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, name := range db.AllCols() {
+		if err := db.Drop(name); err != nil {
+			return err
+		}
+	}
+	if err := db.Import(export); err != nil {
+		return err
+	}
+	return db.setReplicaPosition(pos)
+}
+
+// Apply entries of the primary's mutation log to a replica in order, and remember the position of the last entry.
+func (db *DB) ApplyReplicated(logID string, entries []ReplEntry) error {
+	for _, entry := range entries {
+		if err := db.applyReplicated(entry); err != nil {
+			return fmt.Errorf("Cannot apply replication log entry %d (%s of %s): %v", entry.Seq, entry.Op, entry.Col, err)
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return db.setReplicaPosition(ReplPosition{logID, entries[len(entries)-1].Seq})
+}
+
+// Apply a mutation log entry, an entry that has been applied makes no further change.
+func (db *DB) applyReplicated(entry ReplEntry) error {
+	switch entry.Op {
+	case REPL_CREATE:
+		if db.Use(entry.Col) == nil {
+			return db.CreateWithPartitions(entry.Col, entry.NumParts)
+		}
+		return nil
+	case REPL_DROP:
+		if db.Use(entry.Col) != nil {
+			return db.Drop(entry.Col)
+		}
+		return nil
+	case REPL_RENAME:
+		if db.Use(entry.Col) == nil {
+			return nil
+		} else if db.Use(entry.NewName) != nil {
+			// Renamed already, the old collection has been created again by the entries applied once more
+			return db.Drop(entry.Col)
+		}
+		return db.Rename(entry.Col, entry.NewName)
+	}
+	col := db.Use(entry.Col)
+	if col == nil {
+		return fmt.Errorf("Collection %s does not exist", entry.Col)
+	}
+	switch entry.Op {
+	case REPL_PUT:
+		doc, err := convertFormat(jsonFormat{}, col.format)(entry.Doc)
+		if err != nil {
+			return err
+		}
+		err = col.Update(entry.ID, doc)
+		if dberr.Type(err) == dberr.ErrorNoDoc {
+			err = col.InsertWithID(entry.ID, doc)
+		}
+		if dberr.Type(err) == dberr.ErrorSchemaViolation {
+			// The primary has validated the document, a schema set later on is applied once more before it
+			tdlog.Noticef("Replica skipped document %d of %s that does not conform to the latest schema", entry.ID, entry.Col)
+			return nil
+		}
+		return err
+	case REPL_DELETE:
+		if err := col.Delete(entry.ID); err != nil && dberr.Type(err) != dberr.ErrorNoDoc {
+			return err
+		}
+		return nil
+	case REPL_TRUNCATE:
+		return db.Truncate(entry.Col)
+	case REPL_INDEX:
+		if !col.indexed(entry.Path) {
+			return col.Index(entry.Path)
+		}
+		return nil
+	case REPL_UNINDEX:
+		if col.indexed(entry.Path) {
+			return col.Unindex(entry.Path)
+		}
+		return nil
+	case REPL_CONF:
+		return db.applyConf(col, entry)
+	}
+	return fmt.Errorf("Unknown operation %s", entry.Op)
+}
+
+// Return true if the path is indexed.
+func (col *Col) indexed(idxPath []string) bool {
+	for _, indexed := range col.AllIndexes() {
+		if fmt.Sprint(indexed) == fmt.Sprint(idxPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply a configuration change of the primary with the corresponding configuration function.
+func (db *DB) applyConf(col *Col, entry ReplEntry) error {
+	switch entry.Conf {
+	case TTL_CONF_FILE:
+		if entry.Removed {
+			if col.GetTTL() != nil {
+				return col.RemoveTTL()
+			}
+			return nil
+		}
+		var ttl TTL
+		if err := json.Unmarshal([]byte(entry.Content), &ttl); err != nil {
+			return err
+		}
+		return col.SetTTL(ttl.Path, ttl.Seconds)
+	case CAP_CONF_FILE:
+		if entry.Removed {
+			if col.GetCap() != nil {
+				return col.Uncap()
+			}
+			return nil
+		}
+		var capped Capped
+		if err := json.Unmarshal([]byte(entry.Content), &capped); err != nil {
+			return err
+		}
+		return col.Cap(capped.MaxDocs, capped.MaxBytes)
+	case SCHEMA_CONF_FILE:
+		if entry.Removed {
+			if schema, _ := col.GetSchema(); schema != nil {
+				return col.RemoveSchema()
+			}
+			return nil
+		}
+		var schema map[string]interface{}
+		if err := json.Unmarshal([]byte(entry.Content), &schema); err != nil {
+			return err
+		}
+		return col.SetSchema(schema)
+	case ID_CONF_FILE:
+		return col.SetIDStrategy(entry.Content)
+	case ROOM_CONF_FILE:
+		var policy data.RoomPolicy
+		if err := json.Unmarshal([]byte(entry.Content), &policy); err != nil {
+			return err
+		}
+		return col.SetRoomPolicy(policy.Policy, policy.Value)
+	case COMPRESS_CONF_FILE:
+		return col.SetCompression(entry.Content)
+	case ENCRYPT_CONF_FILE:
+		// The replica encrypts by its own keys
+		if col.Encrypted() == entry.Removed {
+			return db.SetEncryption(col.name, !entry.Removed)
+		}
+		return nil
+	case FORMAT_CONF_FILE:
+		if col.GetFormat() != entry.Content {
+			return db.SetFormat(col.name, entry.Content)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown configuration %s", entry.Conf)
+}
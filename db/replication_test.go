@@ -0,0 +1,195 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplication(t *testing.T) {
+	replicaDir := TEST_DATA_DIR + "_replica"
+	for _, dir := range []string{TEST_DATA_DIR, replicaDir} {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+	primary, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		primary.Close()
+	}()
+	if err = primary.StartReplicationLog(10); err != nil {
+		t.Fatal(err)
+	}
+	replog := primary.ReplicationLog()
+	if err = primary.Create("col"); err != nil {
+		t.Fatal(err)
+	} else if err = primary.CreateWithPartitions("gone", 2); err != nil {
+		t.Fatal(err)
+	} else if err = primary.Drop("gone"); err != nil {
+		t.Fatal(err)
+	}
+	col := primary.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.SetIDStrategy(ID_MONOTONIC); err != nil {
+		t.Fatal(err)
+	}
+	kept, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := col.Insert(map[string]interface{}{"a": 2})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = col.Update(kept, map[string]interface{}{"a": 3}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Patch(kept, map[string]interface{}{"$set": map[string]interface{}{"b": "x"}}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(deleted); err != nil {
+		t.Fatal(err)
+	} else if err = primary.SetFormat("col", FORMAT_MSGPACK); err != nil {
+		t.Fatal(err)
+	} else if err = primary.Rename("col", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	first, last := replog.Range()
+	if first != 1 || last != 12 {
+		t.Fatal(first, last)
+	}
+	entries, err := replog.Read(0, 0, 0)
+	if err != nil || len(entries) != 12 || entries[7].Op != REPL_PUT || entries[9].Op != REPL_DELETE {
+		t.Fatal(entries, err)
+	}
+	// Apply the log twice, the second time makes no difference
+	replica, err := OpenDB(replicaDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+	for i := 0; i < 2; i++ {
+		if err = replica.ApplyReplicated(replog.ID, entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pos, err := replica.ReplicaPosition(); err != nil || pos.LogID != replog.ID || pos.Seq != 12 {
+		t.Fatal(pos, err)
+	} else if replica.Use("col") != nil || replica.Use("gone") != nil {
+		t.Fatal(replica.AllCols())
+	}
+	renamed := replica.Use("renamed")
+	if renamed.GetFormat() != FORMAT_MSGPACK || renamed.GetIDStrategy() != ID_MONOTONIC {
+		t.Fatal(renamed.GetFormat(), renamed.GetIDStrategy())
+	} else if doc, err := renamed.Read(kept); err != nil || doc["a"] != int64(3) || doc["b"] != "x" {
+		t.Fatal(doc, err)
+	} else if _, err = renamed.Read(deleted); err == nil {
+		t.Fatal("Did not delete")
+	}
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": 3, "in": []interface{}{"a"}}, renamed, &result); err != nil {
+		t.Fatal(err)
+	} else if _, found := result[kept]; !found || len(result) != 1 {
+		t.Fatal(result)
+	}
+	// Only the latest entries are retained, a long wait ends with a new entry
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		primary.Use("renamed").Insert(map[string]interface{}{"a": 4})
+	}()
+	if entries, err = replog.Read(12, 0, 10*time.Second); err != nil || len(entries) != 1 || entries[0].Seq != 13 {
+		t.Fatal(entries, err)
+	}
+	for i := 0; i < 7; i++ {
+		if _, err = primary.Use("renamed").Insert(map[string]interface{}{"a": 5}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first, last = replog.Range(); first != 11 || last != 20 {
+		t.Fatal(first, last)
+	} else if _, err = replog.Read(9, 0, 0); err == nil {
+		t.Fatal("Did not error")
+	} else if _, err = replog.Read(21, 0, 0); err == nil {
+		t.Fatal("Did not error")
+	} else if entries, err = replog.Read(10, 3, 0); err != nil || len(entries) != 3 || entries[0].Seq != 11 {
+		t.Fatal(entries, err)
+	}
+	// The log file is rewritten with retained entries, and the log carries on after reopening the database
+	if err = primary.Close(); err != nil {
+		t.Fatal(err)
+	} else if content, err := ioutil.ReadFile(path.Join(TEST_DATA_DIR, REPL_LOG_FILE)); err != nil || bytes.Count(content, []byte("\n")) != 1+10 {
+		t.Fatal(string(content), err)
+	} else if primary, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	} else if err = primary.StartReplicationLog(10); err != nil {
+		t.Fatal(err)
+	}
+	reopened := primary.ReplicationLog()
+	if first, last = reopened.Range(); reopened.ID != replog.ID || first != 11 || last != 20 {
+		t.Fatal(reopened.ID, first, last)
+	}
+	// Attachments are not replicated, the primary neither takes them nor starts with them
+	if _, err = primary.Use("renamed").PutAttachment(kept, "a.txt", strings.NewReader("a")); err == nil {
+		t.Fatal("Did not error")
+	} else if err = primary.Close(); err != nil {
+		t.Fatal(err)
+	} else if primary, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	} else if _, err = primary.Use("renamed").PutAttachment(kept, "a.txt", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	} else if err = primary.StartReplicationLog(10); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestReplicationEncrypted(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	keyFile := "/tmp/tiedot_test_keys"
+	defer os.Remove(keyFile)
+	if err := ioutil.WriteFile(keyFile, []byte("1:"+strings.Repeat("01", 32)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	primary, err := OpenDBWithKeys(TEST_DATA_DIR, FileKeyProvider(keyFile))
+	if err != nil {
+		t.Fatal(err)
+	} else if err = primary.StartReplicationLog(10); err != nil {
+		t.Fatal(err)
+	} else if err = primary.Create("col"); err != nil {
+		t.Fatal(err)
+	} else if err = primary.SetEncryption("col", true); err != nil {
+		t.Fatal(err)
+	}
+	id, err := primary.Use("col").Insert(map[string]interface{}{"a": "plaintext"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Document is encrypted in log file, but not in the entries sent to replicas
+	content, err := ioutil.ReadFile(path.Join(TEST_DATA_DIR, REPL_LOG_FILE))
+	if err != nil || bytes.Contains(content, []byte("plaintext")) {
+		t.Fatal(string(content), err)
+	}
+	entries, err := primary.ReplicationLog().Read(2, 0, 0)
+	if err != nil || len(entries) != 1 || entries[0].ID != id || !bytes.Contains(entries[0].Doc, []byte("plaintext")) {
+		t.Fatal(entries, err)
+	} else if err = primary.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Reopened log decrypts the document
+	if primary, err = OpenDBWithKeys(TEST_DATA_DIR, FileKeyProvider(keyFile)); err != nil {
+		t.Fatal(err)
+	} else if err = primary.StartReplicationLog(10); err != nil {
+		t.Fatal(err)
+	} else if entries, err = primary.ReplicationLog().Read(2, 0, 0); err != nil || len(entries) != 1 || !bytes.Contains(entries[0].Doc, []byte("plaintext")) {
+		t.Fatal(entries, err)
+	} else if err = primary.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if content, err = ioutil.ReadFile(path.Join(TEST_DATA_DIR, REPL_LOG_FILE)); err != nil || bytes.Contains(content, []byte("plaintext")) {
+		t.Fatal(string(content), err)
+	}
+}
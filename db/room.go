@@ -0,0 +1,74 @@
+// Document room policy of collections.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+const (
+	ROOM_CONF_FILE = "room" // Name of document room policy configuration file.
+)
+
+// Read document room policy from collection directory and apply it to all partitions.
+func (col *Col) loadRoomPolicy() error {
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, ROOM_CONF_FILE))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var policy data.RoomPolicy
+	if err = json.Unmarshal(content, &policy); err != nil {
+		return fmt.Errorf("Room policy of collection %s is corrupted: %v", col.name, err)
+	} else if err = policy.Validate(); err != nil {
+		return err
+	}
+	for _, part := range col.parts {
+		part.SetRoomPolicy(policy)
+	}
+	return nil
+}
+
+// Change how much room documents occupy: twice the size ("double", default), exactly the size ("exact"), size plus
+// value bytes ("slack"), or size plus value percent ("percent"). The policy applies to documents inserted or relocated
+// from now on, and to all documents after compaction.
+func (col *Col) SetRoomPolicy(policy string, value int) error {
+	roomPolicy := data.RoomPolicy{Policy: policy, Value: value}
+	if err := roomPolicy.Validate(); err != nil {
+		return err
+	}
+	content, err := json.Marshal(roomPolicy)
+	if err != nil {
+		return err
+	}
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	if err = ioutil.WriteFile(path.Join(col.db.path, col.name, ROOM_CONF_FILE), content, 0600); err != nil {
+		return err
+	}
+	for _, part := range col.parts {
+		part.DataLock.Lock()
+		part.SetRoomPolicy(roomPolicy)
+		part.DataLock.Unlock()
+	}
+	col.logConf(ROOM_CONF_FILE)
+	return nil
+}
+
+// Return document room policy of the collection.
+func (col *Col) GetRoomPolicy() data.RoomPolicy {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	policy := col.parts[0].RoomPolicy()
+	if policy.Policy == "" {
+		policy.Policy = data.ROOM_DOUBLE
+	}
+	return policy
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+func TestColRoomPolicy(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if policy := col.GetRoomPolicy(); policy.Policy != data.ROOM_DOUBLE {
+		t.Fatal(policy)
+	}
+	if col.SetRoomPolicy("whatever", 0) == nil {
+		t.Fatal("Did not error")
+	}
+	if err = col.SetRoomPolicy(data.ROOM_EXACT, 0); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	padding := 0
+	for _, partStats := range col.StorageStats() {
+		padding += partStats.Documents.Padding
+	}
+	if padding != 0 {
+		t.Fatal(padding)
+	}
+	// Documents outgrow exact room
+	if err = col.Update(id, map[string]interface{}{"a": "much longer than before"}); err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := col.Read(id); err != nil || doc["a"] != "much longer than before" {
+		t.Fatal(doc, err)
+	}
+	// Policy persists after reopening
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	if policy := db.Use("col").GetRoomPolicy(); policy.Policy != data.ROOM_EXACT {
+		t.Fatal(policy)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
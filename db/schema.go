@@ -0,0 +1,730 @@
+// Document validation against JSON Schema (a subset of draft 7).
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	SCHEMA_CONF_FILE = "schema.json" // Name of collection JSON schema file.
+)
+
+// Compiled JSON schema. Supported keywords are:
+// type, enum, const,
+// multipleOf, maximum, exclusiveMaximum, minimum, exclusiveMinimum,
+// maxLength, minLength, pattern,
+// items, additionalItems, maxItems, minItems, uniqueItems, contains,
+// maxProperties, minProperties, required, properties, patternProperties, additionalProperties, propertyNames,
+// allOf, anyOf, oneOf, not, if, then, else,
+// definitions and $ref (to "#" or "#/definitions/name").
+type Schema struct {
+	root        *Schema
+	always      *bool // true or false as a whole schema
+	ref         string
+	definitions map[string]*Schema
+
+	types    []string
+	enum     []interface{}
+	constant interface{}
+	hasConst bool
+
+	multipleOf, maximum, exclusiveMaximum, minimum, exclusiveMinimum *float64
+
+	maxLength, minLength int
+	pattern              *regexp.Regexp
+
+	items           *Schema
+	tupleItems      []*Schema
+	additionalItems *Schema
+	maxItems        int
+	minItems        int
+	uniqueItems     bool
+	contains        *Schema
+
+	maxProperties        int
+	minProperties        int
+	required             []string
+	properties           map[string]*Schema
+	patternProperties    map[*regexp.Regexp]*Schema
+	additionalProperties *Schema
+	propertyNames        *Schema
+
+	allOf, anyOf, oneOf    []*Schema
+	not, ifS, thenS, elseS *Schema
+}
+
+// Compile a JSON schema.
+func CompileSchema(schema interface{}) (*Schema, error) {
+	return compileSchema(normalizeJSON(schema), nil, "#")
+}
+
+func compileSchema(raw interface{}, root *Schema, at string) (s *Schema, err error) {
+	s = &Schema{root: root, maxLength: -1, maxItems: -1, maxProperties: -1}
+	if root == nil {
+		s.root = s
+	}
+	if always, ok := raw.(bool); ok {
+		s.always = &always
+		return
+	}
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Schema %s must be an object or boolean, but %v given", at, raw)
+	}
+	// Helper functions that read keyword values of the expected types
+	sub := func(key string) (*Schema, error) {
+		if val, exists := obj[key]; exists {
+			return compileSchema(val, s.root, at+"/"+key)
+		}
+		return nil, nil
+	}
+	subs := func(key string) ([]*Schema, error) {
+		val, exists := obj[key]
+		if !exists {
+			return nil, nil
+		}
+		arr, ok := val.([]interface{})
+		if !ok || len(arr) == 0 {
+			return nil, fmt.Errorf("Schema %s/%s must be a non-empty array", at, key)
+		}
+		ret := make([]*Schema, len(arr))
+		for i, elem := range arr {
+			if ret[i], err = compileSchema(elem, s.root, fmt.Sprintf("%s/%s/%d", at, key, i)); err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	}
+	number := func(key string) (*float64, error) {
+		val, exists := obj[key]
+		if !exists {
+			return nil, nil
+		}
+		num, ok := val.(float64)
+		if !ok {
+			return nil, fmt.Errorf("Schema %s/%s must be a number", at, key)
+		}
+		return &num, nil
+	}
+	count := func(key string, defaultVal int) (int, error) {
+		val, exists := obj[key]
+		if !exists {
+			return defaultVal, nil
+		}
+		num, ok := val.(float64)
+		if !ok || num < 0 || num != math.Trunc(num) {
+			return 0, fmt.Errorf("Schema %s/%s must be a non-negative integer", at, key)
+		}
+		return int(num), nil
+	}
+	regex := func(key, expr string) (*regexp.Regexp, error) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Schema %s/%s has invalid regular expression: %v", at, key, err)
+		}
+		return re, nil
+	}
+	schemaMap := func(key string) (map[string]*Schema, error) {
+		val, exists := obj[key]
+		if !exists {
+			return nil, nil
+		}
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Schema %s/%s must be an object", at, key)
+		}
+		ret := make(map[string]*Schema, len(m))
+		for name, elem := range m {
+			if ret[name], err = compileSchema(elem, s.root, at+"/"+key+"/"+name); err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	}
+
+	if ref, exists := obj["$ref"]; exists {
+		if s.ref, ok = ref.(string); !ok || s.ref != "#" && !strings.HasPrefix(s.ref, "#/definitions/") {
+			return nil, fmt.Errorf("Schema %s/$ref only supports \"#\" and \"#/definitions/name\", but %v given", at, ref)
+		}
+	}
+	if s.definitions, err = schemaMap("definitions"); err != nil {
+		return
+	}
+	switch types := obj["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{types}
+	case []interface{}:
+		for _, t := range types {
+			if str, ok := t.(string); ok {
+				s.types = append(s.types, str)
+			} else {
+				return nil, fmt.Errorf("Schema %s/type must contain type names", at)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Schema %s/type must be a type name or an array of names", at)
+	}
+	for _, t := range s.types {
+		switch t {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return nil, fmt.Errorf("Schema %s/type has unknown type %s", at, t)
+		}
+	}
+	if enum, exists := obj["enum"]; exists {
+		if s.enum, ok = enum.([]interface{}); !ok {
+			return nil, fmt.Errorf("Schema %s/enum must be an array", at)
+		}
+	}
+	s.constant, s.hasConst = obj["const"]
+	// Numbers
+	if s.multipleOf, err = number("multipleOf"); err != nil {
+		return
+	} else if s.multipleOf != nil && *s.multipleOf <= 0 {
+		return nil, fmt.Errorf("Schema %s/multipleOf must be greater than 0", at)
+	}
+	if s.maximum, err = number("maximum"); err != nil {
+		return
+	} else if s.exclusiveMaximum, err = number("exclusiveMaximum"); err != nil {
+		return
+	} else if s.minimum, err = number("minimum"); err != nil {
+		return
+	} else if s.exclusiveMinimum, err = number("exclusiveMinimum"); err != nil {
+		return
+	}
+	// Strings
+	if s.maxLength, err = count("maxLength", -1); err != nil {
+		return
+	} else if s.minLength, err = count("minLength", 0); err != nil {
+		return
+	}
+	if pattern, exists := obj["pattern"]; exists {
+		expr, ok := pattern.(string)
+		if !ok {
+			return nil, fmt.Errorf("Schema %s/pattern must be a string", at)
+		}
+		if s.pattern, err = regex("pattern", expr); err != nil {
+			return
+		}
+	}
+	// Arrays
+	if _, isTuple := obj["items"].([]interface{}); isTuple {
+		if s.tupleItems, err = subs("items"); err != nil {
+			return
+		}
+	} else if s.items, err = sub("items"); err != nil {
+		return
+	}
+	if s.additionalItems, err = sub("additionalItems"); err != nil {
+		return
+	} else if s.maxItems, err = count("maxItems", -1); err != nil {
+		return
+	} else if s.minItems, err = count("minItems", 0); err != nil {
+		return
+	} else if s.contains, err = sub("contains"); err != nil {
+		return
+	}
+	if unique, exists := obj["uniqueItems"]; exists {
+		if s.uniqueItems, ok = unique.(bool); !ok {
+			return nil, fmt.Errorf("Schema %s/uniqueItems must be a boolean", at)
+		}
+	}
+	// Objects
+	if s.maxProperties, err = count("maxProperties", -1); err != nil {
+		return
+	} else if s.minProperties, err = count("minProperties", 0); err != nil {
+		return
+	}
+	if required, exists := obj["required"]; exists {
+		names, ok := required.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Schema %s/required must be an array", at)
+		}
+		for _, name := range names {
+			if str, ok := name.(string); ok {
+				s.required = append(s.required, str)
+			} else {
+				return nil, fmt.Errorf("Schema %s/required must contain property names", at)
+			}
+		}
+	}
+	if s.properties, err = schemaMap("properties"); err != nil {
+		return
+	}
+	if patternProps, err := schemaMap("patternProperties"); err != nil {
+		return nil, err
+	} else if patternProps != nil {
+		s.patternProperties = make(map[*regexp.Regexp]*Schema, len(patternProps))
+		for expr, propSchema := range patternProps {
+			re, err := regex("patternProperties", expr)
+			if err != nil {
+				return nil, err
+			}
+			s.patternProperties[re] = propSchema
+		}
+	}
+	if s.additionalProperties, err = sub("additionalProperties"); err != nil {
+		return
+	} else if s.propertyNames, err = sub("propertyNames"); err != nil {
+		return
+	}
+	// Combinations and conditions
+	if s.allOf, err = subs("allOf"); err != nil {
+		return
+	} else if s.anyOf, err = subs("anyOf"); err != nil {
+		return
+	} else if s.oneOf, err = subs("oneOf"); err != nil {
+		return
+	} else if s.not, err = sub("not"); err != nil {
+		return
+	} else if s.ifS, err = sub("if"); err != nil {
+		return
+	} else if s.thenS, err = sub("then"); err != nil {
+		return
+	} else if s.elseS, err = sub("else"); err != nil {
+		return
+	}
+	if root == nil {
+		// All references can be resolved now that definitions are compiled
+		if err = s.checkRefs(make(map[*Schema]int)); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// Make sure that all references in the schema can be resolved, and validation never follows them in circles. The
+// map keeps track of schemas checked for circles.
+func (s *Schema) checkRefs(visits map[*Schema]int) error {
+	if s == nil {
+		return nil
+	}
+	if s.ref != "" && s.resolve() == nil {
+		return fmt.Errorf("Schema reference %s cannot be resolved", s.ref)
+	} else if s.ref != "" && s.circular(visits) {
+		return fmt.Errorf("Schema reference %s leads back to itself for the same value", s.ref)
+	}
+	children := []*Schema{s.items, s.additionalItems, s.contains, s.additionalProperties, s.propertyNames, s.not, s.ifS, s.thenS, s.elseS}
+	children = append(children, s.tupleItems...)
+	children = append(children, s.allOf...)
+	children = append(children, s.anyOf...)
+	children = append(children, s.oneOf...)
+	for _, child := range s.definitions {
+		children = append(children, child)
+	}
+	for _, child := range s.properties {
+		children = append(children, child)
+	}
+	for _, child := range s.patternProperties {
+		children = append(children, child)
+	}
+	for _, child := range children {
+		if err := child.checkRefs(visits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return true if validating a value against the schema comes back to the schema for the same value, by following
+// $ref and keywords that apply to the same value (e.g. allOf). The map tells schemas being followed (1) apart from
+// those that do not come back (2).
+func (s *Schema) circular(visits map[*Schema]int) bool {
+	if s == nil || visits[s] == 2 {
+		return false
+	} else if visits[s] == 1 {
+		return true
+	}
+	visits[s] = 1
+	next := []*Schema{s.resolve()}
+	if s.ref == "" {
+		// Sibling keywords of $ref are ignored
+		next = []*Schema{s.not, s.ifS, s.thenS, s.elseS}
+		next = append(next, s.allOf...)
+		next = append(next, s.anyOf...)
+		next = append(next, s.oneOf...)
+	}
+	for _, schema := range next {
+		if schema.circular(visits) {
+			return true
+		}
+	}
+	visits[s] = 2
+	return false
+}
+
+// Return the schema that $ref points to.
+func (s *Schema) resolve() *Schema {
+	if s.ref == "#" {
+		return s.root
+	}
+	return s.root.definitions[strings.TrimPrefix(s.ref, "#/definitions/")]
+}
+
+// Convert numbers of all kinds into float64, so that documents from JSON and from Go code are treated the same.
+func normalizeJSON(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			ret[key] = normalizeJSON(elem)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, elem := range v {
+			ret[i] = normalizeJSON(elem)
+		}
+		return ret
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	}
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct, reflect.Ptr:
+		// Let JSON encoder figure out the representation of other Go types
+		var ret interface{}
+		if content, err := json.Marshal(val); err == nil && json.Unmarshal(content, &ret) == nil {
+			return ret
+		}
+	}
+	return val
+}
+
+// Return JSON type name of the value.
+func jsonType(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", val)
+}
+
+// Validate a document against the schema and return all violations (empty if the document conforms).
+func (s *Schema) Validate(doc interface{}) (violations []string) {
+	s.validate(normalizeJSON(doc), "", &violations)
+	return
+}
+
+// Return true if the value conforms to the schema.
+func (s *Schema) accepts(val interface{}) bool {
+	violations := make([]string, 0)
+	s.validate(val, "", &violations)
+	return len(violations) == 0
+}
+
+func (s *Schema) validate(val interface{}, at string, violations *[]string) {
+	fail := func(format string, params ...interface{}) {
+		where := at
+		if where == "" {
+			where = "/"
+		}
+		*violations = append(*violations, where+": "+fmt.Sprintf(format, params...))
+	}
+	if s.always != nil {
+		if !*s.always {
+			fail("no value is allowed")
+		}
+		return
+	}
+	if s.ref != "" {
+		// Sibling keywords of $ref are ignored in draft 7
+		s.resolve().validate(val, at, violations)
+		return
+	}
+	valType := jsonType(val)
+	if len(s.types) > 0 {
+		matched := false
+		for _, t := range s.types {
+			if t == valType || t == "number" && valType == "integer" {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("expected type %s, but %s given", strings.Join(s.types, " or "), valType)
+		}
+	}
+	if s.enum != nil {
+		found := false
+		for _, allowed := range s.enum {
+			if reflect.DeepEqual(allowed, val) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value %v is not one of %v", val, s.enum)
+		}
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constant, val) {
+		fail("value %v is not %v", val, s.constant)
+	}
+	switch v := val.(type) {
+	case float64:
+		if s.multipleOf != nil {
+			if quotient := v / *s.multipleOf; math.Abs(quotient-math.Floor(quotient+0.5)) > 1e-9 {
+				fail("%v is not a multiple of %v", v, *s.multipleOf)
+			}
+		}
+		if s.maximum != nil && v > *s.maximum {
+			fail("%v is greater than maximum %v", v, *s.maximum)
+		}
+		if s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum {
+			fail("%v is not less than %v", v, *s.exclusiveMaximum)
+		}
+		if s.minimum != nil && v < *s.minimum {
+			fail("%v is less than minimum %v", v, *s.minimum)
+		}
+		if s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum {
+			fail("%v is not greater than %v", v, *s.exclusiveMinimum)
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.maxLength >= 0 && length > s.maxLength {
+			fail("string is longer than %d characters", s.maxLength)
+		}
+		if length < s.minLength {
+			fail("string is shorter than %d characters", s.minLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("string does not match pattern %s", s.pattern)
+		}
+	case []interface{}:
+		s.validateArray(v, at, violations, fail)
+	case map[string]interface{}:
+		s.validateObject(v, at, violations, fail)
+	}
+	// Combinations and conditions
+	for _, all := range s.allOf {
+		all.validate(val, at, violations)
+	}
+	if s.anyOf != nil {
+		matched := false
+		for _, any := range s.anyOf {
+			if any.accepts(val) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("value does not match any schema in anyOf")
+		}
+	}
+	if s.oneOf != nil {
+		matches := 0
+		for _, one := range s.oneOf {
+			if one.accepts(val) {
+				matches++
+			}
+		}
+		if matches != 1 {
+			fail("value matches %d schemas in oneOf instead of exactly one", matches)
+		}
+	}
+	if s.not != nil && s.not.accepts(val) {
+		fail("value must not match the schema in not")
+	}
+	if s.ifS != nil {
+		if s.ifS.accepts(val) {
+			if s.thenS != nil {
+				s.thenS.validate(val, at, violations)
+			}
+		} else if s.elseS != nil {
+			s.elseS.validate(val, at, violations)
+		}
+	}
+}
+
+func (s *Schema) validateArray(arr []interface{}, at string, violations *[]string, fail func(string, ...interface{})) {
+	if s.maxItems >= 0 && len(arr) > s.maxItems {
+		fail("array has more than %d items", s.maxItems)
+	}
+	if len(arr) < s.minItems {
+		fail("array has fewer than %d items", s.minItems)
+	}
+	if s.uniqueItems {
+	uniqueCheck:
+		for i := range arr {
+			for j := i + 1; j < len(arr); j++ {
+				if reflect.DeepEqual(arr[i], arr[j]) {
+					fail("array items %d and %d are identical", i, j)
+					break uniqueCheck
+				}
+			}
+		}
+	}
+	for i, item := range arr {
+		itemAt := fmt.Sprintf("%s/%d", at, i)
+		if s.items != nil {
+			s.items.validate(item, itemAt, violations)
+		} else if i < len(s.tupleItems) {
+			s.tupleItems[i].validate(item, itemAt, violations)
+		} else if s.tupleItems != nil && s.additionalItems != nil {
+			s.additionalItems.validate(item, itemAt, violations)
+		}
+	}
+	if s.contains != nil {
+		found := false
+		for _, item := range arr {
+			if s.contains.accepts(item) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("array does not contain a matching item")
+		}
+	}
+}
+
+func (s *Schema) validateObject(obj map[string]interface{}, at string, violations *[]string, fail func(string, ...interface{})) {
+	if s.maxProperties >= 0 && len(obj) > s.maxProperties {
+		fail("object has more than %d properties", s.maxProperties)
+	}
+	if len(obj) < s.minProperties {
+		fail("object has fewer than %d properties", s.minProperties)
+	}
+	for _, name := range s.required {
+		if _, exists := obj[name]; !exists {
+			fail("missing required property %s", name)
+		}
+	}
+	// Validate properties in a stable order so that violations are reported in the same order
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		propAt := at + "/" + name
+		if s.propertyNames != nil {
+			s.propertyNames.validate(name, propAt, violations)
+		}
+		matched := false
+		if propSchema, exists := s.properties[name]; exists {
+			propSchema.validate(obj[name], propAt, violations)
+			matched = true
+		}
+		for re, propSchema := range s.patternProperties {
+			if re.MatchString(name) {
+				propSchema.validate(obj[name], propAt, violations)
+				matched = true
+			}
+		}
+		if !matched && s.additionalProperties != nil {
+			s.additionalProperties.validate(obj[name], propAt, violations)
+		}
+	}
+}
+
+// Read JSON schema from collection directory; return nil if the collection does not have a schema.
+func (col *Col) loadSchema() (*Schema, error) {
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, SCHEMA_CONF_FILE))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var schema interface{}
+	if err = json.Unmarshal(content, &schema); err != nil {
+		return nil, fmt.Errorf("JSON schema of collection %s is corrupted: %v", col.name, err)
+	}
+	return CompileSchema(schema)
+}
+
+// Return an error describing all schema violations of the document, or nil if the document conforms.
+func (col *Col) validateDoc(doc map[string]interface{}) error {
+	if col.schema == nil {
+		return nil
+	}
+	if violations := col.schema.Validate(doc); len(violations) > 0 {
+		return dberr.New(dberr.ErrorSchemaViolation, strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+// Set JSON schema on the collection, new and updated documents must conform to it.
+// Documents that are already in the collection are not validated.
+func (col *Col) SetSchema(schema map[string]interface{}) error {
+	compiled, err := CompileSchema(schema)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	if err = ioutil.WriteFile(path.Join(col.db.path, col.name, SCHEMA_CONF_FILE), content, 0600); err != nil {
+		return err
+	}
+	col.schema = compiled
+	col.logConf(SCHEMA_CONF_FILE)
+	return nil
+}
+
+// Return JSON schema of the collection, or nil if the collection does not have a schema.
+func (col *Col) GetSchema() (map[string]interface{}, error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, SCHEMA_CONF_FILE))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var schema map[string]interface{}
+	err = json.Unmarshal(content, &schema)
+	return schema, err
+}
+
+// Remove JSON schema from the collection.
+func (col *Col) RemoveSchema() error {
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	if col.schema == nil {
+		return fmt.Errorf("Collection %s does not have a schema", col.name)
+	}
+	col.schema = nil
+	if err := os.Remove(path.Join(col.db.path, col.name, SCHEMA_CONF_FILE)); err != nil {
+		return err
+	}
+	col.logConf(SCHEMA_CONF_FILE)
+	return nil
+}
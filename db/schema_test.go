@@ -0,0 +1,199 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(`{
+		"definitions": {
+			"tag": {"type": "string", "pattern": "^[a-z]+$", "maxLength": 5}
+		},
+		"type": "object",
+		"required": ["name", "age"],
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0, "exclusiveMaximum": 150},
+			"score": {"type": "number", "multipleOf": 0.5},
+			"tags": {"type": "array", "items": {"$ref": "#/definitions/tag"}, "uniqueItems": true, "maxItems": 3},
+			"kind": {"enum": ["a", "b", null]},
+			"pair": {"type": "array", "items": [{"type": "string"}, {"type": "number"}], "additionalItems": false},
+			"child": {"$ref": "#"},
+			"contact": {
+				"oneOf": [
+					{"required": ["email"]},
+					{"required": ["phone"]}
+				]
+			}
+		},
+		"patternProperties": {"^x-": {"type": "boolean"}},
+		"additionalProperties": false,
+		"if": {"properties": {"kind": {"const": "a"}}, "required": ["kind"]},
+		"then": {"required": ["score"]}
+	}`), &schema); err != nil {
+		t.Fatal(err)
+	}
+	compiled, err := CompileSchema(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := []string{
+		`{"name": "a", "age": 1}`,
+		`{"name": "a", "age": 149, "score": 1.5, "tags": ["ab", "cd"], "kind": null, "x-flag": true}`,
+		`{"name": "a", "age": 1, "kind": "a", "score": 3}`,
+		`{"name": "a", "age": 1, "pair": ["a", 1], "contact": {"email": "a@b"}}`,
+		`{"name": "a", "age": 1, "child": {"name": "b", "age": 2}}`,
+	}
+	for _, doc := range good {
+		var docObj map[string]interface{}
+		json.Unmarshal([]byte(doc), &docObj)
+		if violations := compiled.Validate(docObj); len(violations) != 0 {
+			t.Fatal(doc, violations)
+		}
+	}
+	bad := map[string]string{
+		`{"name": "a"}`:                                                "missing required property age",
+		`{"name": "", "age": 1}`:                                       "/name: string is shorter",
+		`{"name": "a", "age": 1.5}`:                                    "/age: expected type integer",
+		`{"name": "a", "age": 150}`:                                    "/age: 150 is not less than 150",
+		`{"name": "a", "age": 1, "score": 0.3}`:                        "/score: 0.3 is not a multiple of 0.5",
+		`{"name": "a", "age": 1, "tags": ["a", "a"]}`:                  "/tags: array items 0 and 1 are identical",
+		`{"name": "a", "age": 1, "tags": ["ABC"]}`:                     "/tags/0: string does not match pattern",
+		`{"name": "a", "age": 1, "tags": ["a", "b", "c", "d"]}`:        "/tags: array has more than 3 items",
+		`{"name": "a", "age": 1, "kind": "c"}`:                         "/kind: value c is not one of",
+		`{"name": "a", "age": 1, "pair": ["a", 1, 2]}`:                 "/pair/2: no value is allowed",
+		`{"name": "a", "age": 1, "child": {"name": "b"}}`:              "/child: missing required property age",
+		`{"name": "a", "age": 1, "contact": {"email": 1, "phone": 2}}`: "/contact: value matches 2 schemas in oneOf",
+		`{"name": "a", "age": 1, "x-flag": 1}`:                         "/x-flag: expected type boolean",
+		`{"name": "a", "age": 1, "other": 1}`:                          "/other: no value is allowed",
+		`{"name": "a", "age": 1, "kind": "a"}`:                         "missing required property score",
+	}
+	for doc, expected := range bad {
+		var docObj map[string]interface{}
+		json.Unmarshal([]byte(doc), &docObj)
+		violations := compiled.Validate(docObj)
+		if len(violations) != 1 || !strings.Contains(violations[0], expected) {
+			t.Fatal(doc, violations)
+		}
+	}
+	// Documents made in Go code are validated the same way as documents from JSON
+	if violations := compiled.Validate(map[string]interface{}{"name": "a", "age": 3, "tags": []string{"a", "b"}}); len(violations) != 0 {
+		t.Fatal(violations)
+	}
+	// Invalid schemas
+	for _, invalid := range []string{
+		`{"type": "whatever"}`,
+		`{"minLength": -1}`,
+		`{"pattern": "("}`,
+		`{"$ref": "#/definitions/nothing"}`,
+		`{"$ref": "http://example.com/schema"}`,
+		`{"properties": {"a": 1}}`,
+		`{"anyOf": []}`,
+		`{"$ref": "#"}`,
+		`{"definitions": {"a": {"$ref": "#/definitions/b"}, "b": {"$ref": "#/definitions/a"}}, "$ref": "#/definitions/a"}`,
+		`{"definitions": {"a": {"$ref": "#/definitions/a"}}}`,
+		`{"definitions": {"a": {"allOf": [{"type": "object"}, {"$ref": "#/definitions/a"}]}}, "properties": {"x": {"$ref": "#/definitions/a"}}}`,
+		`{"not": {"$ref": "#"}}`,
+	} {
+		var invalidSchema map[string]interface{}
+		json.Unmarshal([]byte(invalid), &invalidSchema)
+		if _, err := CompileSchema(invalidSchema); err == nil {
+			t.Fatal("Did not error", invalid)
+		}
+	}
+}
+
+func TestColSchema(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if schema, err := col.GetSchema(); err != nil || schema != nil {
+		t.Fatal(schema, err)
+	}
+	if col.RemoveSchema() == nil {
+		t.Fatal("Did not error")
+	}
+	if col.SetSchema(map[string]interface{}{"type": 1}) == nil {
+		t.Fatal("Did not error")
+	}
+	if err = col.SetSchema(map[string]interface{}{
+		"required":   []interface{}{"a"},
+		"properties": map[string]interface{}{"a": map[string]interface{}{"type": "integer"}}}); err != nil {
+		t.Fatal(err)
+	}
+	// Insert
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = col.Insert(map[string]interface{}{"a": "1"}); dberr.Type(err) != dberr.ErrorSchemaViolation {
+		t.Fatal(err)
+	}
+	// Update, UpdateFunc, and UpdateBytesFunc
+	if err = col.Update(id, map[string]interface{}{"b": 1}); dberr.Type(err) != dberr.ErrorSchemaViolation {
+		t.Fatal(err)
+	}
+	if err = col.UpdateFunc(id, func(doc map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"a": 1.5}, nil
+	}); dberr.Type(err) != dberr.ErrorSchemaViolation {
+		t.Fatal(err)
+	}
+	if err = col.UpdateBytesFunc(id, func(doc []byte) ([]byte, error) {
+		return []byte(`{"a": null}`), nil
+	}); dberr.Type(err) != dberr.ErrorSchemaViolation {
+		t.Fatal(err)
+	}
+	if err = col.Update(id, map[string]interface{}{"a": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := col.Read(id); err != nil || doc["a"].(float64) != 2 {
+		t.Fatal(doc, err)
+	}
+	// Schema survives reopening and scrubbing
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if schema, err := col.GetSchema(); err != nil || schema["required"].([]interface{})[0] != "a" {
+		t.Fatal(schema, err)
+	}
+	if _, err = col.Insert(map[string]interface{}{}); dberr.Type(err) != dberr.ErrorSchemaViolation {
+		t.Fatal(err)
+	}
+	// Remove schema
+	if err = col.RemoveSchema(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = col.Insert(map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
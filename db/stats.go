@@ -0,0 +1,32 @@
+// Storage statistics of collections.
+
+package db
+
+import "github.com/HouzuoGuo/tiedot/data"
+
+// Space usage of a collection partition.
+type PartitionStats struct {
+	Documents data.CollectionStats           `json:"documents"` // Document data file
+	Lookup    data.HashTableStats            `json:"lookup"`    // Document ID lookup table
+	Indexes   map[string]data.HashTableStats `json:"indexes"`   // Index partitions by index name
+}
+
+// Calculate space usage of every partition, including document data, ID lookup, and index partitions.
+func (col *Col) StorageStats() []PartitionStats {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	stats := make([]PartitionStats, col.numParts)
+	for i, part := range col.parts {
+		part.DataLock.RLock()
+		stats[i].Documents = part.DocStats()
+		stats[i].Lookup = part.LookupStats()
+		part.DataLock.RUnlock()
+		stats[i].Indexes = make(map[string]data.HashTableStats, len(col.hts[i]))
+		for idxName, ht := range col.hts[i] {
+			ht.Lock.RLock()
+			stats[i].Indexes[idxName] = ht.Stats()
+			ht.Lock.RUnlock()
+		}
+	}
+	return stats
+}
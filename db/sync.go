@@ -0,0 +1,157 @@
+// Durability of writes - when changes of data files are written to disk.
+
+package db
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	SYNC_NONE     = "none"     // Leave writing back to the OS, changes are on disk only after Sync
+	SYNC_INTERVAL = "interval" // Sync all collections every SyncInterval, and when the database is closed
+	SYNC_WRITE    = "write"    // Every document write is on disk before it returns
+)
+
+var (
+	SyncInterval = time.Second // How often all collections are synced in SYNC_INTERVAL mode
+)
+
+// Open database with encryption keys (may be nil) in the durability mode, one of SYNC_* constants.
+func OpenDBWithDurability(dbPath string, keys KeyProvider, durability string) (*DB, error) {
+	switch durability {
+	case SYNC_NONE, SYNC_INTERVAL, SYNC_WRITE:
+	default:
+		return nil, fmt.Errorf("Unknown durability mode '%s'", durability)
+	}
+	db, err := openDB(dbPath, keys, false, durability)
+	if err != nil {
+		return db, err
+	}
+	db.runInBackground(TTLSweepInterval, db.sweepExpired)
+	db.runInBackground(CompactInterval, db.compactFragmented)
+	if durability == SYNC_INTERVAL {
+		db.runInBackground(SyncInterval, func() {
+			if err := db.Sync(); err != nil {
+				tdlog.CritNoRepeat("Failed to sync database %s: %v", db.path, err)
+			}
+		})
+	}
+	return db, nil
+}
+
+// Return the durability mode of the database.
+func (db *DB) Durability() string {
+	return db.durability
+}
+
+// Write everything written to all collections so far to disk, and wait for the disk.
+func (db *DB) Sync() error {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	for _, col := range db.cols {
+		if err := col.sync(); err != nil {
+			return err
+		}
+	}
+	if db.replog != nil {
+		return db.replog.sync()
+	}
+	return nil
+}
+
+// Write everything written to the collection so far to disk, and wait for the disk.
+func (col *Col) Sync() error {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	return col.sync()
+}
+
+// Sync documents, indexes, expiry partitions, and attachments. Caller must hold schema lock.
+func (col *Col) sync() error {
+	for _, part := range col.parts {
+		part.DataLock.RLock()
+		err := part.Sync()
+		part.DataLock.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+	for i := range col.parts {
+		for _, ht := range col.hts[i] {
+			ht.Lock.RLock()
+			err := ht.Sync()
+			ht.Lock.RUnlock()
+			if err != nil {
+				return err
+			}
+		}
+		if col.exps != nil {
+			col.exps[i].Lock.RLock()
+			err := col.exps[i].Sync()
+			col.exps[i].Lock.RUnlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return col.syncAttachments()
+}
+
+// Sync attachment files that are not synced as they are written.
+func (col *Col) syncAttachments() error {
+	if col.db.durability == SYNC_WRITE {
+		return nil
+	}
+	col.attachLock.RLock()
+	defer col.attachLock.RUnlock()
+	err := filepath.Walk(path.Join(col.db.path, col.name, ATTACH_DIR), func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		fh, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		return fh.Sync()
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Sync hash tables filled in by a schema change all at once, then turn on their synchronous writes if the database
+// is in SYNC_WRITE mode.
+func (col *Col) syncFilled(hts []*data.HashTable) error {
+	if col.db.durability != SYNC_WRITE {
+		return nil
+	}
+	for _, ht := range hts {
+		if err := ht.Sync(); err != nil {
+			return err
+		}
+		ht.SyncWrites = true
+	}
+	return nil
+}
+
+// Turn synchronous writes of documents and index entries on or off.
+func (col *Col) syncWrites(on bool) {
+	for i, part := range col.parts {
+		part.SyncWrites = on
+		for _, ht := range col.hts[i] {
+			ht.SyncWrites = on
+		}
+		if col.exps != nil {
+			col.exps[i].SyncWrites = on
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDurability(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDBWithDurability(TEST_DATA_DIR, nil, "whatever"); err == nil {
+		t.Fatal("Did not error")
+	}
+	// Per-write mode
+	db, err := OpenDBWithDurability(TEST_DATA_DIR, nil, SYNC_WRITE)
+	if err != nil {
+		t.Fatal(err)
+	} else if db.Durability() != SYNC_WRITE {
+		t.Fatal(db.Durability())
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if _, err = col.Insert(map[string]interface{}{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	// Index and expiry tables filled in by schema changes sync further writes too
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.SetTTL(nil, 3600); err != nil {
+		t.Fatal(err)
+	}
+	for i, part := range col.parts {
+		if !part.SyncWrites || !col.hts[i]["a"].SyncWrites || !col.exps[i].SyncWrites {
+			t.Fatal("Writes are not synchronous")
+		}
+	}
+	id, err := col.Insert(map[string]interface{}{"a": "durable"})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = col.PutAttachment(id, "file", strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	// Bulk insert syncs once per batch, and leaves writes synchronous
+	bulkIDs, errs := col.InsertMany([]map[string]interface{}{{"a": "bulk"}, {"a": "bulk"}, {"a": "bulk"}})
+	for i := range bulkIDs {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		} else if _, expires := col.expiryOf(bulkIDs[i]); !expires {
+			t.Fatal("Bulk inserted document does not expire")
+		}
+	}
+	for i, part := range col.parts {
+		if !part.SyncWrites || !col.hts[i]["a"].SyncWrites || !col.exps[i].SyncWrites {
+			t.Fatal("Writes are not synchronous")
+		}
+	}
+	// Scrub does not sync every document, the rebuilt collection syncs its writes
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	for i, part := range col.parts {
+		if !part.SyncWrites || !col.hts[i]["a"].SyncWrites || !col.exps[i].SyncWrites {
+			t.Fatal("Writes are not synchronous")
+		}
+	}
+	if doc, err := col.Read(id); err != nil || doc["a"] != "durable" {
+		t.Fatal(doc, err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// No syncing mode
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	} else if db.Durability() != SYNC_NONE {
+		t.Fatal(db.Durability())
+	}
+	col = db.Use("col")
+	for i, part := range col.parts {
+		if part.SyncWrites || col.hts[i]["a"].SyncWrites {
+			t.Fatal("Writes are synchronous")
+		}
+	}
+	if id, err = col.Insert(map[string]interface{}{"a": "synced"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err = db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path.Join(TEST_DATA_DIR, "col", DOC_DATA_FILE+"0"))
+	if err != nil {
+		t.Fatal(err)
+	} else if otherContent, err := ioutil.ReadFile(path.Join(TEST_DATA_DIR, "col", DOC_DATA_FILE+"1")); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Contains(content, []byte("synced")) && !bytes.Contains(otherContent, []byte("synced")) {
+		t.Fatal("Document is not in data file")
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Interval mode syncs in background
+	SyncInterval = 10 * time.Millisecond
+	defer func() {
+		SyncInterval = time.Second
+	}()
+	if db, err = OpenDBWithDurability(TEST_DATA_DIR, nil, SYNC_INTERVAL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Use("col").Insert(map[string]interface{}{"a": "interval"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": "interval", "in": []interface{}{"a"}}, db.Use("col"), &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+}
@@ -0,0 +1,311 @@
+// Document expiry (time-to-live) management.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	TTL_CONF_FILE   = "ttl"  // Name of collection expiry configuration file.
+	DOC_EXPIRY_FILE = "exp_" // Prefix of partition hash table (document ID to expiry time) file name.
+)
+
+var (
+	TTLSweepInterval = time.Minute // How often the background sweeper deletes expired documents
+)
+
+// Expiry configuration of a collection.
+type TTL struct {
+	Path    []string `json:"path"`    // Document attribute that carries the expiry (or base) time
+	Seconds int      `json:"seconds"` // Time to live counted from the attribute value, or from the latest write if there is no path
+}
+
+// Calculate the expiry time (Unix seconds) of a document written at the specified time; return false if the document never expires.
+func (ttl *TTL) expiry(doc map[string]interface{}, writtenAt int64) (expireAt int64, expires bool) {
+	if len(ttl.Path) == 0 {
+		return writtenAt + int64(ttl.Seconds), true
+	}
+	// Pick the earliest time out of all the values found on the path
+	for _, val := range GetIn(doc, ttl.Path) {
+		var baseTime int64
+		switch v := val.(type) {
+		case float64:
+			baseTime = int64(v)
+		case int:
+			baseTime = int64(v)
+		case int64:
+			baseTime = v
+		case string:
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				continue
+			}
+			baseTime = parsed.Unix()
+		default:
+			continue
+		}
+		if at := baseTime + int64(ttl.Seconds); !expires || at < expireAt {
+			expireAt, expires = at, true
+		}
+	}
+	return
+}
+
+// Read expiry configuration from collection directory; return nil if the collection does not expire documents.
+func (col *Col) loadTTL() (*TTL, error) {
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, TTL_CONF_FILE))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ttl := new(TTL)
+	if err = json.Unmarshal(content, ttl); err != nil {
+		return nil, fmt.Errorf("Expiry configuration of collection %s is corrupted: %v", col.name, err)
+	}
+	return ttl, nil
+}
+
+// Open expiry hash tables of all partitions.
+func (col *Col) openExpiry() (err error) {
+	col.exps = make([]*data.HashTable, col.numParts)
+	for i := 0; i < col.numParts; i++ {
+		if col.exps[i], err = col.db.openHashTable(
+			path.Join(col.db.path, col.name, DOC_EXPIRY_FILE+strconv.Itoa(i))); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Remember the expiry time of a newly written document. Caller should hold the partition's exclusive data lock, so
+// that the sweeper never sees a written document with its previous expiry time.
+func (col *Col) expireDoc(id int, doc map[string]interface{}) {
+	if col.ttl == nil {
+		return
+	}
+	if expireAt, expires := col.ttl.expiry(doc, time.Now().Unix()); expires {
+		col.setExpiry(id, expireAt)
+	}
+}
+
+// Overwrite expiry time of a document.
+func (col *Col) setExpiry(id int, expireAt int64) {
+	ht := col.exps[id%col.numParts]
+	ht.Lock.Lock()
+	for _, oldExpiry := range ht.Get(id, 0) {
+		ht.Remove(id, oldExpiry)
+	}
+	ht.Put(id, int(expireAt))
+	ht.Lock.Unlock()
+}
+
+// Forget the expiry time of a document.
+func (col *Col) unexpireDoc(id int) {
+	if col.ttl == nil {
+		return
+	}
+	ht := col.exps[id%col.numParts]
+	ht.Lock.Lock()
+	for _, oldExpiry := range ht.Get(id, 0) {
+		ht.Remove(id, oldExpiry)
+	}
+	ht.Lock.Unlock()
+}
+
+// Return expiry time of a document; return false if the document does not expire.
+func (col *Col) expiryOf(id int) (expireAt int64, expires bool) {
+	if col.ttl == nil {
+		return
+	}
+	ht := col.exps[id%col.numParts]
+	ht.Lock.RLock()
+	vals := ht.Get(id, 1)
+	ht.Lock.RUnlock()
+	if len(vals) == 0 {
+		return
+	}
+	return int64(vals[0]), true
+}
+
+// Return true if the document has expired but may not have been deleted yet.
+func (col *Col) expired(id int, now int64) bool {
+	expireAt, expires := col.expiryOf(id)
+	return expires && expireAt <= now
+}
+
+// Remove backup markers of all partitions, so that the next incremental snapshot copies rebuilt expiry tables.
+// Caller must hold exclusive schema lock.
+func (col *Col) unmarkExpiry() error {
+	for _, part := range col.parts {
+		part.DataLock.Lock()
+		err := part.Unmark()
+		part.DataLock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set expiry configuration on the collection. If path is given, documents expire at the time (Unix seconds or RFC3339)
+// found on the path plus the seconds; otherwise documents expire the seconds after they were last inserted or updated.
+func (col *Col) SetTTL(ttlPath []string, seconds int) error {
+	if len(ttlPath) == 0 && seconds <= 0 {
+		return fmt.Errorf("Please specify an expiry path, a positive TTL, or both")
+	}
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	ttl := &TTL{Path: ttlPath, Seconds: seconds}
+	content, err := json.Marshal(ttl)
+	if err != nil {
+		return err
+	}
+	if err = col.unmarkExpiry(); err != nil {
+		return err
+	} else if err = ioutil.WriteFile(path.Join(col.db.path, col.name, TTL_CONF_FILE), content, 0600); err != nil {
+		return err
+	}
+	if col.ttl == nil {
+		if err = col.openExpiry(); err != nil {
+			return err
+		}
+	}
+	for _, ht := range col.exps {
+		ht.SyncWrites = false
+		if err = ht.Clear(); err != nil {
+			return err
+		}
+	}
+	col.ttl = ttl
+	// Existing documents are treated as if they were written just now
+	col.forEachDoc(func(id int, doc []byte) (moveOn bool) {
+		docObj, err := col.format.Unmarshal(doc)
+		if err != nil {
+			// Skip corrupted document
+			return true
+		}
+		col.expireDoc(id, docObj)
+		return true
+	}, false)
+	if err = col.syncFilled(col.exps); err != nil {
+		return err
+	}
+	col.logConf(TTL_CONF_FILE)
+	return nil
+}
+
+// Return expiry configuration of the collection, or nil if documents do not expire.
+func (col *Col) GetTTL() *TTL {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if col.ttl == nil {
+		return nil
+	}
+	pathCopy := make([]string, len(col.ttl.Path))
+	copy(pathCopy, col.ttl.Path)
+	return &TTL{Path: pathCopy, Seconds: col.ttl.Seconds}
+}
+
+// Remove expiry configuration from the collection, documents will no longer expire.
+func (col *Col) RemoveTTL() error {
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	if col.ttl == nil {
+		return fmt.Errorf("Collection %s does not expire documents", col.name)
+	} else if err := col.unmarkExpiry(); err != nil {
+		return err
+	}
+	for i, ht := range col.exps {
+		if err := ht.Close(); err != nil {
+			return err
+		} else if err := os.Remove(path.Join(col.db.path, col.name, DOC_EXPIRY_FILE+strconv.Itoa(i))); err != nil {
+			return err
+		}
+	}
+	col.ttl = nil
+	col.exps = nil
+	if err := os.Remove(path.Join(col.db.path, col.name, TTL_CONF_FILE)); err != nil {
+		return err
+	}
+	col.logConf(TTL_CONF_FILE)
+	return nil
+}
+
+// Delete all expired documents, return number of documents deleted. Does not place schema lock.
+func (col *Col) purgeExpired(now int64) (purged int) {
+	if col.ttl == nil {
+		return
+	}
+	for _, ht := range col.exps {
+		expiredIDs := make([]int, 0)
+		ht.Lock.RLock()
+		ids, expiries := ht.GetPartition(0, 1)
+		ht.Lock.RUnlock()
+		for i, id := range ids {
+			if int64(expiries[i]) <= now {
+				expiredIDs = append(expiredIDs, id)
+			}
+		}
+		for _, id := range expiredIDs {
+			// The document may have been written again in the meantime
+			deleted, err := col.deleteIf(id, false, func(doc []byte) bool {
+				if !col.expired(id, now) {
+					return false
+				} else if len(col.ttl.Path) == 0 {
+					return true
+				}
+				docObj, err := col.format.Unmarshal(doc)
+				if err != nil {
+					// Corrupted document is deleted all the same
+					return true
+				}
+				expireAt, expires := col.ttl.expiry(docObj, now)
+				return expires && expireAt <= now
+			})
+			if deleted {
+				purged++
+			} else if err != nil {
+				// The document disappeared without its expiry being cleaned up
+				col.unexpireDoc(id)
+			}
+		}
+	}
+	return
+}
+
+// Delete expired documents from all collections.
+func (db *DB) sweepExpired() {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	now := time.Now().Unix()
+	for name, col := range db.cols {
+		if purged := col.purgeExpired(now); purged > 0 {
+			tdlog.Infof("Deleted %d expired documents from %s", purged, name)
+		}
+	}
+}
+
+// Wrap a document iteration function so that it does not see expired documents.
+func (col *Col) skipExpired(fun func(id int, doc []byte) bool) func(id int, doc []byte) bool {
+	if col.ttl == nil {
+		return fun
+	}
+	now := time.Now().Unix()
+	return func(id int, doc []byte) bool {
+		if col.expired(id, now) {
+			return true
+		}
+		return fun(id, doc)
+	}
+}
@@ -0,0 +1,187 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestTTLByPath(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	pastID, err := col.Insert(map[string]interface{}{"a": 1, "expire": float64(now - 10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	futureID, err := col.Insert(map[string]interface{}{"a": 1, "expire": time.Unix(now+3600, 0).Format(time.RFC3339)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	neverID, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if col.RemoveTTL() == nil {
+		t.Fatal("Did not error")
+	}
+	if col.SetTTL(nil, 0) == nil {
+		t.Fatal("Did not error")
+	}
+	if err = col.SetTTL([]string{"expire"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := col.GetTTL(); ttl == nil || len(ttl.Path) != 1 || ttl.Path[0] != "expire" || ttl.Seconds != 0 {
+		t.Fatal(ttl)
+	}
+	// Expired document is hidden from reads and queries
+	if _, err = col.Read(pastID); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal("Did not error")
+	}
+	if _, err = col.Read(futureID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = col.Read(neverID); err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}, col, &result); err != nil {
+		t.Fatal(err)
+	}
+	if _, has := result[pastID]; has || len(result) != 2 {
+		t.Fatal(result)
+	}
+	for _, q := range []interface{}{
+		map[string]interface{}{"has": []interface{}{"a"}},
+		map[string]interface{}{"int-from": 0, "int-to": 2, "in": []interface{}{"a"}},
+		[]interface{}{strconv.Itoa(pastID), strconv.Itoa(futureID), strconv.Itoa(neverID)},
+	} {
+		result = make(map[int]struct{})
+		if err = EvalQuery(q, col, &result); err != nil {
+			t.Fatal(err)
+		} else if _, has := result[pastID]; has || len(result) != 2 {
+			t.Fatal(q, result)
+		}
+	}
+	// Sweeper deletes expired document and its index entries
+	db.sweepExpired()
+	if _, err = col.Read(pastID); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal("Did not error")
+	}
+	if vals := col.hashScan("a", StrHash("1"), 0); len(vals) != 2 {
+		t.Fatal(vals)
+	}
+	// Sweeper does not delete a document written with a later expiry after its expiry was read
+	col.setExpiry(futureID, now-5)
+	if purged := col.purgeExpired(now); purged != 0 {
+		t.Fatal(purged)
+	}
+	col.expireDoc(futureID, map[string]interface{}{"expire": time.Unix(now+3600, 0).Format(time.RFC3339)})
+	// Updating the expiry attribute changes expiry time
+	if err = col.Update(futureID, map[string]interface{}{"a": 1, "expire": now - 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = col.Read(futureID); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal("Did not error")
+	}
+	// Configuration persists after reopening the database
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if _, err = col.Read(futureID); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal("Did not error")
+	}
+	if _, err = col.Read(neverID); err != nil {
+		t.Fatal(err)
+	}
+	// Remove TTL
+	if err = col.RemoveTTL(); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := col.GetTTL(); ttl != nil {
+		t.Fatal(ttl)
+	}
+	if _, err = col.Read(futureID); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTTLCollectionWide(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	TTLSweepInterval = 100 * time.Millisecond
+	defer func() {
+		TTLSweepInterval = time.Minute
+	}()
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.SetTTL(nil, 2); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Scrub keeps the original expiry time
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if col.GetTTL() == nil {
+		t.Fatal("TTL is lost after scrub")
+	}
+	if _, err = col.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	// Background sweeper deletes the document
+	time.Sleep(3500 * time.Millisecond)
+	if _, err = col.Read(id); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal("Did not error")
+	}
+	if count := col.ApproxDocCount(); count != 0 {
+		t.Fatal(count)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
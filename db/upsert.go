@@ -0,0 +1,81 @@
+// Upsert - insert or update a document by unique key.
+
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// Exclusively lock an upsert key, wait if the key is already locked.
+func (col *Col) lockUpsert(key string) {
+	for {
+		col.upsertLock.Lock()
+		ch, ok := col.upserting[key]
+		if !ok {
+			col.upserting[key] = make(chan struct{})
+		}
+		col.upsertLock.Unlock()
+		if ok {
+			<-ch
+		} else {
+			break
+		}
+	}
+}
+
+// Unlock an upsert key.
+func (col *Col) unlockUpsert(key string) {
+	col.upsertLock.Lock()
+	ch := col.upserting[key]
+	delete(col.upserting, key)
+	col.upsertLock.Unlock()
+	close(ch)
+}
+
+// Insert the document, or replace the document that has the same value on the key path.
+// The key path must be indexed, and the document must have exactly one value on the key path.
+// Upserts of the same key are serialized; the caller must not insert/update documents of the key by other means.
+func (col *Col) Upsert(keyPath []string, doc map[string]interface{}) (id int, inserted bool, err error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	idxName := strings.Join(keyPath, INDEX_PATH_SEP)
+	if _, indexed := col.indexPaths[idxName]; !indexed {
+		return 0, false, dberr.New(dberr.ErrorNeedIndex, idxName, "upsert")
+	}
+	keyVals := make([]interface{}, 0, 1)
+	for _, val := range GetIn(doc, keyPath) {
+		if val != nil {
+			keyVals = append(keyVals, val)
+		}
+	}
+	if len(keyVals) == 0 {
+		return 0, false, dberr.New(dberr.ErrorMissing, idxName)
+	} else if len(keyVals) > 1 {
+		return 0, false, fmt.Errorf("Document has %d values on upsert key %s, expecting only one", len(keyVals), idxName)
+	}
+	keyStr := fmt.Sprint(keyVals[0])
+	col.lockUpsert(idxName + INDEX_PATH_SEP + keyStr)
+	defer col.unlockUpsert(idxName + INDEX_PATH_SEP + keyStr)
+
+	// Look for the existing document, filter result to avoid hash collision
+	existingID, found := 0, false
+	for _, match := range col.hashScan(idxName, col.hash(keyStr), 0) {
+		existing, readErr := col.read(match, false)
+		if readErr != nil {
+			continue
+		}
+		for _, val := range GetIn(existing, keyPath) {
+			if fmt.Sprint(val) == keyStr && (!found || match < existingID) {
+				existingID, found = match, true
+			}
+		}
+	}
+	if found {
+		return existingID, false, col.update(existingID, doc, false)
+	}
+	id, err = col.insert(doc, false)
+	return id, err == nil, err
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestUpsert(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	key := []string{"ext", "id"}
+	if _, _, err = col.Upsert(key, map[string]interface{}{"ext": map[string]interface{}{"id": 1}}); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	if err = col.Index(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = col.Upsert(key, map[string]interface{}{"a": 1}); dberr.Type(err) != dberr.ErrorMissing {
+		t.Fatal(err)
+	}
+	if _, _, err = col.Upsert(key, map[string]interface{}{"ext": []interface{}{map[string]interface{}{"id": 1}, map[string]interface{}{"id": 2}}}); err == nil {
+		t.Fatal("Did not error")
+	}
+	id, inserted, err := col.Upsert(key, map[string]interface{}{"ext": map[string]interface{}{"id": 1}, "v": 1})
+	if err != nil || !inserted {
+		t.Fatal(inserted, err)
+	}
+	id2, inserted, err := col.Upsert(key, map[string]interface{}{"ext": map[string]interface{}{"id": 1}, "v": 2})
+	if err != nil || inserted || id2 != id {
+		t.Fatal(id2, inserted, err)
+	}
+	if doc, err := col.Read(id); err != nil || doc["v"].(float64) != 2 {
+		t.Fatal(doc, err)
+	}
+	// Concurrent upserts of the same key result in one document
+	wg := new(sync.WaitGroup)
+	insertedCount := 0
+	countLock := new(sync.Mutex)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, inserted, err := col.Upsert(key, map[string]interface{}{"ext": map[string]interface{}{"id": "concurrent"}, "v": i})
+			if err != nil {
+				t.Error(err)
+			}
+			if inserted {
+				countLock.Lock()
+				insertedCount++
+				countLock.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if insertedCount != 1 {
+		t.Fatal(insertedCount)
+	}
+	if count := countDocs(col); count != 2 {
+		t.Fatal(count)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,34 @@
+// Integrity verification of collections.
+
+package db
+
+import (
+	"sort"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+// Report documents, ID lookup buckets and index buckets that fail their checksum or have corrupted headers, partition
+// by partition. Does not modify anything.
+func (col *Col) Verify() []data.Corruption {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	idxNames := make([]string, 0, len(col.indexPaths))
+	for idxName := range col.indexPaths {
+		idxNames = append(idxNames, idxName)
+	}
+	sort.Strings(idxNames)
+	corrupt := make([]data.Corruption, 0)
+	for i, part := range col.parts {
+		part.DataLock.RLock()
+		corrupt = append(corrupt, part.Verify()...)
+		part.DataLock.RUnlock()
+		for _, idxName := range idxNames {
+			ht := col.hts[i][idxName]
+			ht.Lock.RLock()
+			corrupt = append(corrupt, ht.Verify()...)
+			ht.Lock.RUnlock()
+		}
+	}
+	return corrupt
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestColVerify(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 10)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	victim, err := col.Insert(map[string]interface{}{"a": "needle"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if corrupt := col.Verify(); len(corrupt) != 0 {
+		t.Fatal(corrupt)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Damage the document on disk
+	dataFile := path.Join(TEST_DATA_DIR, "col", DOC_DATA_FILE+strconv.Itoa(victim%2))
+	content, err := ioutil.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	needle := bytes.Index(content, []byte("needle"))
+	if needle == -1 {
+		t.Fatal("Document is not found in data file")
+	}
+	content[needle] = 'N'
+	if err = ioutil.WriteFile(dataFile, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if _, err = col.Read(victim); dberr.Type(err) != dberr.ErrorCorruptDoc {
+		t.Fatal(err)
+	} else if doc, err := col.Read(ids[0]); err != nil || doc["a"] != float64(0) {
+		t.Fatal(doc, err)
+	}
+	if corrupt := col.Verify(); len(corrupt) != 1 || corrupt[0].File != dataFile || corrupt[0].Reason != "document checksum mismatch" {
+		t.Fatal(corrupt)
+	}
+	// Verification does not modify anything
+	if corrupt := col.Verify(); len(corrupt) != 1 {
+		t.Fatal(corrupt)
+	}
+	// Corrupted document may be deleted
+	if err = col.Delete(victim); err != nil {
+		t.Fatal(err)
+	} else if corrupt := col.Verify(); len(corrupt) != 0 {
+		t.Fatal(corrupt)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -9,11 +9,17 @@ const (
 	ErrorUndefined errorType = "Unknown Error."
 
 	// IO error
-	ErrorIO    errorType = "IO error has occured, see log for more details."
-	ErrorNoDoc errorType = "Document `%d` does not exist"
+	ErrorIO         errorType = "IO error has occured, see log for more details."
+	ErrorNoDoc      errorType = "Document `%d` does not exist"
+	ErrorCorruptDoc errorType = "Document `%d` is corrupted"
 
 	// Document errors
-	ErrorDocTooLarge errorType = "Document is too large. Max: `%d`, Given: `%d`"
+	ErrorDocExists       errorType = "Document `%d` already exists"
+	ErrorDocTooLarge     errorType = "Document is too large. Max: `%d`, Given: `%d`"
+	ErrorSchemaViolation errorType = "Document does not conform to collection schema: %s"
+	ErrorBadPatch        errorType = "Cannot apply patch: %s"
+	ErrorNoAttachment    errorType = "Document `%d` does not have attachment `%s`"
+	ErrorAttachmentName  errorType = "Invalid attachment name `%s`"
 
 	// Query input errors
 	ErrorNeedIndex         errorType = "Please index %v and retry query %v."
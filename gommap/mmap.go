@@ -40,10 +40,34 @@ func Map(f *os.File) (MMap, error) {
 	return mmap(length, fd)
 }
 
+// MapCopy maps an entire file into memory privately: changes to the memory are never written to the file, hence the
+// file may be opened read-only.
+func MapCopy(f *os.File) (MMap, error) {
+	fd := uintptr(f.Fd())
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	length := int(fi.Size())
+	if int64(length) != fi.Size() {
+		return nil, errors.New("memory map file length overflow")
+	}
+	return mmapCopy(length, fd)
+}
+
 func (m *MMap) header() *reflect.SliceHeader {
 	return (*reflect.SliceHeader)(unsafe.Pointer(m))
 }
 
+// Flush synchronously writes changes of the memory mapped region to the file.
+func (m MMap) Flush() error {
+	if len(m) == 0 {
+		return nil
+	}
+	dh := m.header()
+	return flush(dh.Data, uintptr(dh.Len))
+}
+
 // Unmap deletes the memory mapped region, flushes any remaining changes, and sets
 // m to nil.
 // Trying to read or write any remaining references to m after Unmap is called will
@@ -14,6 +14,18 @@ func mmap(len int, fd uintptr) ([]byte, error) {
 	return syscall.Mmap(int(fd), 0, len, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
 }
 
+func mmapCopy(len int, fd uintptr) ([]byte, error) {
+	return syscall.Mmap(int(fd), 0, len, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE)
+}
+
+func flush(addr, len uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, addr, len, syscall.MS_SYNC)
+	if errno != 0 {
+		return syscall.Errno(errno)
+	}
+	return nil
+}
+
 func unmap(addr, len uintptr) error {
 	_, _, errno := syscall.Syscall(syscall.SYS_MUNMAP, addr, len, 0)
 	if errno != 0 {
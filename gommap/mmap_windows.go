@@ -23,12 +23,21 @@ var handleMap = map[uintptr]syscall.Handle{}
 
 // Windows mmap always mapes the entire file regardless of the specified length.
 func mmap(length int, hfile uintptr) ([]byte, error) {
-	h, errno := syscall.CreateFileMapping(syscall.Handle(hfile), nil, syscall.PAGE_READWRITE, 0, 0, nil)
+	return mapView(length, hfile, syscall.PAGE_READWRITE, syscall.FILE_MAP_WRITE)
+}
+
+// Copy-on-write mapping, changes are not written to the file.
+func mmapCopy(length int, hfile uintptr) ([]byte, error) {
+	return mapView(length, hfile, syscall.PAGE_WRITECOPY, syscall.FILE_MAP_COPY)
+}
+
+func mapView(length int, hfile uintptr, prot, access uint32) ([]byte, error) {
+	h, errno := syscall.CreateFileMapping(syscall.Handle(hfile), nil, prot, 0, 0, nil)
 	if h == 0 {
 		return nil, os.NewSyscallError("CreateFileMapping", errno)
 	}
 
-	addr, errno := syscall.MapViewOfFile(h, syscall.FILE_MAP_WRITE, 0, 0, 0)
+	addr, errno := syscall.MapViewOfFile(h, access, 0, 0, 0)
 	if addr == 0 {
 		return nil, os.NewSyscallError("MapViewOfFile", errno)
 	}
@@ -45,6 +54,11 @@ func mmap(length int, hfile uintptr) ([]byte, error) {
 	return m, nil
 }
 
+// FlushViewOfFile does not wait for the disk, the caller should also flush file buffers of the file handle.
+func flush(addr, len uintptr) error {
+	return os.NewSyscallError("FlushViewOfFile", syscall.FlushViewOfFile(addr, len))
+}
+
 func unmap(addr, len uintptr) error {
 	if err := syscall.UnmapViewOfFile(addr); err != nil {
 		return err
@@ -0,0 +1,180 @@
+// Document attachment handlers.
+
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// Store an attachment of a document. Parameters are passed in URL query, and the attachment content is either the
+// request body or the first file in multipart form; the file name is used if there is no "name" parameter.
+func PutAttachment(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, PUT, OPTIONS")
+	// Parsing form would read the entire content, look for parameters in URL query only
+	query := r.URL.Query()
+	col, id, name := query.Get("col"), query.Get("id"), query.Get("name")
+	if col == "" || id == "" {
+		http.Error(w, "Please pass URL query parameter value of 'col' and 'id'.", 400)
+		return
+	}
+	docID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid document ID '%v'.", id), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	var content io.Reader = r.Body
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		form, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), 400)
+			return
+		}
+		for {
+			part, err := form.NextPart()
+			if err != nil {
+				http.Error(w, "Please pass attachment content as a file in multipart form.", 400)
+				return
+			}
+			if part.FileName() != "" {
+				if name == "" {
+					name = part.FileName()
+				}
+				content = part
+				break
+			}
+		}
+	}
+	if name == "" {
+		http.Error(w, "Please pass URL query parameter value of 'name'.", 400)
+		return
+	}
+	size, err := dbcol.PutAttachment(docID, name, content)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), errStatus(err))
+		return
+	}
+	resp, err := json.Marshal(map[string]interface{}{"name": name, "size": size})
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.WriteHeader(201)
+	w.Write(resp)
+}
+
+// Stream an attachment of a document.
+func GetAttachment(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, id, name string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "id", &id) {
+		return
+	}
+	if !Require(w, r, "name", &name) {
+		return
+	}
+	docID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid document ID '%v'.", id), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	content, size, err := dbcol.GetAttachment(docID, name)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), errStatus(err))
+		return
+	}
+	defer content.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	io.Copy(w, content)
+}
+
+// Return names and sizes of all attachments of a document.
+func ListAttachments(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, id string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "id", &id) {
+		return
+	}
+	docID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid document ID '%v'.", id), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	attachments, err := dbcol.ListAttachments(docID)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), errStatus(err))
+		return
+	}
+	resp, err := json.Marshal(attachments)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Remove an attachment of a document.
+func DeleteAttachment(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, id, name string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "id", &id) {
+		return
+	}
+	if !Require(w, r, "name", &name) {
+		return
+	}
+	docID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid document ID '%v'.", id), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	if err = dbcol.DeleteAttachment(docID, name); err != nil {
+		http.Error(w, fmt.Sprint(err), errStatus(err))
+		return
+	}
+}
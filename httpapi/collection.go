@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 // Create a collection.
@@ -18,7 +20,15 @@ func Create(w http.ResponseWriter, r *http.Request) {
 	if !Require(w, r, "col", &col) {
 		return
 	}
-	if err := HttpDB.Create(col); err != nil {
+	numParts := 0
+	if numPartsStr := r.FormValue("numparts"); numPartsStr != "" {
+		var err error
+		if numParts, err = strconv.Atoi(numPartsStr); err != nil || numParts < 1 {
+			http.Error(w, fmt.Sprintf("Invalid number of partitions '%v'.", numPartsStr), 400)
+			return
+		}
+	}
+	if err := HttpDB.CreateWithPartitions(col, numParts); err != nil {
 		http.Error(w, fmt.Sprint(err), 400)
 	} else {
 		w.WriteHeader(201)
@@ -94,10 +104,506 @@ func Scrub(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-/*
-Noop
-*/
+// Compact collection partitions online, only those in which garbage takes up at least the portion of "threshold" (0 to 1).
+func Compact(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	threshold := 0.0
+	if thresholdStr := r.FormValue("threshold"); thresholdStr != "" {
+		var err error
+		if threshold, err = strconv.ParseFloat(thresholdStr, 64); err != nil || threshold < 0 || threshold > 1 {
+			http.Error(w, fmt.Sprintf("Invalid threshold '%v', please use a number between 0 and 1.", thresholdStr), 400)
+			return
+		}
+	}
+	dbCol := HttpDB.Use(col)
+	if dbCol == nil {
+		http.Error(w, fmt.Sprintf("Collection %s does not exist", col), 400)
+		return
+	}
+	compacted, err := dbCol.Compact(threshold)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write([]byte(strconv.Itoa(compacted)))
+}
+
+// Write everything written so far to disk, either of a collection or of the entire database.
 func Sync(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "must-revalidate")
 	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var err error
+	if col := r.FormValue("col"); col == "" {
+		err = HttpDB.Sync()
+	} else if dbCol := HttpDB.Use(col); dbCol == nil {
+		http.Error(w, fmt.Sprintf("Collection %s does not exist", col), 400)
+		return
+	} else {
+		err = dbCol.Sync()
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+	}
+}
+
+// Expire documents in a collection, either at the time found on a document path, or a number of seconds after the latest write.
+func TTL(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	var ttlPath []string
+	if path := r.FormValue("path"); path != "" {
+		ttlPath = strings.Split(path, ",")
+	}
+	seconds := 0
+	if secondsStr := r.FormValue("seconds"); secondsStr != "" {
+		var err error
+		if seconds, err = strconv.Atoi(secondsStr); err != nil || seconds < 0 {
+			http.Error(w, fmt.Sprintf("Invalid number of seconds '%v'.", secondsStr), 400)
+			return
+		}
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	if err := dbcol.SetTTL(ttlPath, seconds); err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	w.WriteHeader(201)
+}
+
+// Stop expiring documents in a collection.
+func Unttl(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	if err := dbcol.RemoveTTL(); err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+}
+
+// Limit a collection to a number of documents and/or total document size, the oldest documents are evicted on insert.
+func Cap(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	limits := make([]int, 2)
+	for i, key := range []string{"docs", "bytes"} {
+		if val := r.FormValue(key); val != "" {
+			var err error
+			if limits[i], err = strconv.Atoi(val); err != nil || limits[i] < 0 {
+				http.Error(w, fmt.Sprintf("Invalid limit '%s'.", val), 400)
+				return
+			}
+		}
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	if err := dbcol.Cap(limits[0], limits[1]); err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	w.WriteHeader(201)
+}
+
+// Remove size limits from a collection.
+func Uncap(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	if err := dbcol.Uncap(); err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+}
+
+// Set JSON schema on a collection, new and updated documents must conform to it.
+func SetSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, schema string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "schema", &schema) {
+		return
+	}
+	var jsonSchema map[string]interface{}
+	if err := json.Unmarshal([]byte(schema), &jsonSchema); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON schema.", schema), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	if err := dbcol.SetSchema(jsonSchema); err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	w.WriteHeader(201)
+}
+
+// Return JSON schema of a collection.
+func GetSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	schema, err := dbcol.GetSchema()
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	} else if schema == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not have a schema.", col), 404)
+		return
+	}
+	resp, err := json.Marshal(schema)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Remove JSON schema from a collection.
+func Unschema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	if err := dbcol.RemoveSchema(); err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+}
+
+// Set the strategy of generating document IDs of a collection.
+func IDStrategy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, strategy string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "strategy", &strategy) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	if err := dbcol.SetIDStrategy(strategy); err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+}
+
+// Return the strategy of generating document IDs of a collection.
+func GetIDStrategy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	w.Write([]byte(dbcol.GetIDStrategy()))
+}
+
+// Return space usage of every partition of a collection.
+func StorageStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	resp, err := json.Marshal(dbcol.StorageStats())
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Report corrupted records of a collection without modifying anything.
+func Verify(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	resp, err := json.Marshal(dbcol.Verify())
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Set document room policy of a collection.
+func RoomPolicy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, policy string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "policy", &policy) {
+		return
+	}
+	value := 0
+	if valueStr := r.FormValue("value"); valueStr != "" {
+		var err error
+		if value, err = strconv.Atoi(valueStr); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid value '%v'.", valueStr), 400)
+			return
+		}
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	if err := dbcol.SetRoomPolicy(policy, value); err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+}
+
+// Return document room policy of a collection.
+func GetRoomPolicy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	resp, err := json.Marshal(dbcol.GetRoomPolicy())
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Set document compression codec of a collection.
+func Compression(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, codec string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "codec", &codec) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	if err := dbcol.SetCompression(codec); err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+}
+
+// Return document compression codec of a collection.
+func GetCompression(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	w.Write([]byte(dbcol.GetCompression()))
+}
+
+// Encrypt ("enabled" is true) or decrypt all documents and indexes of a collection.
+func Encrypt(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, enabled string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "enabled", &enabled) {
+		return
+	}
+	enable, err := strconv.ParseBool(enabled)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid enabled '%v'.", enabled), 400)
+		return
+	}
+	if err = HttpDB.SetEncryption(col, enable); err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+}
+
+// Start re-encrypting documents of a collection by the current encryption key in background.
+func RotateKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if _, err := HttpDB.RotateKey(col); err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	w.WriteHeader(202)
+}
+
+// Convert all documents of a collection into the document format.
+func Format(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, format string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "format", &format) {
+		return
+	}
+	if err := HttpDB.SetFormat(col, format); err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+}
+
+// Return document format of a collection.
+func GetFormat(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	w.Write([]byte(dbcol.GetFormat()))
 }
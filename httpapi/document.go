@@ -3,12 +3,31 @@
 package httpapi
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
 )
 
+// Return HTTP status code appropriate for the document operation error.
+func errStatus(err error) int {
+	switch dberr.Type(err) {
+	case dberr.ErrorNoDoc, dberr.ErrorNoAttachment:
+		return 404
+	case dberr.ErrorDocExists:
+		return 409
+	case dberr.ErrorSchemaViolation, dberr.ErrorDocTooLarge, dberr.ErrorBadPatch, dberr.ErrorNeedIndex, dberr.ErrorMissing, dberr.ErrorAttachmentName:
+		return 400
+	}
+	return 500
+}
+
 // Insert a document into collection.
 func Insert(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "must-revalidate")
@@ -32,15 +51,68 @@ func Insert(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
 		return
 	}
-	id, err := dbcol.Insert(jsonDoc)
+	var id int
+	var err error
+	if callerID := r.FormValue("id"); callerID != "" {
+		// Caller-supplied document ID
+		if id, err = strconv.Atoi(callerID); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid document ID '%v'.", callerID), 400)
+			return
+		}
+		err = dbcol.InsertWithID(id, jsonDoc)
+	} else {
+		id, err = dbcol.Insert(jsonDoc)
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprint(err), 500)
+		http.Error(w, fmt.Sprint(err), errStatus(err))
 		return
 	}
 	w.WriteHeader(201)
 	w.Write([]byte(fmt.Sprint(id)))
 }
 
+// Insert a document, or replace the document that has the same value on the key path (comma-separated).
+func Upsert(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, key, doc string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "key", &key) {
+		return
+	}
+	if !Require(w, r, "doc", &doc) {
+		return
+	}
+	var jsonDoc map[string]interface{}
+	if err := json.Unmarshal([]byte(doc), &jsonDoc); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON document.", doc), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	id, inserted, err := dbcol.Upsert(strings.Split(key, ","), jsonDoc)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), errStatus(err))
+		return
+	}
+	resp, err := json.Marshal(map[string]interface{}{"id": id, "inserted": inserted})
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	if inserted {
+		w.WriteHeader(201)
+	}
+	w.Write(resp)
+}
+
 // Find and retrieve a document by ID.
 func Get(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "must-revalidate")
@@ -157,7 +229,53 @@ func Update(w http.ResponseWriter, r *http.Request) {
 	}
 	err = dbcol.Update(docID, newDoc)
 	if err != nil {
-		http.Error(w, fmt.Sprint(err), 500)
+		http.Error(w, fmt.Sprint(err), errStatus(err))
+		return
+	}
+}
+
+// Partially update a document with patch operators, or with JSON merge patch if "type" is "merge".
+func Patch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, id, patch string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "id", &id) {
+		return
+	}
+	if !Require(w, r, "patch", &patch) {
+		return
+	}
+	docID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid document ID '%v'.", id), 400)
+		return
+	}
+	var patchObj map[string]interface{}
+	if err := json.Unmarshal([]byte(patch), &patchObj); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON object.", patch), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	switch patchType := r.FormValue("type"); patchType {
+	case "", "ops":
+		err = dbcol.Patch(docID, patchObj)
+	case "merge":
+		err = dbcol.MergePatch(docID, patchObj)
+	default:
+		http.Error(w, fmt.Sprintf("Unknown patch type '%s', please use 'ops' or 'merge'.", patchType), 400)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), errStatus(err))
 		return
 	}
 }
@@ -205,3 +323,107 @@ func ApproxDocCount(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Write([]byte(strconv.Itoa(dbcol.ApproxDocCount())))
 }
+
+// Parse documents of a bulk insert, either a JSON array or newline-delimited JSON documents.
+func parseDocs(body []byte) (docs []map[string]interface{}, err error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &docs)
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	for {
+		var doc map[string]interface{}
+		if err = dec.Decode(&doc); err == io.EOF {
+			return docs, nil
+		} else if err != nil {
+			return
+		}
+		docs = append(docs, doc)
+	}
+}
+
+// Insert many documents into collection, the documents come from parameter "docs" or request body.
+func InsertMany(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	body := []byte(r.FormValue("docs"))
+	if len(body) == 0 {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			http.Error(w, fmt.Sprint(err), 400)
+			return
+		}
+	}
+	docs, err := parseDocs(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Documents are neither a JSON array nor newline-delimited JSON: %v", err), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	ids, errs := dbcol.InsertMany(docs)
+	results := make([]map[string]interface{}, len(docs))
+	for i := range docs {
+		if errs[i] == nil {
+			results[i] = map[string]interface{}{"id": ids[i]}
+		} else {
+			results[i] = map[string]interface{}{"error": fmt.Sprint(errs[i])}
+		}
+	}
+	resp, err := json.Marshal(results)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Find and retrieve many documents by comma-separated IDs.
+func GetMany(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, ids string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "ids", &ids) {
+		return
+	}
+	docIDs := make([]int, 0)
+	for _, id := range strings.Split(ids, ",") {
+		docID, err := strconv.Atoi(strings.TrimSpace(id))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid document ID '%v'.", id), 400)
+			return
+		}
+		docIDs = append(docIDs, docID)
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	docs, missing := dbcol.ReadMany(docIDs)
+	resultDocs := make(map[string]interface{}, len(docs))
+	for docID, doc := range docs {
+		resultDocs[strconv.Itoa(docID)] = doc
+	}
+	resp, err := json.Marshal(map[string]interface{}{"docs": resultDocs, "missing": missing})
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write(resp)
+}
@@ -36,6 +36,29 @@ func Dump(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Take an online snapshot of the database into a directory, incremental if base snapshot directory is given.
+func Snapshot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var dest string
+	if !Require(w, r, "dest", &dest) {
+		return
+	}
+	backup, err := HttpDB.Snapshot(dest, r.FormValue("base"))
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	resp, err := json.Marshal(backup)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write(resp)
+}
+
 // Return server memory statistics.
 func MemStats(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "must-revalidate")
@@ -89,3 +89,83 @@ func Count(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Write([]byte(strconv.Itoa(len(queryResult))))
 }
+
+// Write the outcome of a bulk update/delete as JSON.
+func writeBulkResult(w http.ResponseWriter, result db.BulkResult) {
+	resp, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Apply patch operators to all documents matched by a query, nothing is written if "dryrun" is "true".
+func UpdateWhere(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, q, patch string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "q", &q) {
+		return
+	}
+	if !Require(w, r, "patch", &patch) {
+		return
+	}
+	var qJson interface{}
+	if err := json.Unmarshal([]byte(q), &qJson); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", q), 400)
+		return
+	}
+	var patchObj map[string]interface{}
+	if err := json.Unmarshal([]byte(patch), &patchObj); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON object.", patch), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	result, err := dbcol.UpdateWhere(qJson, patchObj, r.FormValue("dryrun") == "true")
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	writeBulkResult(w, result)
+}
+
+// Delete all documents matched by a query, nothing is deleted if "dryrun" is "true".
+func DeleteWhere(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, q string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "q", &q) {
+		return
+	}
+	var qJson interface{}
+	if err := json.Unmarshal([]byte(q), &qJson); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", q), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	result, err := dbcol.DeleteWhere(qJson, r.FormValue("dryrun") == "true")
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	writeBulkResult(w, result)
+}
@@ -0,0 +1,347 @@
+// Primary/replica replication handlers and the replica that pulls mutation log from its primary.
+
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/db"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	REPL_LOG_ID_HEADER  = "X-Tiedot-Log-Id"  // Response header of log ID that an export for replica starts from
+	REPL_LOG_SEQ_HEADER = "X-Tiedot-Log-Seq" // Response header of log sequence number that an export for replica starts from
+	REPL_BATCH          = 1000               // Maximum number of log entries a replica pulls at a time
+	REPL_WAIT           = 10 * time.Second   // How long the primary holds a log request until there are new entries
+	REPL_RETRY          = time.Second        // How long a replica waits after failing to pull or apply log entries
+)
+
+var (
+	HttpReplica *Replica // Pull changes of the primary into HttpDB (nil if the server is not a replica)
+
+	replicasSeen     = make(map[string]ReplicaProgress) // Progress of replicas that pull from this primary, by name
+	replicasSeenLock = new(sync.Mutex)
+)
+
+// Replication progress of a replica as seen by its primary.
+type ReplicaProgress struct {
+	Applied     int64     `json:"applied"`    // Sequence number of the last applied log entry
+	LagEntries  int64     `json:"lagEntries"` // Number of log entries not yet applied
+	LagSeconds  float64   `json:"lagSeconds"` // Age of the oldest change not yet applied
+	LastContact time.Time `json:"lastContact"`
+}
+
+// Replication status of a replica.
+type ReplicaStatus struct {
+	Role        string    `json:"role"`
+	Primary     string    `json:"primary"`
+	LogID       string    `json:"logID"`
+	Applied     int64     `json:"applied"`     // Sequence number of the last applied log entry
+	PrimaryLast int64     `json:"primaryLast"` // Sequence number of the latest log entry of the primary as of last contact
+	LagEntries  int64     `json:"lagEntries"`  // Number of log entries not yet applied as of last contact
+	LagSeconds  float64   `json:"lagSeconds"`  // Age of the oldest change not yet applied as of last contact
+	LastContact time.Time `json:"lastContact"`
+	LastError   string    `json:"lastError"`
+	Resyncs     int       `json:"resyncs"` // Number of times the replica started over from an export of the primary
+}
+
+// Mutation log entries returned to a replica.
+type replLogResp struct {
+	LogID    string         `json:"logID"`
+	Last     int64          `json:"last"`     // Sequence number of the latest entry
+	NextTime int64          `json:"nextTime"` // Time of the entry after the returned ones (0 if there is none)
+	Entries  []db.ReplEntry `json:"entries"`
+}
+
+// A replica pulls mutation log from its primary and applies it to the database.
+type Replica struct {
+	DB      *db.DB
+	Primary string // host:port of the primary, or its base URL
+	Token   string // Pre-shared authorization token of the primary (empty if there is none)
+	Name    string // Tells the replica apart in status of the primary
+	client  *http.Client
+	stop    chan struct{}
+	lock    *sync.Mutex
+	status  ReplicaStatus
+}
+
+// Create a replica of the primary that applies changes to the database.
+func NewReplica(replicaDB *db.DB, primary, token, name string) *Replica {
+	return &Replica{DB: replicaDB, Primary: primary, Token: token, Name: name,
+		client: &http.Client{Timeout: 2*REPL_WAIT + 10*time.Second},
+		stop:   make(chan struct{}),
+		lock:   new(sync.Mutex),
+		status: ReplicaStatus{Role: "replica", Primary: primary}}
+}
+
+// Return URL of the primary endpoint.
+func (rep *Replica) url(endpoint string) string {
+	if strings.Contains(rep.Primary, "://") {
+		return strings.TrimSuffix(rep.Primary, "/") + endpoint
+	}
+	return "http://" + rep.Primary + endpoint
+}
+
+// Send a GET request to the primary.
+func (rep *Replica) get(reqURL string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rep.Token != "" {
+		req.Header.Set("Authorization", "token "+rep.Token)
+	}
+	return rep.client.Do(req)
+}
+
+// Pull and apply changes of the primary until stopped.
+func (rep *Replica) Run() {
+	tdlog.Noticef("Replicating %s", rep.Primary)
+	for {
+		select {
+		case <-rep.stop:
+			return
+		default:
+		}
+		if err := rep.Step(); err != nil {
+			rep.lock.Lock()
+			rep.status.LastError = fmt.Sprint(err)
+			rep.lock.Unlock()
+			tdlog.CritNoRepeat("Replication of %s: %v", rep.Primary, err)
+			select {
+			case <-rep.stop:
+				return
+			case <-time.After(REPL_RETRY):
+			}
+		}
+	}
+}
+
+// Stop pulling changes of the primary.
+func (rep *Replica) Stop() {
+	close(rep.stop)
+}
+
+// Pull the next log entries from the primary and apply them, waiting a while if there are none. The replica starts
+// over from an export of the primary if it has not replicated the primary before, or the primary no longer retains
+// entries it needs.
+func (rep *Replica) Step() error {
+	pos, err := rep.DB.ReplicaPosition()
+	if err != nil {
+		return err
+	} else if pos.LogID == "" {
+		return rep.resync()
+	}
+	params := url.Values{"logid": {pos.LogID}, "after": {strconv.FormatInt(pos.Seq, 10)}, "limit": {strconv.Itoa(REPL_BATCH)},
+		"wait": {strconv.Itoa(int(REPL_WAIT / time.Second))}, "replica": {rep.Name}}
+	resp, err := rep.get(rep.url("/replog") + "?" + params.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		tdlog.Noticef("Primary %s no longer has log entries after %s/%d, starting over", rep.Primary, pos.LogID, pos.Seq)
+		return rep.resync()
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Primary responded to log request with status %s", resp.Status)
+	}
+	var logResp replLogResp
+	if err = json.NewDecoder(resp.Body).Decode(&logResp); err != nil {
+		return err
+	} else if err = rep.DB.ApplyReplicated(logResp.LogID, logResp.Entries); err != nil {
+		return err
+	}
+	applied := pos.Seq
+	if len(logResp.Entries) > 0 {
+		applied = logResp.Entries[len(logResp.Entries)-1].Seq
+	}
+	rep.lock.Lock()
+	defer rep.lock.Unlock()
+	rep.status.LogID, rep.status.Applied, rep.status.PrimaryLast = logResp.LogID, applied, logResp.Last
+	rep.status.LagEntries, rep.status.LagSeconds = logResp.Last-applied, 0
+	if logResp.NextTime > 0 {
+		rep.status.LagSeconds = time.Since(time.Unix(0, logResp.NextTime)).Seconds()
+	}
+	rep.status.LastContact, rep.status.LastError = time.Now(), ""
+	return nil
+}
+
+// Replace all collections with an export of the primary, and continue from the log position of the export.
+func (rep *Replica) resync() error {
+	resp, err := rep.get(rep.url("/replexport"))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Primary responded to export request with status %s", resp.Status)
+	}
+	pos := db.ReplPosition{LogID: resp.Header.Get(REPL_LOG_ID_HEADER)}
+	if pos.Seq, err = strconv.ParseInt(resp.Header.Get(REPL_LOG_SEQ_HEADER), 10, 64); err != nil || pos.LogID == "" {
+		return fmt.Errorf("Primary did not tell the log position of export")
+	} else if err = rep.DB.ResetReplica(pos, resp.Body); err != nil {
+		return err
+	}
+	tdlog.Noticef("Replica has started over from an export of %s at %s/%d", rep.Primary, pos.LogID, pos.Seq)
+	rep.lock.Lock()
+	defer rep.lock.Unlock()
+	rep.status.LogID, rep.status.Applied = pos.LogID, pos.Seq
+	rep.status.LastContact, rep.status.LastError = time.Now(), ""
+	rep.status.Resyncs++
+	return nil
+}
+
+// Return replication status of the replica.
+func (rep *Replica) Status() ReplicaStatus {
+	rep.lock.Lock()
+	defer rep.lock.Unlock()
+	return rep.status
+}
+
+// Return 403 for requests that would change the database of a replica.
+func replicaReadOnly(originalHandler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if HttpReplica != nil {
+			http.Error(w, fmt.Sprintf("This server is a read-only replica of %s", HttpReplica.Primary), http.StatusForbidden)
+			return
+		}
+		originalHandler(w, r)
+	}
+}
+
+// Return mutation log entries after a sequence number to a replica, waiting a while if there are none.
+func ReplLog(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var logID, after string
+	if !Require(w, r, "logid", &logID) {
+		return
+	}
+	if !Require(w, r, "after", &after) {
+		return
+	}
+	replog := HttpDB.ReplicationLog()
+	if replog == nil {
+		http.Error(w, "This server does not record changes for replicas, please start it with -replog", http.StatusNotFound)
+		return
+	}
+	afterSeq, err := strconv.ParseInt(after, 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid after: %s", after), 400)
+		return
+	}
+	limit, wait := REPL_BATCH, 0
+	if r.FormValue("limit") != "" {
+		if limit, err = strconv.Atoi(r.FormValue("limit")); err != nil || limit < 1 {
+			http.Error(w, fmt.Sprintf("Invalid limit: %s", r.FormValue("limit")), 400)
+			return
+		}
+	}
+	if r.FormValue("wait") != "" {
+		if wait, err = strconv.Atoi(r.FormValue("wait")); err != nil || wait < 0 || time.Duration(wait)*time.Second > REPL_WAIT {
+			http.Error(w, fmt.Sprintf("Invalid wait: %s", r.FormValue("wait")), 400)
+			return
+		}
+	}
+	if logID != replog.ID {
+		http.Error(w, fmt.Sprintf("Replication log %s is not the current log %s", logID, replog.ID), http.StatusGone)
+		return
+	}
+	// The replica has applied all entries up to the requested one
+	progress := ReplicaProgress{Applied: afterSeq, LastContact: time.Now()}
+	pending, err := replog.Read(afterSeq, 1, 0)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusGone)
+		return
+	} else if len(pending) > 0 {
+		progress.LagSeconds = time.Since(time.Unix(0, pending[0].Time)).Seconds()
+	}
+	_, last := replog.Range()
+	progress.LagEntries = last - afterSeq
+	name := r.FormValue("replica")
+	if name == "" {
+		name = r.RemoteAddr
+	}
+	replicasSeenLock.Lock()
+	replicasSeen[name] = progress
+	replicasSeenLock.Unlock()
+	entries, err := replog.Read(afterSeq, limit, time.Duration(wait)*time.Second)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusGone)
+		return
+	}
+	logResp := replLogResp{LogID: replog.ID, Entries: entries}
+	_, logResp.Last = replog.Range()
+	applied := afterSeq
+	if len(entries) > 0 {
+		applied = entries[len(entries)-1].Seq
+	}
+	if next, err := replog.Read(applied, 1, 0); err == nil && len(next) > 0 {
+		logResp.NextTime = next[0].Time
+	}
+	resp, err := json.Marshal(logResp)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Export the database for a replica to start over from, the response headers tell the log position of the export.
+func ReplExport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	replog := HttpDB.ReplicationLog()
+	if replog == nil {
+		http.Error(w, "This server does not record changes for replicas, please start it with -replog", http.StatusNotFound)
+		return
+	}
+	// Changes made during the export are applied again afterwards, which makes no difference
+	_, last := replog.Range()
+	w.Header().Set(REPL_LOG_ID_HEADER, replog.ID)
+	w.Header().Set(REPL_LOG_SEQ_HEADER, strconv.FormatInt(last, 10))
+	if err := HttpDB.Export(w); err != nil {
+		tdlog.CritNoRepeat("Failed to export database for replica: %v", err)
+	}
+}
+
+// Return replication status: the log range and replica progress of a primary, or the lag of a replica.
+func ReplStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var status interface{}
+	if HttpReplica != nil {
+		status = HttpReplica.Status()
+	} else if replog := HttpDB.ReplicationLog(); replog != nil {
+		first, last := replog.Range()
+		replicas := make(map[string]ReplicaProgress)
+		replicasSeenLock.Lock()
+		for name, progress := range replicasSeen {
+			replicas[name] = progress
+		}
+		replicasSeenLock.Unlock()
+		status = map[string]interface{}{"role": "primary", "logID": replog.ID, "first": first, "last": last, "replicas": replicas}
+	} else {
+		status = map[string]interface{}{"role": "standalone"}
+	}
+	resp, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write(resp)
+}
@@ -0,0 +1,96 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+func TestReplication(t *testing.T) {
+	primaryDir, replicaDir := "/tmp/tiedot_test_primary", "/tmp/tiedot_test_replica"
+	for _, dir := range []string{primaryDir, replicaDir} {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+	var err error
+	if HttpDB, err = db.OpenDB(primaryDir); err != nil {
+		t.Fatal(err)
+	}
+	defer HttpDB.Close()
+	if err = HttpDB.StartReplicationLog(100); err != nil {
+		t.Fatal(err)
+	} else if err = HttpDB.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := HttpDB.Use("col").Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/replog", ReplLog)
+	mux.HandleFunc("/replexport", ReplExport)
+	mux.HandleFunc("/replstatus", ReplStatus)
+	mux.HandleFunc("/insert", replicaReadOnly(Insert))
+	primary := httptest.NewServer(mux)
+	defer primary.Close()
+
+	replicaDB, err := db.OpenDB(replicaDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replicaDB.Close()
+	replica := NewReplica(replicaDB, strings.TrimPrefix(primary.URL, "http://"), "", "test-replica")
+	// The replica starts from an export, and then follows the log
+	if err = replica.Step(); err != nil {
+		t.Fatal(err)
+	} else if status := replica.Status(); status.Resyncs != 1 || status.Applied != 2 {
+		t.Fatal(status)
+	}
+	after, err := HttpDB.Use("col").Insert(map[string]interface{}{"a": 2})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = HttpDB.Use("col").Delete(before); err != nil {
+		t.Fatal(err)
+	} else if err = replica.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if status := replica.Status(); status.Applied != 4 || status.LagEntries != 0 || status.LagSeconds != 0 {
+		t.Fatal(status)
+	} else if doc, err := replicaDB.Use("col").Read(after); err != nil || doc["a"] != float64(2) {
+		t.Fatal(doc, err)
+	} else if _, err = replicaDB.Use("col").Read(before); err == nil {
+		t.Fatal("Did not delete")
+	}
+	// The primary shows progress of the replica
+	resp, err := http.Get(primary.URL + "/replstatus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status struct {
+		Role     string
+		Last     int64
+		Replicas map[string]ReplicaProgress
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if err != nil || status.Role != "primary" || status.Last != 4 || status.Replicas["test-replica"].Applied != 2 || status.Replicas["test-replica"].LagEntries != 2 {
+		t.Fatal(status, err)
+	}
+	// A log that is not the current one needs the replica to start over
+	if resp, err = http.Get(primary.URL + "/replog?logid=other&after=0"); err != nil || resp.StatusCode != http.StatusGone {
+		t.Fatal(resp, err)
+	}
+	// Replica rejects changes
+	HttpReplica = replica
+	defer func() {
+		HttpReplica = nil
+	}()
+	if resp, err = http.Get(primary.URL + "/insert?col=col&doc={}"); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatal(resp, err)
+	}
+}
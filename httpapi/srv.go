@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
 
 	"github.com/HouzuoGuo/tiedot/db"
 	"github.com/HouzuoGuo/tiedot/tdlog"
@@ -29,7 +30,13 @@ import (
 )
 
 var (
-	HttpDB *db.DB // HTTP API endpoints operate on this database
+	HttpDB   *db.DB         // HTTP API endpoints operate on this database
+	HttpKeys db.KeyProvider // Encryption keys of the database (nil if there is none)
+
+	HttpDurability = db.SYNC_NONE // When changes of the database are written to disk, one of db.SYNC_* constants
+
+	HttpReplicaOf    string // Address (host:port) of the primary to replicate, the server rejects changes (empty if not a replica)
+	HttpReplogRetain int    // Number of mutation log entries retained for replicas (0 to not record changes)
 )
 
 // Store form parameter value of specified key to *val and return true; if key does not exist, set HTTP status 400 and return false.
@@ -45,10 +52,15 @@ func Require(w http.ResponseWriter, r *http.Request, key string, val *string) bo
 // Start HTTP server and block until the server shuts down. Panic on error.
 func Start(dir string, port int, tlsCrt, tlsKey, jwtPubKey, jwtPrivateKey, bind, authToken string) {
 	var err error
-	HttpDB, err = db.OpenDB(dir)
+	HttpDB, err = db.OpenDBWithDurability(dir, HttpKeys, HttpDurability)
 	if err != nil {
 		panic(err)
 	}
+	if HttpReplogRetain > 0 {
+		if err = HttpDB.StartReplicationLog(HttpReplogRetain); err != nil {
+			panic(err)
+		}
+	}
 
 	// These endpoints are always available and do not require authentication
 	http.HandleFunc("/", Welcome)
@@ -91,30 +103,75 @@ func Start(dir string, port int, tlsCrt, tlsKey, jwtPubKey, jwtPrivateKey, bind,
 			return originalHandler
 		}
 	}
+	// Replica accepts no change other than those of its primary
+	if HttpReplicaOf != "" {
+		hostname, _ := os.Hostname()
+		HttpReplica = NewReplica(HttpDB, HttpReplicaOf, authToken, fmt.Sprintf("%s:%d", hostname, port))
+		go HttpReplica.Run()
+	}
+	writeWrap := func(originalHandler http.HandlerFunc) http.HandlerFunc {
+		return authWrap(replicaReadOnly(originalHandler))
+	}
 	// collection management (stop-the-world)
-	http.HandleFunc("/create", authWrap(Create))
-	http.HandleFunc("/rename", authWrap(Rename))
-	http.HandleFunc("/drop", authWrap(Drop))
+	http.HandleFunc("/create", writeWrap(Create))
+	http.HandleFunc("/rename", writeWrap(Rename))
+	http.HandleFunc("/drop", writeWrap(Drop))
 	http.HandleFunc("/all", authWrap(All))
 	http.HandleFunc("/scrub", authWrap(Scrub))
+	http.HandleFunc("/compact", authWrap(Compact))
+	http.HandleFunc("/storagestats", authWrap(StorageStats))
+	http.HandleFunc("/verify", authWrap(Verify))
 	http.HandleFunc("/sync", authWrap(Sync))
+	http.HandleFunc("/ttl", writeWrap(TTL))
+	http.HandleFunc("/unttl", writeWrap(Unttl))
+	http.HandleFunc("/cap", writeWrap(Cap))
+	http.HandleFunc("/uncap", writeWrap(Uncap))
+	http.HandleFunc("/schema", writeWrap(SetSchema))
+	http.HandleFunc("/getschema", authWrap(GetSchema))
+	http.HandleFunc("/unschema", writeWrap(Unschema))
+	http.HandleFunc("/idstrategy", writeWrap(IDStrategy))
+	http.HandleFunc("/getidstrategy", authWrap(GetIDStrategy))
+	http.HandleFunc("/roompolicy", writeWrap(RoomPolicy))
+	http.HandleFunc("/getroompolicy", authWrap(GetRoomPolicy))
+	http.HandleFunc("/compression", writeWrap(Compression))
+	http.HandleFunc("/getcompression", authWrap(GetCompression))
+	http.HandleFunc("/encrypt", writeWrap(Encrypt))
+	http.HandleFunc("/rotatekey", authWrap(RotateKey))
+	http.HandleFunc("/format", writeWrap(Format))
+	http.HandleFunc("/getformat", authWrap(GetFormat))
 	// query
 	http.HandleFunc("/query", authWrap(Query))
 	http.HandleFunc("/count", authWrap(Count))
+	http.HandleFunc("/updatewhere", writeWrap(UpdateWhere))
+	http.HandleFunc("/deletewhere", writeWrap(DeleteWhere))
 	// document management
-	http.HandleFunc("/insert", authWrap(Insert))
+	http.HandleFunc("/insert", writeWrap(Insert))
+	http.HandleFunc("/insertmany", writeWrap(InsertMany))
 	http.HandleFunc("/get", authWrap(Get))
+	http.HandleFunc("/getmany", authWrap(GetMany))
 	http.HandleFunc("/getpage", authWrap(GetPage))
-	http.HandleFunc("/update", authWrap(Update))
-	http.HandleFunc("/delete", authWrap(Delete))
+	http.HandleFunc("/update", writeWrap(Update))
+	http.HandleFunc("/patch", writeWrap(Patch))
+	http.HandleFunc("/upsert", writeWrap(Upsert))
+	http.HandleFunc("/delete", writeWrap(Delete))
 	http.HandleFunc("/approxdoccount", authWrap(ApproxDocCount))
+	// attachments
+	http.HandleFunc("/putattachment", writeWrap(PutAttachment))
+	http.HandleFunc("/getattachment", authWrap(GetAttachment))
+	http.HandleFunc("/listattachments", authWrap(ListAttachments))
+	http.HandleFunc("/deleteattachment", writeWrap(DeleteAttachment))
 	// index management (stop-the-world)
-	http.HandleFunc("/index", authWrap(Index))
+	http.HandleFunc("/index", writeWrap(Index))
 	http.HandleFunc("/indexes", authWrap(Indexes))
-	http.HandleFunc("/unindex", authWrap(Unindex))
+	http.HandleFunc("/unindex", writeWrap(Unindex))
 	// misc (stop-the-world)
 	http.HandleFunc("/shutdown", authWrap(Shutdown))
 	http.HandleFunc("/dump", authWrap(Dump))
+	http.HandleFunc("/snapshot", authWrap(Snapshot))
+	// replication
+	http.HandleFunc("/replog", authWrap(ReplLog))
+	http.HandleFunc("/replexport", authWrap(ReplExport))
+	http.HandleFunc("/replstatus", authWrap(ReplStatus))
 
 	iface := "all interfaces"
 	if bind != "" {
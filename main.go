@@ -1,8 +1,10 @@
-// Run tiedot HTTP API server, benchmarks, or embedded usage example.
+// Run tiedot HTTP API server, integrity check, benchmarks, or embedded usage example.
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
@@ -11,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/HouzuoGuo/tiedot/db"
 	"github.com/HouzuoGuo/tiedot/httpapi"
 	"github.com/HouzuoGuo/tiedot/tdlog"
 )
@@ -51,7 +54,7 @@ func main() {
 	// General params
 	var mode string
 	var maxprocs int
-	flag.StringVar(&mode, "mode", "", "Mandatory - specify the execution mode [httpd|bench|bench2|example]")
+	flag.StringVar(&mode, "mode", "", "Mandatory - specify the execution mode [httpd|fsck|restore|export|import|repartition|bench|bench2|example]")
 	flag.IntVar(&maxprocs, "gomaxprocs", defaultMaxprocs, "GOMAXPROCS")
 	// Debug params
 	var profile, debug bool
@@ -64,12 +67,36 @@ func main() {
 	var port int
 	var authToken string
 	var tlsCrt, tlsKey string
-	flag.StringVar(&dir, "dir", "", "(HTTP server) database directory")
+	flag.StringVar(&dir, "dir", "", "(HTTP server, fsck, restore, export, import, repartition) database directory")
 	flag.StringVar(&bind, "bind", "", "(HTTP server) bind to IP address (all network interfaces by default)")
 	flag.IntVar(&port, "port", 8080, "(HTTP server) port number")
 	flag.StringVar(&tlsCrt, "tlscrt", "", "(HTTP server) TLS certificate (empty to disable TLS).")
 	flag.StringVar(&tlsKey, "tlskey", "", "(HTTP server) TLS certificate key (empty to disable TLS).")
 	flag.StringVar(&authToken, "authtoken", "", "(HTTP server) Only authorize requests carrying this token in 'Authorization: token TOKEN' header. (empty to disable)")
+	var durability string
+	flag.StringVar(&durability, "sync", db.SYNC_NONE, "(HTTP server) When data is written to disk ["+db.SYNC_NONE+"|"+db.SYNC_INTERVAL+"|"+db.SYNC_WRITE+"]")
+	var replicaOf string
+	flag.StringVar(&replicaOf, "replicaof", "", "(HTTP server) Replicate the primary server at host:port and reject changes (empty to disable)")
+	var replogRetain int
+	flag.IntVar(&replogRetain, "replog", 0, "(HTTP server) Record changes for replicas, retaining this many of the latest changes (0 to disable)")
+	var keyFile string
+	flag.StringVar(&keyFile, "keyfile", "", "(HTTP server, fsck, restore, export, import, repartition) File of encryption keys, one 'version:hex-key' per line (empty to read keys from environment variable "+db.KEY_ENV+")")
+
+	// Fsck mode params
+	var repair bool
+	flag.BoolVar(&repair, "repair", false, "(fsck) Remove dangling index entries and orphan ID lookup entries")
+
+	// Restore mode params
+	var backupDir string
+	flag.StringVar(&backupDir, "backup", "", "(restore) Snapshot directory to restore the database from")
+
+	// Export/import mode params
+	var exportFile string
+	flag.StringVar(&exportFile, "file", "", "(export, import) NDJSON file to export to or import from (empty for standard output/input)")
+
+	// Repartition mode params
+	var numParts int
+	flag.IntVar(&numParts, "partitions", runtime.NumCPU(), "(repartition) New number of partitions")
 
 	// HTTP + JWT params
 	var jwtPubKey, jwtPrivateKey string
@@ -101,7 +128,7 @@ func main() {
 	if profile {
 		resultFile, err := os.Create("perf.out")
 		if err != nil {
-			tdlog.Noticef("Cannot create profiler result file %s", resultFile)
+			tdlog.Noticef("Cannot create profiler result file: %v", err)
 			os.Exit(1)
 		}
 		pprof.StartCPUProfile(resultFile)
@@ -119,6 +146,13 @@ func main() {
 		}()
 	}
 
+	var keys db.KeyProvider
+	if keyFile != "" {
+		keys = db.FileKeyProvider(keyFile)
+	} else if os.Getenv(db.KEY_ENV) != "" {
+		keys = db.EnvKeyProvider(db.KEY_ENV)
+	}
+
 	switch mode {
 	case "httpd":
 		// Run HTTP API server
@@ -138,7 +172,94 @@ func main() {
 			tdlog.Notice("To enable JWT, please specify RSA private and public key.")
 			os.Exit(1)
 		}
+		if replicaOf != "" && replogRetain != 0 {
+			tdlog.Notice("A replica does not record changes for other replicas, please specify either -replicaof or -replog.")
+			os.Exit(1)
+		} else if replogRetain < 0 {
+			tdlog.Notice("Please specify a positive number of changes to retain, for example -replog=100000")
+			os.Exit(1)
+		}
+		httpapi.HttpKeys = keys
+		httpapi.HttpDurability = durability
+		httpapi.HttpReplicaOf = replicaOf
+		httpapi.HttpReplogRetain = replogRetain
 		httpapi.Start(dir, port, tlsCrt, tlsKey, jwtPubKey, jwtPrivateKey, bind, authToken)
+	case "fsck":
+		// Check integrity of a database that is not in use
+		if dir == "" {
+			tdlog.Notice("Please specify database directory, for example -dir=/tmp/db")
+			os.Exit(1)
+		}
+		report, err := db.Fsck(dir, keys, repair)
+		if err != nil {
+			tdlog.Noticef("Cannot check database %s: %v", dir, err)
+			os.Exit(1)
+		}
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+		if len(report.Problems) > 0 {
+			os.Exit(2)
+		}
+	case "restore":
+		// Replace a database that is not in use by a snapshot
+		if dir == "" || backupDir == "" {
+			tdlog.Notice("Please specify database and snapshot directories, for example -dir=/tmp/db -backup=/tmp/snapshot")
+			os.Exit(1)
+		}
+		if err := db.Restore(backupDir, dir, keys); err != nil {
+			tdlog.Noticef("Cannot restore database %s from %s: %v", dir, backupDir, err)
+			os.Exit(1)
+		}
+	case "export", "import":
+		// Export the database to NDJSON, or import collections from NDJSON
+		if dir == "" {
+			tdlog.Notice("Please specify database directory, for example -dir=/tmp/db")
+			os.Exit(1)
+		}
+		database, err := db.OpenDBWithKeys(dir, keys)
+		if err != nil {
+			tdlog.Noticef("Cannot open database %s: %v", dir, err)
+			os.Exit(1)
+		}
+		if mode == "export" {
+			out := os.Stdout
+			if exportFile != "" {
+				if out, err = os.Create(exportFile); err != nil {
+					tdlog.Noticef("Cannot create %s: %v", exportFile, err)
+					os.Exit(1)
+				}
+			}
+			if err = database.Export(out); err == nil {
+				err = out.Close()
+			}
+		} else {
+			in := os.Stdin
+			if exportFile != "" {
+				if in, err = os.Open(exportFile); err != nil {
+					tdlog.Noticef("Cannot open %s: %v", exportFile, err)
+					os.Exit(1)
+				}
+				defer in.Close()
+			}
+			err = database.Import(in)
+		}
+		if closeErr := database.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			tdlog.Noticef("Cannot %s database %s: %v", mode, dir, err)
+			os.Exit(1)
+		}
+	case "repartition":
+		// Redistribute documents of a database that is not in use among a new number of partitions
+		if dir == "" {
+			tdlog.Notice("Please specify database directory, for example -dir=/tmp/db")
+			os.Exit(1)
+		}
+		if err := db.Repartition(dir, keys, numParts); err != nil {
+			tdlog.Noticef("Cannot repartition database %s: %v", dir, err)
+			os.Exit(1)
+		}
 	case "example":
 		// Run embedded usage examples
 		embeddedExample()